@@ -42,6 +42,10 @@ func (t *taprootUserActivatedFeature) Blockheight(network *Network) int {
 	case Testnet().Name():
 		// A nice low value for testing
 		return 100
+
+	case Signet().Name():
+		// Taproot is active on signets since their genesis, but we keep the same margin as testnet
+		return 100
 	}
 
 	panic(fmt.Sprintf("Unexpected network: %v", network.Name()))
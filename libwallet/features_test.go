@@ -57,6 +57,17 @@ func Test_DetermineUserActivatedFeatureStatus(t *testing.T) {
 			},
 			UserActivatedFeatureStatusOff,
 		},
+		{
+			"taproot live in signet with no kit",
+			args{
+				feature:         UserActivatedFeatureTaproot,
+				height:          100,
+				kitVersion:      neverExportedKit,
+				backendFeatures: backendFeaturesWithTaproot,
+				network:         Signet(),
+			},
+			UserActivatedFeatureStatusActive,
+		},
 		{
 			"taproot live in mainnet with no kit",
 			args{
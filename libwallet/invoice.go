@@ -3,6 +3,8 @@ package libwallet
 import (
 	"fmt"
 
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
 	"github.com/lightningnetwork/lnd/zpay32"
 	"github.com/muun/libwallet/errors"
 )
@@ -22,6 +24,10 @@ type Invoice struct {
 
 const lightningScheme = "lightning:"
 
+// signetInvoiceHRP is the network part of the prefix of signet invoices ("lntbs"). It differs from
+// the one in signet addresses, and our version of zpay32 doesn't know about it.
+const signetInvoiceHRP = "tbs"
+
 // ParseInvoice parses an Invoice from an invoice string and a network
 func ParseInvoice(rawInput string, network *Network) (*Invoice, error) {
 
@@ -42,7 +48,7 @@ func ParseInvoice(rawInput string, network *Network) (*Invoice, error) {
 		invoice = components.Host
 	}
 
-	parsedInvoice, err := zpay32.Decode(invoice, network.network)
+	parsedInvoice, err := zpay32.Decode(invoice, invoiceParams(network))
 	if err != nil {
 		return nil, errors.Errorf(ErrInvalidInvoice, "Couldn't parse invoice: %w", err)
 	}
@@ -50,7 +56,12 @@ func ParseInvoice(rawInput string, network *Network) (*Invoice, error) {
 	var fallbackAdd *MuunPaymentURI
 
 	if parsedInvoice.FallbackAddr != nil {
-		fallbackAdd, err = GetPaymentURI(parsedInvoice.FallbackAddr.String(), network)
+		fallbackAddr, err := invoiceFallbackAddr(parsedInvoice.FallbackAddr, network)
+		if err != nil {
+			return nil, errors.Errorf(ErrInvalidInvoice, "Couldn't get address: %w", err)
+		}
+
+		fallbackAdd, err = GetPaymentURI(fallbackAddr.String(), network)
 		if err != nil {
 			return nil, errors.Errorf(ErrInvalidInvoice, "Couldn't get address: %w", err)
 		}
@@ -81,3 +92,29 @@ func ParseInvoice(rawInput string, network *Network) (*Invoice, error) {
 		Sats:            sats,
 	}, nil
 }
+
+// invoiceParams returns the chain params zpay32 needs to encode and decode invoices for a network.
+func invoiceParams(network *Network) *chaincfg.Params {
+	if network.Name() != Signet().Name() {
+		return network.network
+	}
+
+	params := *network.network
+	params.Bech32HRPSegwit = signetInvoiceHRP
+
+	return &params
+}
+
+// invoiceFallbackAddr re-encodes a fallback address decoded with invoiceParams, since segwit
+// addresses in signet invoices would otherwise use the invoice prefix.
+func invoiceFallbackAddr(addr btcutil.Address, network *Network) (btcutil.Address, error) {
+	switch addr := addr.(type) {
+	case *btcutil.AddressWitnessPubKeyHash:
+		return btcutil.NewAddressWitnessPubKeyHash(addr.ScriptAddress(), network.network)
+
+	case *btcutil.AddressWitnessScriptHash:
+		return btcutil.NewAddressWitnessScriptHash(addr.ScriptAddress(), network.network)
+	}
+
+	return addr, nil
+}
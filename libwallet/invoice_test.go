@@ -3,7 +3,14 @@ package libwallet
 import (
 	"encoding/hex"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
 )
 
 func TestParseInvoice(t *testing.T) {
@@ -213,3 +220,56 @@ func TestParseInvoice(t *testing.T) {
 		})
 	}
 }
+
+func TestParseInvoiceSignet(t *testing.T) {
+	network := Signet()
+
+	nodeKey, _ := btcec.NewPrivateKey(btcec.S256())
+
+	var paymentHash [32]byte
+	paymentHash[0] = 1
+
+	fallbackAddr, _ := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), invoiceParams(network))
+
+	invoice, err := zpay32.NewInvoice(
+		invoiceParams(network),
+		paymentHash,
+		time.Now(),
+		zpay32.Amount(lnwire.MilliSatoshi(10_000_000)),
+		zpay32.Description("signet"),
+		zpay32.FallbackAddr(fallbackAddr),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawInvoice, err := invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(hash []byte) ([]byte, error) {
+			return btcec.SignCompact(btcec.S256(), nodeKey, hash, true)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(rawInvoice, "lntbs") {
+		t.Fatalf("expected a signet invoice, got %v", rawInvoice)
+	}
+
+	parsed, err := ParseInvoice(rawInvoice, network)
+	if err != nil {
+		t.Fatalf("ParseInvoice() error = %v", err)
+	}
+
+	if parsed.Sats != 10_000 {
+		t.Errorf("ParseInvoice() sats = %v, want %v", parsed.Sats, 10_000)
+	}
+
+	if !strings.HasPrefix(parsed.FallbackAddress.Address, "tb1") {
+		t.Errorf("ParseInvoice() fallback = %v, want a signet address", parsed.FallbackAddress.Address)
+	}
+
+	if _, err := ParseInvoice(rawInvoice, Testnet()); err == nil {
+		t.Errorf("ParseInvoice() accepted a signet invoice on testnet")
+	}
+}
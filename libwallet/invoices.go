@@ -287,7 +287,7 @@ func (i *InvoiceBuilder) Build() (string, error) {
 
 	// create the invoice
 	invoice, err := zpay32.NewInvoice(
-		i.net.network, paymentHash, time.Now(), iopts...,
+		invoiceParams(i.net), paymentHash, time.Now(), iopts...,
 	)
 	if err != nil {
 		return "", err
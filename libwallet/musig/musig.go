@@ -67,6 +67,28 @@ func CombinePubKeysWithTweak(userKey, muunKey *btcec.PublicKey, customTweak []by
 	return btcec.ParsePubKey(serialized[:], btcec.S256())
 }
 
+// CombinePubKeys returns the aggregated key for the user and muun keys, before any tweak is applied.
+// For V5 addresses, this is the taproot internal key. Since aggregation works on x-only keys, the
+// returned key always has an even Y coordinate.
+func CombinePubKeys(userKey, muunKey *btcec.PublicKey) (*btcec.PublicKey, error) {
+	combined, err := combinePubKeys(userKey, muunKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var serialized [33]byte
+	serialized[0] = 0x02
+	if C.secp256k1_xonly_pubkey_serialize(
+		ctx,
+		toUchar(serialized[1:]),
+		combined,
+	) == 0 {
+		return nil, fmt.Errorf("failed to serialize combined key")
+	}
+
+	return btcec.ParsePubKey(serialized[:], btcec.S256())
+}
+
 func combinePubKeys(userKey *btcec.PublicKey, muunKey *btcec.PublicKey) (*C.secp256k1_xonly_pubkey, error) {
 
 	// Safe C-interop rules require C pointer (ie the array) can't contain go
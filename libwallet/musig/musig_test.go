@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/btcsuite/btcd/btcec"
+	"github.com/muun/libwallet/btcsuitew/chainhashw"
 )
 
 func TestSigning(t *testing.T) {
@@ -64,6 +65,37 @@ func TestSigning(t *testing.T) {
 	}
 }
 
+func TestCombinePubKeys(t *testing.T) {
+	userPriv, _ := btcec.NewPrivateKey(btcec.S256())
+	muunPriv, _ := btcec.NewPrivateKey(btcec.S256())
+
+	internalKey, err := CombinePubKeys(userPriv.PubKey(), muunPriv.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tweakedKey, err := CombinePubKeysWithTweak(userPriv.PubKey(), muunPriv.PubKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default tweak must turn the internal key into the output key:
+	xOnlyInternalKey := internalKey.SerializeCompressed()[1:]
+	tweak := chainhashw.TaggedHashB(chainhashw.TagTapTweak, xOnlyInternalKey)
+
+	curve := btcec.S256()
+	tweakX, tweakY := curve.ScalarBaseMult(tweak)
+	expectedX, _ := curve.Add(internalKey.X, internalKey.Y, tweakX, tweakY)
+
+	if expectedX.Cmp(tweakedKey.X) != 0 {
+		t.Fatalf(
+			"tweaked internal key doesn't match output key: %x != %x",
+			expectedX.Bytes(),
+			tweakedKey.X.Bytes(),
+		)
+	}
+}
+
 func TestSigningWithCustomTweak(t *testing.T) {
 	someRandomKey, _ := btcec.NewPrivateKey(btcec.S256())
 	customTweak := someRandomKey.Serialize()
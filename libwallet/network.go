@@ -1,6 +1,8 @@
 package libwallet
 
 import (
+	"errors"
+
 	"github.com/btcsuite/btcd/chaincfg"
 )
 
@@ -24,6 +26,21 @@ func Regtest() *Network {
 	return &Network{network: &chaincfg.RegressionNetParams}
 }
 
+// Signet returns an instance of the default Bitcoin Signet Network
+func Signet() *Network {
+	return &Network{network: newSignetParams(defaultSignetChallenge)}
+}
+
+// CustomSignet returns an instance of a Signet Network whose blocks are signed with the given
+// challenge script. Its name is also "signet", only the network magic differs from the default.
+func CustomSignet(challenge []byte) (*Network, error) {
+	if len(challenge) == 0 {
+		return nil, errors.New("signet challenge can't be empty")
+	}
+
+	return &Network{network: newSignetParams(challenge)}, nil
+}
+
 // Name returns the Network's name
 func (n *Network) Name() string {
 	return n.network.Name
@@ -1,10 +1,13 @@
 package libwallet
 
 import (
+	"encoding/hex"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
 )
 
 func TestMainnet(t *testing.T) {
@@ -64,6 +67,7 @@ func TestNetwork_Name(t *testing.T) {
 		{name: "regtest", instance: Regtest(), want: "regtest"},
 		{name: "mainnet", instance: Mainnet(), want: "mainnet"},
 		{name: "testnet", instance: Testnet(), want: "testnet3"},
+		{name: "signet", instance: Signet(), want: "signet"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -73,3 +77,114 @@ func TestNetwork_Name(t *testing.T) {
 		})
 	}
 }
+
+func TestSignet(t *testing.T) {
+	params := Signet().ToParams()
+
+	const genesisHash = "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6"
+
+	if params.GenesisHash.String() != genesisHash {
+		t.Errorf("Signet() genesis = %v, want %v", params.GenesisHash, genesisHash)
+	}
+
+	if params.GenesisBlock.BlockHash() != *params.GenesisHash {
+		t.Errorf("Signet() genesis block doesn't match its hash")
+	}
+
+	if params.Net != wire.BitcoinNet(0x40cf030a) {
+		t.Errorf("Signet() magic = %x, want %x", uint32(params.Net), 0x40cf030a)
+	}
+
+	if params.Bech32HRPSegwit != "tb" {
+		t.Errorf("Signet() hrp = %v, want tb", params.Bech32HRPSegwit)
+	}
+}
+
+func TestCustomSignet(t *testing.T) {
+	// A 1-of-1 multisig challenge, as used by private signets:
+	challenge, _ := hex.DecodeString(
+		"5121021aa8ddbfec8a4f4ddc9cd3fb1a5ebd3c1bbc5fca0a0d2bc4e6ef12896fb9a55751ae",
+	)
+
+	network, err := CustomSignet(challenge)
+	if err != nil {
+		t.Fatalf("CustomSignet() error = %v", err)
+	}
+
+	params := network.ToParams()
+	defaultParams := Signet().ToParams()
+
+	if params.Net == defaultParams.Net {
+		t.Errorf("CustomSignet() has the same magic as the default signet")
+	}
+
+	if *params.GenesisHash != *defaultParams.GenesisHash {
+		t.Errorf("CustomSignet() genesis = %v, want %v", params.GenesisHash, defaultParams.GenesisHash)
+	}
+
+	if network.Name() != "signet" {
+		t.Errorf("CustomSignet() name = %v, want signet", network.Name())
+	}
+
+	_, err = CustomSignet(nil)
+	if err == nil {
+		t.Errorf("CustomSignet() with no challenge should fail")
+	}
+}
+
+func TestSignetAddresses(t *testing.T) {
+	const (
+		basePath    = "m/schema:1'/recovery:1'"
+		addressPath = "m/schema:1'/recovery:1'/external:1/2"
+
+		basePK          = "tpubDBf5wCeqg3KrLJiXaveDzD5JtFJ1ss9NVvFMx4RYS73SjwPEEawcAQ7V1B5DGM4gunWDeYNrnkc49sUaf7mS1wUKiJJQD6WEctExUQoLvrg"
+		baseCosigningPK = "tpubDB22PFkUaHoB7sgxh7exCivV5rAevVSzbB8WkFCCdbHq39r8xnYexiot4NGbi8PM6E1ySVeaHsoDeMYb6EMndpFrzVmuX8iQNExzwNpU61B"
+	)
+
+	network := Signet()
+
+	baseUserKey, _ := NewHDPublicKeyFromString(basePK, basePath, network)
+	baseMuunKey, _ := NewHDPublicKeyFromString(baseCosigningPK, basePath, network)
+
+	userKey, _ := baseUserKey.DeriveTo(addressPath)
+	muunKey, _ := baseMuunKey.DeriveTo(addressPath)
+
+	creators := map[string]func(userKey, muunKey *HDPublicKey) (MuunAddress, error){
+		"v2": CreateAddressV2,
+		"v3": CreateAddressV3,
+		"v4": CreateAddressV4,
+		"v5": CreateAddressV5,
+	}
+
+	for name, create := range creators {
+		t.Run(name, func(t *testing.T) {
+			address, err := create(userKey, muunKey)
+			if err != nil {
+				t.Fatalf("failed to create address: %v", err)
+			}
+
+			uri, err := GetPaymentURI(address.Address(), network)
+			if err != nil {
+				t.Fatalf("GetPaymentURI() error = %v", err)
+			}
+
+			if uri.Address != address.Address() {
+				t.Errorf("GetPaymentURI() address = %v, want %v", uri.Address, address.Address())
+			}
+
+			// Signet addresses are encoded like testnet ones, and not like mainnet ones:
+			if _, err := GetPaymentURI(address.Address(), Mainnet()); err == nil {
+				t.Errorf("GetPaymentURI() accepted a signet address on mainnet")
+			}
+		})
+	}
+
+	v1Address, err := CreateAddressV1(userKey)
+	if err != nil {
+		t.Fatalf("failed to create v1 address: %v", err)
+	}
+
+	if !strings.HasPrefix(v1Address.Address(), "m") && !strings.HasPrefix(v1Address.Address(), "n") {
+		t.Errorf("CreateAddressV1() = %v, want a testnet-like address", v1Address.Address())
+	}
+}
@@ -0,0 +1,80 @@
+package libwallet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// defaultSignetChallenge is the block signing script of the public signet, from BIP325.
+var defaultSignetChallenge = []byte{
+	0x51, 0x21, 0x03, 0xad, 0x5e, 0x0e, 0xda, 0xd1, 0x8c, 0xb1, 0xf0, 0xfc, 0x0d, 0x28, 0xa3,
+	0xd4, 0xf1, 0xf3, 0xe4, 0x45, 0x64, 0x03, 0x37, 0x48, 0x9a, 0xbb, 0x10, 0x40, 0x4f, 0x2d,
+	0x1e, 0x08, 0x6b, 0xe4, 0x30, 0x21, 0x03, 0x59, 0xef, 0x50, 0x21, 0x96, 0x4f, 0xe2, 0x2d,
+	0x6f, 0x8e, 0x05, 0xb2, 0x46, 0x3c, 0x95, 0x40, 0xce, 0x96, 0x88, 0x3f, 0xe3, 0xb2, 0x78,
+	0x76, 0x0f, 0x04, 0x8f, 0x51, 0x89, 0xf2, 0xe6, 0xc4, 0x52, 0xae,
+}
+
+// signetPowLimit is the highest proof of work value a signet block can have.
+var signetPowLimit, _ = new(big.Int).SetString(
+	"00000377ae000000000000000000000000000000000000000000000000000000", 16,
+)
+
+// signetGenesisBlock is shared by all signets. It has the same coinbase as mainnet's genesis block,
+// with a different header.
+var signetGenesisBlock = wire.MsgBlock{
+	Header: wire.BlockHeader{
+		Version:    1,
+		PrevBlock:  chainhash.Hash{},
+		MerkleRoot: chaincfg.MainNetParams.GenesisBlock.Header.MerkleRoot,
+		Timestamp:  time.Unix(1598918400, 0),
+		Bits:       0x1e0377ae,
+		Nonce:      52613770,
+	},
+	Transactions: chaincfg.MainNetParams.GenesisBlock.Transactions,
+}
+
+// newSignetParams creates the chain parameters of a signet with the given challenge. Signets share
+// the address encodings of testnet, and they're told apart by their network magic, which is derived
+// from the challenge.
+func newSignetParams(challenge []byte) *chaincfg.Params {
+	params := chaincfg.TestNet3Params
+
+	genesisBlock := signetGenesisBlock
+	genesisHash := genesisBlock.BlockHash()
+
+	params.Name = "signet"
+	params.Net = signetMagic(challenge)
+	params.DefaultPort = "38333"
+	params.DNSSeeds = nil
+	params.GenesisBlock = &genesisBlock
+	params.GenesisHash = &genesisHash
+	params.PowLimit = signetPowLimit
+	params.PowLimitBits = 0x1e0377ae
+	params.BIP0034Height = 1
+	params.BIP0065Height = 1
+	params.BIP0066Height = 1
+	params.ReduceMinDifficulty = false
+	params.MinDiffReductionTime = 0
+	params.Checkpoints = nil
+
+	return &params
+}
+
+// signetMagic returns the network magic for a challenge, which BIP325 defines as the first 4 bytes
+// of the double SHA256 of the serialized challenge script.
+func signetMagic(challenge []byte) wire.BitcoinNet {
+	var serialized bytes.Buffer
+
+	// Writing to a buffer can't fail:
+	_ = wire.WriteVarBytes(&serialized, 0, challenge)
+
+	hash := chainhash.DoubleHashB(serialized.Bytes())
+
+	return wire.BitcoinNet(binary.LittleEndian.Uint32(hash[:4]))
+}
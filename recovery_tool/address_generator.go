@@ -3,33 +3,129 @@ package main
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/muun/libwallet"
 	"github.com/muun/recovery/utils"
 )
 
+// addressVersions are the versions generated for every derivation path, in order.
+var addressVersions = []int{
+	libwallet.AddressVersionV2,
+	libwallet.AddressVersionV3,
+	libwallet.AddressVersionV4,
+	libwallet.AddressVersionV5,
+}
+
+// defaultGapLimit is the number of consecutive unused indices after which a branch is exhausted.
+// It's generous, since wallets can hand out many addresses that never receive a payment.
+const defaultGapLimit = 100
+
+// indicesPerBatch keeps batches at 100 addresses (one for every address version), which servers
+// handle well in a single request.
+const indicesPerBatch = 25
+
+// fixedIndicesPerBatch is the batch size for fixed depth scans, larger since they're meant for
+// backends that scan every script in the batch at once, like bitcoind's `scantxoutset`.
+const fixedIndicesPerBatch = 250
+
+// Fixed depth scans never go shallower than older versions of the tool, which always scanned
+// these indices of the change and external branches, and of every contact branch. Tests lower them
+// to keep scans short.
+var (
+	minFixedDepth        = 2501
+	minContactFixedDepth = 201
+)
+
+// contactCount is the number of contact branches derived when contacts are generated.
+const contactCount = 100
+
+// AddressGenerator derives all the addresses that could hold funds for a wallet. It only requires
+// the public keys at the wallet's base path, "m/1'/1'".
+//
+// Every branch (change, external and each contact) is extended until gapLimit consecutive indices
+// are unused, so it implements scanner.AddressSource and is told about used addresses as the scan
+// progresses.
 type AddressGenerator struct {
 	addressCount     int
-	userKey          *libwallet.HDPrivateKey
-	muunKey          *libwallet.HDPrivateKey
+	userKey          *libwallet.HDPublicKey
+	muunKey          *libwallet.HDPublicKey
 	generateContacts bool
+	gapLimit         int
+	fixedDepth       int // indices scanned in every branch regardless of use, or 0 to use gapLimit
+
+	mu       sync.Mutex
+	branches map[string]*addressBranch // by derivation path
+}
+
+// addressBranch is a derivation path whose children are addresses.
+type addressBranch struct {
+	name      string
+	userKey   *libwallet.HDPublicKey
+	muunKey   *libwallet.HDPublicKey
+	minDepth  int            // indices always scanned at a fixed depth
+	highWater int            // highest used index, -1 if none; guarded by the generator's mutex
+	pending   sync.WaitGroup // batches sent to the scanner, and not marked as scanned yet
 }
 
-func NewAddressGenerator(userKey, muunKey *libwallet.HDPrivateKey, generateContacts bool) *AddressGenerator {
+func NewAddressGenerator(
+	userKey, muunKey *libwallet.HDPublicKey,
+	generateContacts bool,
+	gapLimit int,
+) *AddressGenerator {
 	return &AddressGenerator{
 		addressCount:     0,
 		userKey:          userKey,
 		muunKey:          muunKey,
 		generateContacts: generateContacts,
+		gapLimit:         gapLimit,
+		branches:         make(map[string]*addressBranch),
 	}
 }
 
-// Stream returns a channel that emits all addresses generated.
-func (g *AddressGenerator) Stream() chan libwallet.MuunAddress {
-	ch := make(chan libwallet.MuunAddress)
+// UseFixedDepth scans the first depth indices of every branch, instead of extending branches until
+// gapLimit indices are unused. It's for backends that can't tell emptied addresses from unused
+// ones, where stopping at a gap could miss funds. Branches are never scanned shallower than older
+// versions of the tool did. It must be called before Batches.
+func (g *AddressGenerator) UseFixedDepth(depth int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.fixedDepth = depth
+}
+
+// FixedDepths returns the indices scanned in the change and external branches, and in each contact
+// branch, with a fixed depth.
+func (g *AddressGenerator) FixedDepths() (int, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return maxInt(g.fixedDepth, minFixedDepth), maxInt(g.fixedDepth, minContactFixedDepth)
+}
+
+// Batches returns a channel that emits all addresses generated, in batches. Branches are generated
+// concurrently, and each one waits for its batches to be scanned before deciding to go further.
+func (g *AddressGenerator) Batches() <-chan []libwallet.MuunAddress {
+	ch := make(chan []libwallet.MuunAddress)
+
+	branches := g.createBranches()
 
 	go func() {
-		g.generate(ch)
+		var wg sync.WaitGroup
+
+		for _, branch := range branches {
+			wg.Add(1)
+
+			go func(branch *addressBranch) {
+				defer wg.Done()
+				g.generateBranch(ch, branch)
+			}(branch)
+		}
+
+		wg.Wait()
 		utils.NewLogger("ADDR").Printf("Addresses %v\n", g.addressCount)
 
 		close(ch)
@@ -38,92 +134,271 @@ func (g *AddressGenerator) Stream() chan libwallet.MuunAddress {
 	return ch
 }
 
-func (g *AddressGenerator) generate(consumer chan libwallet.MuunAddress) {
-	g.generateChangeAddrs(consumer)
-	g.generateExternalAddrs(consumer)
-	if g.generateContacts {
-		g.generateContactAddrs(consumer, 100)
+// MarkScanned updates the high-water marks with the used addresses of a batch, and lets the branch
+// that generated it move on.
+func (g *AddressGenerator) MarkScanned(batch []libwallet.MuunAddress, used []libwallet.MuunAddress) {
+	if len(batch) == 0 {
+		return
+	}
+
+	g.mu.Lock()
+
+	g.raiseHighWater(used)
+
+	branch, _ := g.findBranch(batch[0])
+
+	g.mu.Unlock()
+
+	if branch != nil {
+		branch.pending.Done()
 	}
 }
 
-func (g *AddressGenerator) generateChangeAddrs(consumer chan libwallet.MuunAddress) {
-	const changePath = "m/1'/1'/0"
-	changeUserKey, _ := g.userKey.DeriveTo(changePath)
-	changeMuunKey, _ := g.muunKey.DeriveTo(changePath)
+// MarkUsed updates the high-water marks with addresses found used after the scan, and tells whether
+// Addresses now reaches further.
+func (g *AddressGenerator) MarkUsed(used []libwallet.MuunAddress) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	lasts := make(map[*addressBranch]int, len(g.branches))
+	for _, branch := range g.branches {
+		lasts[branch] = g.lastIndex(branch)
+	}
+
+	g.raiseHighWater(used)
+
+	for branch, last := range lasts {
+		if g.lastIndex(branch) > last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HighWaterMarks returns the highest used index of every branch, by name.
+func (g *AddressGenerator) HighWaterMarks() map[string]int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	marks := make(map[string]int, len(g.branches))
+	for _, branch := range g.branches {
+		marks[branch.name] = branch.highWater
+	}
+
+	return marks
+}
+
+// Addresses derives every address a scan reached: those of each branch up to gapLimit indices past
+// its high-water mark (or up to the fixed depth), sorted by branch. It must be called once the scan
+// is complete.
+func (g *AddressGenerator) Addresses() []libwallet.MuunAddress {
+	g.mu.Lock()
+
+	paths := make([]string, 0, len(g.branches))
+	for path := range g.branches {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	branches := make([]*addressBranch, len(paths))
+	lasts := make([]int, len(paths))
+
+	for i, path := range paths {
+		branches[i] = g.branches[path]
+		lasts[i] = g.lastIndex(branches[i])
+	}
+
+	g.mu.Unlock()
 
-	g.deriveTree(consumer, changeUserKey, changeMuunKey, 2500, "change")
+	var addresses []libwallet.MuunAddress
+
+	for i, branch := range branches {
+		addresses = append(addresses, g.deriveBatch(branch, 0, lasts[i])...)
+	}
+
+	return addresses
 }
 
-func (g *AddressGenerator) generateExternalAddrs(consumer chan libwallet.MuunAddress) {
+func (g *AddressGenerator) createBranches() []*addressBranch {
+	const changePath = "m/1'/1'/0"
 	const externalPath = "m/1'/1'/1"
-	externalUserKey, _ := g.userKey.DeriveTo(externalPath)
-	externalMuunKey, _ := g.muunKey.DeriveTo(externalPath)
+	const contactsPath = "m/1'/1'/2"
 
-	g.deriveTree(consumer, externalUserKey, externalMuunKey, 2500, "external")
+	g.addBranch("change", changePath, minFixedDepth)
+	g.addBranch("external", externalPath, minFixedDepth)
+
+	if g.generateContacts {
+		for i := 0; i <= contactCount; i++ {
+			g.addBranch(fmt.Sprintf("contacts-%v", i), fmt.Sprintf("%s/%d", contactsPath, i), minContactFixedDepth)
+		}
+	}
+
+	branches := make([]*addressBranch, 0, len(g.branches))
+	for _, branch := range g.branches {
+		branches = append(branches, branch)
+	}
+
+	return branches
 }
 
-func (g *AddressGenerator) generateContactAddrs(consumer chan libwallet.MuunAddress, numContacts int64) {
-	const addressPath = "m/1'/1'/2"
-	contactUserKey, _ := g.userKey.DeriveTo(addressPath)
-	contactMuunKey, _ := g.muunKey.DeriveTo(addressPath)
-	for i := int64(0); i <= numContacts; i++ {
-		partialContactUserKey, _ := contactUserKey.DerivedAt(i, false)
-		partialMuunUserKey, _ := contactMuunKey.DerivedAt(i, false)
+func (g *AddressGenerator) addBranch(name string, path string, minDepth int) {
+	userKey, err := g.userKey.DeriveTo(path)
+	if err != nil {
+		log.Printf("skipping branch %v due to %v", name, err)
+		return
+	}
+
+	muunKey, err := g.muunKey.DeriveTo(path)
+	if err != nil {
+		log.Printf("skipping branch %v due to %v", name, err)
+		return
+	}
 
-		branch := fmt.Sprintf("contacts-%v", i)
-		g.deriveTree(consumer, partialContactUserKey, partialMuunUserKey, 200, branch)
+	g.branches[path] = &addressBranch{
+		name:      name,
+		userKey:   userKey,
+		muunKey:   muunKey,
+		minDepth:  minDepth,
+		highWater: -1,
 	}
 }
 
-func (g *AddressGenerator) deriveTree(
-	consumer chan libwallet.MuunAddress,
-	rootUserKey, rootMuunKey *libwallet.HDPrivateKey,
-	count int64,
-	name string,
-) {
+// generateBranch sends batches of addresses until gapLimit indices past the high-water mark have
+// been scanned without finding any used address, or until the fixed depth.
+func (g *AddressGenerator) generateBranch(consumer chan<- []libwallet.MuunAddress, branch *addressBranch) {
+	next := 0
+
+	g.mu.Lock()
+	batchSize := indicesPerBatch
+	if g.fixedDepth > 0 {
+		batchSize = fixedIndicesPerBatch
+	}
+	g.mu.Unlock()
+
+	for {
+		g.mu.Lock()
+		last := g.lastIndex(branch)
+		g.mu.Unlock()
+
+		if next > last {
+			return
+		}
+
+		for start := next; start <= last; start += batchSize {
+			end := start + batchSize - 1
+			if end > last {
+				end = last
+			}
 
-	for i := int64(0); i <= count; i++ {
-		userKey, err := rootUserKey.DerivedAt(i, false)
+			batch := g.deriveBatch(branch, start, end)
+			if len(batch) == 0 {
+				continue
+			}
+
+			branch.pending.Add(1)
+			consumer <- batch
+		}
+
+		next = last + 1
+
+		branch.pending.Wait()
+	}
+}
+
+// deriveBatch creates the addresses of every version for a range of indices, inclusive.
+func (g *AddressGenerator) deriveBatch(branch *addressBranch, start, end int) []libwallet.MuunAddress {
+	var batch []libwallet.MuunAddress
+
+	for i := start; i <= end; i++ {
+		userKey, err := branch.userKey.DerivedAt(int64(i))
 		if err != nil {
-			log.Printf("skipping child %v for %v due to %v", i, name, err)
+			log.Printf("skipping child %v for %v due to %v", i, branch.name, err)
 			continue
 		}
-		muunKey, err := rootMuunKey.DerivedAt(i, false)
+		muunKey, err := branch.muunKey.DerivedAt(int64(i))
 		if err != nil {
-			log.Printf("skipping child %v for %v due to %v", i, name, err)
+			log.Printf("skipping child %v for %v due to %v", i, branch.name, err)
 			continue
 		}
 
-		addrV2, err := libwallet.CreateAddressV2(userKey.PublicKey(), muunKey.PublicKey())
-		if err == nil {
-			consumer <- addrV2
-			g.addressCount++
-		} else {
-			log.Printf("failed to generate %v v2 for %v due to %v", name, i, err)
+		for _, version := range addressVersions {
+			addr, err := createAddress(version, userKey, muunKey)
+			if err == nil {
+				batch = append(batch, addr)
+			} else {
+				log.Printf("failed to generate %v v%v for %v due to %v", branch.name, version, i, err)
+			}
 		}
+	}
 
-		addrV3, err := libwallet.CreateAddressV3(userKey.PublicKey(), muunKey.PublicKey())
-		if err == nil {
-			consumer <- addrV3
-			g.addressCount++
-		} else {
-			log.Printf("failed to generate %v v3 for %v due to %v", name, i, err)
-		}
+	g.mu.Lock()
+	g.addressCount += len(batch)
+	g.mu.Unlock()
 
-		addrV4, err := libwallet.CreateAddressV4(userKey.PublicKey(), muunKey.PublicKey())
-		if err == nil {
-			consumer <- addrV4
-			g.addressCount++
-		} else {
-			log.Printf("failed to generate %v v4 for %v due to %v", name, i, err)
-		}
+	return batch
+}
 
-		addrV5, err := libwallet.CreateAddressV5(userKey.PublicKey(), muunKey.PublicKey())
-		if err == nil {
-			consumer <- addrV5
-			g.addressCount++
-		} else {
-			log.Printf("failed to generate %v v5 for %v due to %v", name, i, err)
+// raiseHighWater moves the high-water marks up to the used addresses. The caller must hold the
+// mutex.
+func (g *AddressGenerator) raiseHighWater(used []libwallet.MuunAddress) {
+	for _, addr := range used {
+		branch, index := g.findBranch(addr)
+		if branch != nil && index > branch.highWater {
+			branch.highWater = index
 		}
 	}
 }
+
+// lastIndex returns the last index of a branch to scan, as far as we know now. The caller must hold
+// the mutex.
+func (g *AddressGenerator) lastIndex(branch *addressBranch) int {
+	if g.fixedDepth > 0 {
+		return maxInt(g.fixedDepth, branch.minDepth) - 1
+	}
+
+	return branch.highWater + g.gapLimit
+}
+
+// findBranch returns the branch that generated an address, and its index. The caller must hold
+// the mutex.
+func (g *AddressGenerator) findBranch(addr libwallet.MuunAddress) (*addressBranch, int) {
+	path := addr.DerivationPath()
+
+	separator := strings.LastIndex(path, "/")
+	if separator < 0 {
+		return nil, 0
+	}
+
+	index, err := strconv.Atoi(path[separator+1:])
+	if err != nil {
+		return nil, 0
+	}
+
+	return g.branches[path[:separator]], index
+}
+
+// createAddress creates the address of a given version for a pair of derived keys.
+func createAddress(version int, userKey, muunKey *libwallet.HDPublicKey) (libwallet.MuunAddress, error) {
+	switch version {
+	case libwallet.AddressVersionV2:
+		return libwallet.CreateAddressV2(userKey, muunKey)
+	case libwallet.AddressVersionV3:
+		return libwallet.CreateAddressV3(userKey, muunKey)
+	case libwallet.AddressVersionV4:
+		return libwallet.CreateAddressV4(userKey, muunKey)
+	case libwallet.AddressVersionV5:
+		return libwallet.CreateAddressV5(userKey, muunKey)
+	}
+
+	return nil, fmt.Errorf("unsupported address version %d", version)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
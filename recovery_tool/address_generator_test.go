@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/scanner"
+)
+
+// unspentOnlyBackend serves unspent outputs from memory, keyed by hex-encoded script, and reports
+// them as the only history, like a node without an address index.
+type unspentOnlyBackend struct {
+	unspents map[string][]backend.Unspent
+}
+
+func (b *unspentOnlyBackend) Name() string {
+	return "unspent-only"
+}
+
+func (b *unspentOnlyBackend) IsUnspentOnly() bool {
+	return true
+}
+
+func (b *unspentOnlyBackend) ListUnspent(scripts [][]byte) ([][]backend.Unspent, error) {
+	result := make([][]backend.Unspent, len(scripts))
+	for i, script := range scripts {
+		result[i] = b.unspents[hex.EncodeToString(script)]
+	}
+
+	return result, nil
+}
+
+func (b *unspentOnlyBackend) GetHistory(scripts [][]byte) ([][]backend.HistoryItem, error) {
+	result := make([][]backend.HistoryItem, len(scripts))
+	for i, script := range scripts {
+		for _, unspent := range b.unspents[hex.EncodeToString(script)] {
+			result[i] = append(result[i], backend.HistoryItem{TxID: unspent.TxID, Height: unspent.Height})
+		}
+	}
+
+	return result, nil
+}
+
+func (b *unspentOnlyBackend) GetTransaction(txID string) (*wire.MsgTx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (b *unspentOnlyBackend) Broadcast(tx *wire.MsgTx) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (b *unspentOnlyBackend) EstimateFee(targetBlocks int) (float64, error) {
+	return 0, errors.New("not implemented")
+}
+
+func TestFixedDepthFindsFundsPastEmptiedAddresses(t *testing.T) {
+	network := libwallet.Regtest()
+
+	userRoot, _ := libwallet.NewHDPrivateKey([]byte("0123456789abcdef0123456789abcdef"), network)
+	muunKey, _ := libwallet.NewHDPrivateKey([]byte("fedcba9876543210fedcba9876543210"), network)
+
+	userKey, err := userRoot.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	muunBaseKey, err := muunKey.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const gapLimit = 5
+
+	// Indices 0 to 11 were used and emptied, which is longer than the gap limit, so only the funds
+	// at index 12 remain:
+	script := createTestScript(t, userKey.PublicKey(), muunBaseKey.PublicKey(), "m/1'/1'/1/12", libwallet.AddressVersionV4)
+
+	chainBackend := &unspentOnlyBackend{
+		unspents: map[string][]backend.Unspent{
+			hex.EncodeToString(script): {{TxID: "aa", Vout: 1, Amount: 50000, Height: 100}},
+		},
+	}
+
+	scan := func(addrGen *AddressGenerator) []*scanner.Utxo {
+		var report *scanner.Report
+		for report = range scanner.NewScanner(chainBackend, network, nil).Scan(addrGen) {
+		}
+
+		if report.Err != nil {
+			t.Fatal(report.Err)
+		}
+
+		return report.UtxosFound
+	}
+
+	// A gap limit scan stops before the funds, which is why it can't be used:
+	addrGen := NewAddressGenerator(userKey.PublicKey(), muunBaseKey.PublicKey(), false, gapLimit)
+	if utxos := scan(addrGen); len(utxos) != 0 {
+		t.Fatalf("expected the gap limit to hide the funds, got %d utxos", len(utxos))
+	}
+
+	addrGen = NewAddressGenerator(userKey.PublicKey(), muunBaseKey.PublicKey(), false, gapLimit)
+	// A small gap limit doesn't make the scan shallower than older versions of the tool, whose
+	// depth we lower to keep the test short:
+	defer func(depth int) { minFixedDepth = depth }(minFixedDepth)
+	minFixedDepth = gapLimit*fixedDepthFactor + 1
+
+	if depth := useFixedDepth(addrGen, chainBackend); depth != minFixedDepth {
+		t.Fatalf("expected a fixed depth of %d, got %d", minFixedDepth, depth)
+	}
+
+	utxos := scan(addrGen)
+	if len(utxos) != 1 || utxos[0].Address.DerivationPath() != "m/1'/1'/1/12" {
+		t.Fatalf("expected the utxo at m/1'/1'/1/12, got %+v", utxos)
+	}
+}
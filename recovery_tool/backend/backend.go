@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Backend is a source of blockchain data for the scanner and the sweeper, and a way to broadcast
+// transactions. Implementations must be safe for concurrent use, and manage their own connections.
+type Backend interface {
+	// Name describes the backend, for logs and checkpoints.
+	Name() string
+
+	// ListUnspent returns the unspent outputs of every output script, in the same order.
+	ListUnspent(scripts [][]byte) ([][]Unspent, error)
+
+	// GetHistory returns the transactions that touched every output script, in the same order.
+	GetHistory(scripts [][]byte) ([][]HistoryItem, error)
+
+	// GetTransaction fetches a transaction by its ID.
+	GetTransaction(txID string) (*wire.MsgTx, error)
+
+	// Broadcast sends a transaction to the network, and returns its ID.
+	Broadcast(tx *wire.MsgTx) (string, error)
+
+	// EstimateFee returns the fee rate, in sats/vB, for a transaction to confirm within the target
+	// number of blocks.
+	EstimateFee(targetBlocks int) (float64, error)
+}
+
+// ScriptQuerier is implemented by backends that can fetch the unspent outputs and the history of
+// scripts together, so both come from the same server and share round-trips.
+type ScriptQuerier interface {
+	// QueryScripts returns the unspent outputs and the history of every output script, in the same
+	// order.
+	QueryScripts(scripts [][]byte) ([][]Unspent, [][]HistoryItem, error)
+}
+
+// MultiBroadcaster is implemented by backends with several servers, which can send a transaction to
+// many of them so that a single server can't censor it.
+type MultiBroadcaster interface {
+	// BroadcastToMany sends a transaction to up to count different servers, and returns the
+	// outcome for each server tried. Servers that can't be reached are replaced with others.
+	BroadcastToMany(tx *wire.MsgTx, count int) []BroadcastResult
+}
+
+// MempoolInspector is implemented by backends that can describe the fee rates paid in the mempool,
+// which predict the next blocks better than fee estimates based on past ones.
+type MempoolInspector interface {
+	// GetFeeHistogram returns the total vsize of mempool transactions by fee rate, sorted by
+	// descending fee rate.
+	GetFeeHistogram() ([]FeeHistogramBin, error)
+}
+
+// HeaderProvider is implemented by backends that serve block headers and merkle proofs, so that
+// confirmed transactions can be verified without trusting the server (SPV).
+type HeaderProvider interface {
+	// GetTipHeight returns the height of the best chain known to the server.
+	GetTipHeight() (int, error)
+
+	// GetHeaders returns up to count consecutive block headers, starting at a height. It may return
+	// fewer than requested, but at least one unless the start is past the tip.
+	GetHeaders(startHeight int, count int) ([]*wire.BlockHeader, error)
+
+	// GetMerkleProof returns the proof that a transaction is included in the block at a height.
+	GetMerkleProof(txID string, height int) (*MerkleProof, error)
+}
+
+// UnspentOnly is implemented by backends that only know the unspent outputs of scripts, so their
+// GetHistory can't tell an emptied script from an unused one. Scans can't decide how far to look
+// from their history.
+type UnspentOnly interface {
+	IsUnspentOnly() bool
+}
+
+// ScriptSubscriber is implemented by backends that can notify changes in the history of output
+// scripts as they happen, so they don't have to be asked again and again.
+type ScriptSubscriber interface {
+	// SubscribeScripts subscribes to every output script on a connection of its own, and sends
+	// changes until stop is closed or the connection ends, when callers must subscribe again.
+	SubscribeScripts(scripts [][]byte, stop <-chan struct{}) (*Subscription, error)
+}
+
+// Subscription reports the statuses of output scripts. A status is a hash of the history of a
+// script, empty if it has none, so it changes whenever a transaction touches the script or
+// confirms.
+type Subscription struct {
+	// Statuses are the statuses when subscribing, in the same order as the scripts.
+	Statuses []string
+
+	// Changes receives new statuses, and is closed when the subscription ends.
+	Changes <-chan ScriptStatus
+}
+
+// ScriptStatus is the new status of the script at Index, in the list of subscribed scripts.
+type ScriptStatus struct {
+	Index  int
+	Status string
+}
+
+// MerkleProof links a transaction to the merkle root of a block. Branch has the hashes of the
+// siblings from the bottom up, and Pos is the index of the transaction in the block.
+type MerkleProof struct {
+	Height int
+	Pos    int
+	Branch []*chainhash.Hash
+}
+
+// FeeHistogramBin is the total vsize of mempool transactions paying at least FeeRate sats/vB, and
+// less than the rate of the previous bin.
+type FeeHistogramBin struct {
+	FeeRate float64
+	VSize   int64
+}
+
+// BroadcastResult is the outcome of sending a transaction to a single server. Err is the reason
+// the server couldn't be reached, or rejected the transaction.
+type BroadcastResult struct {
+	Server string
+	TxID   string
+	Err    error
+}
+
+// Unspent references an unspent transaction output. Height is 0 or less while unconfirmed.
+type Unspent struct {
+	TxID   string
+	Vout   int
+	Amount int64
+	Height int
+}
+
+// HistoryItem references a transaction in the history of an output script. Height is 0 or less
+// while unconfirmed.
+type HistoryItem struct {
+	TxID   string
+	Height int
+}
+
+// encodeTx serializes a transaction to hex, including witness data.
+func encodeTx(tx *wire.MsgTx) (string, error) {
+	txBytes := new(bytes.Buffer)
+
+	err := tx.BtcEncode(txBytes, wire.ProtocolVersion, wire.WitnessEncoding)
+	if err != nil {
+		return "", fmt.Errorf("error while encoding tx: %w", err)
+	}
+
+	return hex.EncodeToString(txBytes.Bytes()), nil
+}
+
+// decodeHeaders parses a hex string of concatenated block headers.
+func decodeHeaders(headersHex string) ([]*wire.BlockHeader, error) {
+	headersBytes, err := hex.DecodeString(headersHex)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding headers: %w", err)
+	}
+
+	if len(headersBytes)%wire.MaxBlockHeaderPayload != 0 {
+		return nil, fmt.Errorf("error while decoding headers: unexpected length %d", len(headersBytes))
+	}
+
+	headers := make([]*wire.BlockHeader, len(headersBytes)/wire.MaxBlockHeaderPayload)
+	reader := bytes.NewReader(headersBytes)
+
+	for i := range headers {
+		headers[i] = new(wire.BlockHeader)
+
+		err = headers[i].Deserialize(reader)
+		if err != nil {
+			return nil, fmt.Errorf("error while decoding headers: %w", err)
+		}
+	}
+
+	return headers, nil
+}
+
+// decodeTx parses a hex-encoded transaction.
+func decodeTx(txHex string) (*wire.MsgTx, error) {
+	txBytes, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding tx: %w", err)
+	}
+
+	tx := wire.NewMsgTx(0)
+
+	err = tx.Deserialize(bytes.NewReader(txBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding tx: %w", err)
+	}
+
+	return tx, nil
+}
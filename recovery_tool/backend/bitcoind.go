@@ -0,0 +1,355 @@
+package backend
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/recovery/bitcoind"
+	"github.com/muun/recovery/utils"
+)
+
+// Bitcoind is a Backend that uses a Bitcoin Core node over JSON-RPC, so addresses are never
+// revealed to third parties.
+//
+// Funds are found with `scantxoutset`, which walks the whole UTXO set and can't run concurrently.
+// Requests made while a scan is running are queued, and served together by the next scan.
+// Descriptors in the Emergency Kit only carry key fingerprints, so we scan `raw()` descriptors
+// with the output scripts of every address.
+//
+// Without an address index, the node can't provide history. Addresses holding funds are reported
+// with their unspent outputs as history, so emptied addresses look unused. It implements
+// UnspentOnly, so scans don't stop at a gap of seemingly unused addresses.
+type Bitcoind struct {
+	client      *bitcoind.Client
+	genesisHash string
+	requests    chan *scanRequest
+	log         *utils.Logger
+
+	mu       sync.Mutex
+	unspents map[string][]Unspent // by script, for every script scanned
+	heights  map[string]int       // by txid, for every unspent output found
+}
+
+// scanRequest is a set of scripts waiting for the next `scantxoutset` call.
+type scanRequest struct {
+	scripts [][]byte
+	done    chan error
+}
+
+// scanTxOutSetResult models the result of `scantxoutset start`.
+type scanTxOutSetResult struct {
+	Success  bool                  `json:"success"`
+	Height   int                   `json:"height"`
+	Unspents []scanTxOutSetUnspent `json:"unspents"`
+}
+
+type scanTxOutSetUnspent struct {
+	TxID         string  `json:"txid"`
+	Vout         int     `json:"vout"`
+	ScriptPubKey string  `json:"scriptPubKey"`
+	Amount       float64 `json:"amount"`
+	Height       int     `json:"height"`
+}
+
+// estimateSmartFeeResult models the result of `estimatesmartfee`.
+type estimateSmartFeeResult struct {
+	FeeRate float64  `json:"feerate"`
+	Errors  []string `json:"errors"`
+}
+
+// NewBitcoind creates a Bitcoind backend. If a genesis hash is given, Check fails for nodes on
+// other networks.
+func NewBitcoind(client *bitcoind.Client, genesisHash string) *Bitcoind {
+	b := &Bitcoind{
+		client:      client,
+		genesisHash: genesisHash,
+		requests:    make(chan *scanRequest),
+		log:         utils.NewLogger("Backend/Bitcoind"),
+		unspents:    make(map[string][]Unspent),
+		heights:     make(map[string]int),
+	}
+
+	go b.serveScans()
+
+	return b
+}
+
+// Name describes the backend.
+func (b *Bitcoind) Name() string {
+	return "bitcoind " + b.client.URL()
+}
+
+// Check verifies that the node can be reached with our credentials, and is on the right network.
+func (b *Bitcoind) Check() error {
+	var genesisHash string
+
+	err := b.client.Call("getblockhash", []interface{}{0}, &genesisHash)
+	if err != nil {
+		return err
+	}
+
+	if b.genesisHash != "" && !strings.EqualFold(genesisHash, b.genesisHash) {
+		return fmt.Errorf("node has genesis %s, expected %s", genesisHash, b.genesisHash)
+	}
+
+	return nil
+}
+
+// IsUnspentOnly returns true, since the node keeps no history for arbitrary scripts.
+func (b *Bitcoind) IsUnspentOnly() bool {
+	return true
+}
+
+// ListUnspent finds the unspent outputs of every script with `scantxoutset`.
+func (b *Bitcoind) ListUnspent(scripts [][]byte) ([][]Unspent, error) {
+	err := b.scan(scripts)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	unspents := make([][]Unspent, len(scripts))
+	for i, script := range scripts {
+		unspents[i] = b.unspents[hex.EncodeToString(script)]
+	}
+
+	return unspents, nil
+}
+
+// GetHistory returns the transactions of the unspent outputs of every script, since the node
+// keeps no history for arbitrary scripts. Scripts already scanned are not scanned again.
+func (b *Bitcoind) GetHistory(scripts [][]byte) ([][]HistoryItem, error) {
+	var missing [][]byte
+
+	b.mu.Lock()
+	for _, script := range scripts {
+		if _, ok := b.unspents[hex.EncodeToString(script)]; !ok {
+			missing = append(missing, script)
+		}
+	}
+	b.mu.Unlock()
+
+	if len(missing) > 0 {
+		err := b.scan(missing)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	history := make([][]HistoryItem, len(scripts))
+	for i, script := range scripts {
+		history[i] = b.getHistory(script)
+	}
+
+	return history, nil
+}
+
+// QueryScripts finds the unspent outputs of every script with a single `scantxoutset`, and returns
+// them along with their transactions as history.
+func (b *Bitcoind) QueryScripts(scripts [][]byte) ([][]Unspent, [][]HistoryItem, error) {
+	err := b.scan(scripts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	unspents := make([][]Unspent, len(scripts))
+	history := make([][]HistoryItem, len(scripts))
+
+	for i, script := range scripts {
+		unspents[i] = b.unspents[hex.EncodeToString(script)]
+		history[i] = b.getHistory(script)
+	}
+
+	return unspents, history, nil
+}
+
+// getHistory returns the transactions of the unspent outputs of a script. The caller must hold the
+// mutex.
+func (b *Bitcoind) getHistory(script []byte) []HistoryItem {
+	var history []HistoryItem
+
+	seen := make(map[string]bool)
+
+	for _, unspent := range b.unspents[hex.EncodeToString(script)] {
+		if !seen[unspent.TxID] {
+			seen[unspent.TxID] = true
+			history = append(history, HistoryItem{TxID: unspent.TxID, Height: unspent.Height})
+		}
+	}
+
+	return history
+}
+
+// GetTransaction calls `getrawtransaction`. Nodes without `txindex` only find transactions in
+// the mempool or, if we know the block, in that block.
+func (b *Bitcoind) GetTransaction(txID string) (*wire.MsgTx, error) {
+	params := []interface{}{txID, false}
+
+	b.mu.Lock()
+	height, ok := b.heights[txID]
+	b.mu.Unlock()
+
+	if ok && height > 0 {
+		var blockHash string
+
+		err := b.client.Call("getblockhash", []interface{}{height}, &blockHash)
+		if err != nil {
+			return nil, fmt.Errorf("error while fetching tx %s: %w", txID, err)
+		}
+
+		params = append(params, blockHash)
+	}
+
+	var txHex string
+
+	err := b.client.Call("getrawtransaction", params, &txHex)
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching tx %s: %w", txID, err)
+	}
+
+	return decodeTx(txHex)
+}
+
+// Broadcast calls `sendrawtransaction`.
+func (b *Bitcoind) Broadcast(tx *wire.MsgTx) (string, error) {
+	txHex, err := encodeTx(tx)
+	if err != nil {
+		return "", err
+	}
+
+	var txID string
+
+	err = b.client.Call("sendrawtransaction", []interface{}{txHex}, &txID)
+	if err != nil {
+		return "", fmt.Errorf("error while broadcasting: %w", err)
+	}
+
+	return txID, nil
+}
+
+// EstimateFee calls `estimatesmartfee`, converting the result from BTC/kvB to sats/vB.
+func (b *Bitcoind) EstimateFee(targetBlocks int) (float64, error) {
+	var result estimateSmartFeeResult
+
+	err := b.client.Call("estimatesmartfee", []interface{}{targetBlocks}, &result)
+	if err != nil {
+		return 0, fmt.Errorf("error while estimating fee: %w", err)
+	}
+
+	if result.FeeRate <= 0 {
+		return 0, fmt.Errorf("the node can't estimate fees: %v", strings.Join(result.Errors, ", "))
+	}
+
+	return result.FeeRate * 1e8 / 1000, nil
+}
+
+// scan queues scripts for the next `scantxoutset` call, and waits until it completes.
+func (b *Bitcoind) scan(scripts [][]byte) error {
+	request := &scanRequest{scripts: scripts, done: make(chan error, 1)}
+
+	b.requests <- request
+
+	return <-request.done
+}
+
+// serveScans runs a `scantxoutset` for every group of requests that arrive while the node is busy.
+func (b *Bitcoind) serveScans() {
+	for request := range b.requests {
+		requests := []*scanRequest{request}
+
+		// Take every other request that's already waiting:
+	collect:
+		for {
+			select {
+			case request := <-b.requests:
+				requests = append(requests, request)
+			default:
+				break collect
+			}
+		}
+
+		var scripts [][]byte
+		for _, request := range requests {
+			scripts = append(scripts, request.scripts...)
+		}
+
+		err := b.scanTxOutSet(scripts)
+
+		for _, request := range requests {
+			request.done <- err
+		}
+	}
+}
+
+// scanTxOutSet runs a single `scantxoutset` for a list of scripts, and stores the results.
+func (b *Bitcoind) scanTxOutSet(scripts [][]byte) error {
+	descriptors := make([]interface{}, 0, len(scripts))
+	scanned := make(map[string]bool, len(scripts))
+
+	for _, script := range scripts {
+		scriptHex := hex.EncodeToString(script)
+
+		if !scanned[scriptHex] {
+			scanned[scriptHex] = true
+			descriptors = append(descriptors, "raw("+scriptHex+")")
+		}
+	}
+
+	b.log.Printf("Scanning the UTXO set for %d scripts", len(descriptors))
+
+	var result scanTxOutSetResult
+
+	err := b.client.CallWithTimeout(
+		"scantxoutset",
+		[]interface{}{"start", descriptors},
+		&result,
+		bitcoind.NoTimeout,
+	)
+	if err != nil {
+		return fmt.Errorf("Scanning the UTXO set failed: %w", err)
+	}
+
+	if !result.Success {
+		return errors.New("Scanning the UTXO set failed: the node aborted the scan")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for scriptHex := range scanned {
+		b.unspents[scriptHex] = nil
+	}
+
+	for _, unspent := range result.Unspents {
+		amount, err := btcutil.NewAmount(unspent.Amount)
+		if err != nil {
+			return fmt.Errorf("invalid amount for %s:%d: %w", unspent.TxID, unspent.Vout, err)
+		}
+
+		scriptHex := strings.ToLower(unspent.ScriptPubKey)
+
+		b.unspents[scriptHex] = append(b.unspents[scriptHex], Unspent{
+			TxID:   unspent.TxID,
+			Vout:   unspent.Vout,
+			Amount: int64(amount),
+			Height: unspent.Height,
+		})
+
+		b.heights[unspent.TxID] = unspent.Height
+	}
+
+	return nil
+}
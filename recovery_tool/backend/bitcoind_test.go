@@ -0,0 +1,246 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/bitcoind"
+)
+
+// fakeNode stands in for bitcoind, answering the RPC methods used by the Bitcoind backend.
+type fakeNode struct {
+	mu          sync.Mutex
+	unspents    map[string][]scanTxOutSetUnspent // by script
+	txs         map[string]string                // hex by txid
+	scans       int
+	broadcasted []string
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if !ok || user != "user" || password != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ID     int64             `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var result interface{}
+	var rpcErr *bitcoind.RPCError
+
+	switch req.Method {
+	case "getblockhash":
+		result = chaincfg.RegressionNetParams.GenesisHash.String()
+
+	case "scantxoutset":
+		n.scans++
+
+		var descriptors []string
+		_ = json.Unmarshal(req.Params[1], &descriptors)
+
+		found := []scanTxOutSetUnspent{}
+		for _, descriptor := range descriptors {
+			script := strings.TrimSuffix(strings.TrimPrefix(descriptor, "raw("), ")")
+			found = append(found, n.unspents[script]...)
+		}
+
+		result = &scanTxOutSetResult{Success: true, Height: 200, Unspents: found}
+
+	case "getrawtransaction":
+		var txID string
+		_ = json.Unmarshal(req.Params[0], &txID)
+
+		if tx, ok := n.txs[txID]; ok {
+			result = tx
+		} else {
+			rpcErr = &bitcoind.RPCError{Code: -5, Message: "No such mempool transaction"}
+		}
+
+	case "sendrawtransaction":
+		var txHex string
+		_ = json.Unmarshal(req.Params[0], &txHex)
+
+		n.broadcasted = append(n.broadcasted, txHex)
+		result = "ff"
+
+	case "estimatesmartfee":
+		result = &estimateSmartFeeResult{FeeRate: 0.00012}
+
+	default:
+		rpcErr = &bitcoind.RPCError{Code: -32601, Message: "Method not found"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rpcErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": req.ID, "result": result, "error": rpcErr})
+}
+
+func newTestBitcoind(t *testing.T, node *fakeNode, auth bitcoind.Auth) *Bitcoind {
+	server := httptest.NewServer(node)
+	t.Cleanup(server.Close)
+
+	client := bitcoind.NewClient(server.URL, auth)
+
+	return NewBitcoind(client, chaincfg.RegressionNetParams.GenesisHash.String())
+}
+
+func TestBitcoindCheck(t *testing.T) {
+	node := &fakeNode{}
+
+	err := newTestBitcoind(t, node, bitcoind.Auth{User: "user", Password: "pass"}).Check()
+	if err != nil {
+		t.Fatalf("expected the check to pass, got %v", err)
+	}
+
+	err = newTestBitcoind(t, node, bitcoind.Auth{User: "user", Password: "wrong"}).Check()
+	if err == nil {
+		t.Fatal("expected the check to fail with wrong credentials")
+	}
+
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	otherNetwork := NewBitcoind(
+		bitcoind.NewClient(server.URL, bitcoind.Auth{User: "user", Password: "pass"}),
+		chaincfg.MainNetParams.GenesisHash.String(),
+	)
+
+	err = otherNetwork.Check()
+	if err == nil {
+		t.Fatal("expected the check to fail for a node on another network")
+	}
+}
+
+func TestBitcoindListUnspentAndHistory(t *testing.T) {
+	node := &fakeNode{
+		unspents: map[string][]scanTxOutSetUnspent{
+			"0014aa": {
+				{TxID: "t1", Vout: 0, ScriptPubKey: "0014aa", Amount: 0.0005, Height: 150},
+				{TxID: "t1", Vout: 2, ScriptPubKey: "0014aa", Amount: 0.00000546, Height: 150},
+			},
+		},
+	}
+
+	b := newTestBitcoind(t, node, bitcoind.Auth{User: "user", Password: "pass"})
+
+	scripts := [][]byte{{0x00, 0x14, 0xaa}, {0x00, 0x14, 0xbb}}
+
+	unspents, err := b.ListUnspent(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(unspents) != 2 || len(unspents[0]) != 2 || len(unspents[1]) != 0 {
+		t.Fatalf("unexpected unspents %+v", unspents)
+	}
+
+	if unspents[0][0].Amount != 50000 || unspents[0][1].Amount != 546 {
+		t.Errorf("unexpected amounts %+v", unspents[0])
+	}
+
+	history, err := b.GetHistory(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history[0]) != 1 || history[0][0].TxID != "t1" || history[0][0].Height != 150 {
+		t.Errorf("unexpected history %+v", history[0])
+	}
+
+	if len(history[1]) != 0 {
+		t.Errorf("unexpected history %+v", history[1])
+	}
+
+	if node.scans != 1 {
+		t.Errorf("expected history to be served without scanning again, got %d scans", node.scans)
+	}
+}
+
+func TestBitcoindCoalescesScans(t *testing.T) {
+	node := &fakeNode{}
+	b := newTestBitcoind(t, node, bitcoind.Auth{User: "user", Password: "pass"})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := b.ListUnspent([][]byte{{0x51, byte(i)}})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if node.scans == 0 || node.scans > 10 {
+		t.Errorf("unexpected number of scans %d", node.scans)
+	}
+}
+
+func TestBitcoindTransactions(t *testing.T) {
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 1}, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+
+	txHex, err := encodeTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &fakeNode{txs: map[string]string{tx.TxHash().String(): txHex}}
+	b := newTestBitcoind(t, node, bitcoind.Auth{User: "user", Password: "pass"})
+
+	fetched, err := b.GetTransaction(tx.TxHash().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetched.TxHash() != tx.TxHash() {
+		t.Errorf("fetched tx %v, expected %v", fetched.TxHash(), tx.TxHash())
+	}
+
+	_, err = b.GetTransaction("00")
+	if err == nil {
+		t.Error("expected an error for an unknown transaction")
+	}
+
+	_, err = b.Broadcast(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(node.broadcasted) != 1 || node.broadcasted[0] != txHex {
+		t.Errorf("unexpected broadcasted txs %v", node.broadcasted)
+	}
+
+	feeRate, err := b.EstimateFee(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if feeRate != 12 {
+		t.Errorf("expected 12 sats/vB, got %v", feeRate)
+	}
+}
@@ -0,0 +1,717 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/utils"
+)
+
+// maxPipelinedRequests is the most requests sent at once on a connection, to servers that don't
+// support batching.
+const maxPipelinedRequests = 20
+
+// subscriptionsPerBatch keeps subscription batches at the size of scan batches, since a wallet
+// can have tens of thousands of scripts.
+const subscriptionsPerBatch = 100
+
+// Electrum is a Backend that uses a single connection at a time, rotating among a list of servers.
+// Concurrent calls share the connection, and their requests are pipelined over it.
+//
+// Errors almost certainly arise from server failures, which are extremely common. Unreachable IPs,
+// dropped connections, sudden EOFs, etc. When a call fails, we assume the server is at fault and
+// disconnect, so the next call connects to another one. Retrying is up to callers.
+type Electrum struct {
+	clients    *clientSet
+	servers    *electrum.ServerProvider
+	serverList []string
+	log        *utils.Logger
+
+	mu      sync.Mutex
+	current *sharedClient // client for the server in use, nil until the first call
+}
+
+// NewElectrum creates an Electrum backend for a list of servers. If a genesis hash is given,
+// servers on other networks are rejected. Connections go through the dialer, if given, and
+// certificates are trusted on first use if given a store.
+func NewElectrum(
+	servers []string,
+	requireTls bool,
+	genesisHash string,
+	dialer electrum.Dialer,
+	trustStore *electrum.TrustStore,
+) *Electrum {
+
+	clients := &clientSet{
+		requireTls:  requireTls,
+		genesisHash: genesisHash,
+		dialer:      dialer,
+		trustStore:  trustStore,
+		clients:     make(map[string]*sharedClient),
+	}
+
+	return newElectrum(servers, clients)
+}
+
+// newElectrum creates an Electrum backend that takes its clients from a set, which may be shared
+// with other backends.
+func newElectrum(servers []string, clients *clientSet) *Electrum {
+	return &Electrum{
+		clients:    clients,
+		servers:    electrum.NewServerProvider(servers),
+		serverList: servers,
+		log:        utils.NewLogger("Backend/Electrum"),
+	}
+}
+
+// clientSet keeps a client for every server, so backends that share it (like replicas) use a single
+// connection to each server.
+type clientSet struct {
+	requireTls  bool
+	genesisHash string
+	dialer      electrum.Dialer
+	trustStore  *electrum.TrustStore
+
+	mu      sync.Mutex
+	clients map[string]*sharedClient
+}
+
+// get returns the client for a server, creating it (without connecting) the first time.
+func (s *clientSet) get(server string) *sharedClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shared, ok := s.clients[server]
+	if !ok {
+		shared = &sharedClient{
+			server: server,
+			client: electrum.NewClient(s.requireTls, s.genesisHash, s.dialer, s.trustStore),
+		}
+
+		s.clients[server] = shared
+	}
+
+	return shared
+}
+
+// sharedClient is the client for a server, used concurrently by many callers. Connecting and
+// disconnecting are serialized, since the client doesn't allow them to run concurrently.
+type sharedClient struct {
+	server string
+	client *electrum.Client
+
+	mu sync.Mutex
+}
+
+// connect connects the client to its server, unless it's already connected.
+func (c *sharedClient) connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client.IsConnected() {
+		return nil
+	}
+
+	return c.client.Connect(c.server)
+}
+
+// disconnect cuts the connection, failing the requests of every caller still waiting.
+func (c *sharedClient) disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.client.Disconnect()
+}
+
+// Name describes the backend.
+func (e *Electrum) Name() string {
+	if len(e.serverList) == 1 {
+		return "electrum " + e.serverList[0]
+	}
+
+	return fmt.Sprintf("electrum (%d servers)", len(e.serverList))
+}
+
+// ListUnspent calls `blockchain.scripthash.listunspent` for every script, batching if the server
+// supports it, or pipelining the requests otherwise.
+func (e *Electrum) ListUnspent(scripts [][]byte) ([][]Unspent, error) {
+	var unspents [][]Unspent
+
+	err := e.withClient(func(client *electrum.Client) error {
+		var err error
+		unspents, err = listUnspent(client, getIndexHashes(scripts))
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return unspents, nil
+}
+
+// GetHistory calls `blockchain.scripthash.get_history` for every script, batching if the server
+// supports it, or pipelining the requests otherwise.
+func (e *Electrum) GetHistory(scripts [][]byte) ([][]HistoryItem, error) {
+	var history [][]HistoryItem
+
+	err := e.withClient(func(client *electrum.Client) error {
+		var err error
+		history, err = getHistory(client, getIndexHashes(scripts))
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// QueryScripts lists the unspent outputs and gets the history of every script at once, on the same
+// connection.
+func (e *Electrum) QueryScripts(scripts [][]byte) ([][]Unspent, [][]HistoryItem, error) {
+	var unspents [][]Unspent
+	var history [][]HistoryItem
+
+	err := e.withClient(func(client *electrum.Client) error {
+		indexHashes := getIndexHashes(scripts)
+
+		unspentErr := make(chan error, 1)
+
+		go func() {
+			var err error
+			unspents, err = listUnspent(client, indexHashes)
+			unspentErr <- err
+		}()
+
+		var err error
+		history, err = getHistory(client, indexHashes)
+
+		if err := <-unspentErr; err != nil {
+			return err
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return unspents, history, nil
+}
+
+// listUnspent calls `blockchain.scripthash.listunspent` for every script hash on a client.
+func listUnspent(client *electrum.Client, indexHashes []string) ([][]Unspent, error) {
+	var unspentRefGroups [][]electrum.UnspentRef
+
+	if client.SupportsBatching() {
+		groups, err := client.ListUnspentBatch(indexHashes)
+		if err != nil {
+			return nil, fmt.Errorf("Listing with batching failed: %w", err)
+		}
+
+		unspentRefGroups = groups
+
+	} else {
+		unspentRefGroups = make([][]electrum.UnspentRef, len(indexHashes))
+
+		err := pipeline(len(indexHashes), func(i int) error {
+			var err error
+
+			unspentRefGroups[i], err = client.ListUnspent(indexHashes[i])
+			if err != nil {
+				return fmt.Errorf("Listing without batching failed: %w", err)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	unspents := make([][]Unspent, len(unspentRefGroups))
+
+	for i, unspentRefGroup := range unspentRefGroups {
+		for _, unspentRef := range unspentRefGroup {
+			unspents[i] = append(unspents[i], Unspent{
+				TxID:   unspentRef.TxHash,
+				Vout:   unspentRef.TxPos,
+				Amount: unspentRef.Value,
+				Height: unspentRef.Height,
+			})
+		}
+	}
+
+	return unspents, nil
+}
+
+// getHistory calls `blockchain.scripthash.get_history` for every script hash on a client.
+func getHistory(client *electrum.Client, indexHashes []string) ([][]HistoryItem, error) {
+	var historyRefGroups [][]electrum.HistoryRef
+
+	if client.SupportsBatching() {
+		groups, err := client.GetHistoryBatch(indexHashes)
+		if err != nil {
+			return nil, fmt.Errorf("Getting history with batching failed: %w", err)
+		}
+
+		historyRefGroups = groups
+
+	} else {
+		historyRefGroups = make([][]electrum.HistoryRef, len(indexHashes))
+
+		err := pipeline(len(indexHashes), func(i int) error {
+			var err error
+
+			historyRefGroups[i], err = client.GetHistory(indexHashes[i])
+			if err != nil {
+				return fmt.Errorf("Getting history without batching failed: %w", err)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	history := make([][]HistoryItem, len(historyRefGroups))
+
+	for i, historyRefGroup := range historyRefGroups {
+		for _, historyRef := range historyRefGroup {
+			history[i] = append(history[i], HistoryItem{TxID: historyRef.TxHash, Height: historyRef.Height})
+		}
+	}
+
+	return history, nil
+}
+
+// GetTransaction calls `blockchain.transaction.get`.
+func (e *Electrum) GetTransaction(txID string) (*wire.MsgTx, error) {
+	var txHex string
+
+	err := e.withClient(func(client *electrum.Client) error {
+		var err error
+		txHex, err = client.GetTransaction(txID)
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching tx %s: %w", txID, err)
+	}
+
+	return decodeTx(txHex)
+}
+
+// Broadcast calls `blockchain.transaction.broadcast`.
+func (e *Electrum) Broadcast(tx *wire.MsgTx) (string, error) {
+	txHex, err := encodeTx(tx)
+	if err != nil {
+		return "", err
+	}
+
+	var txID string
+
+	err = e.withClient(func(client *electrum.Client) error {
+		var err error
+		txID, err = client.Broadcast(txHex)
+		return err
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("error while broadcasting: %w", err)
+	}
+
+	return txID, nil
+}
+
+// BroadcastToMany calls `blockchain.transaction.broadcast` on up to count servers at once, using
+// the shared client of each one. Servers that can't be reached are replaced with the next ones in
+// the list, until every server was tried.
+func (e *Electrum) BroadcastToMany(tx *wire.MsgTx, count int) []BroadcastResult {
+	txHex, err := encodeTx(tx)
+	if err != nil {
+		return []BroadcastResult{{Err: err}}
+	}
+
+	candidates := make(chan string, len(e.serverList))
+	for range e.serverList {
+		candidates <- e.servers.NextServer()
+	}
+	close(candidates)
+
+	results := make(chan BroadcastResult)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < count && i < len(e.serverList); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for server := range candidates {
+				shared := e.clients.get(server)
+
+				err := shared.connect()
+				if err != nil {
+					results <- BroadcastResult{Server: server, Err: err}
+					continue
+				}
+
+				txID, err := shared.client.Broadcast(txHex)
+				results <- BroadcastResult{Server: server, TxID: txID, Err: err}
+				return
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var collected []BroadcastResult
+	for result := range results {
+		collected = append(collected, result)
+	}
+
+	return collected
+}
+
+// EstimateFee calls `blockchain.estimatefee`, converting the result from BTC/kvB to sats/vB.
+func (e *Electrum) EstimateFee(targetBlocks int) (float64, error) {
+	var btcPerKvB float64
+
+	err := e.withClient(func(client *electrum.Client) error {
+		var err error
+		btcPerKvB, err = client.EstimateFee(targetBlocks)
+		return err
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("error while estimating fee: %w", err)
+	}
+
+	if btcPerKvB <= 0 {
+		return 0, errors.New("the server can't estimate fees")
+	}
+
+	return btcPerKvB * 1e8 / 1000, nil
+}
+
+// GetFeeHistogram calls `mempool.get_fee_histogram`.
+func (e *Electrum) GetFeeHistogram() ([]FeeHistogramBin, error) {
+	var pairs [][2]float64
+
+	err := e.withClient(func(client *electrum.Client) error {
+		var err error
+		pairs, err = client.GetFeeHistogram()
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error while getting fee histogram: %w", err)
+	}
+
+	histogram := make([]FeeHistogramBin, len(pairs))
+	for i, pair := range pairs {
+		histogram[i] = FeeHistogramBin{FeeRate: pair[0], VSize: int64(pair[1])}
+	}
+
+	return histogram, nil
+}
+
+// GetTipHeight calls `blockchain.headers.subscribe`.
+func (e *Electrum) GetTipHeight() (int, error) {
+	var tip *electrum.HeaderRef
+
+	err := e.withClient(func(client *electrum.Client) error {
+		var err error
+		tip, err = client.SubscribeHeaders()
+		return err
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("error while getting the tip: %w", err)
+	}
+
+	return tip.Height, nil
+}
+
+// GetHeaders calls `blockchain.block.headers`.
+func (e *Electrum) GetHeaders(startHeight int, count int) ([]*wire.BlockHeader, error) {
+	var headers *electrum.BlockHeaders
+
+	err := e.withClient(func(client *electrum.Client) error {
+		var err error
+		headers, err = client.GetBlockHeaders(startHeight, count)
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error while getting headers from %d: %w", startHeight, err)
+	}
+
+	decoded, err := decodeHeaders(headers.Hex)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decoded) != headers.Count || len(decoded) > count {
+		return nil, fmt.Errorf("the server returned %d headers, expected %d", len(decoded), headers.Count)
+	}
+
+	return decoded, nil
+}
+
+// GetMerkleProof calls `blockchain.transaction.get_merkle`.
+func (e *Electrum) GetMerkleProof(txID string, height int) (*MerkleProof, error) {
+	var proof *electrum.MerkleProof
+
+	err := e.withClient(func(client *electrum.Client) error {
+		var err error
+		proof, err = client.GetMerkle(txID, height)
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error while getting merkle proof for %s: %w", txID, err)
+	}
+
+	branch := make([]*chainhash.Hash, len(proof.Merkle))
+
+	for i, hashHex := range proof.Merkle {
+		branch[i], err = chainhash.NewHashFromStr(hashHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merkle proof for %s: %w", txID, err)
+		}
+	}
+
+	return &MerkleProof{Height: proof.BlockHeight, Pos: proof.Pos, Branch: branch}, nil
+}
+
+// SubscribeScripts calls `blockchain.scripthash.subscribe` for every script, on a dedicated
+// connection that stays open for notifications until stop is closed. Changes to the same script are
+// merged while the caller is busy, so only the latest status is sent.
+func (e *Electrum) SubscribeScripts(scripts [][]byte, stop <-chan struct{}) (*Subscription, error) {
+	client := electrum.NewClient(e.clients.requireTls, e.clients.genesisHash, e.clients.dialer, e.clients.trustStore)
+
+	var err error
+	for attempt := 0; attempt < len(e.serverList) && !client.IsConnected(); attempt++ {
+		err = client.Connect(e.servers.NextServer())
+	}
+
+	if !client.IsConnected() {
+		return nil, fmt.Errorf("failed to connect to a server: %w", err)
+	}
+
+	// Listen before subscribing, so no notification is missed:
+	notifications, err := client.Notifications("blockchain.scripthash.subscribe")
+	if err != nil {
+		client.Disconnect()
+		return nil, err
+	}
+
+	indexHashes := getIndexHashes(scripts)
+
+	statuses, err := subscribeScriptHashes(client, indexHashes)
+	if err != nil {
+		client.Disconnect()
+		return nil, e.log.Errorf("%w", err)
+	}
+
+	indices := make(map[string]int, len(indexHashes))
+	for i, indexHash := range indexHashes {
+		indices[indexHash] = i
+	}
+
+	changes := make(chan ScriptStatus)
+
+	go func() {
+		defer close(changes)
+		defer client.Disconnect()
+
+		pending := make(map[int]string) // statuses not sent yet, by index
+
+		for {
+			// Only try to send when there's something pending:
+			var send chan<- ScriptStatus
+			var next ScriptStatus
+
+			for index, status := range pending {
+				send = changes
+				next = ScriptStatus{Index: index, Status: status}
+				break
+			}
+
+			select {
+			case notification, ok := <-notifications:
+				if !ok {
+					return
+				}
+
+				indexHash, status, err := electrum.ParseScriptHashNotification(notification)
+				if err != nil {
+					e.log.Printf("Ignoring a malformed notification: %v", err)
+					continue
+				}
+
+				if index, ok := indices[indexHash]; ok {
+					pending[index] = status
+				}
+
+			case send <- next:
+				delete(pending, next.Index)
+
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return &Subscription{Statuses: statuses, Changes: changes}, nil
+}
+
+// subscribeScriptHashes subscribes to every script hash in batches if the server supports it, or
+// pipelining the requests otherwise, and returns their statuses.
+func subscribeScriptHashes(client *electrum.Client, indexHashes []string) ([]string, error) {
+	statuses := make([]string, len(indexHashes))
+
+	if !client.SupportsBatching() {
+		return statuses, pipeline(len(indexHashes), func(i int) error {
+			var err error
+
+			statuses[i], err = client.SubscribeScriptHash(indexHashes[i])
+			if err != nil {
+				return fmt.Errorf("Subscribing without batching failed: %w", err)
+			}
+
+			return nil
+		})
+	}
+
+	batches := (len(indexHashes) + subscriptionsPerBatch - 1) / subscriptionsPerBatch
+
+	return statuses, pipeline(batches, func(i int) error {
+		start := i * subscriptionsPerBatch
+
+		end := start + subscriptionsPerBatch
+		if end > len(indexHashes) {
+			end = len(indexHashes)
+		}
+
+		batch, err := client.SubscribeScriptHashBatch(indexHashes[start:end])
+		if err != nil {
+			return fmt.Errorf("Subscribing with batching failed: %w", err)
+		}
+
+		if len(batch) != end-start {
+			return fmt.Errorf("expected %d statuses, got %d", end-start, len(batch))
+		}
+
+		copy(statuses[start:end], batch)
+
+		return nil
+	})
+}
+
+// withClient runs a function with the client of the server in use, connecting to the next servers
+// if it's not connected. The connection is dropped when it fails, but not when the server answers
+// with an error, since other requests may be in flight on it.
+func (e *Electrum) withClient(fn func(client *electrum.Client) error) error {
+	shared, err := e.connect()
+	if err != nil {
+		return err
+	}
+
+	err = fn(shared.client)
+	if err != nil {
+		var serverErr *electrum.ServerError
+		if !errors.As(err, &serverErr) {
+			shared.disconnect()
+		}
+
+		return e.log.Errorf("%w", err)
+	}
+
+	return nil
+}
+
+// connect returns the client of the server in use if it's connected, or connects to the next
+// servers until one works. It tries each server at most once. Callers wait while connecting, since
+// they'll use the same connection.
+func (e *Electrum) connect() (*sharedClient, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.current != nil && e.current.client.IsConnected() {
+		return e.current, nil
+	}
+
+	var err error
+
+	for attempt := 0; attempt < len(e.serverList); attempt++ {
+		shared := e.clients.get(e.servers.NextServer())
+
+		err = shared.connect()
+		if err == nil {
+			e.current = shared
+			return shared, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to connect to a server: %w", err)
+}
+
+// pipeline calls a function for every index concurrently, so requests on the same client are
+// pipelined, with up to maxPipelinedRequests at once. It returns the first error.
+func pipeline(count int, fn func(i int) error) error {
+	errs := make(chan error, count)
+	slots := make(chan struct{}, maxPipelinedRequests)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			errs <- fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getIndexHashes calculates all the Electrum index hashes for a list of output scripts.
+func getIndexHashes(scripts [][]byte) []string {
+	indexHashes := make([]string, len(scripts))
+
+	for i, script := range scripts {
+		indexHashes[i] = electrum.GetIndexHash(script)
+	}
+
+	return indexHashes
+}
@@ -0,0 +1,203 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/electrum/electrumtest"
+)
+
+func TestElectrumWithoutBatching(t *testing.T) {
+	chain := electrumtest.NewChain(&chaincfg.RegressionNetParams)
+
+	scripts := make([][]byte, 60)
+	for i := range scripts {
+		scripts[i] = append([]byte{0x00, 0x14}, bytes.Repeat([]byte{byte(i)}, 20)...)
+
+		if i%3 == 0 {
+			chain.Fund(scripts[i], int64(1000+i))
+		}
+	}
+
+	server := electrumtest.NewTLSServer(t, chain)
+	server.SetImpl("Fulcrum 1.9.1")
+
+	electrum := NewElectrum([]string{server.Address}, true, chain.GenesisHash(), nil, nil)
+
+	// The requests are pipelined, and the results keep the order of the scripts:
+	unspents, err := electrum.ListUnspent(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := electrum.GetHistory(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range scripts {
+		funded := i%3 == 0
+
+		if funded != (len(unspents[i]) == 1) || funded != (len(history[i]) == 1) {
+			t.Fatalf("script %d: unexpected unspents %+v and history %+v", i, unspents[i], history[i])
+		}
+
+		if funded && unspents[i][0].Amount != int64(1000+i) {
+			t.Fatalf("script %d got the unspents of another: %+v", i, unspents[i])
+		}
+	}
+
+	if server.Requests("blockchain.scripthash.listunspent") != len(scripts) {
+		t.Errorf("expected a request per script, got %d", server.Requests("blockchain.scripthash.listunspent"))
+	}
+
+	// Querying both at once, on the same connection, gives the same results:
+	queriedUnspents, queriedHistory, err := electrum.QueryScripts(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(queriedUnspents, unspents) || !reflect.DeepEqual(queriedHistory, history) {
+		t.Fatalf("expected %+v and %+v, got %+v and %+v", unspents, history, queriedUnspents, queriedHistory)
+	}
+}
+
+func TestElectrumSharesConnections(t *testing.T) {
+	chain := electrumtest.NewChain(&chaincfg.RegressionNetParams)
+
+	scripts := [][]byte{append([]byte{0x00, 0x14}, bytes.Repeat([]byte{1}, 20)...)}
+	chain.Fund(scripts[0], 1000)
+
+	servers := []*electrumtest.Server{electrumtest.NewTLSServer(t, chain), electrumtest.NewTLSServer(t, chain)}
+	electrum := NewElectrum([]string{servers[0].Address, servers[1].Address}, true, chain.GenesisHash(), nil, nil)
+
+	// Concurrent calls on the backend and its replicas share one connection to every server:
+	backends := []Backend{electrum, electrum}
+	for _, replica := range electrum.Replicas() {
+		backends = append(backends, replica.Backend, replica.Backend)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(backends))
+
+	for _, backend := range backends {
+		wg.Add(1)
+
+		go func(backend Backend) {
+			defer wg.Done()
+
+			_, err := backend.ListUnspent(scripts)
+			errs <- err
+		}(backend)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, server := range servers {
+		if connections := server.Requests("server.version"); connections != 1 {
+			t.Errorf("expected 1 connection to server %d, got %d", i, connections)
+		}
+	}
+}
+
+func TestElectrumKeepsConnectionOnServerErrors(t *testing.T) {
+	chain := electrumtest.NewChain(&chaincfg.RegressionNetParams)
+
+	scripts := [][]byte{append([]byte{0x00, 0x14}, bytes.Repeat([]byte{1}, 20)...)}
+	chain.Fund(scripts[0], 1000)
+
+	var serverErr *electrum.ServerError
+
+	servers := []*electrumtest.Server{electrumtest.NewTLSServer(t, chain), electrumtest.NewTLSServer(t, chain)}
+	electrum := NewElectrum([]string{servers[0].Address, servers[1].Address}, true, chain.GenesisHash(), nil, nil)
+
+	// A transaction the server doesn't know is an answer, not a broken connection:
+	_, err := electrum.GetTransaction(strings.Repeat("ab", 32))
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("expected a server error, got %v", err)
+	}
+
+	_, err = electrum.ListUnspent(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both calls went to the same server, on the same connection:
+	connections := servers[0].Requests("server.version") + servers[1].Requests("server.version")
+	if connections != 1 {
+		t.Fatalf("expected a single connection, got %d", connections)
+	}
+}
+
+func TestSubscribeScripts(t *testing.T) {
+	for _, impl := range []string{electrumtest.DefaultImpl, "Fulcrum 1.9.1"} {
+		t.Run(impl, func(t *testing.T) {
+			chain := electrumtest.NewChain(&chaincfg.RegressionNetParams)
+
+			// Enough scripts for several batches:
+			scripts := make([][]byte, 250)
+			for i := range scripts {
+				scripts[i] = append([]byte{0x00, 0x14}, bytes.Repeat([]byte{byte(i)}, 20)...)
+			}
+
+			chain.Fund(scripts[7], 1000)
+
+			server := electrumtest.NewTLSServer(t, chain)
+			server.SetImpl(impl)
+
+			electrum := NewElectrum([]string{server.Address}, true, chain.GenesisHash(), nil, nil)
+
+			stop := make(chan struct{})
+
+			subscription, err := electrum.SubscribeScripts(scripts, stop)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, status := range subscription.Statuses {
+				if (i == 7) != (status != "") {
+					t.Fatalf("script %d: unexpected status %q", i, status)
+				}
+			}
+
+			// Confirming the funds of one script, and funding another, changes both statuses:
+			chain.Mine()
+			chain.Fund(scripts[200], 2000)
+
+			changed := make(map[int]string)
+
+			for len(changed) < 2 {
+				select {
+				case change := <-subscription.Changes:
+					changed[change.Index] = change.Status
+
+				case <-time.After(5 * time.Second):
+					t.Fatalf("expected changes of scripts 7 and 200, got %v", changed)
+				}
+			}
+
+			if changed[7] == subscription.Statuses[7] || changed[200] == "" || len(changed) != 2 {
+				t.Fatalf("unexpected changes %v", changed)
+			}
+
+			close(stop)
+
+			for range subscription.Changes {
+			}
+		})
+	}
+}
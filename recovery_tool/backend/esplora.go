@@ -0,0 +1,374 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/esplora"
+	"github.com/muun/recovery/utils"
+)
+
+// Esplora is a Backend that uses the Esplora REST API of one or more servers, such as
+// mempool.space. Script hashes are the same ones Electrum uses.
+//
+// Each call goes to the next server in the list. If a server fails (unreachable, rate-limited or
+// broken), the call is retried with the following one, until every server was tried. Errors caused
+// by the request itself, like a rejected transaction, are returned right away.
+type Esplora struct {
+	pool        *esplora.Pool
+	servers     *electrum.ServerProvider
+	clients     map[string]*esplora.Client
+	serverList  []string
+	genesisHash string
+	dialer      electrum.Dialer
+	log         *utils.Logger
+}
+
+// NewEsplora creates an Esplora backend for a list of base URLs, with up to poolSize concurrent
+// requests. If a genesis hash is given, Check fails for servers on other networks. Connections go
+// through the dialer, if given.
+func NewEsplora(servers []string, poolSize int, genesisHash string, dialer electrum.Dialer) *Esplora {
+	var dial esplora.DialFunc
+	if dialer != nil {
+		dial = dialer.DialContext
+	}
+
+	clients := make(map[string]*esplora.Client, len(servers))
+	for _, server := range servers {
+		clients[server] = esplora.NewClient(server, dial)
+	}
+
+	return &Esplora{
+		pool:        esplora.NewPool(poolSize),
+		servers:     electrum.NewServerProvider(servers),
+		clients:     clients,
+		serverList:  servers,
+		genesisHash: genesisHash,
+		dialer:      dialer,
+		log:         utils.NewLogger("Backend/Esplora"),
+	}
+}
+
+// Name describes the backend.
+func (e *Esplora) Name() string {
+	if len(e.serverList) == 1 {
+		return "esplora " + e.clients[e.serverList[0]].URL()
+	}
+
+	return fmt.Sprintf("esplora (%d servers)", len(e.serverList))
+}
+
+// Check verifies that every server is on the right network. Unreachable servers are skipped, as
+// long as one of them answers.
+func (e *Esplora) Check() error {
+	var lastErr error
+	reachable := 0
+
+	for _, server := range e.serverList {
+		client := e.clients[server]
+
+		genesisHash, err := client.GetBlockHash(0)
+		if err != nil {
+			e.log.Printf("Skipping check of %s: %v", client.URL(), err)
+			lastErr = err
+			continue
+		}
+
+		if e.genesisHash != "" && !strings.EqualFold(genesisHash, e.genesisHash) {
+			return fmt.Errorf("%s has genesis %s, expected %s", client.URL(), genesisHash, e.genesisHash)
+		}
+
+		reachable++
+	}
+
+	if reachable == 0 {
+		return fmt.Errorf("no server could be reached: %w", lastErr)
+	}
+
+	return nil
+}
+
+// ListUnspent calls `/scripthash/:hash/utxo` for every script.
+func (e *Esplora) ListUnspent(scripts [][]byte) ([][]Unspent, error) {
+	unspents := make([][]Unspent, len(scripts))
+
+	for i, indexHash := range getIndexHashes(scripts) {
+		var utxos []esplora.Utxo
+
+		err := e.withClient(func(client *esplora.Client) error {
+			var err error
+			utxos, err = client.ListUnspent(indexHash)
+			return err
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Listing unspent outputs failed: %w", err)
+		}
+
+		for _, utxo := range utxos {
+			unspents[i] = append(unspents[i], Unspent{
+				TxID:   utxo.TxID,
+				Vout:   utxo.Vout,
+				Amount: utxo.Value,
+				Height: getHeight(utxo.Status),
+			})
+		}
+	}
+
+	return unspents, nil
+}
+
+// GetHistory calls `/scripthash/:hash/txs` for every script, following its pages.
+func (e *Esplora) GetHistory(scripts [][]byte) ([][]HistoryItem, error) {
+	history := make([][]HistoryItem, len(scripts))
+
+	for i, indexHash := range getIndexHashes(scripts) {
+		var txs []esplora.Tx
+
+		err := e.withClient(func(client *esplora.Client) error {
+			var err error
+			txs, err = client.GetHistory(indexHash)
+			return err
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Getting history failed: %w", err)
+		}
+
+		for _, tx := range txs {
+			history[i] = append(history[i], HistoryItem{TxID: tx.TxID, Height: getHeight(tx.Status)})
+		}
+	}
+
+	return history, nil
+}
+
+// QueryScripts calls `/scripthash/:hash/utxo` and `/scripthash/:hash/txs` for every script, asking
+// the same server for both.
+func (e *Esplora) QueryScripts(scripts [][]byte) ([][]Unspent, [][]HistoryItem, error) {
+	unspents := make([][]Unspent, len(scripts))
+	history := make([][]HistoryItem, len(scripts))
+
+	for i, indexHash := range getIndexHashes(scripts) {
+		var utxos []esplora.Utxo
+		var txs []esplora.Tx
+
+		err := e.withClient(func(client *esplora.Client) error {
+			var err error
+
+			utxos, err = client.ListUnspent(indexHash)
+			if err != nil {
+				return err
+			}
+
+			txs, err = client.GetHistory(indexHash)
+			return err
+		})
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("Querying scripts failed: %w", err)
+		}
+
+		for _, utxo := range utxos {
+			unspents[i] = append(unspents[i], Unspent{
+				TxID:   utxo.TxID,
+				Vout:   utxo.Vout,
+				Amount: utxo.Value,
+				Height: getHeight(utxo.Status),
+			})
+		}
+
+		for _, tx := range txs {
+			history[i] = append(history[i], HistoryItem{TxID: tx.TxID, Height: getHeight(tx.Status)})
+		}
+	}
+
+	return unspents, history, nil
+}
+
+// GetTransaction calls `/tx/:txid/hex`.
+func (e *Esplora) GetTransaction(txID string) (*wire.MsgTx, error) {
+	var txHex string
+
+	err := e.withClient(func(client *esplora.Client) error {
+		var err error
+		txHex, err = client.GetTransaction(txID)
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching tx %s: %w", txID, err)
+	}
+
+	return decodeTx(txHex)
+}
+
+// Broadcast posts the transaction to `/tx`.
+func (e *Esplora) Broadcast(tx *wire.MsgTx) (string, error) {
+	txHex, err := encodeTx(tx)
+	if err != nil {
+		return "", err
+	}
+
+	var txID string
+
+	err = e.withClient(func(client *esplora.Client) error {
+		var err error
+		txID, err = client.Broadcast(txHex)
+		return err
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("error while broadcasting: %w", err)
+	}
+
+	return txID, nil
+}
+
+// BroadcastToMany posts the transaction to up to count servers at once. Servers that fail are
+// replaced with the next ones in the list, but rejections are final.
+func (e *Esplora) BroadcastToMany(tx *wire.MsgTx, count int) []BroadcastResult {
+	txHex, err := encodeTx(tx)
+	if err != nil {
+		return []BroadcastResult{{Err: err}}
+	}
+
+	candidates := make(chan *esplora.Client, len(e.serverList))
+	for range e.serverList {
+		candidates <- e.clients[e.servers.NextServer()]
+	}
+	close(candidates)
+
+	results := make(chan BroadcastResult)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < count && i < len(e.serverList); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for client := range candidates {
+				txID, err := client.Broadcast(txHex)
+				results <- BroadcastResult{Server: client.URL(), TxID: txID, Err: err}
+
+				var httpErr *esplora.HTTPError
+				if err == nil || errors.As(err, &httpErr) && !httpErr.IsServerFailure() {
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var collected []BroadcastResult
+	for result := range results {
+		collected = append(collected, result)
+	}
+
+	return collected
+}
+
+// EstimateFee calls `/fee-estimates`, which already returns sats/vB. Only some targets are
+// estimated, so we use the closest one that's not slower than requested.
+func (e *Esplora) EstimateFee(targetBlocks int) (float64, error) {
+	var estimates map[int]float64
+
+	err := e.withClient(func(client *esplora.Client) error {
+		var err error
+		estimates, err = client.FeeEstimates()
+		return err
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("error while estimating fee: %w", err)
+	}
+
+	if len(estimates) == 0 {
+		return 0, errors.New("the server can't estimate fees")
+	}
+
+	targets := make([]int, 0, len(estimates))
+	for target := range estimates {
+		targets = append(targets, target)
+	}
+
+	sort.Ints(targets)
+
+	closest := targets[0]
+	for _, target := range targets {
+		if target <= targetBlocks {
+			closest = target
+		}
+	}
+
+	return estimates[closest], nil
+}
+
+// GetFeeHistogram calls `/mempool`, and returns its fee histogram.
+func (e *Esplora) GetFeeHistogram() ([]FeeHistogramBin, error) {
+	var mempool *esplora.Mempool
+
+	err := e.withClient(func(client *esplora.Client) error {
+		var err error
+		mempool, err = client.GetMempool()
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error while getting fee histogram: %w", err)
+	}
+
+	histogram := make([]FeeHistogramBin, len(mempool.FeeHistogram))
+	for i, pair := range mempool.FeeHistogram {
+		histogram[i] = FeeHistogramBin{FeeRate: pair[0], VSize: int64(pair[1])}
+	}
+
+	return histogram, nil
+}
+
+// withClient runs a function with the next client in the list, within the concurrency limit, and
+// moves on to the following ones while servers fail.
+func (e *Esplora) withClient(fn func(client *esplora.Client) error) error {
+	e.pool.Acquire()
+	defer e.pool.Release()
+
+	var err error
+
+	for attempt := 0; attempt < len(e.serverList); attempt++ {
+		client := e.clients[e.servers.NextServer()]
+
+		err = fn(client)
+		if err == nil {
+			return nil
+		}
+
+		var httpErr *esplora.HTTPError
+		if errors.As(err, &httpErr) && !httpErr.IsServerFailure() {
+			return err
+		}
+
+		e.log.Printf("Request to %s failed: %v", client.URL(), err)
+	}
+
+	return e.log.Errorf("%w", err)
+}
+
+// getHeight returns the block height of a confirmed transaction, or 0 for unconfirmed ones.
+func getHeight(status esplora.Status) int {
+	if !status.Confirmed {
+		return 0
+	}
+
+	return status.BlockHeight
+}
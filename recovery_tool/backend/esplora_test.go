@@ -0,0 +1,298 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/esplora"
+)
+
+// fakeEsplora stands in for an Esplora server, answering the endpoints used by the Esplora backend.
+type fakeEsplora struct {
+	mu       sync.Mutex
+	down     bool
+	requests int
+	utxos    map[string][]esplora.Utxo // by script hash
+	txs      map[string][]esplora.Tx   // by script hash, newest first
+	rawTxs   map[string]string         // hex by txid
+	posted   []string
+}
+
+func (f *fakeEsplora) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests++
+
+	if f.down {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+
+	switch {
+	case parts[0] == "block-height":
+		fmt.Fprint(w, chaincfg.RegressionNetParams.GenesisHash.String())
+
+	case parts[0] == "scripthash" && parts[2] == "utxo":
+		_ = json.NewEncoder(w).Encode(f.utxos[parts[1]])
+
+	case parts[0] == "scripthash" && parts[2] == "txs":
+		_ = json.NewEncoder(w).Encode(f.historyPage(parts[1], parts[3:]))
+
+	case parts[0] == "tx" && r.Method == http.MethodPost:
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(string(body), "00") {
+			http.Error(w, "sendrawtransaction RPC error: TX decode failed", http.StatusBadRequest)
+			return
+		}
+
+		f.posted = append(f.posted, string(body))
+		fmt.Fprint(w, "ff")
+
+	case parts[0] == "tx":
+		if txHex, ok := f.rawTxs[parts[1]]; ok {
+			fmt.Fprint(w, txHex)
+		} else {
+			http.Error(w, "Transaction not found", http.StatusNotFound)
+		}
+
+	case parts[0] == "fee-estimates":
+		fmt.Fprint(w, `{"1": 30.5, "2": 25, "6": 12.1, "144": 1.5}`)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeEsplora) countRequests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests
+}
+
+// historyPage paginates like Esplora: the first page has every mempool tx and up to 25 confirmed
+// ones, and `/txs/chain/:last_seen` continues after the last confirmed one.
+func (f *fakeEsplora) historyPage(scriptHash string, rest []string) []esplora.Tx {
+	var page []esplora.Tx
+	var confirmed int
+
+	txs := f.txs[scriptHash]
+	start := 0
+
+	if len(rest) == 2 && rest[0] == "chain" {
+		for i, tx := range txs {
+			if tx.TxID == rest[1] {
+				start = i + 1
+			}
+		}
+	}
+
+	for _, tx := range txs[start:] {
+		if !tx.Status.Confirmed {
+			if start == 0 {
+				page = append(page, tx)
+			}
+			continue
+		}
+
+		if confirmed == 25 {
+			break
+		}
+
+		page = append(page, tx)
+		confirmed++
+	}
+
+	return page
+}
+
+func newTestEsplora(t *testing.T, fakes ...*fakeEsplora) *Esplora {
+	var servers []string
+
+	for _, fake := range fakes {
+		server := httptest.NewServer(fake)
+		t.Cleanup(server.Close)
+
+		servers = append(servers, server.URL+"/api")
+	}
+
+	return NewEsplora(servers, 2, chaincfg.RegressionNetParams.GenesisHash.String(), nil)
+}
+
+func TestEsploraCheck(t *testing.T) {
+	err := newTestEsplora(t, &fakeEsplora{down: true}, &fakeEsplora{}).Check()
+	if err != nil {
+		t.Fatalf("expected the check to pass with one reachable server, got %v", err)
+	}
+
+	err = newTestEsplora(t, &fakeEsplora{down: true}).Check()
+	if err == nil {
+		t.Fatal("expected the check to fail without reachable servers")
+	}
+
+	server := httptest.NewServer(&fakeEsplora{})
+	defer server.Close()
+
+	err = NewEsplora([]string{server.URL + "/api"}, 1, chaincfg.MainNetParams.GenesisHash.String(), nil).Check()
+	if err == nil {
+		t.Fatal("expected the check to fail for a server on another network")
+	}
+}
+
+func TestEsploraListUnspentAndHistory(t *testing.T) {
+	script := []byte{0x00, 0x14, 0xaa}
+	scriptHash := electrum.GetIndexHash(script)
+
+	// 60 confirmed transactions, newest first, take 3 pages:
+	txs := []esplora.Tx{{TxID: "mempool"}}
+	for height := 160; height > 100; height-- {
+		txs = append(txs, esplora.Tx{
+			TxID:   fmt.Sprintf("tx%d", height),
+			Status: esplora.Status{Confirmed: true, BlockHeight: height},
+		})
+	}
+
+	fake := &fakeEsplora{
+		utxos: map[string][]esplora.Utxo{
+			scriptHash: {
+				{TxID: "tx150", Vout: 1, Value: 5000, Status: esplora.Status{Confirmed: true, BlockHeight: 150}},
+				{TxID: "mempool", Vout: 0, Value: 1000},
+			},
+		},
+		txs: map[string][]esplora.Tx{scriptHash: txs},
+	}
+
+	b := newTestEsplora(t, &fakeEsplora{down: true}, fake)
+
+	scripts := [][]byte{script, {0x00, 0x14, 0xbb}}
+
+	unspents, err := b.ListUnspent(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(unspents) != 2 || len(unspents[0]) != 2 || len(unspents[1]) != 0 {
+		t.Fatalf("unexpected unspents %+v", unspents)
+	}
+
+	if unspents[0][0].Height != 150 || unspents[0][1].Height != 0 || unspents[0][0].Amount != 5000 {
+		t.Errorf("unexpected unspents %+v", unspents[0])
+	}
+
+	history, err := b.GetHistory(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history[0]) != 61 || len(history[1]) != 0 {
+		t.Fatalf("expected 61 and 0 history items, got %d and %d", len(history[0]), len(history[1]))
+	}
+
+	if history[0][0].Height != 0 || history[0][60].TxID != "tx101" || history[0][60].Height != 101 {
+		t.Errorf("unexpected history %+v", history[0])
+	}
+}
+
+func TestEsploraTransactions(t *testing.T) {
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 1}, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+
+	txHex, err := encodeTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	down := &fakeEsplora{down: true}
+	fake := &fakeEsplora{rawTxs: map[string]string{tx.TxHash().String(): txHex}}
+
+	b := newTestEsplora(t, down, fake)
+
+	fetched, err := b.GetTransaction(tx.TxHash().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetched.TxHash() != tx.TxHash() {
+		t.Errorf("fetched tx %v, expected %v", fetched.TxHash(), tx.TxHash())
+	}
+
+	_, err = b.Broadcast(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.posted) != 1 || fake.posted[0] != txHex {
+		t.Errorf("unexpected posted txs %v", fake.posted)
+	}
+
+	// A rejected transaction is not retried with other servers:
+	down.mu.Lock()
+	down.down = false
+	down.mu.Unlock()
+
+	requests := down.countRequests() + fake.countRequests()
+
+	_, err = b.Broadcast(wire.NewMsgTx(0))
+	if err == nil {
+		t.Fatal("expected the broadcast to be rejected")
+	}
+
+	if sent := down.countRequests() + fake.countRequests() - requests; sent != 1 {
+		t.Errorf("expected a single request, got %d", sent)
+	}
+
+	for target, expected := range map[int]float64{1: 30.5, 3: 25, 6: 12.1, 100: 12.1, 1008: 1.5} {
+		feeRate, err := b.EstimateFee(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if feeRate != expected {
+			t.Errorf("expected %v sats/vB for %d blocks, got %v", expected, target, feeRate)
+		}
+	}
+}
+
+func TestEsploraBroadcastToMany(t *testing.T) {
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 1}, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+
+	fakes := []*fakeEsplora{{down: true}, {}, {}, {}}
+	b := newTestEsplora(t, fakes...)
+
+	results := b.BroadcastToMany(tx, 2)
+
+	accepted := 0
+	for _, result := range results {
+		if result.Err == nil {
+			accepted++
+		}
+	}
+
+	// The server that's down is replaced, so exactly 2 servers accept:
+	if accepted != 2 || len(results) != 3 {
+		t.Errorf("expected 2 of 3 servers to accept, got %+v", results)
+	}
+
+	results = b.BroadcastToMany(wire.NewMsgTx(0), 4)
+
+	for _, result := range results {
+		if result.Err == nil {
+			t.Errorf("expected every server to reject the tx, got %+v", result)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/muun/recovery/electrum"
+)
+
+// replicaPoolSize is the amount of concurrent requests to each server of an Esplora replica.
+const replicaPoolSize = 2
+
+// Replicable is implemented by backends with several servers, which can be queried separately to
+// compare their answers.
+type Replicable interface {
+	// Replicas returns a backend for every server. Connections of each one are kept between calls.
+	Replicas() []Replica
+}
+
+// Replica is a backend that uses a single server, and the operator that runs it. Servers with the
+// same operator can't be trusted to give independent answers.
+type Replica struct {
+	Backend
+	Operator string
+}
+
+// Replicas returns a single-server Electrum backend for every server. They share clients with this
+// backend, so there's still one connection per server.
+func (e *Electrum) Replicas() []Replica {
+	replicas := make([]Replica, len(e.serverList))
+
+	for i, server := range e.serverList {
+		replicas[i] = Replica{
+			Backend:  newElectrum([]string{server}, e.clients),
+			Operator: getOperator(server),
+		}
+	}
+
+	return replicas
+}
+
+// Replicas returns a single-server Esplora backend for every server.
+func (e *Esplora) Replicas() []Replica {
+	replicas := make([]Replica, len(e.serverList))
+
+	for i, server := range e.serverList {
+		replicas[i] = Replica{
+			Backend:  NewEsplora([]string{server}, replicaPoolSize, e.genesisHash, e.dialer),
+			Operator: getOperator(server),
+		}
+	}
+
+	return replicas
+}
+
+// getOperator guesses who runs a server, from an Electrum address or an Esplora URL: the domain it
+// belongs to (without subdomains), or the network of its IP address. Dynamic DNS services and
+// hosting providers that give out subdomains are treated as a single operator, which errs on the
+// side of caution.
+func getOperator(server string) string {
+	host := server
+
+	if parsed, err := url.Parse(server); err == nil && parsed.Host != "" {
+		host = parsed.Host
+	}
+
+	if address, _, err := electrum.ParseServer(host); err == nil {
+		host = address
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		}
+
+		return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+
+	labels := strings.Split(host, ".")
+
+	// Country domains often have second levels like com.br or co.uk, keep one more label:
+	keep := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		keep = 3
+	}
+
+	if len(labels) <= keep {
+		return host
+	}
+
+	return strings.Join(labels[len(labels)-keep:], ".")
+}
@@ -0,0 +1,27 @@
+package backend
+
+import "testing"
+
+func TestGetOperator(t *testing.T) {
+	testCases := []struct {
+		server   string
+		operator string
+	}{
+		{server: "e.keff.org:50002", operator: "keff.org"},
+		{server: "e2.keff.org:50002", operator: "keff.org"},
+		{server: "electrum.coinext.com.br:50002", operator: "coinext.com.br"},
+		{server: "electrum.example.com:50002#abcdef", operator: "example.com"},
+		{server: "example.com:50002", operator: "example.com"},
+		{server: "192.0.2.17:50002", operator: "192.0.2.0/24"},
+		{server: "[2001:db8:1:2::1]:50002", operator: "2001:db8:1::/48"},
+		{server: "https://mempool.space/api", operator: "mempool.space"},
+		{server: "https://blockstream.info/api", operator: "blockstream.info"},
+		{server: "http://192.0.2.200:3000/api", operator: "192.0.2.0/24"},
+	}
+
+	for _, testCase := range testCases {
+		if operator := getOperator(testCase.server); operator != testCase.operator {
+			t.Errorf("expected operator %s for %s, got %s", testCase.operator, testCase.server, operator)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package bitcoind
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/muun/recovery/utils"
+)
+
+const callTimeout = time.Second * 30
+
+// NoTimeout can be given to CallWithTimeout for calls that take as long as they take, such as
+// `scantxoutset`.
+const NoTimeout = time.Duration(0)
+
+// Client is a minimal JSON-RPC client for Bitcoin Core. It's safe for concurrent use, since every
+// call is an independent HTTP request.
+type Client struct {
+	url        string
+	user       string
+	password   string
+	cookieFile string
+	nextID     int64
+	log        *utils.Logger
+}
+
+// Auth holds the credentials for a node. Either a user and password (`rpcuser` and `rpcpassword`
+// in bitcoin.conf) or the path to the `.cookie` file created by the node must be given.
+type Auth struct {
+	User       string
+	Password   string
+	CookieFile string
+}
+
+// RPCError is an error returned by the node.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("bitcoind error %d: %s", e.Code, e.Message)
+}
+
+// request models the structure of all JSON-RPC requests.
+type request struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int64         `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+// response models the structure of all JSON-RPC responses.
+type response struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// NewClient creates a Client for the node at the given URL. The scheme is optional, and defaults
+// to http.
+func NewClient(url string, auth Auth) *Client {
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+
+	return &Client{
+		url:        url,
+		user:       auth.User,
+		password:   auth.Password,
+		cookieFile: auth.CookieFile,
+		log:        utils.NewLogger("Bitcoind"),
+	}
+}
+
+// URL returns the address of the node.
+func (c *Client) URL() string {
+	return c.url
+}
+
+// Call invokes an RPC method, and decodes its result.
+func (c *Client) Call(method string, params []interface{}, result interface{}) error {
+	return c.CallWithTimeout(method, params, result, callTimeout)
+}
+
+// CallWithTimeout is like Call, with a custom timeout.
+func (c *Client) CallWithTimeout(
+	method string,
+	params []interface{},
+	result interface{},
+	timeout time.Duration,
+) error {
+
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	body, err := json.Marshal(&request{
+		JSONRPC: "1.0",
+		ID:      atomic.AddInt64(&c.nextID, 1),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return c.log.Errorf("Marshal failed %s: %w", method, err)
+	}
+
+	user, password, err := c.credentials()
+	if err != nil {
+		return err
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return c.log.Errorf("Request failed %s: %w", method, err)
+	}
+
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.SetBasicAuth(user, password)
+
+	c.log.Printf("Sending %s request", method)
+	start := time.Now()
+
+	httpClient := &http.Client{Timeout: timeout}
+
+	httpResponse, err := httpClient.Do(httpRequest)
+	if err != nil {
+		return c.log.Errorf("Send failed %s: %w", method, err)
+	}
+	defer httpResponse.Body.Close()
+
+	c.log.Printf("Received %s after %vms", method, time.Since(start).Milliseconds())
+
+	if httpResponse.StatusCode == http.StatusUnauthorized || httpResponse.StatusCode == http.StatusForbidden {
+		return c.log.Errorf("Authentication failed, check the RPC credentials")
+	}
+
+	responseBytes, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return c.log.Errorf("Receive failed %s: %w", method, err)
+	}
+
+	// Bitcoin Core answers errors with a 500 status, but the body is still a valid response:
+	var rpcResponse response
+
+	err = json.Unmarshal(responseBytes, &rpcResponse)
+	if err != nil {
+		return c.log.Errorf("Unmarshal failed %s (status %d): %w", method, httpResponse.StatusCode, err)
+	}
+
+	if rpcResponse.Error != nil {
+		return c.log.Errorf("%s failed: %w", method, rpcResponse.Error)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(rpcResponse.Result, result)
+	if err != nil {
+		return c.log.Errorf("Unmarshal of result failed %s: %w", method, err)
+	}
+
+	return nil
+}
+
+// credentials returns the user and password to use. The cookie file is read on every call, since
+// the node creates a new one each time it starts.
+func (c *Client) credentials() (string, string, error) {
+	if c.cookieFile == "" {
+		return c.user, c.password, nil
+	}
+
+	content, err := os.ReadFile(c.cookieFile)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read cookie file: %w", err)
+	}
+
+	cookie := strings.TrimSpace(string(content))
+
+	separator := strings.Index(cookie, ":")
+	if separator < 0 {
+		return "", "", errors.New("invalid cookie file, expected 'user:password'")
+	}
+
+	return cookie[:separator], cookie[separator+1:], nil
+}
@@ -0,0 +1,79 @@
+package bitcoind
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCookieAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if user != "__cookie__" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"id":1,"result":42,"error":null}`))
+	}))
+	defer server.Close()
+
+	cookieFile := filepath.Join(t.TempDir(), ".cookie")
+
+	err := os.WriteFile(cookieFile, []byte("__cookie__:secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(strings.TrimPrefix(server.URL, "http://"), Auth{CookieFile: cookieFile})
+
+	var result int
+
+	err = client.Call("getblockcount", nil, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != 42 {
+		t.Errorf("expected 42, got %v", result)
+	}
+
+	// The node creates a new cookie when it restarts:
+	err = os.WriteFile(cookieFile, []byte("__cookie__:other"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Call("getblockcount", nil, &result)
+	if err == nil {
+		t.Error("expected an authentication error")
+	}
+
+	client = NewClient(server.URL, Auth{CookieFile: filepath.Join(t.TempDir(), "missing")})
+
+	err = client.Call("getblockcount", nil, &result)
+	if err == nil {
+		t.Error("expected an error for a missing cookie file")
+	}
+}
+
+func TestRPCError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"id":1,"result":null,"error":{"code":-8,"message":"Scan already in progress"}}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, Auth{User: "user", Password: "pass"})
+
+	err := client.Call("scantxoutset", []interface{}{"start", []string{}}, nil)
+
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -8 {
+		t.Errorf("expected an RPC error with code -8, got %v", err)
+	}
+}
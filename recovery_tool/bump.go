@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/scanner"
+)
+
+// runBump replaces a recorded sweep transaction that got stuck with one that pays a higher fee,
+// spending the same outputs to the same destination.
+func runBump(args []string) {
+	var config config
+
+	flags := flag.NewFlagSet("bump", flag.ExitOnError)
+	config.registerCommonFlags(flags)
+	config.registerKeyFlags(flags)
+	config.registerBackendFlags(flags)
+	config.registerBroadcastFlags(flags)
+	config.registerFeeFlags(flags)
+	config.registerSweepsFlag(flags)
+	flags.StringVar(&config.sweepTxID, "txid", "", "Replace the recorded sweep with this transaction ID (default: the last one)")
+
+	setupCommand(&config, flags, args, "bump [options] [optional: path to Emergency Kit PDF]", true)
+
+	err := config.requireBackend()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	printNetwork(&config)
+
+	if config.usesProvidedElectrum {
+		validateProvidedElectrum(&config)
+	}
+
+	file, err := readSweepsFile(config.sweepsFile)
+	if err != nil {
+		exitWithError(invalidInput("%v", err))
+	}
+
+	attempt, err := file.find(config.sweepTxID)
+	if err != nil {
+		exitWithError(invalidInput("%v", err))
+	}
+
+	chainBackend := newBackend(&config)
+
+	original, err := chainBackend.GetTransaction(attempt.TxID)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to fetch the transaction to replace: %w", err))
+	}
+
+	if !signalsReplacement(original) {
+		exitWithError(invalidInput("the transaction %s doesn't signal replace-by-fee, so it can't be bumped", attempt.TxID))
+	}
+
+	err = checkReplaceable(chainBackend, original)
+	if err != nil {
+		exitWithError(invalidInput("the transaction %s can't be bumped: %v", attempt.TxID, err))
+	}
+
+	destinations, err := parseDestinations(attempt.Destination, config.network)
+	if err != nil {
+		exitWithError(invalidInput("invalid destination %s in the sweeps file: %v", attempt.Destination, err))
+	}
+
+	decryptedKeys := getDecryptedKeys(&config)
+
+	userKey, muunKey, err := getBasePublicKeys(decryptedKeys)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	utxos, err := attempt.restoreUtxos(userKey, muunKey, chainBackend)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	originalFee, err := getTxFee(original, utxos)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	sweeper := Sweeper{
+		UserKey:      decryptedKeys[0].Key,
+		MuunKey:      decryptedKeys[1].Key,
+		Birthday:     decryptedKeys[1].Birthday,
+		Destinations: destinations,
+		Network:      config.network,
+		Backend:      chainBackend,
+
+		BroadcastServers: config.broadcastServers,
+	}
+
+	fee := getReplacementFee(&sweeper, utxos, &config, original, originalFee)
+
+	replacementTx := buildSignedSweep(&sweeper, utxos, fee)
+
+	err = checkReplacement(original, replacementTx, utxos)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	replacement := newSweepAttempt(userKey, muunKey, utxos, replacementTx, fee, destinations)
+	replacement.Replaces = attempt.TxID
+
+	recordSweep(&config, replacement)
+
+	broadcastSweep(&sweeper, replacementTx)
+}
+
+// getReplacementFee asks for the fee of the replacement like getSweepFee, until it's high enough to
+// replace the original, and for confirmation to go ahead.
+func getReplacementFee(
+	sweeper *Sweeper,
+	utxos []*scanner.Utxo,
+	config *config,
+	original *wire.MsgTx,
+	originalFee int64,
+) int64 {
+
+	txOutputAmount, txSize, err := sweeper.GetSweepTxAmountAndSize(utxos)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	minFeeRate := getMinReplacementFeeRate(originalFee, txSize.VSize)
+
+	sayBlock(`
+		The transaction {white %v} pays %v sats (%.1f sats/vB).
+		The replacement must pay at least {white %v sats/vB}.
+	`, original.TxHash(), originalFee, float64(originalFee)/float64(getVirtualSize(original)), minFeeRate)
+
+	for {
+		fee := getFee(config, sweeper.Backend, txOutputAmount, txSize, sweeper.Destinations)
+		if fee >= minFeeRate*txSize.VSize {
+			outputs, err := getSweepOutputs(sweeper.Destinations, txOutputAmount-fee)
+			if err != nil {
+				exitWithError(err)
+			}
+
+			getConfirmation(config, fee, txSize, outputs)
+			return fee
+		}
+
+		err := invalidInput("the fee rate must be at least %d sats/vB to replace the transaction", minFeeRate)
+		if config.nonInteractive {
+			exitWithError(err)
+		}
+
+		say("%v\n", err)
+		config.feeRate = 0
+	}
+}
+
+// getMinReplacementFeeRate returns the lowest fee rate, in sats/vB, that lets a transaction of the
+// given size replace one paying originalFee. BIP125 requires it to pay the original fee plus its
+// own relay at the minimum rate.
+func getMinReplacementFeeRate(originalFee, vsize int64) int64 {
+	minFee := originalFee + minRelayFeeRate*vsize
+
+	return (minFee + vsize - 1) / vsize
+}
+
+// checkReplacement verifies that nodes will accept a transaction in place of the original, under
+// the rules of BIP125: the original signals replaceability, the replacement spends the same
+// outputs, and it pays a higher fee that also covers its own relay.
+func checkReplacement(original, replacement *wire.MsgTx, utxos []*scanner.Utxo) error {
+	if !signalsReplacement(original) {
+		return errors.New("the original transaction doesn't signal replace-by-fee")
+	}
+
+	if !spendSameOutputs(original, replacement) {
+		return errors.New("the replacement doesn't spend the same outputs as the original transaction")
+	}
+
+	originalFee, err := getTxFee(original, utxos)
+	if err != nil {
+		return err
+	}
+
+	replacementFee, err := getTxFee(replacement, utxos)
+	if err != nil {
+		return err
+	}
+
+	minFee := originalFee + minRelayFeeRate*getVirtualSize(replacement)
+	if replacementFee < minFee {
+		return fmt.Errorf("the replacement pays %d sats, but it must pay at least %d", replacementFee, minFee)
+	}
+
+	return nil
+}
+
+// checkReplaceable makes sure the original is still unconfirmed, and that nothing spends its outputs
+// (like a `cpfp` child), since BIP125 would require the replacement to pay the fees of those
+// descendants too. It looks at the history of the output scripts, so backends without history
+// (like bitcoind) only tell whether it's confirmed and unspent.
+func checkReplaceable(chainBackend backend.Backend, original *wire.MsgTx) error {
+	txID := original.TxHash()
+
+	scripts := make([][]byte, len(original.TxOut))
+	for i, txOut := range original.TxOut {
+		scripts[i] = txOut.PkScript
+	}
+
+	histories, err := chainBackend.GetHistory(scripts)
+	if err != nil {
+		return fmt.Errorf("failed to check the status of the transaction: %w", err)
+	}
+
+	checked := make(map[string]bool)
+
+	for _, history := range histories {
+		for _, item := range history {
+			if item.TxID == txID.String() {
+				if item.Height > 0 {
+					return fmt.Errorf("it was already confirmed in block %d", item.Height)
+				}
+
+				continue
+			}
+
+			// Descendants of an unconfirmed transaction are unconfirmed too:
+			if item.Height > 0 || checked[item.TxID] {
+				continue
+			}
+
+			checked[item.TxID] = true
+
+			tx, err := chainBackend.GetTransaction(item.TxID)
+			if err != nil {
+				return fmt.Errorf("failed to fetch transaction %s: %w", item.TxID, err)
+			}
+
+			for _, txIn := range tx.TxIn {
+				if txIn.PreviousOutPoint.Hash == txID {
+					return fmt.Errorf(
+						"the transaction %s spends its outputs, and the replacement would have to pay its fees too",
+						item.TxID,
+					)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// signalsReplacement tells whether a transaction opted in to replace-by-fee, with an input
+// sequence number below the maximum minus one.
+func signalsReplacement(tx *wire.MsgTx) bool {
+	for _, txIn := range tx.TxIn {
+		if txIn.Sequence < wire.MaxTxInSequenceNum-1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// spendSameOutputs tells whether two transactions have the same inputs, in any order.
+func spendSameOutputs(a, b *wire.MsgTx) bool {
+	if len(a.TxIn) != len(b.TxIn) {
+		return false
+	}
+
+	spent := make(map[wire.OutPoint]bool, len(a.TxIn))
+	for _, txIn := range a.TxIn {
+		spent[txIn.PreviousOutPoint] = true
+	}
+
+	for _, txIn := range b.TxIn {
+		if !spent[txIn.PreviousOutPoint] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getTxFee returns the fee of a transaction that spends some of the given UTXOs.
+func getTxFee(tx *wire.MsgTx, utxos []*scanner.Utxo) (int64, error) {
+	amounts := make(map[wire.OutPoint]int64, len(utxos))
+
+	for _, utxo := range utxos {
+		hash, err := chainhash.NewHashFromStr(utxo.TxID)
+		if err != nil {
+			return 0, err
+		}
+
+		amounts[*wire.NewOutPoint(hash, uint32(utxo.OutputIndex))] = utxo.Amount
+	}
+
+	var fee int64
+
+	for _, txIn := range tx.TxIn {
+		amount, ok := amounts[txIn.PreviousOutPoint]
+		if !ok {
+			return 0, fmt.Errorf("the transaction %s spends %v, which isn't part of the sweep", tx.TxHash(), txIn.PreviousOutPoint)
+		}
+
+		fee += amount
+	}
+
+	for _, txOut := range tx.TxOut {
+		fee -= txOut.Value
+	}
+
+	return fee, nil
+}
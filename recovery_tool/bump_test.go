@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/scanner"
+)
+
+// historyBackend serves history and transactions from memory, keyed by hex-encoded script and ID.
+type historyBackend struct {
+	unspentOnlyBackend
+	history map[string][]backend.HistoryItem
+	txs     map[string]*wire.MsgTx
+}
+
+func (b *historyBackend) GetHistory(scripts [][]byte) ([][]backend.HistoryItem, error) {
+	result := make([][]backend.HistoryItem, len(scripts))
+	for i, script := range scripts {
+		result[i] = b.history[hex.EncodeToString(script)]
+	}
+
+	return result, nil
+}
+
+func (b *historyBackend) GetTransaction(txID string) (*wire.MsgTx, error) {
+	if tx, ok := b.txs[txID]; ok {
+		return tx, nil
+	}
+
+	return nil, errors.New("not found")
+}
+
+// createTestSweep returns a transaction spending the UTXOs, with the given sequence number, to a
+// single output of the given amount.
+func createTestSweep(utxos []*scanner.Utxo, sequence uint32, amount int64) *wire.MsgTx {
+	tx := wire.NewMsgTx(2)
+
+	for _, utxo := range utxos {
+		hash, _ := chainhash.NewHashFromStr(utxo.TxID)
+
+		txIn := wire.NewTxIn(wire.NewOutPoint(hash, uint32(utxo.OutputIndex)), nil, nil)
+		txIn.Sequence = sequence
+
+		tx.AddTxIn(txIn)
+	}
+
+	tx.AddTxOut(wire.NewTxOut(amount, append([]byte{0x00, 0x14}, make([]byte, 20)...)))
+
+	return tx
+}
+
+func TestGetMinReplacementFeeRate(t *testing.T) {
+	testCases := []struct {
+		originalFee int64
+		vsize       int64
+		expected    int64
+	}{
+		{originalFee: 1000, vsize: 200, expected: 6},
+		{originalFee: 1001, vsize: 200, expected: 7}, // rounded up
+		{originalFee: 0, vsize: 150, expected: 1},
+		{originalFee: 300, vsize: 100, expected: 4},
+	}
+
+	for _, tc := range testCases {
+		actual := getMinReplacementFeeRate(tc.originalFee, tc.vsize)
+		if actual != tc.expected {
+			t.Errorf("fee %d for %d vB: expected %d sats/vB, got %d", tc.originalFee, tc.vsize, tc.expected, actual)
+		}
+
+		// The rate must be enough for the replacement to pass checkReplacement:
+		if actual*tc.vsize < tc.originalFee+minRelayFeeRate*tc.vsize {
+			t.Errorf("fee %d for %d vB: %d sats/vB doesn't cover the original and the relay", tc.originalFee, tc.vsize, actual)
+		}
+	}
+}
+
+func TestCheckReplacement(t *testing.T) {
+	utxos := []*scanner.Utxo{
+		{TxID: strings.Repeat("aa", 32), OutputIndex: 0, Amount: 30000},
+		{TxID: strings.Repeat("bb", 32), OutputIndex: 1, Amount: 20000},
+	}
+
+	const rbf = wire.MaxTxInSequenceNum - 2
+
+	original := createTestSweep(utxos, rbf, 49000)
+	vsize := getVirtualSize(createTestSweep(utxos, rbf, 0))
+
+	testCases := []struct {
+		desc        string
+		original    *wire.MsgTx
+		replacement *wire.MsgTx
+		valid       bool
+	}{
+		{
+			desc:        "higher fee covering the relay",
+			original:    original,
+			replacement: createTestSweep(utxos, rbf, 49000-minRelayFeeRate*vsize),
+			valid:       true,
+		},
+		{
+			desc:        "higher fee not covering the relay",
+			original:    original,
+			replacement: createTestSweep(utxos, rbf, 49000-minRelayFeeRate*vsize+1),
+		},
+		{
+			desc:        "inputs in another order",
+			original:    original,
+			replacement: createTestSweep([]*scanner.Utxo{utxos[1], utxos[0]}, rbf, 48000),
+			valid:       true,
+		},
+		{
+			desc:        "fewer inputs",
+			original:    original,
+			replacement: createTestSweep(utxos[:1], rbf, 20000),
+		},
+		{
+			desc:        "original without replace-by-fee",
+			original:    createTestSweep(utxos, wire.MaxTxInSequenceNum, 49000),
+			replacement: createTestSweep(utxos, rbf, 48000),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := checkReplacement(tc.original, tc.replacement, utxos)
+			if tc.valid && err != nil {
+				t.Fatalf("expected the replacement to be valid, got %v", err)
+			}
+
+			if !tc.valid && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestCheckReplaceable(t *testing.T) {
+	utxos := []*scanner.Utxo{{TxID: strings.Repeat("aa", 32), OutputIndex: 0, Amount: 30000}}
+
+	original := createTestSweep(utxos, wire.MaxTxInSequenceNum-2, 29000)
+	originalID := original.TxHash().String()
+	script := hex.EncodeToString(original.TxOut[0].PkScript)
+
+	child := createTestSweep([]*scanner.Utxo{{TxID: originalID, OutputIndex: 0}}, wire.MaxTxInSequenceNum, 28000)
+	unrelated := createTestSweep([]*scanner.Utxo{{TxID: strings.Repeat("cc", 32)}}, wire.MaxTxInSequenceNum, 1000)
+
+	txs := map[string]*wire.MsgTx{
+		child.TxHash().String():     child,
+		unrelated.TxHash().String(): unrelated,
+	}
+
+	testCases := []struct {
+		desc    string
+		history []backend.HistoryItem
+		err     string
+	}{
+		{
+			desc:    "unconfirmed",
+			history: []backend.HistoryItem{{TxID: originalID, Height: 0}},
+		},
+		{
+			desc:    "unconfirmed with another payment to the destination",
+			history: []backend.HistoryItem{{TxID: originalID}, {TxID: unrelated.TxHash().String()}},
+		},
+		{
+			desc:    "confirmed",
+			history: []backend.HistoryItem{{TxID: originalID, Height: 120}},
+			err:     "confirmed in block 120",
+		},
+		{
+			desc:    "with a child",
+			history: []backend.HistoryItem{{TxID: originalID}, {TxID: child.TxHash().String()}},
+			err:     "spends its outputs",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			chainBackend := &historyBackend{
+				history: map[string][]backend.HistoryItem{script: tc.history},
+				txs:     txs,
+			}
+
+			err := checkReplaceable(chainBackend, original)
+			if tc.err == "" && err != nil {
+				t.Fatalf("expected the transaction to be replaceable, got %v", err)
+			}
+
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/muun/recovery/electrum"
@@ -9,6 +11,9 @@ import (
 )
 
 func main() {
+	proxyURL := flag.String("proxy", "", "Connect through this SOCKS5 proxy (socks5://host:port), to also survey onion servers")
+	flag.Parse()
+
 	config := &survey.Config{
 		InitialServers:     electrum.PublicServers,
 		Workers:            30,
@@ -16,6 +21,16 @@ func main() {
 		SpeedTestBatchSize: 100,
 	}
 
+	if *proxyURL != "" {
+		dialer, err := electrum.NewProxyDialer(*proxyURL)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		config.Dialer = dialer
+	}
+
 	survey := survey.NewSurvey(config)
 	results := survey.Run()
 
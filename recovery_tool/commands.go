@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+)
+
+// Default paths for the files moved between the online and offline machines.
+const (
+	defaultUtxoFile = "utxos.json"
+	defaultTxFile   = "sweep_tx.hex"
+)
+
+// commands are the steps of the air-gapped workflow, plus `bump` and `cpfp` to accelerate a sweep,
+// and `watch` to follow late deposits. Only `scan` and `broadcast` need a network connection, and
+// they never see the Recovery Code.
+var commands = map[string]func(args []string){
+	"xpubs":     runXpubs,
+	"scan":      runScan,
+	"sign":      runSign,
+	"broadcast": runBroadcast,
+	"bump":      runBump,
+	"cpfp":      runCPFP,
+	"watch":     runWatch,
+}
+
+// xpubsEvent carries the extended public keys the `scan` command needs.
+type xpubsEvent struct {
+	Type     string `json:"type"`
+	UserXpub string `json:"userXpub"`
+	MuunXpub string `json:"muunXpub"`
+}
+
+// runXpubs prints the extended public keys at the base path. It runs offline.
+func runXpubs(args []string) {
+	var config config
+
+	flags := flag.NewFlagSet("xpubs", flag.ExitOnError)
+	config.registerCommonFlags(flags)
+	config.registerKeyFlags(flags)
+
+	setupCommand(&config, flags, args, "xpubs [options] [optional: path to Emergency Kit PDF]", true)
+
+	decryptedKeys := getDecryptedKeys(&config)
+
+	userKey, muunKey, err := getBasePublicKeys(decryptedKeys)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	emitEvent(&xpubsEvent{Type: "xpubs", UserXpub: userKey.String(), MuunXpub: muunKey.String()})
+
+	sayBlock(`
+		{white User xpub}: %v
+		{white Muun xpub}: %v
+
+		These keys can't move your funds, but they reveal your addresses and balance.
+		Take them to a networked machine and use the {white scan} command.
+
+	`, userKey.String(), muunKey.String())
+}
+
+// scanUsage explains where the keys come from, since the output descriptors in the Emergency Kit
+// only carry the fingerprints of the keys and can't be scanned.
+const scanUsage = `scan [options]
+
+Scans with the extended public keys that the xpubs command prints on the offline machine. The
+output descriptors in the Emergency Kit can't be used instead, since they only carry the
+fingerprints of the keys.
+`
+
+// runScan finds all UTXOs using only the extended public keys, and writes them to a UTXO file.
+func runScan(args []string) {
+	var config config
+
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	config.registerCommonFlags(flags)
+	config.registerScanFlags(flags)
+	flags.StringVar(&config.userXpub, "user-xpub", "", "User extended public key, as printed by the xpubs command")
+	flags.StringVar(&config.muunXpub, "muun-xpub", "", "Muun extended public key, as printed by the xpubs command")
+	flags.StringVar(&config.utxoFile, "utxos", "", "Write the UTXO file to this path (default \""+defaultUtxoFile+"\")")
+
+	setupCommand(&config, flags, args, scanUsage, false)
+
+	err := config.requireBackend()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	printNetwork(&config)
+
+	if config.usesProvidedElectrum {
+		validateProvidedElectrum(&config)
+	}
+
+	userKey := getXpub(&config, config.userXpub, "user xpub")
+	muunKey := getXpub(&config, config.muunXpub, "muun xpub")
+
+	sayBlock(`
+		Starting scan of all possible addresses. This will take a few minutes.
+	`)
+
+	addrGen := NewAddressGenerator(userKey, muunKey, config.generateContacts, config.gapLimit)
+
+	chainBackend := newBackend(&config)
+
+	utxos := scanUtxos(addrGen, chainBackend, &config)
+
+	if len(utxos) == 0 {
+		sayBlock("No funds were discovered\n\n")
+		return
+	}
+
+	printUtxos(utxos)
+
+	events := make([]utxoEvent, len(utxos))
+	for i, utxo := range utxos {
+		events[i] = newUtxoEvent(utxo)
+	}
+
+	// The offline signer checks amounts against these, since legacy signatures don't commit to them:
+	prevTxs, err := fetchPrevTxs(chainBackend, events)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	err = writeUtxoFile(config.utxoFile, userKey, muunKey, utxos, prevTxs)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	sayBlock(`
+		UTXO file written to {white %v}
+		Take it to your offline machine and use the {white sign} command.
+
+	`, config.utxoFile)
+}
+
+// runSign builds and signs the sweep transaction for a UTXO file. It runs offline.
+func runSign(args []string) {
+	var config config
+
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	config.registerCommonFlags(flags)
+	config.registerKeyFlags(flags)
+	config.registerSweepFlags(flags)
+	flags.StringVar(&config.utxoFile, "utxos", "", "Read the UTXO file from this path (default \""+defaultUtxoFile+"\")")
+	flags.StringVar(&config.txFile, "tx", "", "Write the signed transaction to this path (default \""+defaultTxFile+"\")")
+
+	setupCommand(&config, flags, args, "sign [options] [optional: path to Emergency Kit PDF]", true)
+
+	file, err := readUtxoFile(config.utxoFile)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	decryptedKeys := getDecryptedKeys(&config)
+	destinations := getDestinations(&config)
+
+	userKey, muunKey, err := getBasePublicKeys(decryptedKeys)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	utxos, err := file.restoreUtxos(userKey, muunKey)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if len(utxos) == 0 {
+		exitWithError(invalidInput("the utxo file has no funds to sweep"))
+	}
+
+	printUtxos(utxos)
+
+	sweeper := Sweeper{
+		UserKey:      decryptedKeys[0].Key,
+		MuunKey:      decryptedKeys[1].Key,
+		Birthday:     decryptedKeys[1].Birthday,
+		Destinations: destinations,
+		Network:      config.network,
+	}
+
+	fee := getSweepFee(&sweeper, utxos, &config)
+
+	sweepTx := buildSignedSweep(&sweeper, utxos, fee)
+
+	txBytes := new(bytes.Buffer)
+	err = sweepTx.BtcEncode(txBytes, wire.ProtocolVersion, wire.WitnessEncoding)
+	if err != nil {
+		exitWithError(fmt.Errorf("error while encoding tx: %w", err))
+	}
+
+	err = os.WriteFile(config.txFile, []byte(hex.EncodeToString(txBytes.Bytes())+"\n"), 0600)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to write signed tx: %w", err))
+	}
+
+	sayBlock(`
+		Signed transaction written to {white %v}
+		Take it to a networked machine and use the {white broadcast} command.
+
+	`, config.txFile)
+}
+
+// runBroadcast sends a transaction signed with the `sign` command.
+func runBroadcast(args []string) {
+	var config config
+
+	flags := flag.NewFlagSet("broadcast", flag.ExitOnError)
+	config.registerCommonFlags(flags)
+	config.registerBackendFlags(flags)
+	config.registerBroadcastFlags(flags)
+	flags.StringVar(&config.txFile, "tx", "", "Read the signed transaction from this path (default \""+defaultTxFile+"\")")
+
+	setupCommand(&config, flags, args, "broadcast [options]", false)
+
+	err := config.requireBackend()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	content, err := os.ReadFile(config.txFile)
+	if err != nil {
+		exitWithError(invalidInput("failed to read signed tx: %v", err))
+	}
+
+	txBytes, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		exitWithError(invalidInput("failed to decode signed tx: %v", err))
+	}
+
+	sweepTx := wire.NewMsgTx(0)
+	err = sweepTx.Deserialize(bytes.NewReader(txBytes))
+	if err != nil {
+		exitWithError(invalidInput("failed to decode signed tx: %v", err))
+	}
+
+	broadcastSweep(&Sweeper{
+		Network:          config.network,
+		Backend:          newBackend(&config),
+		BroadcastServers: config.broadcastServers,
+	}, sweepTx)
+}
+
+// setupCommand parses the arguments of a command, and completes its configuration like main does.
+func setupCommand(config *config, flags *flag.FlagSet, args []string, usage string, acceptsKit bool) {
+	flags.Usage = func() {
+		fmt.Println("Usage: recovery-tool " + usage)
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(args) // exits on error
+
+	maxArgs := 0
+	if acceptsKit {
+		maxArgs = 1
+	}
+
+	if flags.NArg() > maxArgs {
+		flags.Usage()
+		os.Exit(0)
+	}
+
+	err := config.resolve(flags)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	err = setOutputFormat(config.outputFormat)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	if config.utxoFile == "" {
+		config.utxoFile = defaultUtxoFile
+	}
+
+	if config.txFile == "" {
+		config.txFile = defaultTxFile
+	}
+}
+
+// getXpub returns the extended public key given in the config or, if interactive, asks for it.
+func getXpub(config *config, value string, name string) *libwallet.HDPublicKey {
+	if value != "" {
+		key, err := parseBasePublicKey(strings.TrimSpace(value), config.network)
+		if err == nil {
+			return key
+		}
+
+		if config.nonInteractive {
+			exitWithError(invalidInput("invalid %s: %v", name, err))
+		}
+
+		say(`
+			The provided %s is not valid: %v
+		`, name, err)
+	}
+
+	if config.nonInteractive {
+		exitWithError(missingInput(name))
+	}
+
+	return readXpub(name, config.network)
+}
+
+func readXpub(name string, network *libwallet.Network) *libwallet.HDPublicKey {
+	sayBlock(`
+		{yellow Enter the %v}
+		(it looks like this: 'xpub6Bn6nzd6...', run the xpubs command on the offline machine to get it)
+	`, name)
+
+	var userInput string
+	ask(&userInput)
+
+	key, err := parseBasePublicKey(userInput, network)
+	if err != nil {
+		say(`
+			%v
+			Please, try again
+		`, err)
+
+		return readXpub(name, network)
+	}
+
+	return key
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/electrum"
+)
+
+// Exit codes, so that scripts running the tool in non-interactive mode can tell failures apart
+// without parsing our output.
+const (
+	exitCodeSuccess       = 0
+	exitCodeError         = 1 // unexpected error during the recovery process
+	exitCodeElectrum      = 2 // couldn't connect to the provided Electrum server or node
+	exitCodeMissingInput  = 3 // a required value was not provided in non-interactive mode
+	exitCodeInvalidInput  = 4 // a provided value is malformed or out of range
+	exitCodeNotConfirmed  = 5 // the user declined, or didn't explicitly confirm, the transaction
+	exitCodeInvalidConfig = 6 // the configuration file couldn't be read or parsed
+	exitCodeNotSeen       = 7 // the transaction was sent, but didn't show up in the mempool
+)
+
+// Environment variables that can provide values for non-interactive mode. They take precedence
+// over the configuration file, but not over command-line flags.
+const (
+	envRecoveryCode   = "RECOVERY_TOOL_RECOVERY_CODE"
+	envEmergencyKit   = "RECOVERY_TOOL_EMERGENCY_KIT"
+	envFirstKey       = "RECOVERY_TOOL_FIRST_KEY"
+	envSecondKey      = "RECOVERY_TOOL_SECOND_KEY"
+	envDestination    = "RECOVERY_TOOL_DESTINATION"
+	envFeeRate        = "RECOVERY_TOOL_FEE_RATE"
+	envElectrumServer = "RECOVERY_TOOL_ELECTRUM_SERVER"
+	envUserXpub       = "RECOVERY_TOOL_USER_XPUB"
+	envMuunXpub       = "RECOVERY_TOOL_MUUN_XPUB"
+	envNetwork        = "RECOVERY_TOOL_NETWORK"
+	envSignet         = "RECOVERY_TOOL_SIGNET_CHALLENGE"
+	envGapLimit       = "RECOVERY_TOOL_GAP_LIMIT"
+	envBitcoind       = "RECOVERY_TOOL_BITCOIND"
+	envBitcoindCookie = "RECOVERY_TOOL_BITCOIND_COOKIE"
+	envBitcoindUser   = "RECOVERY_TOOL_BITCOIND_USER"
+	envBitcoindPass   = "RECOVERY_TOOL_BITCOIND_PASSWORD"
+	envEsplora        = "RECOVERY_TOOL_ESPLORA"
+	envBroadcastTo    = "RECOVERY_TOOL_BROADCAST_SERVERS"
+	envConsensus      = "RECOVERY_TOOL_CONSENSUS"
+	envSweepThreshold = "RECOVERY_TOOL_SWEEP_THRESHOLD"
+	envProxy          = "RECOVERY_TOOL_PROXY"
+)
+
+// stdinValue is the placeholder that, used as the value of a flag, variable or config field,
+// tells the tool to read that value from a line of standard input instead.
+const stdinValue = "-"
+
+type config struct {
+	generateContacts     bool
+	providedElectrum     string
+	usesProvidedElectrum bool
+	onlyScan             bool
+	gapLimit             int
+	audit                bool
+
+	// Amount of Electrum or Esplora servers, from different operators, to compare each batch of the
+	// scan on. A single one is used if it's 0 or 1.
+	consensus int
+
+	// Scan progress is saved to the checkpoint file, and restored from it when resuming.
+	checkpointFile string
+	resume         bool
+
+	// Bitcoin network, and the Electrum servers we connect to on it (the provided ones, or the
+	// public servers for the network).
+	networkName     string
+	signetChallenge string
+	network         *libwallet.Network
+	electrumServers []string
+
+	// A Bitcoin Core node to use instead of Electrum servers, and its RPC credentials. Without
+	// credentials, the node's default cookie file is used.
+	bitcoindURL      string
+	bitcoindCookie   string
+	bitcoindUser     string
+	bitcoindPassword string
+
+	// Esplora servers to use instead of Electrum servers, as a comma-separated list of base URLs,
+	// or `public` for the public servers of the network.
+	esplora        string
+	esploraServers []string
+
+	// SOCKS5 proxy for connections to Electrum and Esplora servers, such as Tor. It's required to
+	// reach onion servers.
+	proxy  string
+	dialer electrum.Dialer
+
+	// Certificates of provided Electrum servers are trusted on first use, and saved to this file.
+	knownServersFile string
+	trustStore       *electrum.TrustStore
+
+	// Sweep transactions are recorded to this file before broadcasting, so `bump` can replace them.
+	// `bump` and `cpfp` act on the one with sweepTxID, or the last one.
+	sweepsFile string
+	sweepTxID  string
+
+	// The output of the sweep a `cpfp` child spends, and the WIF private key to sign it, if the
+	// destination is ours.
+	cpfpVout int
+	cpfpKey  string
+
+	// Amount of Electrum or Esplora servers to send the sweep transaction to, for those worried
+	// about a single server dropping it.
+	broadcastServers int
+
+	// Non-interactive mode. When enabled, the tool never prompts: every value must be given by
+	// flags, environment variables or the configuration file.
+	nonInteractive bool
+	assumeYes      bool
+	configFile     string
+	recoveryCode   string
+	emergencyKit   string
+	firstKey       string
+	secondKey      string
+	destination    string
+	feeRate        int64
+
+	// Output format, either human-readable text or newline-delimited JSON events.
+	outputFormat string
+
+	// When set, write a PSBT for the sweep to this path instead of signing and broadcasting.
+	psbtFile string
+
+	// Air-gapped workflow. `scan` takes the extended public keys at the base path and writes the
+	// UTXO file, `sign` reads it and writes the signed transaction, and `broadcast` sends it.
+	userXpub string
+	muunXpub string
+	utxoFile string
+	txFile   string
+
+	// `watch` sweeps the new confirmed funds once they add up to this amount in sats, or never if
+	// it's 0.
+	sweepThreshold int64
+}
+
+// fileConfig models the JSON document accepted by the `--config` flag. All fields are optional.
+type fileConfig struct {
+	RecoveryCode     string `json:"recoveryCode"`
+	EmergencyKit     string `json:"emergencyKit"`
+	FirstKey         string `json:"firstKey"`
+	SecondKey        string `json:"secondKey"`
+	Destination      string `json:"destination"`
+	FeeRate          int64  `json:"feeRate"`
+	ElectrumServer   string `json:"electrumServer"`
+	GenerateContacts bool   `json:"generateContacts"`
+	OnlyScan         bool   `json:"onlyScan"`
+	NonInteractive   bool   `json:"nonInteractive"`
+	Yes              bool   `json:"yes"`
+	Output           string `json:"output"`
+	PSBTFile         string `json:"psbtFile"`
+	UserXpub         string `json:"userXpub"`
+	MuunXpub         string `json:"muunXpub"`
+	UtxoFile         string `json:"utxoFile"`
+	TxFile           string `json:"txFile"`
+	Network          string `json:"network"`
+	SignetChallenge  string `json:"signetChallenge"`
+	GapLimit         int    `json:"gapLimit"`
+	Audit            bool   `json:"audit"`
+	CheckpointFile   string `json:"checkpointFile"`
+	Resume           bool   `json:"resume"`
+	Bitcoind         string `json:"bitcoind"`
+	BitcoindCookie   string `json:"bitcoindCookie"`
+	BitcoindUser     string `json:"bitcoindUser"`
+	BitcoindPassword string `json:"bitcoindPassword"`
+	Esplora          string `json:"esplora"`
+	BroadcastServers int    `json:"broadcastServers"`
+	Consensus        int    `json:"consensus"`
+	Proxy            string `json:"proxy"`
+	KnownServersFile string `json:"knownServersFile"`
+	SweepsFile       string `json:"sweepsFile"`
+	SweepThreshold   int64  `json:"sweepThreshold"`
+}
+
+// inputError is an error caused by the values we were given, tagged with the exit code to use.
+type inputError struct {
+	code int
+	err  error
+}
+
+func (e *inputError) Error() string {
+	return e.err.Error()
+}
+
+func (e *inputError) Unwrap() error {
+	return e.err
+}
+
+func missingInput(name string) error {
+	return &inputError{exitCodeMissingInput, fmt.Errorf("missing required value: %s", name)}
+}
+
+func invalidInput(format string, v ...interface{}) error {
+	return &inputError{exitCodeInvalidInput, fmt.Errorf(format, v...)}
+}
+
+// registerFlags binds the command-line flags of the single-process recovery to this config.
+func (c *config) registerFlags(flags *flag.FlagSet) {
+	c.registerCommonFlags(flags)
+	c.registerScanFlags(flags)
+	c.registerKeyFlags(flags)
+	c.registerSweepFlags(flags)
+	c.registerBroadcastFlags(flags)
+	c.registerSweepsFlag(flags)
+
+	flags.BoolVar(&c.onlyScan, "only-scan", false, "Only scan for UTXOs without generating a transaction")
+	flags.StringVar(&c.psbtFile, "psbt", "", "Write an unsigned PSBT for the sweep to this file instead of broadcasting")
+}
+
+func (c *config) registerCommonFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&c.nonInteractive, "non-interactive", false, "Never prompt, fail if a required value is missing")
+	flags.StringVar(&c.configFile, "config", "", "Read values from this JSON configuration file")
+	flags.StringVar(&c.outputFormat, "output", "", "Output format, 'text' (default) or 'json'")
+	flags.StringVar(&c.networkName, "network", "", "Bitcoin network, 'mainnet' (default), 'testnet', 'signet' or 'regtest'")
+	flags.StringVar(&c.signetChallenge, "signet-challenge", "", "Challenge script of a custom signet (hex)")
+}
+
+func (c *config) registerScanFlags(flags *flag.FlagSet) {
+	c.registerBackendFlags(flags)
+
+	flags.BoolVar(&c.generateContacts, "generate-contacts", false, "Generate contact addresses")
+	flags.StringVar(&c.checkpointFile, "checkpoint", "", "Save scan progress to this path (default \""+defaultCheckpointFile+"\")")
+	flags.BoolVar(&c.resume, "resume", false, "Resume an interrupted scan from the checkpoint")
+	flags.BoolVar(&c.audit, "audit", false, "Print the full transaction history of the wallet after scanning")
+	flags.IntVar(&c.gapLimit, "gap-limit", 0, fmt.Sprintf("Stop scanning a branch after this many unused addresses in a row (default %d)", defaultGapLimit))
+	flags.IntVar(&c.consensus, "consensus", 0, "Scan every batch of addresses on this many servers of different operators, and compare their results")
+}
+
+func (c *config) registerBackendFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.providedElectrum, "electrum-server", "", "Connect to this electrum server (or several, comma-separated), as host:port or host:port#sha256-fingerprint")
+	flags.StringVar(&c.knownServersFile, "known-servers", "", "Remember certificates of provided electrum servers in this file (default \""+defaultKnownServersFile+"\")")
+	flags.StringVar(&c.proxy, "proxy", "", "Connect to servers through this SOCKS5 proxy, such as Tor (socks5://host:port)")
+	flags.StringVar(&c.bitcoindURL, "bitcoind", "", "Use this Bitcoin Core node (host:port of its RPC interface) instead of Electrum")
+	flags.StringVar(&c.bitcoindCookie, "bitcoind-cookie", "", "Path to the node's .cookie file (default: the node's data directory)")
+	flags.StringVar(&c.bitcoindUser, "bitcoind-user", "", "RPC user of the node, instead of the cookie file")
+	flags.StringVar(&c.bitcoindPassword, "bitcoind-password", "", "RPC password of the node")
+	flags.StringVar(&c.esplora, "esplora", "", "Use these Esplora API base URLs (comma-separated, or 'public') instead of Electrum")
+}
+
+func (c *config) registerBroadcastFlags(flags *flag.FlagSet) {
+	flags.IntVar(&c.broadcastServers, "broadcast-servers", 0, "Send the transaction to this many Electrum or Esplora servers, reporting each result")
+}
+
+func (c *config) registerSweepsFlag(flags *flag.FlagSet) {
+	flags.StringVar(&c.sweepsFile, "sweeps", "", "Record sweep transactions to this path (default \""+defaultSweepsFile+"\")")
+}
+
+func (c *config) registerKeyFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.recoveryCode, "recovery-code", "", "Recovery Code (use '-' to read it from stdin)")
+	flags.StringVar(&c.emergencyKit, "emergency-kit", "", "Path to the Emergency Kit PDF")
+	flags.StringVar(&c.firstKey, "first-key", "", "First encrypted private key (use '-' to read it from stdin)")
+	flags.StringVar(&c.secondKey, "second-key", "", "Second encrypted private key (use '-' to read it from stdin)")
+}
+
+func (c *config) registerSweepFlags(flags *flag.FlagSet) {
+	c.registerFeeFlags(flags)
+
+	flags.StringVar(&c.destination, "destination", "", "Destination bitcoin address, or several as address:sats, address:percent% or address:rest separated by commas")
+}
+
+func (c *config) registerFeeFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&c.assumeYes, "yes", false, "Confirm the sweep transaction without prompting")
+	flags.Int64Var(&c.feeRate, "fee-rate", 0, "Fee rate for the sweep transaction (sats/vB)")
+}
+
+// resolve completes the values not given as flags, first from environment variables and then from
+// the configuration file (if any), and reads values marked with '-' from stdin. The flags must be
+// parsed already, and their first argument is taken as the emergency kit.
+func (c *config) resolve(flags *flag.FlagSet) error {
+	if c.emergencyKit == "" {
+		c.emergencyKit = flags.Arg(0)
+	}
+
+	// Booleans can be turned off by flags too, so we need to know which ones were given:
+	setFlags := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	var file fileConfig
+
+	if c.configFile != "" {
+		content, err := os.ReadFile(c.configFile)
+		if err != nil {
+			return &inputError{exitCodeInvalidConfig, fmt.Errorf("failed to read config file: %w", err)}
+		}
+
+		err = json.Unmarshal(content, &file)
+		if err != nil {
+			return &inputError{exitCodeInvalidConfig, fmt.Errorf("failed to parse config file: %w", err)}
+		}
+	}
+
+	fillString(&c.recoveryCode, envRecoveryCode, file.RecoveryCode)
+	fillString(&c.emergencyKit, envEmergencyKit, file.EmergencyKit)
+	fillString(&c.firstKey, envFirstKey, file.FirstKey)
+	fillString(&c.secondKey, envSecondKey, file.SecondKey)
+	fillString(&c.destination, envDestination, file.Destination)
+	fillString(&c.providedElectrum, envElectrumServer, file.ElectrumServer)
+	fillString(&c.userXpub, envUserXpub, file.UserXpub)
+	fillString(&c.muunXpub, envMuunXpub, file.MuunXpub)
+	fillString(&c.networkName, envNetwork, file.Network)
+	fillString(&c.signetChallenge, envSignet, file.SignetChallenge)
+	fillString(&c.bitcoindURL, envBitcoind, file.Bitcoind)
+	fillString(&c.bitcoindCookie, envBitcoindCookie, file.BitcoindCookie)
+	fillString(&c.bitcoindUser, envBitcoindUser, file.BitcoindUser)
+	fillString(&c.bitcoindPassword, envBitcoindPass, file.BitcoindPassword)
+	fillString(&c.esplora, envEsplora, file.Esplora)
+	fillString(&c.proxy, envProxy, file.Proxy)
+
+	if c.networkName == "" {
+		c.networkName = networkMainnet
+	}
+
+	network, err := getNetwork(c.networkName, c.signetChallenge)
+	if err != nil {
+		return invalidInput("%w", err)
+	}
+
+	c.network = network
+
+	if c.bitcoindURL != "" && c.bitcoindUser == "" && c.bitcoindCookie == "" {
+		c.bitcoindCookie = getDefaultCookiePath(network)
+	}
+
+	if c.utxoFile == "" {
+		c.utxoFile = file.UtxoFile
+	}
+
+	if c.txFile == "" {
+		c.txFile = file.TxFile
+	}
+
+	if c.outputFormat == "" {
+		c.outputFormat = file.Output
+	}
+
+	if c.checkpointFile == "" {
+		c.checkpointFile = file.CheckpointFile
+	}
+
+	if c.knownServersFile == "" {
+		c.knownServersFile = file.KnownServersFile
+	}
+
+	if c.knownServersFile == "" {
+		c.knownServersFile = defaultKnownServersFile
+	}
+
+	if c.sweepsFile == "" {
+		c.sweepsFile = file.SweepsFile
+	}
+
+	if c.sweepsFile == "" {
+		c.sweepsFile = defaultSweepsFile
+	}
+
+	if c.checkpointFile == "" {
+		c.checkpointFile = defaultCheckpointFile
+	}
+
+	if c.psbtFile == "" {
+		c.psbtFile = file.PSBTFile
+	}
+
+	if c.outputFormat == "" {
+		c.outputFormat = outputText
+	}
+
+	if c.feeRate == 0 {
+		if rawFeeRate := os.Getenv(envFeeRate); rawFeeRate != "" {
+			feeRate, err := strconv.ParseInt(rawFeeRate, 10, 64)
+			if err != nil {
+				return invalidInput("invalid %s: %v", envFeeRate, err)
+			}
+			c.feeRate = feeRate
+		} else {
+			c.feeRate = file.FeeRate
+		}
+	}
+
+	if c.gapLimit == 0 {
+		if rawGapLimit := os.Getenv(envGapLimit); rawGapLimit != "" {
+			gapLimit, err := strconv.Atoi(rawGapLimit)
+			if err != nil {
+				return invalidInput("invalid %s: %v", envGapLimit, err)
+			}
+			c.gapLimit = gapLimit
+		} else {
+			c.gapLimit = file.GapLimit
+		}
+	}
+
+	if c.broadcastServers == 0 {
+		if rawBroadcastServers := os.Getenv(envBroadcastTo); rawBroadcastServers != "" {
+			broadcastServers, err := strconv.Atoi(rawBroadcastServers)
+			if err != nil {
+				return invalidInput("invalid %s: %v", envBroadcastTo, err)
+			}
+			c.broadcastServers = broadcastServers
+		} else {
+			c.broadcastServers = file.BroadcastServers
+		}
+	}
+
+	if c.consensus == 0 {
+		if rawConsensus := os.Getenv(envConsensus); rawConsensus != "" {
+			consensus, err := strconv.Atoi(rawConsensus)
+			if err != nil {
+				return invalidInput("invalid %s: %v", envConsensus, err)
+			}
+			c.consensus = consensus
+		} else {
+			c.consensus = file.Consensus
+		}
+	}
+
+	if c.sweepThreshold == 0 {
+		if rawSweepThreshold := os.Getenv(envSweepThreshold); rawSweepThreshold != "" {
+			sweepThreshold, err := strconv.ParseInt(rawSweepThreshold, 10, 64)
+			if err != nil {
+				return invalidInput("invalid %s: %v", envSweepThreshold, err)
+			}
+			c.sweepThreshold = sweepThreshold
+		} else {
+			c.sweepThreshold = file.SweepThreshold
+		}
+	}
+
+	if c.sweepThreshold < 0 {
+		return invalidInput("invalid sweep threshold %d, it must be positive", c.sweepThreshold)
+	}
+
+	if c.consensus < 0 {
+		return invalidInput("invalid consensus %d, it must be positive", c.consensus)
+	}
+
+	if c.broadcastServers < 0 {
+		return invalidInput("invalid amount of broadcast servers %d, it must be positive", c.broadcastServers)
+	}
+
+	if c.gapLimit < 0 {
+		return invalidInput("invalid gap limit %d, it must be positive", c.gapLimit)
+	}
+
+	if c.gapLimit == 0 {
+		c.gapLimit = defaultGapLimit
+	}
+
+	fillBool(&c.generateContacts, setFlags["generate-contacts"], file.GenerateContacts)
+	fillBool(&c.onlyScan, setFlags["only-scan"], file.OnlyScan)
+	fillBool(&c.audit, setFlags["audit"], file.Audit)
+	fillBool(&c.resume, setFlags["resume"], file.Resume)
+	fillBool(&c.nonInteractive, setFlags["non-interactive"], file.NonInteractive)
+	fillBool(&c.assumeYes, setFlags["yes"], file.Yes)
+
+	// Values marked with '-' are read from stdin, one per line, in this order:
+	for _, value := range []*string{&c.recoveryCode, &c.firstKey, &c.secondKey, &c.destination, &c.cpfpKey} {
+		if *value != stdinValue {
+			continue
+		}
+
+		line, err := readStdinLine()
+		if err != nil {
+			return invalidInput("failed to read value from stdin: %v", err)
+		}
+
+		*value = line
+	}
+
+	if c.proxy != "" {
+		dialer, err := electrum.NewProxyDialer(c.proxy)
+		if err != nil {
+			return invalidInput("%w", err)
+		}
+
+		c.dialer = dialer
+	}
+
+	c.usesProvidedElectrum = len(strings.TrimSpace(c.providedElectrum)) > 0
+
+	if c.usesProvidedElectrum {
+		c.electrumServers = splitServers(c.providedElectrum)
+
+		for _, server := range c.electrumServers {
+			if _, _, err := electrum.ParseServer(server); err != nil {
+				return invalidInput("%w", err)
+			}
+		}
+
+		// Public servers renew their certificates often, so we only remember those of servers the
+		// user chose:
+		trustStore, err := electrum.LoadTrustStore(c.knownServersFile)
+		if err != nil {
+			return &inputError{exitCodeInvalidConfig, err}
+		}
+
+		c.trustStore = trustStore
+	} else {
+		c.electrumServers = getDefaultElectrumServers(c.network)
+	}
+
+	if c.esplora == esploraPublic {
+		c.esploraServers = getDefaultEsploraServers(c.network)
+	} else {
+		c.esploraServers = splitServers(c.esplora)
+	}
+
+	return nil
+}
+
+// splitServers parses a comma-separated list of servers.
+func splitServers(list string) []string {
+	var servers []string
+
+	for _, server := range strings.Split(list, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+
+	return servers
+}
+
+// requireBackend fails if there's no server to connect to, since there are no public servers for
+// some networks.
+func (c *config) requireBackend() error {
+	backends := 0
+	for _, given := range []bool{c.usesProvidedElectrum, c.bitcoindURL != "", c.esplora != ""} {
+		if given {
+			backends++
+		}
+	}
+
+	if backends > 1 {
+		return invalidInput("use only one of an electrum server, a bitcoind node or esplora servers")
+	}
+
+	if c.proxy == "" {
+		for _, servers := range [][]string{c.electrumServers, c.esploraServers} {
+			for _, server := range servers {
+				if electrum.IsOnion(server) {
+					return invalidInput("onion server %s needs a proxy, such as --proxy socks5://127.0.0.1:9050", server)
+				}
+			}
+		}
+	}
+
+	if c.bitcoindURL != "" && c.broadcastServers > 1 {
+		return invalidInput("--broadcast-servers needs electrum or esplora servers, not a bitcoind node")
+	}
+
+	if c.bitcoindURL != "" && c.consensus > 1 {
+		return invalidInput("--consensus needs electrum or esplora servers, not a bitcoind node")
+	}
+
+	if c.esplora != "" {
+		if len(c.esploraServers) == 0 {
+			return missingInput(fmt.Sprintf("esplora server (there are no public servers for %s)", c.networkName))
+		}
+
+		return nil
+	}
+
+	if c.bitcoindURL == "" && len(c.electrumServers) == 0 {
+		return missingInput(fmt.Sprintf("electrum server (there are no public servers for %s)", c.networkName))
+	}
+
+	return nil
+}
+
+// readStdinLine reads a single line from stdin. It reads byte by byte, to avoid buffering input
+// that later prompts may need.
+func readStdinLine() (string, error) {
+	var line strings.Builder
+	buf := make([]byte, 1)
+
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			if buf[0] == '\n' {
+				break
+			}
+			line.WriteByte(buf[0])
+		}
+
+		if err == io.EOF && line.Len() > 0 {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return strings.TrimSpace(line.String()), nil
+}
+
+// fillString sets an empty value from an environment variable or, failing that, a fallback.
+func fillString(value *string, envName string, fallback string) {
+	if *value != "" {
+		return
+	}
+
+	if envValue, ok := os.LookupEnv(envName); ok && envValue != "" {
+		*value = envValue
+		return
+	}
+
+	*value = fallback
+}
+
+// fillBool sets a value not given as a flag from a fallback, so flags can override it either way.
+func fillBool(value *bool, isSet bool, fallback bool) {
+	if !isSet {
+		*value = fallback
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveBoolPrecedence(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+
+	err := os.WriteFile(configFile, []byte(`{"yes": true, "resume": true, "audit": true}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c config
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.registerFlags(flags)
+
+	// Flags override the file either way, and the file fills in the ones not given:
+	err = flags.Parse([]string{"--config", configFile, "--yes=false", "--non-interactive", "--audit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.resolve(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.assumeYes || !c.nonInteractive || !c.resume || !c.audit || c.onlyScan {
+		t.Fatalf("unexpected values %+v", c)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/muun/libwallet/btcsuitew/txscriptw"
+	"github.com/muun/recovery/backend"
+)
+
+// Weights used to estimate the size of a child transaction, assuming signatures of maximum size and
+// compressed public keys.
+const (
+	txOverheadWeight    = 4*10 + 2    // version, input and output counts and lock time, plus segwit marker and flag
+	txInBaseWeight      = 4 * 41      // outpoint, sequence and an empty signature script length
+	p2wpkhWitnessWeight = 1 + 73 + 34 // item count, signature and compressed public key
+)
+
+// runCPFP accelerates an unconfirmed sweep with a child transaction that spends its output, paying
+// enough for both to reach the chosen fee rate. The tool signs the child if given the key of the
+// destination, exports it as a PSBT for another wallet, or just tells the fee it must pay.
+func runCPFP(args []string) {
+	var config config
+
+	flags := flag.NewFlagSet("cpfp", flag.ExitOnError)
+	config.registerCommonFlags(flags)
+	config.registerBackendFlags(flags)
+	config.registerBroadcastFlags(flags)
+	config.registerFeeFlags(flags)
+	config.registerSweepsFlag(flags)
+	flags.StringVar(&config.sweepTxID, "txid", "", "Accelerate the sweep with this transaction ID (default: the last one recorded)")
+	flags.IntVar(&config.cpfpVout, "vout", 0, "Index of the sweep output the child spends")
+	flags.StringVar(&config.cpfpKey, "key", "", "WIF private key of the sweep output, to sign the child (use '-' to read it from stdin)")
+	flags.StringVar(&config.destination, "destination", "", "Send the child to this address (default: the address of the sweep output)")
+	flags.StringVar(&config.psbtFile, "psbt", "", "Write an unsigned PSBT for the child to this file, to sign it with your wallet")
+
+	setupCommand(&config, flags, args, "cpfp [options]", false)
+
+	err := config.requireBackend()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	printNetwork(&config)
+
+	if config.usesProvidedElectrum {
+		validateProvidedElectrum(&config)
+	}
+
+	txID := config.sweepTxID
+	if txID == "" {
+		file, err := readSweepsFile(config.sweepsFile)
+		if err != nil {
+			exitWithError(invalidInput("%v", err))
+		}
+
+		attempt, err := file.find("")
+		if err != nil {
+			exitWithError(invalidInput("%v, pass the transaction with --txid", err))
+		}
+
+		txID = attempt.TxID
+	}
+
+	chainBackend := newBackend(&config)
+
+	parent, err := chainBackend.GetTransaction(txID)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to fetch the transaction to accelerate: %w", err))
+	}
+
+	if config.cpfpVout < 0 || config.cpfpVout >= len(parent.TxOut) {
+		exitWithError(invalidInput("the transaction %s has no output %d", txID, config.cpfpVout))
+	}
+
+	parentFee, err := getParentFee(chainBackend, parent)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	params := config.network.ToParams()
+	spent := parent.TxOut[config.cpfpVout]
+
+	outputScript := spent.PkScript
+	if config.destination != "" {
+		destinationAddress, err := parseAddress(strings.TrimSpace(config.destination), config.network)
+		if err != nil {
+			exitWithError(invalidInput("invalid destination: %v", err))
+		}
+
+		outputScript, err = txscriptw.PayToAddrScript(destinationAddress)
+		if err != nil {
+			exitWithError(err)
+		}
+	}
+
+	parentVSize := getVirtualSize(parent)
+	parentFeeRate := float64(parentFee) / float64(parentVSize)
+
+	sayBlock(`
+		The transaction {white %v} pays %v sats for %v vbytes (%.1f sats/vB).
+	`, txID, parentFee, parentVSize, parentFeeRate)
+
+	childSize := estimateChildSize(spent.PkScript, outputScript)
+	packageFeeRate := getPackageFeeRate(&config, chainBackend, parentFeeRate)
+	childFee := getChildFee(parentFee, parentVSize, childSize.VSize, packageFeeRate)
+
+	if spent.Value-childFee < dustThreshold {
+		exitWithError(invalidInput("the output has %d sats, too little to pay the %d sats the child needs", spent.Value, childFee))
+	}
+
+	emitEvent(&cpfpEvent{
+		Type:           "cpfp",
+		TxID:           txID,
+		Vout:           config.cpfpVout,
+		ParentFee:      parentFee,
+		ParentVSize:    parentVSize,
+		PackageFeeRate: packageFeeRate,
+		ChildFee:       childFee,
+		ChildVSize:     childSize.VSize,
+	})
+
+	sayBlock(`
+		To reach %v sats/vB, a child spending output {white %v:%v} must pay {white %v sats} for about %v vbytes ({white %v sats/vB}).
+	`, packageFeeRate, txID, config.cpfpVout, childFee, childSize.VSize, (childFee+childSize.VSize-1)/childSize.VSize)
+
+	child := buildChildTx(parent, config.cpfpVout, outputScript, childFee)
+
+	switch {
+	case config.psbtFile != "":
+		writeChildPSBT(parent, child, config.psbtFile)
+
+	case config.cpfpKey != "":
+		wif, err := getWIF(&config, params)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		err = signChild(child, spent, wif, params)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		outputs := []sweepOutput{{address: describeScript(outputScript, params), amount: child.TxOut[0].Value}}
+
+		getConfirmation(&config, childFee, childSize, outputs)
+
+		broadcastSweep(&Sweeper{
+			Network:          config.network,
+			Backend:          chainBackend,
+			BroadcastServers: config.broadcastServers,
+		}, child)
+
+	default:
+		sayBlock(`
+			The tool can't sign for the destination. If your wallet there supports it, spend that output
+			with the fee above, or pass its private key with {white --key}, or use {white --psbt} to sign it with
+			your wallet. Exchanges usually can't do this: ask them to accelerate the deposit, or use {white bump}.
+
+		`)
+	}
+}
+
+// getParentFee returns the fee of a transaction, fetching the ones it spends from the backend.
+func getParentFee(chainBackend backend.Backend, parent *wire.MsgTx) (int64, error) {
+	prevTxs := make(map[chainhash.Hash]*wire.MsgTx)
+
+	var fee int64
+
+	for _, txIn := range parent.TxIn {
+		prevOut := txIn.PreviousOutPoint
+
+		prevTx, ok := prevTxs[prevOut.Hash]
+		if !ok {
+			var err error
+
+			prevTx, err = chainBackend.GetTransaction(prevOut.Hash.String())
+			if err != nil {
+				return 0, fmt.Errorf("failed to fetch the transactions spent by the sweep: %w", err)
+			}
+
+			prevTxs[prevOut.Hash] = prevTx
+		}
+
+		if int(prevOut.Index) >= len(prevTx.TxOut) {
+			return 0, fmt.Errorf("the transaction %s has no output %d", prevOut.Hash, prevOut.Index)
+		}
+
+		fee += prevTx.TxOut[prevOut.Index].Value
+	}
+
+	for _, txOut := range parent.TxOut {
+		fee -= txOut.Value
+	}
+
+	return fee, nil
+}
+
+// getPackageFeeRate returns the fee rate for the sweep and its child together, given in the config
+// or, if interactive, asked for suggesting the ones estimated by the backend.
+func getPackageFeeRate(config *config, chainBackend backend.Backend, parentFeeRate float64) int64 {
+	if config.feeRate != 0 {
+		err := checkPackageFeeRate(config.feeRate, parentFeeRate)
+		if err == nil {
+			return config.feeRate
+		}
+
+		if config.nonInteractive {
+			exitWithError(invalidInput("invalid fee rate: %v", err))
+		}
+
+		say(`
+			The provided fee rate can't be used: %v
+		`, err)
+	}
+
+	if config.nonInteractive {
+		exitWithError(missingInput("fee rate"))
+	}
+
+	return readPackageFeeRate(parentFeeRate, getPresetFeeRates(chainBackend))
+}
+
+func readPackageFeeRate(parentFeeRate float64, suggestions []feeSuggestion) int64 {
+	sayBlock(`
+		{yellow Enter the fee rate for the sweep and its child together (sats/vB)}
+	`)
+
+	if len(suggestions) > 0 {
+		say("Suggested fee rates:\n")
+
+		for _, suggestion := range suggestions {
+			say(
+				"• {white %-8s} %4d sats/vB, confirms in %s (%d blocks)\n",
+				suggestion.name,
+				suggestion.feeRate,
+				suggestion.eta,
+				suggestion.target,
+			)
+		}
+
+		say("\nType the name of a suggestion, or a fee rate of your choice.\n")
+	}
+
+	var userInput string
+	ask(&userInput)
+
+	userInput = strings.TrimSpace(userInput)
+
+	for _, suggestion := range suggestions {
+		if strings.EqualFold(userInput, suggestion.name) {
+			userInput = strconv.FormatInt(suggestion.feeRate, 10)
+		}
+	}
+
+	feeRate, err := strconv.ParseInt(userInput, 10, 64)
+	if err != nil {
+		err = errors.New("The fee must be a whole number")
+	} else {
+		err = checkPackageFeeRate(feeRate, parentFeeRate)
+	}
+
+	if err != nil {
+		say(`
+			%v
+			Please, try again
+		`, err)
+
+		return readPackageFeeRate(parentFeeRate, suggestions)
+	}
+
+	return feeRate
+}
+
+func checkPackageFeeRate(feeRate int64, parentFeeRate float64) error {
+	if feeRate < minRelayFeeRate {
+		return fmt.Errorf("The fee rate must be at least %d sats/vB, or nodes won't relay the transaction", minRelayFeeRate)
+	}
+
+	if float64(feeRate) <= parentFeeRate {
+		return fmt.Errorf("The sweep already pays %.1f sats/vB, choose a higher fee rate", parentFeeRate)
+	}
+
+	return nil
+}
+
+// getChildFee returns the fee a child must pay so that, together with its parent, they pay the
+// package fee rate. The child always pays at least the minimum relay fee for itself.
+func getChildFee(parentFee, parentVSize, childVSize, packageFeeRate int64) int64 {
+	childFee := packageFeeRate*(parentVSize+childVSize) - parentFee
+
+	if childFee < minRelayFeeRate*childVSize {
+		return minRelayFeeRate * childVSize
+	}
+
+	return childFee
+}
+
+// estimateChildSize returns the size of a child with a single input and output, once signed.
+func estimateChildSize(spentScript, outputScript []byte) SweepSize {
+	outputWeight := int64(8+1+len(outputScript)) * blockchain.WitnessScaleFactor
+
+	weight := txOverheadWeight + estimateInputWeight(spentScript) + outputWeight
+
+	return SweepSize{
+		Weight: weight,
+		VSize:  (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor,
+	}
+}
+
+// estimateInputWeight returns the weight of an input spending a script. Scripts we can't know the
+// spending conditions of, like P2WSH, are counted as P2WPKH.
+func estimateInputWeight(script []byte) int64 {
+	switch txscript.GetScriptClass(script) {
+	case txscript.PubKeyHashTy:
+		// A signature script with the signature and the public key, and an empty witness:
+		return txInBaseWeight + 4*(1+73+34) + 1
+
+	case txscript.ScriptHashTy:
+		// Assumed to be P2SH-P2WPKH, with the witness program in the signature script:
+		return txInBaseWeight + 4*23 + p2wpkhWitnessWeight
+	}
+
+	if len(script) == 34 && script[0] == txscript.OP_1 && script[1] == txscript.OP_DATA_32 {
+		// A taproot key spend, with a single schnorr signature:
+		return txInBaseWeight + 1 + 65
+	}
+
+	return txInBaseWeight + p2wpkhWitnessWeight
+}
+
+// buildChildTx creates the unsigned child spending an output of the parent. It signals
+// replace-by-fee like the sweep.
+func buildChildTx(parent *wire.MsgTx, vout int, outputScript []byte, fee int64) *wire.MsgTx {
+	child := wire.NewMsgTx(2)
+
+	parentHash := parent.TxHash()
+
+	txIn := wire.NewTxIn(wire.NewOutPoint(&parentHash, uint32(vout)), nil, nil)
+	txIn.Sequence = rbfSequence
+
+	child.AddTxIn(txIn)
+	child.AddTxOut(wire.NewTxOut(parent.TxOut[vout].Value-fee, outputScript))
+
+	return child
+}
+
+// writeChildPSBT exports the child as an unsigned PSBT, with the output it spends.
+func writeChildPSBT(parent, child *wire.MsgTx, path string) {
+	packet, err := psbt.NewFromUnsignedTx(child)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to create psbt: %w", err))
+	}
+
+	spent := parent.TxOut[child.TxIn[0].PreviousOutPoint.Index]
+
+	packet.Inputs[0].NonWitnessUtxo = parent
+	if txscript.IsWitnessProgram(spent.PkScript) {
+		packet.Inputs[0].WitnessUtxo = spent
+	}
+
+	encodedPSBT, _, err := encodePSBT(packet)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	err = os.WriteFile(path, []byte(encodedPSBT), 0600)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to write psbt: %w", err))
+	}
+
+	sayBlock(`
+		PSBT written to {white %v}
+		The child was {yellow not} broadcast. Sign it and broadcast it with your wallet software.
+
+	`, path)
+}
+
+// getWIF decodes the private key of the sweep output given in the config.
+func getWIF(config *config, params *chaincfg.Params) (*btcutil.WIF, error) {
+	wif, err := btcutil.DecodeWIF(strings.TrimSpace(config.cpfpKey))
+	if err != nil {
+		return nil, invalidInput("invalid private key: %v", err)
+	}
+
+	if !wif.IsForNet(params) {
+		return nil, invalidInput("the private key is not for %s", config.network.Name())
+	}
+
+	return wif, nil
+}
+
+// signChild signs the input of a child spending an output that pays to a key directly, as P2PKH,
+// P2WPKH or P2SH-P2WPKH do, and verifies the result.
+func signChild(child *wire.MsgTx, spent *wire.TxOut, wif *btcutil.WIF, params *chaincfg.Params) error {
+	pubKeyHash := btcutil.Hash160(wif.SerializePubKey())
+
+	p2wpkhScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(pubKeyHash).Script()
+	if err != nil {
+		return err
+	}
+
+	p2pkhScript, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_DUP).AddOp(txscript.OP_HASH160).AddData(pubKeyHash).
+		AddOp(txscript.OP_EQUALVERIFY).AddOp(txscript.OP_CHECKSIG).
+		Script()
+	if err != nil {
+		return err
+	}
+
+	p2shScript, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_HASH160).AddData(btcutil.Hash160(p2wpkhScript)).AddOp(txscript.OP_EQUAL).
+		Script()
+	if err != nil {
+		return err
+	}
+
+	sigHashes := txscript.NewTxSigHashes(child)
+	txIn := child.TxIn[0]
+
+	switch {
+	case bytes.Equal(spent.PkScript, p2pkhScript):
+		txIn.SignatureScript, err = txscript.SignatureScript(
+			child, 0, spent.PkScript, txscript.SigHashAll, wif.PrivKey, wif.CompressPubKey,
+		)
+
+	case bytes.Equal(spent.PkScript, p2wpkhScript) && wif.CompressPubKey:
+		txIn.Witness, err = txscript.WitnessSignature(
+			child, sigHashes, 0, spent.Value, p2wpkhScript, txscript.SigHashAll, wif.PrivKey, true,
+		)
+
+	case bytes.Equal(spent.PkScript, p2shScript) && wif.CompressPubKey:
+		txIn.Witness, err = txscript.WitnessSignature(
+			child, sigHashes, 0, spent.Value, p2wpkhScript, txscript.SigHashAll, wif.PrivKey, true,
+		)
+		if err == nil {
+			txIn.SignatureScript, err = txscript.NewScriptBuilder().AddData(p2wpkhScript).Script()
+		}
+
+	default:
+		return invalidInput("the key doesn't match the output, or its type isn't supported: use --psbt to sign with your wallet")
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to sign the child: %w", err)
+	}
+
+	engine, err := txscript.NewEngine(
+		spent.PkScript, child, 0, txscript.StandardVerifyFlags, nil, sigHashes, spent.Value,
+	)
+	if err == nil {
+		err = engine.Execute()
+	}
+
+	if err != nil {
+		return fmt.Errorf("the signed child is invalid: %w", err)
+	}
+
+	return nil
+}
+
+// describeScript returns the address an output script pays to, or the script in hex if it has none.
+func describeScript(script []byte, params *chaincfg.Params) string {
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(script, params)
+	if err != nil || len(addrs) != 1 {
+		return fmt.Sprintf("script %x", script)
+	}
+
+	return addrs[0].String()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+func TestGetChildFee(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		parentFee      int64
+		parentVSize    int64
+		childVSize     int64
+		packageFeeRate int64
+		expected       int64
+	}{
+		{
+			desc:           "child pays for both",
+			parentFee:      200,
+			parentVSize:    200,
+			childVSize:     110,
+			packageFeeRate: 10,
+			expected:       2900,
+		},
+		{
+			desc:           "parent paying almost enough",
+			parentFee:      1900,
+			parentVSize:    200,
+			childVSize:     110,
+			packageFeeRate: 10,
+			expected:       1200,
+		},
+		{
+			desc:           "parent paying more than the package rate",
+			parentFee:      5000,
+			parentVSize:    200,
+			childVSize:     110,
+			packageFeeRate: 5,
+			expected:       110, // the minimum relay fee of the child
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			actual := getChildFee(tc.parentFee, tc.parentVSize, tc.childVSize, tc.packageFeeRate)
+			if actual != tc.expected {
+				t.Fatalf("expected %d sats, got %d", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSignChild(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+
+	privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{0x11}, 32))
+	otherKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{0x22}, 32))
+
+	newWIF := func(key *btcec.PrivateKey, compressed bool) *btcutil.WIF {
+		wif, err := btcutil.NewWIF(key, params, compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return wif
+	}
+
+	wif := newWIF(privKey, true)
+	pubKeyHash := btcutil.Hash160(wif.SerializePubKey())
+
+	p2pkh, err := btcutil.NewAddressPubKeyHash(pubKeyHash, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2wpkh, err := btcutil.NewAddressWitnessPubKeyHash(pubKeyHash, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2wpkhScript, err := txscript.PayToAddrScript(p2wpkh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2sh, err := btcutil.NewAddressScriptHash(p2wpkhScript, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputScript := p2wpkhScript
+
+	testCases := []struct {
+		desc  string
+		addr  btcutil.Address
+		wif   *btcutil.WIF
+		valid bool
+	}{
+		{desc: "p2pkh", addr: p2pkh, wif: wif, valid: true},
+		{desc: "p2wpkh", addr: p2wpkh, wif: wif, valid: true},
+		{desc: "p2sh-p2wpkh", addr: p2sh, wif: wif, valid: true},
+		{desc: "another key", addr: p2wpkh, wif: newWIF(otherKey, true)},
+		{desc: "uncompressed key for p2wpkh", addr: p2wpkh, wif: newWIF(privKey, false)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			script, err := txscript.PayToAddrScript(tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parent := wire.NewMsgTx(2)
+			parent.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 0}, nil, nil))
+			parent.AddTxOut(wire.NewTxOut(5000, []byte{txscript.OP_RETURN}))
+			parent.AddTxOut(wire.NewTxOut(50000, script))
+
+			size := estimateChildSize(script, outputScript)
+			fee := getChildFee(100, getVirtualSize(parent), size.VSize, 10)
+
+			child := buildChildTx(parent, 1, outputScript, fee)
+
+			// signChild verifies the signed input with the script engine:
+			err = signChild(child, parent.TxOut[1], tc.wif, params)
+
+			if !tc.valid {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if child.TxOut[0].Value != 50000-fee || child.TxIn[0].Sequence != rbfSequence {
+				t.Fatalf("unexpected child %+v", child)
+			}
+
+			// The estimate can't fall short, or the child would pay less than the package rate, but
+			// it's allowed a few vbytes over (signatures can be shorter than the maximum):
+			weight := blockchain.GetTransactionWeight(btcutil.NewTx(child))
+			if size.Weight < weight || size.VSize-getVirtualSize(child) > 3 {
+				t.Fatalf("estimated a weight of %d, but the signed child has %d", size.Weight, weight)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet"
+)
+
+// dustThreshold is the smallest amount we send to an output. Nodes don't relay smaller outputs.
+const dustThreshold = 546
+
+// destinationRest marks the destination that receives what's left after paying the others.
+const destinationRest = "rest"
+
+// destination is an output of the sweep. It receives a fixed amount, a percentage of what's left
+// after the fixed amounts and the fee, or the rest.
+type destination struct {
+	address btcutil.Address
+	amount  int64   // in sats, if fixed
+	percent float64 // if a percentage
+	rest    bool
+}
+
+// sweepOutput is an address and the amount it receives, as shown in the summary.
+type sweepOutput struct {
+	address string
+	amount  int64
+}
+
+// parseDestinations parses a comma-separated list of addresses, each followed by `:` and an amount
+// in sats, a percentage such as `40%`, or `rest`. A single address alone receives everything.
+func parseDestinations(input string, network *libwallet.Network) ([]destination, error) {
+	entries := strings.Split(strings.TrimSpace(input), ",")
+
+	destinations := make([]destination, 0, len(entries))
+	seen := make(map[string]bool)
+
+	var totalPercent float64
+	var rests int
+
+	for _, entry := range entries {
+		rawAddress, rawAmount := strings.TrimSpace(entry), ""
+		if separator := strings.Index(rawAddress, ":"); separator >= 0 {
+			rawAddress, rawAmount = rawAddress[:separator], strings.TrimSpace(rawAddress[separator+1:])
+		}
+
+		addr, err := parseAddress(rawAddress, network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", rawAddress, err)
+		}
+
+		if seen[addr.String()] {
+			return nil, fmt.Errorf("the address %s is listed twice", addr)
+		}
+		seen[addr.String()] = true
+
+		dest := destination{address: addr}
+
+		switch {
+		case rawAmount == "" && len(entries) == 1, strings.EqualFold(rawAmount, destinationRest):
+			dest.rest = true
+			rests++
+
+		case rawAmount == "":
+			return nil, fmt.Errorf("missing amount for %s, use sats, a percentage or %q", addr, destinationRest)
+
+		case strings.HasSuffix(rawAmount, "%"):
+			dest.percent, err = strconv.ParseFloat(strings.TrimSuffix(rawAmount, "%"), 64)
+			if err != nil || dest.percent <= 0 || dest.percent > 100 {
+				return nil, fmt.Errorf("invalid percentage %s for %s", rawAmount, addr)
+			}
+
+			totalPercent += dest.percent
+
+		default:
+			dest.amount, err = strconv.ParseInt(rawAmount, 10, 64)
+			if err != nil || dest.amount < dustThreshold {
+				return nil, fmt.Errorf("invalid amount %s for %s, it must be at least %d sats", rawAmount, addr, dustThreshold)
+			}
+		}
+
+		destinations = append(destinations, dest)
+	}
+
+	const epsilon = 1e-9
+
+	switch {
+	case rests > 1:
+		return nil, errors.New("only one destination can take the rest")
+
+	case rests == 1 && totalPercent > 100-epsilon:
+		return nil, fmt.Errorf("the percentages add up to %v%%, leaving nothing for the rest", totalPercent)
+
+	case rests == 0 && totalPercent == 0:
+		return nil, fmt.Errorf("one destination must take the rest, marked with %q", destinationRest)
+
+	case rests == 0 && math.Abs(totalPercent-100) > epsilon:
+		return nil, fmt.Errorf("the percentages add up to %v%%, they must add up to 100%% unless a destination takes the rest", totalPercent)
+	}
+
+	return destinations, nil
+}
+
+// formatDestinations is the inverse of parseDestinations.
+func formatDestinations(destinations []destination) string {
+	if len(destinations) == 1 && destinations[0].rest {
+		return destinations[0].address.String()
+	}
+
+	entries := make([]string, len(destinations))
+
+	for i, dest := range destinations {
+		var amount string
+
+		switch {
+		case dest.rest:
+			amount = destinationRest
+		case dest.percent > 0:
+			amount = strconv.FormatFloat(dest.percent, 'f', -1, 64) + "%"
+		default:
+			amount = strconv.FormatInt(dest.amount, 10)
+		}
+
+		entries[i] = dest.address.String() + ":" + amount
+	}
+
+	return strings.Join(entries, ",")
+}
+
+// splitAmount divides the amount left after the fee among the destinations. Fixed amounts are paid
+// first, then the percentages of what remains, and the destination that takes the rest gets what's
+// left (or the last percentage does, to account for rounding). Every output must be above dust.
+func splitAmount(destinations []destination, amount int64) ([]int64, error) {
+	amounts := make([]int64, len(destinations))
+	remaining := amount
+
+	for i, dest := range destinations {
+		amounts[i] = dest.amount
+		remaining -= dest.amount
+	}
+
+	if remaining < 0 {
+		return nil, fmt.Errorf("the funds can't cover the fixed amounts, %d sats are missing", -remaining)
+	}
+
+	variable := remaining
+	restIndex, lastPercentIndex := -1, -1
+
+	for i, dest := range destinations {
+		if dest.percent > 0 {
+			amounts[i] = int64(float64(variable) * dest.percent / 100)
+			remaining -= amounts[i]
+			lastPercentIndex = i
+		}
+
+		if dest.rest {
+			restIndex = i
+		}
+	}
+
+	if restIndex < 0 {
+		restIndex = lastPercentIndex
+	}
+
+	amounts[restIndex] += remaining
+
+	for i, dest := range destinations {
+		if amounts[i] < dustThreshold {
+			return nil, fmt.Errorf(
+				"the output to %s would get %d sats, below the dust limit of %d", dest.address, amounts[i], dustThreshold,
+			)
+		}
+	}
+
+	return amounts, nil
+}
+
+// getSweepOutputs returns the amount each destination receives.
+func getSweepOutputs(destinations []destination, amount int64) ([]sweepOutput, error) {
+	amounts, err := splitAmount(destinations, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := make([]sweepOutput, len(destinations))
+	for i, dest := range destinations {
+		outputs[i] = sweepOutput{address: dest.address.String(), amount: amounts[i]}
+	}
+
+	return outputs, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet"
+)
+
+// createTestAddresses returns distinct P2WPKH addresses of a network.
+func createTestAddresses(t *testing.T, network *libwallet.Network, count int) []btcutil.Address {
+	addresses := make([]btcutil.Address, count)
+
+	for i := range addresses {
+		addr, err := btcutil.NewAddressWitnessPubKeyHash(bytes.Repeat([]byte{byte(i + 1)}, 20), network.ToParams())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addresses[i] = addr
+	}
+
+	return addresses
+}
+
+func TestParseDestinations(t *testing.T) {
+	network := libwallet.Regtest()
+	addresses := createTestAddresses(t, network, 3)
+
+	a, b, c := addresses[0].String(), addresses[1].String(), addresses[2].String()
+
+	testCases := []struct {
+		input    string
+		expected []destination // nil if invalid
+	}{
+		{
+			input:    a,
+			expected: []destination{{address: addresses[0], rest: true}},
+		},
+		{
+			input:    " " + a + ":1000, " + b + ":REST ",
+			expected: []destination{{address: addresses[0], amount: 1000}, {address: addresses[1], rest: true}},
+		},
+		{
+			input:    a + ":40%," + b + ":60%",
+			expected: []destination{{address: addresses[0], percent: 40}, {address: addresses[1], percent: 60}},
+		},
+		{
+			input: a + ":12.5%," + b + ":2000," + c + ":rest",
+			expected: []destination{
+				{address: addresses[0], percent: 12.5},
+				{address: addresses[1], amount: 2000},
+				{address: addresses[2], rest: true},
+			},
+		},
+		{input: a + ":40%," + b + ":50%"},                // percentages not adding up to 100
+		{input: a + ":40%," + b + ":60%," + c + ":rest"}, // nothing left for the rest
+		{input: a + ":rest," + b + ":rest"},
+		{input: a + ":1000," + b + ":2000"}, // nobody takes the rest
+		{input: a + ":100," + b + ":rest"},  // dust
+		{input: a + ":0%," + b + ":rest"},
+		{input: a + ":101%," + b + ":rest"},
+		{input: a + ":abc," + b + ":rest"},
+		{input: a + "," + b + ":rest"}, // missing amount
+		{input: a + ":1000," + a + ":rest"},
+		{input: "bogus:rest"},
+		{input: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"}, // mainnet
+	}
+
+	for _, tc := range testCases {
+		actual, err := parseDestinations(tc.input, network)
+
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", tc.input, actual)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.input, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%q: expected %+v, got %+v", tc.input, tc.expected, actual)
+		}
+
+		// Formatting and parsing again gives the same destinations, as the sweeps file needs:
+		again, err := parseDestinations(formatDestinations(actual), network)
+		if err != nil || !reflect.DeepEqual(again, actual) {
+			t.Errorf("%q: expected %q to parse back, got %+v (%v)", tc.input, formatDestinations(actual), again, err)
+		}
+	}
+}
+
+func TestSplitAmount(t *testing.T) {
+	addresses := createTestAddresses(t, libwallet.Regtest(), 3)
+
+	fixed := func(i int, amount int64) destination {
+		return destination{address: addresses[i], amount: amount}
+	}
+
+	percent := func(i int, percent float64) destination {
+		return destination{address: addresses[i], percent: percent}
+	}
+
+	rest := func(i int) destination {
+		return destination{address: addresses[i], rest: true}
+	}
+
+	testCases := []struct {
+		desc         string
+		destinations []destination
+		amount       int64
+		expected     []int64
+		err          string
+	}{
+		{
+			desc:         "everything to one",
+			destinations: []destination{rest(0)},
+			amount:       10000,
+			expected:     []int64{10000},
+		},
+		{
+			desc:         "fixed and rest",
+			destinations: []destination{fixed(0, 3000), rest(1)},
+			amount:       10000,
+			expected:     []int64{3000, 7000},
+		},
+		{
+			desc:         "percentages of what's left after fixed amounts",
+			destinations: []destination{fixed(0, 2000), percent(1, 50), percent(2, 50)},
+			amount:       10000,
+			expected:     []int64{2000, 4000, 4000},
+		},
+		{
+			desc:         "rounding goes to the rest",
+			destinations: []destination{percent(0, 33), percent(1, 33), rest(2)},
+			amount:       10001,
+			expected:     []int64{3300, 3300, 3401},
+		},
+		{
+			desc:         "rounding goes to the last percentage without a rest",
+			destinations: []destination{percent(0, 33.3), percent(1, 66.7)},
+			amount:       10001,
+			expected:     []int64{3330, 6671},
+		},
+		{
+			desc:         "rest listed first",
+			destinations: []destination{rest(0), percent(1, 25)},
+			amount:       8000,
+			expected:     []int64{6000, 2000},
+		},
+		{
+			desc:         "fixed amounts exceeding the funds",
+			destinations: []destination{fixed(0, 6000), fixed(1, 5000), rest(2)},
+			amount:       10000,
+			err:          "1000 sats are missing",
+		},
+		{
+			desc:         "rest below dust",
+			destinations: []destination{fixed(0, 9600), rest(1)},
+			amount:       10000,
+			err:          "below the dust limit",
+		},
+		{
+			desc:         "percentage below dust",
+			destinations: []destination{percent(0, 1), rest(1)},
+			amount:       10000,
+			err:          "would get 100 sats",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			amounts, err := splitAmount(tc.destinations, tc.amount)
+
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %v (%v)", tc.err, err, amounts)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(amounts, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, amounts)
+			}
+
+			var total int64
+			for _, amount := range amounts {
+				total += amount
+			}
+
+			if total != tc.amount {
+				t.Fatalf("expected the amounts to add up to %d, got %d", tc.amount, total)
+			}
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package electrum
 
 import (
-	"bufio"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
@@ -10,6 +10,7 @@ import (
 	"net"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/muun/recovery/utils"
@@ -17,10 +18,12 @@ import (
 
 const defaultLoggerTag = "Electrum/?"
 const connectionTimeout = time.Second * 30
-const callTimeout = time.Second * 30
 const messageDelim = byte('\n')
 const noTimeout = 0
 
+// callTimeout is how long a request waits for its response. Tests shorten it.
+var callTimeout = time.Second * 30
+
 var implsWithBatching = []string{"ElectrumX"}
 
 // Client is a TLS client that implements a subset of the Electrum protocol.
@@ -28,15 +31,24 @@ var implsWithBatching = []string{"ElectrumX"}
 // It includes a minimal implementation of a JSON-RPC client, since the one provided by the
 // standard library doesn't support features such as batching.
 //
-// It is absolutely not thread-safe. Every Client should have a single owner.
+// Requests can be made concurrently, and are pipelined over a single connection: each one waits
+// for the response with its ID, with its own timeout. Connect and Disconnect must not be called
+// concurrently, and the exported fields are set while connecting.
 type Client struct {
-	Server        string
-	ServerImpl    string
-	ProtoVersion  string
+	Server       string
+	ServerImpl   string
+	ProtoVersion string
+	log          *utils.Logger
+	requireTls   bool
+	genesisHash  string
+	dialer       Dialer
+	proxied      bool
+	trustStore   *TrustStore
+	pinned       string // fingerprint of the certificate pinned for the current server
+
+	mu            sync.Mutex
+	conn          *connection
 	nextRequestID int
-	conn          net.Conn
-	log           *utils.Logger
-	requireTls    bool
 }
 
 // Request models the structure of all Electrum protocol requests.
@@ -46,6 +58,16 @@ type Request struct {
 	Params []Param `json:"params"`
 }
 
+// ServerError is an error response from the server, like a rejected transaction. The connection
+// stays usable after one, unlike after a failure to send or receive.
+type ServerError struct {
+	Err interface{} // type varies among Electrum implementations.
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("Electrum error: %v", e.Err)
+}
+
 // ErrorResponse models the structure of a generic error response.
 type ErrorResponse struct {
 	ID    int         `json:"id"`
@@ -76,18 +98,68 @@ type ListUnspentResponse struct {
 	Result []UnspentRef `json:"result"`
 }
 
+// GetHistoryResponse models a `blockchain.scripthash.get_history` response.
+type GetHistoryResponse struct {
+	ID     int          `json:"id"`
+	Result []HistoryRef `json:"result"`
+}
+
 // GetTransactionResponse models the structure of a `blockchain.transaction.get` response.
 type GetTransactionResponse struct {
 	ID     int    `json:"id"`
 	Result string `json:"result"`
 }
 
+// EstimateFeeResponse models the structure of a `blockchain.estimatefee` response.
+type EstimateFeeResponse struct {
+	ID     int     `json:"id"`
+	Result float64 `json:"result"`
+}
+
+// FeeHistogramResponse models the structure of a `mempool.get_fee_histogram` response, a list of
+// [fee rate in sats/vB, vsize] pairs.
+type FeeHistogramResponse struct {
+	ID     int          `json:"id"`
+	Result [][2]float64 `json:"result"`
+}
+
 // BroadcastResponse models the structure of a `blockchain.transaction.broadcast` response.
 type BroadcastResponse struct {
 	ID     int    `json:"id"`
 	Result string `json:"result"`
 }
 
+// GetMerkleResponse models the structure of a `blockchain.transaction.get_merkle` response.
+type GetMerkleResponse struct {
+	ID     int         `json:"id"`
+	Result MerkleProof `json:"result"`
+}
+
+// BlockHeaderResponse models the structure of a `blockchain.block.header` response.
+type BlockHeaderResponse struct {
+	ID     int    `json:"id"`
+	Result string `json:"result"`
+}
+
+// BlockHeadersResponse models the structure of a `blockchain.block.headers` response.
+type BlockHeadersResponse struct {
+	ID     int          `json:"id"`
+	Result BlockHeaders `json:"result"`
+}
+
+// HeadersSubscribeResponse models the structure of a `blockchain.headers.subscribe` response.
+type HeadersSubscribeResponse struct {
+	ID     int       `json:"id"`
+	Result HeaderRef `json:"result"`
+}
+
+// ScriptHashSubscribeResponse models the structure of a `blockchain.scripthash.subscribe` response.
+// The result is null for scripts without history.
+type ScriptHashSubscribeResponse struct {
+	ID     int     `json:"id"`
+	Result *string `json:"result"`
+}
+
 // UnspentRef models an item in the `ListUnspentResponse` results.
 type UnspentRef struct {
 	TxHash string `json:"tx_hash"`
@@ -96,6 +168,36 @@ type UnspentRef struct {
 	Height int    `json:"height"`
 }
 
+// HistoryRef models an item in the `GetHistoryResponse` results. Height is 0 for transactions in
+// the mempool, or -1 if they also have unconfirmed inputs.
+type HistoryRef struct {
+	TxHash string `json:"tx_hash"`
+	Height int    `json:"height"`
+	Fee    int64  `json:"fee,omitempty"`
+}
+
+// MerkleProof models the `GetMerkleResponse` result: the hashes that link a transaction at a
+// position in a block to its merkle root, from the bottom up.
+type MerkleProof struct {
+	BlockHeight int      `json:"block_height"`
+	Merkle      []string `json:"merkle"`
+	Pos         int      `json:"pos"`
+}
+
+// BlockHeaders models the `BlockHeadersResponse` result. Hex is the concatenation of Count headers,
+// which may be fewer than requested.
+type BlockHeaders struct {
+	Count int    `json:"count"`
+	Hex   string `json:"hex"`
+	Max   int    `json:"max"`
+}
+
+// HeaderRef models the `HeadersSubscribeResponse` result, the tip of the server's chain.
+type HeaderRef struct {
+	Height int    `json:"height"`
+	Hex    string `json:"hex"`
+}
+
 // ServerFeatures contains the relevant information from `ServerFeatures` results.
 type ServerFeatures struct {
 	ID            int    `json:"id"`
@@ -110,29 +212,51 @@ type ServerFeatures struct {
 // Param is a convenience type that models an item in the `Params` array of an Request.
 type Param = interface{}
 
-// NewClient creates an initialized Client instance.
-func NewClient(requireTls bool) *Client {
+// NewClient creates an initialized Client instance. If a genesis hash is given, servers on other
+// networks are rejected when connecting. Connections are opened with the given dialer, or directly
+// if it's nil. If a trust store is given, server certificates are trusted on first use.
+func NewClient(requireTls bool, genesisHash string, dialer Dialer, trustStore *TrustStore) *Client {
+	proxied := dialer != nil
+
+	if !proxied {
+		dialer = &net.Dialer{Timeout: connectionTimeout}
+	}
+
 	return &Client{
-		log:        utils.NewLogger(defaultLoggerTag),
-		requireTls: requireTls,
+		log:         utils.NewLogger(defaultLoggerTag),
+		requireTls:  requireTls,
+		genesisHash: genesisHash,
+		dialer:      dialer,
+		proxied:     proxied,
+		trustStore:  trustStore,
 	}
 }
 
-// Connect establishes a TLS connection to an Electrum server.
+// Connect establishes a TLS connection to an Electrum server, given as `host:port`, or as
+// `host:port#fingerprint` to pin its certificate.
 func (c *Client) Connect(server string) error {
 	c.Disconnect()
 
-	c.log.SetTag("Electrum/" + server)
-	c.Server = server
+	address, pinned, err := ParseServer(server)
+	if err != nil {
+		return c.log.Errorf("Connect failed: %w", err)
+	}
+
+	c.log.SetTag("Electrum/" + address)
+	c.Server = address
+	c.pinned = pinned
 
 	c.log.Printf("Connecting")
 
-	err := c.establishConnection()
+	conn, err := c.establishConnection()
 	if err != nil {
-		c.Disconnect()
 		return c.log.Errorf("Connect failed: %w", err)
 	}
 
+	c.mu.Lock()
+	c.conn = newConnection(conn, c.log)
+	c.mu.Unlock()
+
 	// Before calling it a day send a test request (trust me), and as we do identify the server:
 	err = c.identifyServer()
 	if err != nil {
@@ -145,20 +269,22 @@ func (c *Client) Connect(server string) error {
 	return nil
 }
 
-// Disconnect cuts the connection (if connected) to the Electrum server.
+// Disconnect cuts the connection (if connected) to the Electrum server. Requests still waiting
+// fail, and subscriptions end.
 func (c *Client) Disconnect() error {
-	if c.conn == nil {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	if conn == nil {
 		return nil
 	}
 
 	c.log.Printf("Disconnecting")
 
-	err := c.conn.Close()
-	if err != nil {
-		return c.log.Errorf("Disconnect failed: %w", err)
-	}
+	conn.close(errDisconnected)
 
-	c.conn = nil
 	return nil
 }
 
@@ -282,6 +408,117 @@ func (c *Client) GetTransaction(txID string) (string, error) {
 	return response.Result, nil
 }
 
+// EstimateFee calls `blockchain.estimatefee` and returns the fee rate in BTC/kvB, or -1 if the
+// server can't estimate it.
+func (c *Client) EstimateFee(targetBlocks int) (float64, error) {
+	request := Request{
+		Method: "blockchain.estimatefee",
+		Params: []Param{targetBlocks},
+	}
+
+	var response EstimateFeeResponse
+
+	err := c.call(&request, &response, callTimeout)
+	if err != nil {
+		return 0, c.log.Errorf("EstimateFee failed: %w", err)
+	}
+
+	return response.Result, nil
+}
+
+// GetFeeHistogram calls `mempool.get_fee_histogram` and returns [fee rate, vsize] pairs, sorted
+// by descending fee rate. Each pair is the total vsize of mempool transactions paying between its
+// rate and the previous one.
+func (c *Client) GetFeeHistogram() ([][2]float64, error) {
+	request := Request{
+		Method: "mempool.get_fee_histogram",
+		Params: []Param{},
+	}
+
+	var response FeeHistogramResponse
+
+	err := c.call(&request, &response, callTimeout)
+	if err != nil {
+		return nil, c.log.Errorf("GetFeeHistogram failed: %w", err)
+	}
+
+	return response.Result, nil
+}
+
+// GetMerkle calls `blockchain.transaction.get_merkle` and returns the proof that a transaction is
+// included in the block at the given height.
+func (c *Client) GetMerkle(txID string, height int) (*MerkleProof, error) {
+	request := Request{
+		Method: "blockchain.transaction.get_merkle",
+		Params: []Param{txID, height},
+	}
+
+	var response GetMerkleResponse
+
+	err := c.call(&request, &response, callTimeout)
+	if err != nil {
+		return nil, c.log.Errorf("GetMerkle failed: %w", err)
+	}
+
+	return &response.Result, nil
+}
+
+// GetBlockHeader calls `blockchain.block.header` and returns the header at a height, in hex.
+func (c *Client) GetBlockHeader(height int) (string, error) {
+	request := Request{
+		Method: "blockchain.block.header",
+		Params: []Param{height},
+	}
+
+	var response BlockHeaderResponse
+
+	err := c.call(&request, &response, callTimeout)
+	if err != nil {
+		return "", c.log.Errorf("GetBlockHeader failed: %w", err)
+	}
+
+	return response.Result, nil
+}
+
+// GetBlockHeaders calls `blockchain.block.headers` and returns up to count consecutive headers
+// starting at a height. Servers cap the count, usually to 2016.
+func (c *Client) GetBlockHeaders(startHeight int, count int) (*BlockHeaders, error) {
+	request := Request{
+		Method: "blockchain.block.headers",
+		Params: []Param{startHeight, count},
+	}
+
+	var response BlockHeadersResponse
+
+	// Give it a little more time than other calls, the response can be large
+	timeout := callTimeout * 2
+
+	err := c.call(&request, &response, timeout)
+	if err != nil {
+		return nil, c.log.Errorf("GetBlockHeaders failed: %w", err)
+	}
+
+	return &response.Result, nil
+}
+
+// SubscribeHeaders calls `blockchain.headers.subscribe` and returns the tip of the server's chain.
+// The server notifies new tips afterwards, to the subscribers of the method.
+func (c *Client) SubscribeHeaders() (*HeaderRef, error) {
+	request := Request{
+		Method: "blockchain.headers.subscribe",
+		Params: []Param{},
+	}
+
+	var response HeadersSubscribeResponse
+
+	err := c.call(&request, &response, callTimeout)
+	if err != nil {
+		return nil, c.log.Errorf("SubscribeHeaders failed: %w", err)
+	}
+
+	return &response.Result, nil
+}
+
 // ListUnspent calls `blockchain.scripthash.listunspent` and returns the UTXO results.
 func (c *Client) ListUnspent(indexHash string) ([]UnspentRef, error) {
 	request := Request{
@@ -335,38 +572,264 @@ func (c *Client) ListUnspentBatch(indexHashes []string) ([][]UnspentRef, error)
 	return unspentRefs, nil
 }
 
-func (c *Client) establishConnection() error {
+// GetHistory calls `blockchain.scripthash.get_history` and returns the transactions that touched
+// the script, confirmed or not.
+func (c *Client) GetHistory(indexHash string) ([]HistoryRef, error) {
+	request := Request{
+		Method: "blockchain.scripthash.get_history",
+		Params: []Param{indexHash},
+	}
+	var response GetHistoryResponse
+
+	err := c.call(&request, &response, callTimeout)
+	if err != nil {
+		return nil, c.log.Errorf("GetHistory failed: %w", err)
+	}
+
+	return response.Result, nil
+}
+
+// GetHistoryBatch is like `GetHistory`, but using batching.
+func (c *Client) GetHistoryBatch(indexHashes []string) ([][]HistoryRef, error) {
+	requests := make([]*Request, len(indexHashes))
+	method := "blockchain.scripthash.get_history"
+
+	for i, indexHash := range indexHashes {
+		requests[i] = &Request{
+			Method: method,
+			Params: []Param{indexHash},
+		}
+	}
+
+	var responses []GetHistoryResponse
+
+	// Give it a little more time than non-batch calls
+	timeout := callTimeout * 2
+
+	err := c.callBatch(method, requests, &responses, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("GetHistoryBatch failed: %w", err)
+	}
+
+	// Don't forget to sort responses:
+	sort.Slice(responses, func(i, j int) bool {
+		return responses[i].ID < responses[j].ID
+	})
+
+	// Now we can collect all results:
+	var historyRefs [][]HistoryRef
+
+	for _, response := range responses {
+		historyRefs = append(historyRefs, response.Result)
+	}
+
+	return historyRefs, nil
+}
+
+// SubscribeScriptHash calls `blockchain.scripthash.subscribe` and returns the status of the script,
+// a hash of its history, or an empty string if it has none. The server notifies new statuses
+// afterwards, to the subscribers of the method.
+func (c *Client) SubscribeScriptHash(indexHash string) (string, error) {
+	request := Request{
+		Method: "blockchain.scripthash.subscribe",
+		Params: []Param{indexHash},
+	}
+	var response ScriptHashSubscribeResponse
+
+	err := c.call(&request, &response, callTimeout)
+	if err != nil {
+		return "", c.log.Errorf("SubscribeScriptHash failed: %w", err)
+	}
+
+	if response.Result == nil {
+		return "", nil
+	}
+
+	return *response.Result, nil
+}
+
+// SubscribeScriptHashBatch is like `SubscribeScriptHash`, but using batching.
+func (c *Client) SubscribeScriptHashBatch(indexHashes []string) ([]string, error) {
+	requests := make([]*Request, len(indexHashes))
+	method := "blockchain.scripthash.subscribe"
+
+	for i, indexHash := range indexHashes {
+		requests[i] = &Request{
+			Method: method,
+			Params: []Param{indexHash},
+		}
+	}
+
+	var responses []ScriptHashSubscribeResponse
+
+	// Give it a little more time than non-batch calls
+	timeout := callTimeout * 2
+
+	err := c.callBatch(method, requests, &responses, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("SubscribeScriptHashBatch failed: %w", err)
+	}
+
+	// Don't forget to sort responses:
+	sort.Slice(responses, func(i, j int) bool {
+		return responses[i].ID < responses[j].ID
+	})
+
+	// Now we can collect all results:
+	statuses := make([]string, len(responses))
+
+	for i, response := range responses {
+		if response.Result != nil {
+			statuses[i] = *response.Result
+		}
+	}
+
+	return statuses, nil
+}
+
+// ParseScriptHashNotification returns the index hash and the new status sent in a
+// `blockchain.scripthash.subscribe` notification. The status is empty if the script has no history.
+func ParseScriptHashNotification(notification *Notification) (string, string, error) {
+	if len(notification.Params) != 2 {
+		return "", "", fmt.Errorf("expected 2 params, got %d", len(notification.Params))
+	}
+
+	var indexHash string
+	var status *string
+
+	err := json.Unmarshal(notification.Params[0], &indexHash)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid script hash: %w", err)
+	}
+
+	err = json.Unmarshal(notification.Params[1], &status)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid status: %w", err)
+	}
+
+	if status == nil {
+		return indexHash, "", nil
+	}
+
+	return indexHash, *status, nil
+}
+
+func (c *Client) establishConnection() (net.Conn, error) {
 	// We first try to connect over TCP+TLS
 	// If we fail and requireTls is false, we try over TCP
 
+	// Without a proxy, resolving an onion address would leak it to the DNS server:
+	if IsOnion(c.Server) && !c.proxied {
+		return nil, fmt.Errorf("onion server %s needs a proxy", c.Server)
+	}
+
+	host, _, err := net.SplitHostPort(c.Server)
+	if err != nil {
+		return nil, err
+	}
+
 	// TODO: check if insecure is necessary
 	config := &tls.Config{
 		InsecureSkipVerify: true,
+		ServerName:         host,
 	}
 
-	dialer := &net.Dialer{
-		Timeout: connectionTimeout,
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
 	}
 
-	tlsConn, err := tls.DialWithDialer(dialer, "tcp", c.Server, config)
+	tlsConn := tls.Client(conn, config)
+
+	err = c.handshake(tlsConn)
 	if err == nil {
-		c.conn = tlsConn
-		return nil
+		err = c.verifyCertificate(tlsConn)
+		if err != nil {
+			tlsConn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
 	}
+
+	conn.Close()
+
 	if c.requireTls {
-		return err
+		return nil, err
 	}
 
-	conn, err := net.DialTimeout("tcp", c.Server, connectionTimeout)
-	if err != nil {
-		return err
+	// Servers with a known certificate must keep using TLS, or we could be talking to anyone:
+	if c.pinned != "" {
+		return nil, fmt.Errorf("TLS failed for a server with a pinned certificate: %w", err)
 	}
 
-	c.conn = conn
+	if c.trustStore != nil {
+		if _, known := c.trustStore.Lookup(c.Server); known {
+			return nil, fmt.Errorf("TLS failed for a server with a known certificate: %w", err)
+		}
+	}
+
+	c.log.Printf("Connected without TLS")
+
+	return c.dial()
+}
+
+// verifyCertificate checks the server certificate against the pinned fingerprint if any, or the
+// trust store otherwise, and logs which of them was used. Without either, any certificate goes,
+// since most servers use self-signed ones.
+func (c *Client) verifyCertificate(tlsConn *tls.Conn) error {
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("server sent no certificate")
+	}
+
+	fingerprint := GetFingerprint(certs[0])
+
+	if c.pinned != "" {
+		if fingerprint != c.pinned {
+			return fmt.Errorf("certificate %s doesn't match the pinned %s", fingerprint, c.pinned)
+		}
 
+		c.log.Printf("Certificate verified with the pinned fingerprint")
+		return nil
+	}
+
+	if c.trustStore == nil {
+		c.log.Printf("Certificate not verified (%s)", fingerprint)
+		return nil
+	}
+
+	trusted, known := c.trustStore.Lookup(c.Server)
+
+	if !known {
+		c.log.Printf("Certificate trusted on first use (%s)", fingerprint)
+		return c.trustStore.Trust(c.Server, fingerprint)
+	}
+
+	if fingerprint != trusted {
+		return fmt.Errorf("certificate changed from %s to %s, refusing to connect", trusted, fingerprint)
+	}
+
+	c.log.Printf("Certificate verified with the known servers file")
 	return nil
 }
 
+// dial opens a TCP connection to the server with our dialer, which may go through a proxy.
+func (c *Client) dial() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	return c.dialer.DialContext(ctx, "tcp", c.Server)
+}
+
+// handshake runs the TLS handshake, with the same timeout as dialing.
+func (c *Client) handshake(tlsConn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	return tlsConn.HandshakeContext(ctx)
+}
+
 func (c *Client) identifyServer() error {
 	serverVersion, err := c.ServerVersion()
 	if err != nil {
@@ -378,13 +841,49 @@ func (c *Client) identifyServer() error {
 
 	c.log.Printf("Identified %s %s", c.ServerImpl, c.ProtoVersion)
 
+	if c.genesisHash == "" {
+		return nil
+	}
+
+	// Make sure the server follows the chain we expect, so we don't scan or broadcast elsewhere:
+	features, err := c.ServerFeatures()
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(features.GenesisHash, c.genesisHash) {
+		return fmt.Errorf("server has genesis %s, expected %s", features.GenesisHash, c.genesisHash)
+	}
+
 	return nil
 }
 
-// IsConnected returns whether this client is connected to a server.
-// It does not guarantee the next request will succeed.
+// IsConnected returns whether this client is connected to a server, and the connection didn't
+// fail. It does not guarantee the next request will succeed.
 func (c *Client) IsConnected() bool {
-	return c.conn != nil
+	conn := c.getConnection()
+
+	return conn != nil && !conn.isClosed()
+}
+
+// Notifications returns a channel that receives the notifications the server sends for a method,
+// such as `blockchain.headers.subscribe`. Subscribe after calling this, to get every notification.
+// The channel is closed when the connection ends, and subscriptions must be made again on the next
+// one. Notifications are dropped if the channel fills up.
+func (c *Client) Notifications(method string) (<-chan *Notification, error) {
+	conn := c.getConnection()
+	if conn == nil {
+		return nil, c.log.Errorf("Notifications failed %s: not connected", method)
+	}
+
+	return conn.subscribe(method), nil
+}
+
+func (c *Client) getConnection() *connection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn
 }
 
 // call executes a request with JSON marshalling, and loads the response into a pointer.
@@ -399,7 +898,7 @@ func (c *Client) call(request *Request, response interface{}, timeout time.Durat
 	}
 
 	// Make the call, obtain the serialized response:
-	responseBytes, err := c.callRaw(request.Method, requestBytes, timeout)
+	responseBytes, err := c.callRaw(request.Method, []int{request.ID}, requestBytes, timeout)
 	if err != nil {
 		return c.log.Errorf("Send failed %s: %w", request.Method, err)
 	}
@@ -413,7 +912,7 @@ func (c *Client) call(request *Request, response interface{}, timeout time.Durat
 	}
 
 	if maybeErrorResponse.Error != nil {
-		return c.log.Errorf("Electrum error: %v", maybeErrorResponse.Error)
+		return c.log.Errorf("%s failed: %w", request.Method, &ServerError{maybeErrorResponse.Error})
 	}
 
 	// Deserialize the response:
@@ -431,8 +930,10 @@ func (c *Client) callBatch(
 	method string, requests []*Request, response interface{}, timeout time.Duration,
 ) error {
 	// Assign fresh request IDs:
-	for _, request := range requests {
+	ids := make([]int, len(requests))
+	for i, request := range requests {
 		request.ID = c.incRequestID()
+		ids[i] = request.ID
 	}
 
 	// Serialize the request:
@@ -442,7 +943,7 @@ func (c *Client) callBatch(
 	}
 
 	// Make the call, obtain the serialized response:
-	responseBytes, err := c.callRaw(method, requestBytes, timeout)
+	responseBytes, err := c.callRaw(method, ids, requestBytes, timeout)
 	if err != nil {
 		return c.log.Errorf("Send failed %s: %w", method, err)
 	}
@@ -458,7 +959,7 @@ func (c *Client) callBatch(
 	// Walk the responses, returning the first error found:
 	for _, maybeErrorResponse := range maybeErrorResponses {
 		if maybeErrorResponse.Error != nil {
-			return c.log.Errorf("Electrum error: %v", maybeErrorResponse.Error)
+			return c.log.Errorf("%s failed: %w", method, &ServerError{maybeErrorResponse.Error})
 		}
 	}
 
@@ -471,12 +972,14 @@ func (c *Client) callBatch(
 	return nil
 }
 
-// callRaw sends a raw request in bytes, and returns a raw response (or an error).
-func (c *Client) callRaw(method string, request []byte, timeout time.Duration) ([]byte, error) {
+// callRaw sends a raw request in bytes, and returns the raw response with the given IDs (or an
+// error). Other requests can be waiting on the same connection meanwhile.
+func (c *Client) callRaw(method string, ids []int, request []byte, timeout time.Duration) ([]byte, error) {
 	c.log.Printf("Sending %s request", method)
 	c.log.Tracef("Sending %s body: %s", method, string(request))
 
-	if !c.IsConnected() {
+	conn := c.getConnection()
+	if conn == nil {
 		return nil, c.log.Errorf("Send failed %s: not connected", method)
 	}
 
@@ -484,34 +987,13 @@ func (c *Client) callRaw(method string, request []byte, timeout time.Duration) (
 
 	start := time.Now()
 
-	// SetDeadline is an absolute time based timeout. That is, we set an exact
-	// time we want it to fail.
-	var deadline time.Time
-	if timeout == noTimeout {
-		// This means no deadline
-		deadline = time.Time{}
-	} else {
-		deadline = start.Add(timeout)
-	}
-	err := c.conn.SetDeadline(deadline)
-	if err != nil {
-		return nil, c.log.Errorf("Send failed %s: SetDeadline failed", method)
-	}
-
-	_, err = c.conn.Write(request)
-
+	response, err := conn.roundTrip(ids, request, timeout)
 	if err != nil {
 		duration := time.Now().Sub(start)
-		return nil, c.log.Errorf("Send failed %s after %vms: %w", method, duration.Milliseconds(), err)
+		return nil, c.log.Errorf("Call failed %s after %vms: %w", method, duration.Milliseconds(), err)
 	}
 
-	reader := bufio.NewReader(c.conn)
-
-	response, err := reader.ReadBytes(messageDelim)
 	duration := time.Now().Sub(start)
-	if err != nil {
-		return nil, c.log.Errorf("Receive failed %s after %vms: %w", method, duration.Milliseconds(), err)
-	}
 
 	c.log.Printf("Received %s after %vms", method, duration.Milliseconds())
 	c.log.Tracef("Received %s: %s", method, string(response))
@@ -520,6 +1002,9 @@ func (c *Client) callRaw(method string, request []byte, timeout time.Duration) (
 }
 
 func (c *Client) incRequestID() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.nextRequestID++
 	return c.nextRequestID
 }
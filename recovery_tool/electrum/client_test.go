@@ -0,0 +1,351 @@
+package electrum
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/electrum/electrumtest"
+)
+
+var testScript = []byte{0x00, 0x14, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+func newTestChain() *electrumtest.Chain {
+	return electrumtest.NewChain(&chaincfg.RegressionNetParams)
+}
+
+func connect(t *testing.T, server *electrumtest.Server, chain *electrumtest.Chain) *Client {
+	client := NewClient(true, chain.GenesisHash(), nil, nil)
+	t.Cleanup(func() { client.Disconnect() })
+
+	err := client.Connect(server.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func encodeTestTx(t *testing.T, tx *wire.MsgTx) string {
+	var buf bytes.Buffer
+
+	err := tx.Serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func TestClient(t *testing.T) {
+	chain := newTestChain()
+
+	confirmed := chain.Fund(testScript, 5000)
+	chain.Mine()
+	unconfirmed := chain.Fund(testScript, 7000)
+
+	server := electrumtest.NewTLSServer(t, chain)
+	client := connect(t, server, chain)
+
+	if client.ServerImpl != electrumtest.DefaultImpl || !client.SupportsBatching() {
+		t.Fatalf("expected a batching %s, got %s", electrumtest.DefaultImpl, client.ServerImpl)
+	}
+
+	unspents, err := client.ListUnspent(GetIndexHash(testScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []UnspentRef{
+		{TxHash: confirmed.TxHash().String(), TxPos: 0, Value: 5000, Height: 1},
+		{TxHash: unconfirmed.TxHash().String(), TxPos: 0, Value: 7000, Height: 0},
+	}
+
+	if !reflect.DeepEqual(unspents, expected) {
+		t.Fatalf("expected unspents %+v, got %+v", expected, unspents)
+	}
+
+	batch, err := client.ListUnspentBatch([]string{GetIndexHash([]byte{0x51}), GetIndexHash(testScript)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch) != 2 || len(batch[0]) != 0 || !reflect.DeepEqual(batch[1], expected) {
+		t.Fatalf("unexpected batch result %+v", batch)
+	}
+
+	txHex, err := client.GetTransaction(confirmed.TxHash().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if txHex != encodeTestTx(t, confirmed) {
+		t.Fatalf("got the wrong transaction %s", txHex)
+	}
+
+	// Spending an output removes it from the unspents:
+	spend := wire.NewMsgTx(2)
+	spend.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: confirmed.TxHash(), Index: 0}, nil, nil))
+	spend.AddTxOut(wire.NewTxOut(4000, []byte{0x51}))
+
+	txID, err := client.Broadcast(encodeTestTx(t, spend))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if txID != spend.TxHash().String() || len(chain.Mempool()) != 2 {
+		t.Fatalf("expected %v in the mempool, got %s", spend.TxHash(), txID)
+	}
+
+	unspents, err = client.ListUnspent(GetIndexHash(testScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(unspents, expected[1:]) {
+		t.Fatalf("expected the spent output to be gone, got %+v", unspents)
+	}
+
+	history, err := client.GetHistory(GetIndexHash(testScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 3 || history[0].Height != 1 || history[2].Height != 0 {
+		t.Fatalf("expected the funding and spending transactions in the history, got %+v", history)
+	}
+
+	// Double spends are rejected:
+	spend.TxOut[0].Value = 3000
+
+	_, err = client.Broadcast(encodeTestTx(t, spend))
+	if err == nil {
+		t.Fatal("expected a double spend to be rejected")
+	}
+}
+
+func TestClientWithoutTls(t *testing.T) {
+	chain := newTestChain()
+	server := electrumtest.NewServer(t, chain)
+
+	client := NewClient(true, "", nil, nil)
+	defer client.Disconnect()
+
+	err := client.Connect(server.Address)
+	if err == nil {
+		t.Fatal("expected to fail without TLS when it's required")
+	}
+
+	client = NewClient(false, chain.GenesisHash(), nil, nil)
+	defer client.Disconnect()
+
+	err = client.Connect(server.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientPinsFakeServer(t *testing.T) {
+	chain := newTestChain()
+	server := electrumtest.NewTLSServer(t, chain)
+
+	client := NewClient(true, chain.GenesisHash(), nil, nil)
+	defer client.Disconnect()
+
+	err := client.Connect(server.Address + "#" + server.Fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerPeers(t *testing.T) {
+	chain := newTestChain()
+	server := electrumtest.NewTLSServer(t, chain)
+	server.SetPeers("electrum.example.com:50002", "127.0.0.1:50012")
+
+	peers, err := connect(t, server, chain).ServerPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"electrum.example.com:50002", "127.0.0.1:50012"}
+	if !reflect.DeepEqual(peers, expected) {
+		t.Fatalf("expected peers %v, got %v", expected, peers)
+	}
+}
+
+func TestClientFaults(t *testing.T) {
+	defer func(timeout time.Duration) { callTimeout = timeout }(callTimeout)
+	callTimeout = 200 * time.Millisecond
+
+	const listUnspent = "blockchain.scripthash.listunspent"
+
+	testCases := []struct {
+		name   string
+		method string
+		fault  electrumtest.Fault
+	}{
+		{name: "timeout", method: listUnspent, fault: electrumtest.Timeout},
+		{name: "eof", method: listUnspent, fault: electrumtest.EOF},
+		{name: "malformed json", method: listUnspent, fault: electrumtest.MalformedJSON},
+		{name: "wrong genesis", method: "server.features", fault: electrumtest.WrongGenesis},
+		{name: "eof on connect", method: "server.version", fault: electrumtest.EOF},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			chain := newTestChain()
+			chain.Fund(testScript, 5000)
+
+			server := electrumtest.NewTLSServer(t, chain)
+			server.Fail(testCase.method, testCase.fault, 1)
+
+			client := NewClient(true, chain.GenesisHash(), nil, nil)
+			defer client.Disconnect()
+
+			err := client.Connect(server.Address)
+			if err == nil {
+				_, err = client.ListUnspent(GetIndexHash(testScript))
+			}
+
+			if err == nil {
+				t.Fatal("expected the fault to cause an error")
+			}
+
+			// The fault was used up, so the next connection works:
+			err = client.Connect(server.Address)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			unspents, err := client.ListUnspent(GetIndexHash(testScript))
+			if err != nil || len(unspents) != 1 {
+				t.Fatalf("expected 1 unspent after the fault, got %v (%v)", unspents, err)
+			}
+		})
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	chain := newTestChain()
+
+	scripts := make([][]byte, 50)
+	for i := range scripts {
+		scripts[i] = append([]byte{0x00, 0x14}, bytes.Repeat([]byte{byte(i)}, 20)...)
+		chain.Fund(scripts[i], int64(1000+i))
+	}
+
+	server := electrumtest.NewTLSServer(t, chain)
+	client := connect(t, server, chain)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(scripts))
+
+	// Every response reaches the request that asked for it:
+	for i, script := range scripts {
+		wg.Add(1)
+
+		go func(i int, script []byte) {
+			defer wg.Done()
+
+			unspents, err := client.ListUnspent(GetIndexHash(script))
+			if err == nil && (len(unspents) != 1 || unspents[0].Value != int64(1000+i)) {
+				err = fmt.Errorf("script %d got %+v", i, unspents)
+			}
+
+			errs <- err
+		}(i, script)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTimeoutDoesntBlockOtherRequests(t *testing.T) {
+	defer func(timeout time.Duration) { callTimeout = timeout }(callTimeout)
+	callTimeout = 500 * time.Millisecond
+
+	chain := newTestChain()
+	chain.Fund(testScript, 5000)
+
+	server := electrumtest.NewTLSServer(t, chain)
+	client := connect(t, server, chain)
+
+	server.Fail("blockchain.transaction.get", electrumtest.Timeout, 1)
+
+	timedOut := make(chan error)
+	go func() {
+		_, err := client.GetTransaction(chain.Mempool()[0].TxHash().String())
+		timedOut <- err
+	}()
+
+	// While the first request waits, others on the same connection are answered:
+	for i := 0; i < 3; i++ {
+		unspents, err := client.ListUnspent(GetIndexHash(testScript))
+		if err != nil || len(unspents) != 1 {
+			t.Fatalf("expected 1 unspent, got %v (%v)", unspents, err)
+		}
+	}
+
+	if err := <-timedOut; err == nil {
+		t.Fatal("expected the unanswered request to time out")
+	}
+
+	if !client.IsConnected() {
+		t.Fatal("expected the connection to survive a timeout")
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	chain := newTestChain()
+	server := electrumtest.NewTLSServer(t, chain)
+	client := connect(t, server, chain)
+
+	notifications, err := client.Notifications("blockchain.headers.subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tip, err := client.SubscribeHeaders()
+	if err != nil || tip.Height != 0 {
+		t.Fatalf("expected the tip at 0, got %+v (%v)", tip, err)
+	}
+
+	chain.Mine()
+
+	select {
+	case notification := <-notifications:
+		var header HeaderRef
+		if err := json.Unmarshal(notification.Params[0], &header); err != nil || header.Height != 1 {
+			t.Fatalf("expected a notification of block 1, got %s (%v)", notification.Params[0], err)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification of the new block")
+	}
+
+	// Requests still work, and disconnecting ends the subscription:
+	_, err = client.ListUnspent(GetIndexHash(testScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Disconnect()
+
+	if _, ok := <-notifications; ok {
+		t.Fatal("expected the notifications to end with the connection")
+	}
+}
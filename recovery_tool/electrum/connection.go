@@ -0,0 +1,311 @@
+package electrum
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/muun/recovery/utils"
+)
+
+// notificationBuffer is how many notifications a subscriber can fall behind before new ones are
+// dropped. Electrum notifications carry the latest state, so missing some is harmless.
+const notificationBuffer = 100
+
+// errDisconnected fails the requests still waiting when the client disconnects.
+var errDisconnected = errors.New("disconnected")
+
+// Notification is a message sent by the server on its own, for a subscription.
+type Notification struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// connection is an open connection to a server, where many requests can wait for their responses
+// at once. A goroutine reads every message, and hands responses to the requests waiting for them
+// by ID, and notifications to the subscribers of their method.
+type connection struct {
+	conn    net.Conn
+	log     *utils.Logger
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	pending     map[int]chan []byte             // requests waiting for a response, by ID
+	subscribers map[string][]chan *Notification // by method
+	err         error                           // why the connection closed, once it did
+	closed      chan struct{}
+}
+
+// newConnection starts reading the messages of a connection.
+func newConnection(conn net.Conn, log *utils.Logger) *connection {
+	c := &connection{
+		conn:        conn,
+		log:         log,
+		pending:     make(map[int]chan []byte),
+		subscribers: make(map[string][]chan *Notification),
+		closed:      make(chan struct{}),
+	}
+
+	go c.readMessages()
+
+	return c
+}
+
+// roundTrip sends a request and waits for the response to the given IDs, which are several for
+// batches. With noTimeout it waits until the connection closes.
+func (c *connection) roundTrip(ids []int, request []byte, timeout time.Duration) ([]byte, error) {
+	response := make(chan []byte, 1)
+
+	c.mu.Lock()
+
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+
+	for _, id := range ids {
+		c.pending[id] = response
+	}
+
+	c.mu.Unlock()
+
+	defer c.forget(ids)
+
+	err := c.write(request, timeout)
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout != noTimeout {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		expired = timer.C
+	}
+
+	select {
+	case message := <-response:
+		return message, nil
+
+	case <-c.closed:
+		// The response may have arrived right before the connection closed:
+		select {
+		case message := <-response:
+			return message, nil
+		default:
+			return nil, c.getError()
+		}
+
+	case <-expired:
+		return nil, fmt.Errorf("no response after %v", timeout)
+	}
+}
+
+// write sends a message, with the given timeout.
+func (c *connection) write(message []byte, timeout time.Duration) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var deadline time.Time
+	if timeout != noTimeout {
+		deadline = time.Now().Add(timeout)
+	}
+
+	err := c.conn.SetWriteDeadline(deadline)
+	if err != nil {
+		return fmt.Errorf("SetWriteDeadline failed: %w", err)
+	}
+
+	_, err = c.conn.Write(message)
+
+	return err
+}
+
+// forget stops waiting for the responses to the given IDs.
+func (c *connection) forget(ids []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range ids {
+		delete(c.pending, id)
+	}
+}
+
+// subscribe returns a channel that receives the notifications of a method, closed along with the
+// connection.
+func (c *connection) subscribe(method string) <-chan *Notification {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan *Notification, notificationBuffer)
+
+	if c.err != nil {
+		close(ch)
+		return ch
+	}
+
+	c.subscribers[method] = append(c.subscribers[method], ch)
+
+	return ch
+}
+
+// readMessages dispatches every message until the connection fails.
+func (c *connection) readMessages() {
+	reader := bufio.NewReader(c.conn)
+
+	for {
+		message, err := reader.ReadBytes(messageDelim)
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		err = c.dispatch(message)
+		if err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+// dispatch hands a message to the request or the subscribers waiting for it. Messages that can't
+// be parsed leave no way to know who was waiting for them, so they fail the connection.
+func (c *connection) dispatch(message []byte) error {
+	if isNotification(message) {
+		var notification Notification
+
+		err := json.Unmarshal(message, &notification)
+		if err != nil {
+			return fmt.Errorf("malformed notification: %w", err)
+		}
+
+		c.notify(&notification)
+		return nil
+	}
+
+	ids, err := getResponseIDs(message)
+	if err != nil {
+		return fmt.Errorf("malformed response: %w", err)
+	}
+
+	c.mu.Lock()
+
+	var response chan []byte
+
+	for _, id := range ids {
+		if waiting, ok := c.pending[id]; ok {
+			response = waiting
+		}
+
+		delete(c.pending, id)
+	}
+
+	c.mu.Unlock()
+
+	if response == nil {
+		c.log.Printf("Dropping a response nobody is waiting for (ids %v)", ids)
+		return nil
+	}
+
+	response <- message
+
+	return nil
+}
+
+// notify sends a notification to the subscribers of its method, dropping it for those that fell
+// behind.
+func (c *connection) notify(notification *Notification) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ch := range c.subscribers[notification.Method] {
+		select {
+		case ch <- notification:
+		default:
+			c.log.Printf("Dropping a %s notification, the subscriber fell behind", notification.Method)
+		}
+	}
+}
+
+// close shuts the connection down with a reason, failing the requests still waiting and ending
+// subscriptions. Only the first reason is kept.
+func (c *connection) close(reason error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = reason
+	close(c.closed)
+	c.conn.Close()
+
+	for _, subscribers := range c.subscribers {
+		for _, ch := range subscribers {
+			close(ch)
+		}
+	}
+
+	c.subscribers = nil
+}
+
+// isClosed tells whether the connection failed or was closed.
+func (c *connection) isClosed() bool {
+	return c.getError() != nil
+}
+
+func (c *connection) getError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// isNotification tells whether a message is a notification sent by the server, rather than the
+// response to a request. Notifications have a method and no ID.
+func isNotification(message []byte) bool {
+	var notification struct {
+		ID     *int   `json:"id"`
+		Method string `json:"method"`
+	}
+
+	// Batch responses are arrays, and fail to unmarshal here:
+	err := json.Unmarshal(message, &notification)
+
+	return err == nil && notification.ID == nil && notification.Method != ""
+}
+
+// getResponseIDs returns the ID of a response, or the IDs of a batch of responses.
+func getResponseIDs(message []byte) ([]int, error) {
+	var single struct {
+		ID int `json:"id"`
+	}
+
+	err := json.Unmarshal(message, &single)
+	if err == nil {
+		return []int{single.ID}, nil
+	}
+
+	var batch []struct {
+		ID int `json:"id"`
+	}
+
+	err = json.Unmarshal(message, &batch)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, len(batch))
+	for i, response := range batch {
+		ids[i] = response.ID
+	}
+
+	return ids, nil
+}
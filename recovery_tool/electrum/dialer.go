@@ -0,0 +1,57 @@
+package electrum
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer opens connections to servers. It's satisfied by net.Dialer, and by the SOCKS5 dialer
+// returned by NewProxyDialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// NewProxyDialer returns a Dialer that connects through the SOCKS5 proxy at a URL such as
+// `socks5://127.0.0.1:9050`. Host names are resolved by the proxy, never locally, so Tor can
+// reach `.onion` servers and no DNS queries leak.
+func NewProxyDialer(proxyURL string) (Dialer, error) {
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	if parsedURL.Scheme != "socks5" && parsedURL.Scheme != "socks5h" {
+		return nil, fmt.Errorf("invalid proxy URL %q, expected socks5://host:port", proxyURL)
+	}
+
+	if parsedURL.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q, the host is missing", proxyURL)
+	}
+
+	dialer, err := proxy.FromURL(parsedURL, &net.Dialer{Timeout: connectionTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	return dialer.(Dialer), nil
+}
+
+// IsOnion returns whether a server address (host:port, or a URL) is a Tor hidden service.
+func IsOnion(server string) bool {
+	host := server
+
+	if parsedURL, err := url.Parse(server); err == nil && parsedURL.Host != "" {
+		host = parsedURL.Host
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
@@ -0,0 +1,462 @@
+package electrumtest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// defaultFeeRate is the fee rate a new Chain estimates, in sats/vB.
+const defaultFeeRate = 2
+
+// maxNonce is how many nonces Mine tries before giving up, far more than a network with minimum
+// difficulty needs.
+const maxNonce = 1 << 20
+
+// Chain is an in-memory blockchain with a mempool, that servers answer from. Blocks are mined with
+// real proof of work, so the network must have minimum difficulty (regtest). It's safe for
+// concurrent use, and can be shared by several servers.
+type Chain struct {
+	params *chaincfg.Params
+
+	mu      sync.Mutex
+	blocks  []*wire.MsgBlock
+	mempool []*wire.MsgTx
+	txs     map[chainhash.Hash]*chainTx
+	spent   map[wire.OutPoint]chainhash.Hash // by the tx that spends them
+	feeRate float64
+	funded  uint32
+
+	listeners []func() // called after every change
+}
+
+// chainTx is a transaction in the chain, with its location.
+type chainTx struct {
+	tx     *wire.MsgTx
+	height int // 0 while in the mempool
+	pos    int // in its block
+}
+
+// NewChain creates a chain with the genesis block of a network.
+func NewChain(params *chaincfg.Params) *Chain {
+	chain := &Chain{
+		params:  params,
+		txs:     make(map[chainhash.Hash]*chainTx),
+		spent:   make(map[wire.OutPoint]chainhash.Hash),
+		feeRate: defaultFeeRate,
+	}
+
+	chain.addBlock(params.GenesisBlock)
+
+	return chain
+}
+
+// GenesisHash returns the hash of the genesis block, as servers report it.
+func (c *Chain) GenesisHash() string {
+	return c.params.GenesisHash.String()
+}
+
+// Height returns the height of the tip.
+func (c *Chain) Height() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.blocks) - 1
+}
+
+// SetFeeRate changes the fee rate servers estimate, in sats/vB.
+func (c *Chain) SetFeeRate(feeRate float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.feeRate = feeRate
+}
+
+// Fund adds a transaction to the mempool that pays an amount to a script, out of thin air.
+func (c *Chain) Fund(script []byte, amount int64) *wire.MsgTx {
+	defer c.notify()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Spend a different made-up output every time, so transactions are unique:
+	c.funded++
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: c.funded}, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(amount, script))
+
+	c.addToMempool(tx)
+
+	return tx
+}
+
+// Broadcast adds a transaction to the mempool. It fails if it spends outputs that don't exist or
+// were already spent, but signatures aren't checked.
+func (c *Chain) Broadcast(tx *wire.MsgTx) error {
+	defer c.notify()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.txs[tx.TxHash()]; ok {
+		return nil
+	}
+
+	for _, txIn := range tx.TxIn {
+		prev, ok := c.txs[txIn.PreviousOutPoint.Hash]
+		if !ok || int(txIn.PreviousOutPoint.Index) >= len(prev.tx.TxOut) {
+			return fmt.Errorf("missing input %v", txIn.PreviousOutPoint)
+		}
+
+		if spender, ok := c.spent[txIn.PreviousOutPoint]; ok {
+			return fmt.Errorf("input %v already spent by %v", txIn.PreviousOutPoint, spender)
+		}
+	}
+
+	c.addToMempool(tx)
+
+	return nil
+}
+
+// Mine confirms the transactions in the mempool in a new block, and returns it.
+func (c *Chain) Mine() *wire.MsgBlock {
+	defer c.notify()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	height := len(c.blocks)
+	prev := c.blocks[height-1]
+
+	// The coinbase pays nothing, and includes the height to be unique:
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex),
+		[]byte{0x03, byte(height), byte(height >> 8), byte(height >> 16)},
+		nil,
+	))
+	coinbase.AddTxOut(wire.NewTxOut(0, []byte{0x6a}))
+
+	block := wire.NewMsgBlock(&wire.BlockHeader{
+		Version:   4,
+		PrevBlock: prev.BlockHash(),
+		Timestamp: prev.Header.Timestamp.Add(10 * time.Minute),
+		Bits:      c.params.PowLimitBits,
+	})
+
+	block.AddTransaction(coinbase)
+	for _, tx := range c.mempool {
+		block.AddTransaction(tx)
+	}
+
+	block.Header.MerkleRoot = *getMerkleRoot(block.Transactions)
+
+	target := blockchain.CompactToBig(block.Header.Bits)
+
+	for block.Header.Nonce = 0; ; block.Header.Nonce++ {
+		hash := block.Header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			break
+		}
+
+		if block.Header.Nonce == maxNonce {
+			panic("electrumtest: the network is too hard to mine")
+		}
+	}
+
+	c.mempool = nil
+	c.addBlock(block)
+
+	return block
+}
+
+// Mempool returns the transactions waiting to be mined.
+func (c *Chain) Mempool() []*wire.MsgTx {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*wire.MsgTx{}, c.mempool...)
+}
+
+// addListener registers a function to call after every change.
+func (c *Chain) addListener(listener func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.listeners = append(c.listeners, listener)
+}
+
+// notify calls the listeners, without holding the lock.
+func (c *Chain) notify() {
+	c.mu.Lock()
+	listeners := append([]func(){}, c.listeners...)
+	c.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+func (c *Chain) addBlock(block *wire.MsgBlock) {
+	height := len(c.blocks)
+	c.blocks = append(c.blocks, block)
+
+	for pos, tx := range block.Transactions {
+		c.addTx(tx, height, pos)
+	}
+}
+
+func (c *Chain) addToMempool(tx *wire.MsgTx) {
+	c.mempool = append(c.mempool, tx)
+	c.addTx(tx, 0, 0)
+}
+
+func (c *Chain) addTx(tx *wire.MsgTx, height int, pos int) {
+	txHash := tx.TxHash()
+	c.txs[txHash] = &chainTx{tx: tx, height: height, pos: pos}
+
+	if blockchain.IsCoinBaseTx(tx) {
+		return
+	}
+
+	for _, txIn := range tx.TxIn {
+		c.spent[txIn.PreviousOutPoint] = txHash
+	}
+}
+
+// unspent is an output that pays to a script.
+type unspent struct {
+	txHash chainhash.Hash
+	vout   int
+	value  int64
+	height int
+}
+
+// history is a transaction that pays to or spends from a script.
+type history struct {
+	txHash chainhash.Hash
+	height int
+}
+
+// listUnspent returns the unspent outputs that pay to a script hash, confirmed first.
+func (c *Chain) listUnspent(scriptHash string) []unspent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var unspents []unspent
+
+	for txHash, entry := range c.txs {
+		for vout, txOut := range entry.tx.TxOut {
+			if getScriptHash(txOut.PkScript) != scriptHash {
+				continue
+			}
+
+			if _, ok := c.spent[wire.OutPoint{Hash: txHash, Index: uint32(vout)}]; ok {
+				continue
+			}
+
+			unspents = append(unspents, unspent{txHash, vout, txOut.Value, entry.height})
+		}
+	}
+
+	sort.Slice(unspents, func(i, j int) bool {
+		if unspents[i].height != unspents[j].height {
+			return isBefore(unspents[i].height, unspents[j].height)
+		}
+
+		return unspents[i].txHash.String() < unspents[j].txHash.String()
+	})
+
+	return unspents
+}
+
+// getHistory returns the transactions that pay to or spend from a script hash, confirmed first.
+func (c *Chain) getHistory(scriptHash string) []history {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var items []history
+
+	for txHash, entry := range c.txs {
+		if c.touches(entry.tx, scriptHash) {
+			items = append(items, history{txHash, entry.height})
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].height != items[j].height {
+			return isBefore(items[i].height, items[j].height)
+		}
+
+		return items[i].txHash.String() < items[j].txHash.String()
+	})
+
+	return items
+}
+
+// getStatus returns the Electrum status of a script hash: the SHA-256 of its history, as
+// "txid:height:" entries in hex, or an empty string if it has no history.
+func (c *Chain) getStatus(scriptHash string) string {
+	items := c.getHistory(scriptHash)
+	if len(items) == 0 {
+		return ""
+	}
+
+	hash := sha256.New()
+	for _, item := range items {
+		fmt.Fprintf(hash, "%s:%d:", item.txHash, item.height)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// touches tells whether a transaction pays to a script hash, or spends an output that did.
+func (c *Chain) touches(tx *wire.MsgTx, scriptHash string) bool {
+	for _, txOut := range tx.TxOut {
+		if getScriptHash(txOut.PkScript) == scriptHash {
+			return true
+		}
+	}
+
+	for _, txIn := range tx.TxIn {
+		prev, ok := c.txs[txIn.PreviousOutPoint.Hash]
+		if ok && int(txIn.PreviousOutPoint.Index) < len(prev.tx.TxOut) &&
+			getScriptHash(prev.tx.TxOut[txIn.PreviousOutPoint.Index].PkScript) == scriptHash {
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// getTransaction returns a transaction by its ID.
+func (c *Chain) getTransaction(txID string) (*wire.MsgTx, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	txHash, err := chainhash.NewHashFromStr(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, ok := c.txs[*txHash]
+	if !ok {
+		return nil, errors.New("no such mempool or blockchain transaction")
+	}
+
+	return entry.tx, nil
+}
+
+// getMerkleProof returns the position of a transaction in the block at a height, and the hashes
+// that link it to the merkle root.
+func (c *Chain) getMerkleProof(txID string, height int) (int, []*chainhash.Hash, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	txHash, err := chainhash.NewHashFromStr(txID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	entry, ok := c.txs[*txHash]
+	if !ok || entry.height != height || height == 0 {
+		return 0, nil, fmt.Errorf("tx %s not in block at height %d", txID, height)
+	}
+
+	return entry.pos, getMerkleBranch(c.blocks[height].Transactions, entry.pos), nil
+}
+
+// getHeaders returns up to count headers starting at a height.
+func (c *Chain) getHeaders(startHeight int, count int) []*wire.BlockHeader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var headers []*wire.BlockHeader
+
+	for height := startHeight; height < startHeight+count && height < len(c.blocks); height++ {
+		headers = append(headers, &c.blocks[height].Header)
+	}
+
+	return headers
+}
+
+// getFeeRate returns the fee rate to estimate, in sats/vB.
+func (c *Chain) getFeeRate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.feeRate
+}
+
+// isBefore orders heights with the mempool (0) last.
+func isBefore(height, other int) bool {
+	if height == 0 || other == 0 {
+		return other == 0
+	}
+
+	return height < other
+}
+
+// getMerkleRoot computes the merkle root of a block's transactions.
+func getMerkleRoot(txs []*wire.MsgTx) *chainhash.Hash {
+	hashes := getTxHashes(txs)
+	for len(hashes) > 1 {
+		hashes = nextMerkleLevel(hashes)
+	}
+
+	return hashes[0]
+}
+
+// getMerkleBranch returns the hashes that link the transaction at a position to the merkle root,
+// from the bottom up.
+func getMerkleBranch(txs []*wire.MsgTx, pos int) []*chainhash.Hash {
+	var branch []*chainhash.Hash
+
+	hashes := getTxHashes(txs)
+	for len(hashes) > 1 {
+		if len(hashes)%2 == 1 {
+			hashes = append(hashes, hashes[len(hashes)-1])
+		}
+
+		branch = append(branch, hashes[pos^1])
+		hashes = nextMerkleLevel(hashes)
+		pos /= 2
+	}
+
+	return branch
+}
+
+func getTxHashes(txs []*wire.MsgTx) []*chainhash.Hash {
+	hashes := make([]*chainhash.Hash, len(txs))
+	for i, tx := range txs {
+		hash := tx.TxHash()
+		hashes[i] = &hash
+	}
+
+	return hashes
+}
+
+// nextMerkleLevel hashes pairs of a level of the merkle tree, duplicating the last hash if it's odd.
+func nextMerkleLevel(hashes []*chainhash.Hash) []*chainhash.Hash {
+	if len(hashes)%2 == 1 {
+		hashes = append(hashes, hashes[len(hashes)-1])
+	}
+
+	next := make([]*chainhash.Hash, 0, len(hashes)/2)
+	for i := 0; i < len(hashes); i += 2 {
+		next = append(next, blockchain.HashMerkleBranches(hashes[i], hashes[i+1]))
+	}
+
+	return next
+}
@@ -0,0 +1,781 @@
+// Package electrumtest provides an in-process Electrum server for tests, that answers from an
+// in-memory Chain and can be told to misbehave.
+package electrumtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// DefaultImpl is the implementation servers identify as. The client only batches requests to
+// ElectrumX servers.
+const DefaultImpl = "ElectrumX 1.16.0"
+
+// protocolVersion is the version of the Electrum protocol servers identify with.
+const protocolVersion = "1.4"
+
+// maxHeaders is the most headers servers return at once, like real ones.
+const maxHeaders = 2016
+
+// Fault is a way for a server to misbehave when a method is called.
+type Fault int
+
+const (
+	// Timeout never answers, leaving the client waiting.
+	Timeout Fault = iota + 1
+
+	// EOF closes the connection instead of answering.
+	EOF
+
+	// MalformedJSON answers with a message that isn't valid JSON.
+	MalformedJSON
+
+	// WrongGenesis answers `server.features` with the genesis hash of another network.
+	WrongGenesis
+)
+
+// wrongGenesisHash is reported by servers with the WrongGenesis fault.
+const wrongGenesisHash = "0000000000000000000000000000000000000000000000000000000000000001"
+
+// Server is an Electrum server listening on localhost, over TLS or plain TCP. It implements the
+// methods the tool uses, answering from a Chain, and supports batched requests.
+type Server struct {
+	// Address is the `host:port` to connect to.
+	Address string
+
+	// Fingerprint is the SHA-256 of the certificate in hex, for TLS servers.
+	Fingerprint string
+
+	chain    *Chain
+	listener net.Listener
+	tls      bool
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	impl     string
+	peers    []string
+	faults   map[string]*fault // by method
+	requests map[string]int    // by method
+	conns    map[*serverConn]bool
+	closed   bool
+}
+
+// serverConn is a connection to a server, and its subscriptions.
+type serverConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	tip      int               // the last tip notified, or -1 if not subscribed to headers
+	statuses map[string]string // the last status notified, by subscribed script hash
+}
+
+// fault is a Fault injected for a number of calls, or forever if times is 0.
+type fault struct {
+	kind  Fault
+	times int
+}
+
+// request is an Electrum protocol request.
+type request struct {
+	ID     int               `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// response is an Electrum protocol response, with either a result or an error.
+type response struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      int         `json:"id"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   *rpcError   `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewServer starts a plain TCP server for a chain, closed when the test ends.
+func NewServer(t testing.TB, chain *Chain) *Server {
+	return newServer(t, chain, false)
+}
+
+// NewTLSServer starts a TLS server for a chain with a self-signed certificate, like most Electrum
+// servers use. It's closed when the test ends.
+func NewTLSServer(t testing.TB, chain *Chain) *Server {
+	return newServer(t, chain, true)
+}
+
+func newServer(t testing.TB, chain *Chain, useTLS bool) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{
+		Address:  listener.Addr().String(),
+		chain:    chain,
+		tls:      useTLS,
+		impl:     DefaultImpl,
+		faults:   make(map[string]*fault),
+		requests: make(map[string]int),
+		conns:    make(map[*serverConn]bool),
+	}
+
+	if useTLS {
+		server.RenewCertificate(t)
+		listener = tls.NewListener(listener, &tls.Config{GetCertificate: server.getCertificate})
+	}
+
+	server.listener = listener
+
+	t.Cleanup(server.Close)
+
+	chain.addListener(server.notify)
+
+	go server.serve()
+
+	return server
+}
+
+// RenewCertificate replaces the certificate of a TLS server with a new self-signed one, and
+// updates its Fingerprint. New connections get the new certificate.
+func (s *Server) RenewCertificate(t testing.TB) {
+	cert, err := newSelfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cert = &cert
+	s.Fingerprint = hex.EncodeToString(fingerprint[:])
+}
+
+// Close stops listening and drops every connection.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	s.listener.Close()
+
+	for client := range s.conns {
+		client.conn.Close()
+	}
+}
+
+// SetImpl changes the implementation the server identifies as, such as "Fulcrum 1.9.1" to keep
+// the client from batching requests.
+func (s *Server) SetImpl(impl string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.impl = impl
+}
+
+// SetPeers changes the servers returned by `server.peers.subscribe`, as `host:port`.
+func (s *Server) SetPeers(peers ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peers = peers
+}
+
+// Fail makes the next calls of a method misbehave, or all of them if times is 0. A batch fails if
+// its method does.
+func (s *Server) Fail(method string, kind Fault, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults[method] = &fault{kind: kind, times: times}
+}
+
+// Heal removes the faults of every method.
+func (s *Server) Heal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = make(map[string]*fault)
+}
+
+// Requests returns how many times a method was called, counting every request of a batch.
+func (s *Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[method]
+}
+
+// getCertificate returns the current certificate of a TLS server for a handshake.
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cert, nil
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		client := s.track(conn)
+		if client == nil {
+			conn.Close()
+			return
+		}
+
+		go s.handle(client)
+	}
+}
+
+// track registers a connection to close with the server, unless it's already closed.
+func (s *Server) track(conn net.Conn) *serverConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	client := &serverConn{conn: conn, tip: -1, statuses: make(map[string]string)}
+	s.conns[client] = true
+
+	return client
+}
+
+// handle answers the requests of a connection, one line at a time, until it's closed.
+func (s *Server) handle(client *serverConn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, client)
+		s.mu.Unlock()
+
+		client.conn.Close()
+	}()
+
+	reader := bufio.NewReader(client.conn)
+
+	// Plain servers drop TLS handshakes, so clients fall back to plain TCP right away:
+	if !s.tls {
+		first, err := reader.Peek(1)
+		if err != nil || first[0] == 0x16 { // a TLS ClientHello
+			return
+		}
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		line = bytes.TrimSpace(line)
+		batch := len(line) > 0 && line[0] == '['
+
+		var requests []*request
+
+		if batch {
+			err = json.Unmarshal(line, &requests)
+		} else {
+			requests = []*request{{}}
+			err = json.Unmarshal(line, requests[0])
+		}
+
+		if err != nil || len(requests) == 0 {
+			return // real servers drop clients that send garbage
+		}
+
+		kind := s.countRequests(requests)
+
+		var message []byte
+
+		switch kind {
+		case Timeout:
+			continue
+
+		case EOF:
+			return
+
+		case MalformedJSON:
+			message = []byte(`{"jsonrpc": "2.0", "id": ` + fmt.Sprint(requests[0].ID) + `, "result": [`)
+
+		default:
+			responses := make([]*response, len(requests))
+			for i, request := range requests {
+				responses[i] = s.answer(client, request, kind)
+			}
+
+			if batch {
+				message, err = json.Marshal(responses)
+			} else {
+				message, err = json.Marshal(responses[0])
+			}
+
+			if err != nil {
+				return
+			}
+		}
+
+		err = client.send(message)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// countRequests records the requests, and returns the fault to apply to them, if any.
+func (s *Server) countRequests(requests []*request) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var kind Fault
+
+	for _, request := range requests {
+		s.requests[request.Method]++
+
+		if f, ok := s.faults[request.Method]; ok && kind == 0 {
+			kind = f.kind
+		}
+	}
+
+	// Use up one of the times of the fault, once for the whole batch:
+	method := requests[0].Method
+	if f, ok := s.faults[method]; ok && f.times > 0 {
+		f.times--
+		if f.times == 0 {
+			delete(s.faults, method)
+		}
+	}
+
+	return kind
+}
+
+// answer runs a request against the chain.
+func (s *Server) answer(client *serverConn, request *request, kind Fault) *response {
+	result, err := s.call(client, request, kind)
+	if err != nil {
+		return &response{
+			JSONRPC: "2.0",
+			ID:      request.ID,
+			Error:   &rpcError{Code: 1, Message: err.Error()},
+		}
+	}
+
+	return &response{JSONRPC: "2.0", ID: request.ID, Result: result}
+}
+
+func (s *Server) call(client *serverConn, request *request, kind Fault) (interface{}, error) {
+	switch request.Method {
+	case "server.version":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		return []string{s.impl, protocolVersion}, nil
+
+	case "server.features":
+		genesisHash := s.chain.GenesisHash()
+		if kind == WrongGenesis {
+			genesisHash = wrongGenesisHash
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		return map[string]interface{}{
+			"genesis_hash":   genesisHash,
+			"hash_function":  "sha256",
+			"server_version": s.impl,
+			"protocol_min":   protocolVersion,
+			"protocol_max":   protocolVersion,
+			"pruning":        nil,
+		}, nil
+
+	case "server.peers.subscribe":
+		return s.getPeers(), nil
+
+	case "blockchain.scripthash.listunspent":
+		var scriptHash string
+		if err := parseParams(request, &scriptHash); err != nil {
+			return nil, err
+		}
+
+		result := []map[string]interface{}{}
+		for _, unspent := range s.chain.listUnspent(scriptHash) {
+			result = append(result, map[string]interface{}{
+				"tx_hash": unspent.txHash.String(),
+				"tx_pos":  unspent.vout,
+				"value":   unspent.value,
+				"height":  unspent.height,
+			})
+		}
+
+		return result, nil
+
+	case "blockchain.scripthash.get_history":
+		var scriptHash string
+		if err := parseParams(request, &scriptHash); err != nil {
+			return nil, err
+		}
+
+		result := []map[string]interface{}{}
+		for _, item := range s.chain.getHistory(scriptHash) {
+			result = append(result, map[string]interface{}{
+				"tx_hash": item.txHash.String(),
+				"height":  item.height,
+			})
+		}
+
+		return result, nil
+
+	case "blockchain.scripthash.subscribe":
+		var scriptHash string
+		if err := parseParams(request, &scriptHash); err != nil {
+			return nil, err
+		}
+
+		// Holding the lock, changes to the chain are either in this status or notified later:
+		client.mu.Lock()
+		status := s.chain.getStatus(scriptHash)
+		client.statuses[scriptHash] = status
+		client.mu.Unlock()
+
+		return encodeStatus(status), nil
+
+	case "blockchain.transaction.get":
+		var txID string
+		if err := parseParams(request, &txID); err != nil {
+			return nil, err
+		}
+
+		tx, err := s.chain.getTransaction(txID)
+		if err != nil {
+			return nil, err
+		}
+
+		return encodeTx(tx)
+
+	case "blockchain.transaction.broadcast":
+		var txHex string
+		if err := parseParams(request, &txHex); err != nil {
+			return nil, err
+		}
+
+		tx, err := decodeTx(txHex)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.chain.Broadcast(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		return tx.TxHash().String(), nil
+
+	case "blockchain.transaction.get_merkle":
+		var txID string
+		var height int
+		if err := parseParams(request, &txID, &height); err != nil {
+			return nil, err
+		}
+
+		pos, branch, err := s.chain.getMerkleProof(txID, height)
+		if err != nil {
+			return nil, err
+		}
+
+		merkle := make([]string, len(branch))
+		for i, hash := range branch {
+			merkle[i] = hash.String()
+		}
+
+		return map[string]interface{}{"block_height": height, "merkle": merkle, "pos": pos}, nil
+
+	case "blockchain.block.header":
+		var height int
+		if err := parseParams(request, &height); err != nil {
+			return nil, err
+		}
+
+		headers := s.chain.getHeaders(height, 1)
+		if len(headers) == 0 {
+			return nil, fmt.Errorf("height %d out of range", height)
+		}
+
+		return encodeHeaders(headers)
+
+	case "blockchain.block.headers":
+		var startHeight, count int
+		if err := parseParams(request, &startHeight, &count); err != nil {
+			return nil, err
+		}
+
+		if count > maxHeaders {
+			count = maxHeaders
+		}
+
+		headers := s.chain.getHeaders(startHeight, count)
+
+		headersHex, err := encodeHeaders(headers)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{"count": len(headers), "hex": headersHex, "max": maxHeaders}, nil
+
+	case "blockchain.headers.subscribe":
+		height, tip, err := s.getTip()
+		if err != nil {
+			return nil, err
+		}
+
+		client.mu.Lock()
+		client.tip = height
+		client.mu.Unlock()
+
+		return tip, nil
+
+	case "blockchain.estimatefee":
+		// Electrum estimates in BTC/kvB:
+		return s.chain.getFeeRate() * 1000 / 1e8, nil
+
+	case "mempool.get_fee_histogram":
+		return [][2]float64{}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown method %q", request.Method)
+	}
+}
+
+// getTip returns the height of the tip, and the tip as `blockchain.headers.subscribe` does.
+func (s *Server) getTip() (int, map[string]interface{}, error) {
+	height := s.chain.Height()
+
+	headerHex, err := encodeHeaders(s.chain.getHeaders(height, 1))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return height, map[string]interface{}{"height": height, "hex": headerHex}, nil
+}
+
+// notify sends the new tip to the connections subscribed to headers, and the new statuses to those
+// subscribed to script hashes, when the chain changes.
+func (s *Server) notify() {
+	s.mu.Lock()
+
+	var clients []*serverConn
+	for client := range s.conns {
+		clients = append(clients, client)
+	}
+
+	s.mu.Unlock()
+
+	height, tip, err := s.getTip()
+	if err != nil {
+		return
+	}
+
+	for _, client := range clients {
+		client.mu.Lock()
+		changed := client.tip >= 0 && client.tip != height
+		if changed {
+			client.tip = height
+		}
+		client.mu.Unlock()
+
+		if changed {
+			client.notify("blockchain.headers.subscribe", tip)
+		}
+
+		for scriptHash, status := range s.updateStatuses(client) {
+			client.notify("blockchain.scripthash.subscribe", scriptHash, encodeStatus(status))
+		}
+	}
+}
+
+// updateStatuses returns the script hashes a connection is subscribed to whose status changed, and
+// their new status.
+func (s *Server) updateStatuses(client *serverConn) map[string]string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	changed := make(map[string]string)
+
+	for scriptHash, last := range client.statuses {
+		status := s.chain.getStatus(scriptHash)
+		if status != last {
+			client.statuses[scriptHash] = status
+			changed[scriptHash] = status
+		}
+	}
+
+	return changed
+}
+
+// send writes a message to the connection. Notifications can be sent concurrently with responses.
+func (c *serverConn) send(message []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.conn.Write(append(message, '\n'))
+
+	return err
+}
+
+// notify sends a notification for a subscription.
+func (c *serverConn) notify(method string, params ...interface{}) {
+	message, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+	if err != nil {
+		return
+	}
+
+	c.send(message)
+}
+
+// getPeers returns the peers like `server.peers.subscribe` does: [ip, host, [version, "s<port>"]].
+func (s *Server) getPeers() [][]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := [][]interface{}{}
+
+	for _, peer := range s.peers {
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			continue
+		}
+
+		peers = append(peers, []interface{}{host, host, []interface{}{"v" + protocolVersion, "s" + port}})
+	}
+
+	return peers
+}
+
+// parseParams decodes the params of a request into pointers, in order.
+func parseParams(request *request, params ...interface{}) error {
+	if len(request.Params) < len(params) {
+		return fmt.Errorf("%s expects %d params, got %d", request.Method, len(params), len(request.Params))
+	}
+
+	for i, param := range params {
+		err := json.Unmarshal(request.Params[i], param)
+		if err != nil {
+			return fmt.Errorf("invalid param %d of %s: %w", i, request.Method, err)
+		}
+	}
+
+	return nil
+}
+
+func encodeTx(tx *wire.MsgTx) (string, error) {
+	var buf bytes.Buffer
+
+	err := tx.Serialize(&buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeTx(txHex string) (*wire.MsgTx, error) {
+	txBytes, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, errors.New("the transaction is not valid hex")
+	}
+
+	tx := wire.NewMsgTx(0)
+
+	err = tx.Deserialize(bytes.NewReader(txBytes))
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction: %w", err)
+	}
+
+	return tx, nil
+}
+
+func encodeHeaders(headers []*wire.BlockHeader) (string, error) {
+	var buf bytes.Buffer
+
+	for _, header := range headers {
+		err := header.Serialize(&buf)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+// encodeStatus returns a script hash status as servers send it, null for scripts without history.
+func encodeStatus(status string) interface{} {
+	if status == "" {
+		return nil
+	}
+
+	return status
+}
+
+// getScriptHash returns the Electrum script hash of an output script: its SHA-256, reversed.
+func getScriptHash(script []byte) string {
+	hash := sha256.Sum256(script)
+
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+
+	return hex.EncodeToString(hash[:])
+}
+
+// newSelfSignedCert creates a certificate for localhost.
+func newSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
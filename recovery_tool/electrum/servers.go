@@ -103,3 +103,16 @@ var PublicServers = []string{
 	"electrumx-btc.cryptonermal.net:50002",  // impl: ElectrumX 1.15.0, batching: true, ttc: 0.83, speed: 1, from:
 	"electrum.coineuskal.com:50002",         // impl: ElectrumX 1.15.0, batching: true, ttc: 1.73, speed: 0, from: electrum.coinext.com.br:50002
 }
+
+// TestnetServers list.
+//
+// Taken from the Electrum repositories like PublicServers, keeping TLS servers.
+//
+// See https://github.com/spesmilo/electrum/blob/master/electrum/servers_testnet.json
+var TestnetServers = []string{
+	"testnet.aranguren.org:51002",
+	"testnet.qtornado.com:51002",
+	"blockstream.info:993",
+	"electrum.blockstream.info:60002",
+	"tn.not.fyi:55002",
+}
@@ -0,0 +1,109 @@
+package electrum
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// fingerprintSeparator separates a server address from the certificate fingerprint pinned for it,
+// as in `host:port#fingerprint`.
+const fingerprintSeparator = "#"
+
+// TrustStore remembers the certificate of each server the first time we connect to it (trust on
+// first use), in a JSON file that maps server addresses to SHA-256 fingerprints. Later connections
+// are refused if the certificate changed.
+type TrustStore struct {
+	path         string
+	mu           sync.Mutex
+	fingerprints map[string]string
+}
+
+// LoadTrustStore reads the trust store at a path, or creates an empty one if it doesn't exist yet.
+func LoadTrustStore(path string) (*TrustStore, error) {
+	store := &TrustStore{path: path, fingerprints: make(map[string]string)}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known servers: %w", err)
+	}
+
+	err = json.Unmarshal(content, &store.fingerprints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse known servers: %w", err)
+	}
+
+	return store, nil
+}
+
+// Lookup returns the fingerprint trusted for a server, if any.
+func (s *TrustStore) Lookup(server string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fingerprint, ok := s.fingerprints[server]
+	return fingerprint, ok
+}
+
+// Trust records the fingerprint of a server seen for the first time, and saves the store.
+func (s *TrustStore) Trust(server string, fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fingerprints[server] = fingerprint
+
+	content, err := json.MarshalIndent(s.fingerprints, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode known servers: %w", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+
+	err = os.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write known servers: %w", err)
+	}
+
+	err = os.Rename(tmpPath, s.path)
+	if err != nil {
+		return fmt.Errorf("failed to write known servers: %w", err)
+	}
+
+	return nil
+}
+
+// ParseServer splits a server given as `host:port` or `host:port#fingerprint` into its address
+// and its pinned certificate fingerprint (empty if none). Fingerprints are the hex SHA-256 of the
+// certificate, optionally with colons between bytes like `openssl x509 -fingerprint` prints them.
+func ParseServer(server string) (string, string, error) {
+	separator := strings.Index(server, fingerprintSeparator)
+	if separator < 0 {
+		return server, "", nil
+	}
+
+	address := server[:separator]
+	fingerprint := strings.ToLower(strings.ReplaceAll(server[separator+1:], ":", ""))
+
+	decoded, err := hex.DecodeString(fingerprint)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", "", fmt.Errorf("invalid certificate fingerprint for %s, expected a SHA-256 in hex", address)
+	}
+
+	return address, fingerprint, nil
+}
+
+// GetFingerprint returns the hex SHA-256 of a certificate, as used by ParseServer and TrustStore.
+func GetFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,118 @@
+package electrum
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/muun/recovery/electrum/electrumtest"
+)
+
+// otherFingerprint belongs to no server.
+var otherFingerprint = strings.Repeat("ab", 32)
+
+func TestPinnedCertificate(t *testing.T) {
+	server := electrumtest.NewTLSServer(t, newTestChain())
+
+	client := NewClient(true, "", nil, nil)
+	defer client.Disconnect()
+
+	err := client.Connect(server.Address + "#" + server.Fingerprint)
+	if err != nil {
+		t.Fatalf("expected to connect with the right fingerprint, got %v", err)
+	}
+
+	// Fingerprints copied from openssl have colons and uppercase:
+	var withColons []string
+	for i := 0; i < len(server.Fingerprint); i += 2 {
+		withColons = append(withColons, strings.ToUpper(server.Fingerprint[i:i+2]))
+	}
+
+	err = client.Connect(server.Address + "#" + strings.Join(withColons, ":"))
+	if err != nil {
+		t.Fatalf("expected to connect with an openssl fingerprint, got %v", err)
+	}
+
+	err = client.Connect(server.Address + "#" + otherFingerprint)
+	if err == nil {
+		t.Fatal("expected the connection to be refused with another fingerprint")
+	}
+
+	err = client.Connect(server.Address + "#1234")
+	if err == nil {
+		t.Fatal("expected an error for a malformed fingerprint")
+	}
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	server := electrumtest.NewTLSServer(t, newTestChain())
+	path := filepath.Join(t.TempDir(), "known_servers.json")
+
+	store, err := LoadTrustStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(false, "", nil, store)
+	defer client.Disconnect()
+
+	err = client.Connect(server.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate was saved, and is still trusted after reloading the store:
+	store, err = LoadTrustStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trusted, known := store.Lookup(server.Address)
+	if !known || trusted != server.Fingerprint {
+		t.Fatalf("expected %s to be trusted, got %q", server.Fingerprint, trusted)
+	}
+
+	client = NewClient(false, "", nil, store)
+	defer client.Disconnect()
+
+	err = client.Connect(server.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new certificate is refused:
+	server.RenewCertificate(t)
+
+	err = client.Connect(server.Address)
+	if err == nil || !strings.Contains(err.Error(), "certificate changed") {
+		t.Fatalf("expected the changed certificate to be refused, got %v", err)
+	}
+}
+
+func TestKnownServerCantDowngrade(t *testing.T) {
+	plainServer := electrumtest.NewServer(t, newTestChain()).Address
+
+	store, err := LoadTrustStore(filepath.Join(t.TempDir(), "known_servers.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(false, "", nil, store)
+	defer client.Disconnect()
+
+	// Unknown servers can still be reached without TLS, when it's not required:
+	err = client.Connect(plainServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Trust(plainServer, otherFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Connect(plainServer)
+	if err == nil {
+		t.Fatal("expected a server with a known certificate to require TLS")
+	}
+}
@@ -0,0 +1,248 @@
+package esplora
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/muun/recovery/utils"
+)
+
+const requestTimeout = time.Second * 30
+
+// confirmedPageSize is the amount of confirmed transactions returned by each page of
+// `/scripthash/:hash/txs`.
+const confirmedPageSize = 25
+
+// Client is a minimal client for the Esplora REST API, exposed by mempool.space, blockstream.info
+// and self-hosted instances. Like bitcoind.Client, it's safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	log        *utils.Logger
+}
+
+// HTTPError is an error status returned by the server, with the message in the body.
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("esplora error %d: %s", e.StatusCode, e.Message)
+}
+
+// IsServerFailure tells whether the error is the server's fault (rate limits and 5xx), rather
+// than a problem with our request, so another server could succeed.
+func (e *HTTPError) IsServerFailure() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Status models the confirmation status of a transaction.
+type Status struct {
+	Confirmed   bool `json:"confirmed"`
+	BlockHeight int  `json:"block_height"`
+}
+
+// Utxo models an item in the `/scripthash/:hash/utxo` response.
+type Utxo struct {
+	TxID   string `json:"txid"`
+	Vout   int    `json:"vout"`
+	Value  int64  `json:"value"`
+	Status Status `json:"status"`
+}
+
+// Tx models an item in the `/scripthash/:hash/txs` response. Only the fields we use are decoded.
+type Tx struct {
+	TxID   string `json:"txid"`
+	Fee    int64  `json:"fee"`
+	Status Status `json:"status"`
+}
+
+// DialFunc opens connections to servers, like net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// NewClient creates a Client for the API at the given base URL, such as
+// `https://mempool.space/api`. The scheme is optional, and defaults to https. Connections are
+// opened with dial, which may go through a proxy, or directly if it's nil.
+func NewClient(baseURL string, dial DialFunc) *Client {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if dial != nil {
+		transport.Proxy = nil
+		transport.DialContext = dial
+	}
+
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: requestTimeout, Transport: transport},
+		log:        utils.NewLogger("Esplora"),
+	}
+}
+
+// URL returns the base URL of the API.
+func (c *Client) URL() string {
+	return c.baseURL
+}
+
+// GetBlockHash returns the hash of the block at a height.
+func (c *Client) GetBlockHash(height int) (string, error) {
+	return c.getText(fmt.Sprintf("/block-height/%d", height))
+}
+
+// ListUnspent returns the unspent outputs of a script, given its Electrum-style script hash.
+func (c *Client) ListUnspent(scriptHash string) ([]Utxo, error) {
+	var utxos []Utxo
+
+	err := c.getJSON("/scripthash/"+scriptHash+"/utxo", &utxos)
+	if err != nil {
+		return nil, err
+	}
+
+	return utxos, nil
+}
+
+// GetHistory returns every transaction of a script, given its Electrum-style script hash. The API
+// returns mempool transactions and confirmed ones in pages, newest first, so we keep requesting
+// pages until one comes up short.
+func (c *Client) GetHistory(scriptHash string) ([]Tx, error) {
+	var page []Tx
+
+	err := c.getJSON("/scripthash/"+scriptHash+"/txs", &page)
+	if err != nil {
+		return nil, err
+	}
+
+	txs := page
+
+	for {
+		var confirmed []Tx
+		for _, tx := range page {
+			if tx.Status.Confirmed {
+				confirmed = append(confirmed, tx)
+			}
+		}
+
+		if len(confirmed) < confirmedPageSize {
+			return txs, nil
+		}
+
+		lastSeen := confirmed[len(confirmed)-1].TxID
+
+		page = nil
+
+		err := c.getJSON("/scripthash/"+scriptHash+"/txs/chain/"+lastSeen, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		txs = append(txs, page...)
+	}
+}
+
+// GetTransaction returns a transaction in hex.
+func (c *Client) GetTransaction(txID string) (string, error) {
+	return c.getText("/tx/" + txID + "/hex")
+}
+
+// Broadcast posts a transaction in hex, and returns its ID.
+func (c *Client) Broadcast(txHex string) (string, error) {
+	return c.do(http.MethodPost, "/tx", strings.NewReader(txHex))
+}
+
+// Mempool models the `/mempool` response. The histogram has [fee rate, vsize] pairs, sorted by
+// descending fee rate.
+type Mempool struct {
+	Count        int          `json:"count"`
+	VSize        int64        `json:"vsize"`
+	FeeHistogram [][2]float64 `json:"fee_histogram"`
+}
+
+// GetMempool returns statistics of the mempool.
+func (c *Client) GetMempool() (*Mempool, error) {
+	var mempool Mempool
+
+	err := c.getJSON("/mempool", &mempool)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mempool, nil
+}
+
+// FeeEstimates returns fee rates in sats/vB, by confirmation target in blocks.
+func (c *Client) FeeEstimates() (map[int]float64, error) {
+	var estimates map[int]float64
+
+	err := c.getJSON("/fee-estimates", &estimates)
+	if err != nil {
+		return nil, err
+	}
+
+	return estimates, nil
+}
+
+func (c *Client) getText(path string) (string, error) {
+	body, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(body), nil
+}
+
+func (c *Client) getJSON(path string, result interface{}) error {
+	body, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal([]byte(body), result)
+	if err != nil {
+		return c.log.Errorf("Unmarshal failed %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// do sends a request, and returns the body of a successful response.
+func (c *Client) do(method string, path string, body io.Reader) (string, error) {
+	request, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return "", c.log.Errorf("Request failed %s: %w", path, err)
+	}
+
+	if body != nil {
+		request.Header.Set("Content-Type", "text/plain")
+	}
+
+	c.log.Printf("Sending %s %s", method, path)
+	start := time.Now()
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return "", c.log.Errorf("Send failed %s: %w", path, err)
+	}
+	defer response.Body.Close()
+
+	responseBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", c.log.Errorf("Receive failed %s: %w", path, err)
+	}
+
+	c.log.Printf("Received %s after %vms", path, time.Since(start).Milliseconds())
+
+	if response.StatusCode != http.StatusOK {
+		return "", &HTTPError{response.StatusCode, strings.TrimSpace(string(responseBytes))}
+	}
+
+	return string(responseBytes), nil
+}
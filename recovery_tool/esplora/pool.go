@@ -0,0 +1,23 @@
+package esplora
+
+// Pool limits the amount of concurrent requests, like electrum.Pool does with connections, so
+// that public servers don't rate-limit us. Clients don't hold connections of their own, so the
+// pool hands out slots instead of clients.
+type Pool struct {
+	slots chan struct{}
+}
+
+// NewPool creates a Pool that allows `size` concurrent requests.
+func NewPool(size int) *Pool {
+	return &Pool{make(chan struct{}, size)}
+}
+
+// Acquire takes a slot, blocking until one is released.
+func (p *Pool) Acquire() {
+	p.slots <- struct{}{}
+}
+
+// Release returns a slot to the pool, unblocking the next caller trying to `Acquire()`.
+func (p *Pool) Release() {
+	<-p.slots
+}
@@ -0,0 +1,19 @@
+package esplora
+
+// PublicServers are the Esplora instances used on mainnet when none are given. mempool.space is
+// also where we send users to follow their transactions.
+var PublicServers = []string{
+	"https://mempool.space/api",
+	"https://blockstream.info/api",
+}
+
+// TestnetServers are the public Esplora instances for testnet.
+var TestnetServers = []string{
+	"https://mempool.space/testnet/api",
+	"https://blockstream.info/testnet/api",
+}
+
+// SignetServers are the public Esplora instances for the default signet.
+var SignetServers = []string{
+	"https://mempool.space/signet/api",
+}
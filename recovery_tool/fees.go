@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+
+	"github.com/muun/libwallet/operation"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/utils"
+)
+
+// blockVSize is the capacity of a block, in virtual bytes.
+const blockVSize = 1000000
+
+// minRelayFeeRate is the lowest fee rate nodes relay by default, in sats/vB.
+const minRelayFeeRate = 1
+
+// feeTargets are the confirmation targets, in blocks, estimated to build the fee window.
+var feeTargets = []uint{1, 2, 3, 6, 12, 24, 144}
+
+// feePreset is a confirmation target offered when asking for the fee rate.
+type feePreset struct {
+	name   string
+	target uint
+	eta    string
+}
+
+var feePresets = []feePreset{
+	{"fast", 2, "~20 minutes"},
+	{"normal", 6, "~1 hour"},
+	{"economy", 144, "~1 day"},
+}
+
+// feeSuggestion is a preset with the fee rate that hits its target, and the resulting total fee.
+type feeSuggestion struct {
+	feePreset
+	feeRate  int64
+	totalFee int64
+}
+
+// getFeeSuggestions returns the presets that can be paid for with the balance, or none if there's
+// no backend to ask (as when signing offline) or the fees can't be estimated.
+func getFeeSuggestions(
+	chainBackend backend.Backend,
+	totalBalance int64,
+	vsize int64,
+	destinations []destination,
+) []feeSuggestion {
+
+	var suggestions []feeSuggestion
+
+	for _, suggestion := range getPresetFeeRates(chainBackend) {
+		totalFee, err := calculateFee(totalBalance, vsize, suggestion.feeRate, destinations)
+		if err != nil {
+			continue
+		}
+
+		suggestion.totalFee = totalFee
+		suggestions = append(suggestions, suggestion)
+	}
+
+	return suggestions
+}
+
+// getPresetFeeRates returns the fee rate of each preset, without a total fee, or none if there's no
+// backend to ask or the fees can't be estimated.
+func getPresetFeeRates(chainBackend backend.Backend) []feeSuggestion {
+	if chainBackend == nil {
+		return nil
+	}
+
+	window, err := getFeeWindow(chainBackend)
+	if err != nil {
+		utils.NewLogger("Fees").Printf("Fee estimation failed: %v", err)
+		return nil
+	}
+
+	var suggestions []feeSuggestion
+
+	for _, preset := range feePresets {
+		feeRate, err := window.MinimumFeeRate(preset.target)
+		if err != nil {
+			continue
+		}
+
+		suggestions = append(suggestions, feeSuggestion{feePreset: preset, feeRate: int64(math.Ceil(feeRate))})
+	}
+
+	return suggestions
+}
+
+// getFeeWindow estimates the fee rate of each target. Targets the current mempool can fill are
+// read from its fee histogram, when the backend has one, and the rest come from the backend's
+// estimator, which accounts for transactions yet to arrive.
+func getFeeWindow(chainBackend backend.Backend) (*operation.FeeWindow, error) {
+	var histogram []backend.FeeHistogramBin
+
+	if inspector, ok := chainBackend.(backend.MempoolInspector); ok {
+		var err error
+
+		histogram, err = inspector.GetFeeHistogram()
+		if err != nil {
+			utils.NewLogger("Fees").Printf("Fee histogram unavailable: %v", err)
+		}
+	}
+
+	window := &operation.FeeWindow{TargetedFees: make(map[uint]float64)}
+
+	var lastErr error
+
+	for _, target := range feeTargets {
+		if feeRate, ok := getMempoolFeeRate(histogram, target); ok {
+			window.TargetedFees[target] = feeRate
+			continue
+		}
+
+		feeRate, err := chainBackend.EstimateFee(int(target))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		window.TargetedFees[target] = math.Max(feeRate, minRelayFeeRate)
+	}
+
+	if len(window.TargetedFees) == 0 {
+		return nil, lastErr
+	}
+
+	return window, nil
+}
+
+// getMempoolFeeRate returns the fee rate needed to be mined within a target, assuming the
+// transactions in the histogram (sorted by descending fee rate) fill the next blocks. It fails if
+// the mempool is too small to fill them.
+func getMempoolFeeRate(histogram []backend.FeeHistogramBin, target uint) (float64, bool) {
+	var vsize int64
+
+	for _, bin := range histogram {
+		vsize += bin.VSize
+
+		if vsize >= int64(target)*blockVSize {
+			return math.Max(bin.FeeRate, minRelayFeeRate), true
+		}
+	}
+
+	return 0, false
+}
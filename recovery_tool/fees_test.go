@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/backend"
+)
+
+// feeBackend estimates fees from memory, failing for targets without an estimate, and serves a fee
+// histogram.
+type feeBackend struct {
+	unspentOnlyBackend
+	estimates    map[int]float64 // by target, in sats/vB
+	histogram    []backend.FeeHistogramBin
+	histogramErr error
+}
+
+func (b *feeBackend) EstimateFee(targetBlocks int) (float64, error) {
+	if feeRate, ok := b.estimates[targetBlocks]; ok {
+		return feeRate, nil
+	}
+
+	return 0, errors.New("not enough data")
+}
+
+func (b *feeBackend) GetFeeHistogram() ([]backend.FeeHistogramBin, error) {
+	return b.histogram, b.histogramErr
+}
+
+// testHistogram fills the first block at 12 sats/vB, the second at 4 and the third at 1.5.
+var testHistogram = []backend.FeeHistogramBin{
+	{FeeRate: 30, VSize: 600000},
+	{FeeRate: 12, VSize: 600000},
+	{FeeRate: 4, VSize: 1000000},
+	{FeeRate: 1.5, VSize: 2000000},
+}
+
+func TestGetMempoolFeeRate(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		histogram []backend.FeeHistogramBin
+		target    uint
+		expected  float64 // 0 if the mempool can't fill the target
+	}{
+		{desc: "next block", histogram: testHistogram, target: 1, expected: 12},
+		{desc: "second block", histogram: testHistogram, target: 2, expected: 4},
+		{desc: "third block", histogram: testHistogram, target: 3, expected: 1.5},
+		{desc: "more blocks than the mempool fills", histogram: testHistogram, target: 6},
+		{desc: "empty mempool", target: 1},
+		{
+			desc:      "below the minimum relay fee",
+			histogram: []backend.FeeHistogramBin{{FeeRate: 0.5, VSize: 2 * blockVSize}},
+			target:    1,
+			expected:  minRelayFeeRate,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			feeRate, ok := getMempoolFeeRate(tc.histogram, tc.target)
+
+			if ok != (tc.expected != 0) || feeRate != tc.expected {
+				t.Fatalf("expected %v sats/vB, got %v (%v)", tc.expected, feeRate, ok)
+			}
+		})
+	}
+}
+
+func TestGetFeeWindow(t *testing.T) {
+	// Targets past the mempool come from the estimator, raised to the minimum relay fee, and those
+	// it can't estimate are left out:
+	estimates := map[int]float64{1: 50, 2: 40, 3: 30, 6: 1.2, 12: 0.4, 144: 0.2}
+
+	testCases := []struct {
+		desc     string
+		backend  *feeBackend
+		expected map[uint]float64 // nil if estimation fails
+	}{
+		{
+			desc:     "histogram and estimates",
+			backend:  &feeBackend{estimates: estimates, histogram: testHistogram},
+			expected: map[uint]float64{1: 12, 2: 4, 3: 1.5, 6: 1.2, 12: 1, 144: 1},
+		},
+		{
+			desc:     "histogram unavailable",
+			backend:  &feeBackend{estimates: estimates, histogramErr: errors.New("unsupported")},
+			expected: map[uint]float64{1: 50, 2: 40, 3: 30, 6: 1.2, 12: 1, 144: 1},
+		},
+		{
+			desc:    "nothing to estimate with",
+			backend: &feeBackend{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			window, err := getFeeWindow(tc.backend)
+
+			if tc.expected == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", window.TargetedFees)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(window.TargetedFees, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, window.TargetedFees)
+			}
+		})
+	}
+}
+
+func TestGetFeeSuggestions(t *testing.T) {
+	addresses := createTestAddresses(t, libwallet.Regtest(), 1)
+	destinations := []destination{{address: addresses[0], rest: true}}
+
+	chainBackend := &feeBackend{
+		estimates: map[int]float64{6: 1.2, 12: 1, 144: 0.2},
+		histogram: testHistogram,
+	}
+
+	const vsize = 200
+
+	testCases := []struct {
+		desc     string
+		backend  backend.Backend
+		balance  int64
+		expected []feeSuggestion
+	}{
+		{
+			desc:    "every preset affordable",
+			backend: chainBackend,
+			balance: 100000,
+			expected: []feeSuggestion{
+				{feePreset: feePresets[0], feeRate: 4, totalFee: 800},
+				{feePreset: feePresets[1], feeRate: 2, totalFee: 400}, // rounded up
+				{feePreset: feePresets[2], feeRate: 1, totalFee: 200},
+			},
+		},
+		{
+			desc:    "fast preset leaving dust",
+			backend: chainBackend,
+			balance: 1300,
+			expected: []feeSuggestion{
+				{feePreset: feePresets[1], feeRate: 2, totalFee: 400},
+				{feePreset: feePresets[2], feeRate: 1, totalFee: 200},
+			},
+		},
+		{
+			desc:    "no backend, as when signing offline",
+			balance: 100000,
+		},
+		{
+			desc:    "fees can't be estimated",
+			backend: &feeBackend{},
+			balance: 100000,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			suggestions := getFeeSuggestions(tc.backend, tc.balance, vsize, destinations)
+
+			if !reflect.DeepEqual(suggestions, tc.expected) {
+				t.Fatalf("expected %+v, got %+v", tc.expected, suggestions)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/btcsuite/btcutil v1.0.2
 	github.com/gookit/color v1.4.2
 	github.com/muun/libwallet v0.11.0
+	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f
 )
 
 replace github.com/muun/libwallet => ../libwallet
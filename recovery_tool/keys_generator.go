@@ -7,7 +7,8 @@ import (
 	"github.com/muun/libwallet/emergencykit"
 )
 
-var defaultNetwork = libwallet.Mainnet()
+// basePath is where both keys derive the wallet's addresses from.
+const basePath = "m/1'/1'"
 
 func decodeKeysFromInput(rawKey1 string, rawKey2 string) ([]*libwallet.EncryptedPrivateKeyInfo, error) {
 	key1, err := libwallet.DecodeEncryptedPrivateKey(rawKey1)
@@ -39,7 +40,12 @@ func decodeKeysFromMetadata(meta *emergencykit.Metadata) ([]*libwallet.Encrypted
 	return decodedKeys, nil
 }
 
-func decryptKeys(encryptedKeys []*libwallet.EncryptedPrivateKeyInfo, recoveryCode string) ([]*libwallet.DecryptedPrivateKey, error) {
+func decryptKeys(
+	encryptedKeys []*libwallet.EncryptedPrivateKeyInfo,
+	recoveryCode string,
+	network *libwallet.Network,
+) ([]*libwallet.DecryptedPrivateKey, error) {
+
 	// Always take the salt from the second key (the same salt was used for all keys, but our legacy
 	// key format did not include it in the first key):
 	salt := encryptedKeys[1].Salt
@@ -52,7 +58,7 @@ func decryptKeys(encryptedKeys []*libwallet.EncryptedPrivateKeyInfo, recoveryCod
 	decryptedKeys := make([]*libwallet.DecryptedPrivateKey, len(encryptedKeys))
 
 	for i, encryptedKey := range encryptedKeys {
-		decryptedKey, err := decryptionKey.DecryptKey(encryptedKey, defaultNetwork)
+		decryptedKey, err := decryptionKey.DecryptKey(encryptedKey, network)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decrypt key %d: %w", i, err)
 		}
@@ -62,3 +68,22 @@ func decryptKeys(encryptedKeys []*libwallet.EncryptedPrivateKeyInfo, recoveryCod
 
 	return decryptedKeys, nil
 }
+
+// getBasePublicKeys returns the public keys at the base path, which are all that's needed to
+// generate (and scan) the wallet's addresses.
+func getBasePublicKeys(decryptedKeys []*libwallet.DecryptedPrivateKey) (*libwallet.HDPublicKey, *libwallet.HDPublicKey, error) {
+	// The user key is already at the base path, while the muun key is the root:
+	userKey := decryptedKeys[0].Key.PublicKey()
+
+	muunKey, err := decryptedKeys[1].Key.DeriveTo(basePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive muun key: %w", err)
+	}
+
+	return userKey, muunKey.PublicKey(), nil
+}
+
+// parseBasePublicKey decodes an extended public key at the base path.
+func parseBasePublicKey(xpub string, network *libwallet.Network) (*libwallet.HDPublicKey, error) {
+	return libwallet.NewHDPublicKeyFromString(xpub, basePath, network)
+}
@@ -2,43 +2,64 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/gookit/color"
 	"github.com/muun/libwallet"
 	"github.com/muun/libwallet/btcsuitew/btcutilw"
 	"github.com/muun/libwallet/emergencykit"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/bitcoind"
 	"github.com/muun/recovery/electrum"
 	"github.com/muun/recovery/scanner"
 	"github.com/muun/recovery/utils"
 )
 
-const electrumPoolSize = 6
+// esploraPoolSize limits concurrent requests to Esplora servers, which rate-limit aggressively.
+const esploraPoolSize = 4
 
-var debugOutputStream = bytes.NewBuffer(nil)
+// defaultCheckpointFile is where scan progress is saved, unless changed with `--checkpoint`.
+const defaultCheckpointFile = "scan_checkpoint.json"
 
-type config struct {
-	generateContacts     bool
-	providedElectrum     string
-	usesProvidedElectrum bool
-	onlyScan             bool
-}
+// defaultKnownServersFile is where certificates of provided Electrum servers are remembered,
+// unless changed with `--known-servers`.
+const defaultKnownServersFile = "known_servers.json"
+
+// defaultSweepsFile is where sweep transactions are recorded, unless changed with `--sweeps`.
+const defaultSweepsFile = "sweeps.json"
+
+// fixedDepthFactor sets how deep branches are scanned on backends without history, as a multiple of
+// the gap limit, when that's deeper than older versions of the tool scanned.
+const fixedDepthFactor = 10
+
+var debugOutputStream = bytes.NewBuffer(nil)
 
 func main() {
 	utils.SetOutputStream(debugOutputStream)
 
+	// The air-gapped workflow is split in subcommands:
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	var config config
 
 	// Pick up command-line arguments:
-	flag.BoolVar(&config.generateContacts, "generate-contacts", false, "Generate contact addresses")
-	flag.StringVar(&config.providedElectrum, "electrum-server", "", "Connect to this electrum server to find funds")
-	flag.BoolVar(&config.onlyScan, "only-scan", false, "Only scan for UTXOs without generating a transaction")
+	config.registerFlags(flag.CommandLine)
 	flag.Usage = printUsage
 	flag.Parse()
 	args := flag.Args()
@@ -49,46 +70,45 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Welcome!
-	printWelcomeMessage()
-
-	config.usesProvidedElectrum = len(strings.TrimSpace(config.providedElectrum)) > 0
-	if config.usesProvidedElectrum {
-		validateProvidedElectrum(config.providedElectrum)
+	// Complete the configuration with environment variables and the config file, if any:
+	err := config.resolve(flag.CommandLine)
+	if err != nil {
+		exitWithError(err)
 	}
 
-	// We're going to need a few things to move forward with the recovery process. Let's make a list
-	// so we keep them in mind:
-	var recoveryCode string
-	var encryptedKeys []*libwallet.EncryptedPrivateKeyInfo
-	var destinationAddress btcutil.Address
-
-	// First on our list is the Recovery Code. This is the time to go looking for that piece of paper:
-	recoveryCode = readRecoveryCode()
-
-	// Good! Now, on to those keys. We need to read them and decrypt them:
-	encryptedKeys, err := readBackupFromInputOrPDF(flag.Arg(0))
+	err = setOutputFormat(config.outputFormat)
 	if err != nil {
 		exitWithError(err)
 	}
 
-	decryptedKeys, err := decryptKeys(encryptedKeys, recoveryCode)
+	err = config.requireBackend()
 	if err != nil {
 		exitWithError(err)
 	}
 
-	decryptedKeys[0].Key.Path = "m/1'/1'" // a little adjustment for legacy users.
+	// Welcome!
+	printWelcomeMessage()
+	printNetwork(&config)
+
+	if config.usesProvidedElectrum {
+		validateProvidedElectrum(&config)
+	}
+
+	// We're going to need a few things to move forward with the recovery process. First on our list
+	// are the decrypted keys, which need the Recovery Code and the Emergency Kit:
+	decryptedKeys := getDecryptedKeys(&config)
 
+	var destinations []destination
 	if !config.onlyScan {
-		// Finally, we need the destination address to sweep the funds:
-		destinationAddress = readAddress()
+		// Finally, we need the destination addresses to sweep the funds:
+		destinations = getDestinations(&config)
 	}
 
 	sayBlock(`
 		Starting scan of all possible addresses. This will take a few minutes.
 	`)
 
-	doRecovery(decryptedKeys, destinationAddress, config)
+	doRecovery(decryptedKeys, destinations, config)
 
 	sayBlock("We appreciate all kinds of feedback. If you have any, send it to {blue contact@muun.com}\n")
 }
@@ -96,35 +116,249 @@ func main() {
 // doRecovery runs the scan & sweep process, and returns the ID of the broadcasted transaction.
 func doRecovery(
 	decryptedKeys []*libwallet.DecryptedPrivateKey,
-	destinationAddress btcutil.Address,
+	destinations []destination,
 	config config,
 ) {
 
-	addrGen := NewAddressGenerator(decryptedKeys[0].Key, decryptedKeys[1].Key, config.generateContacts)
-
-	var electrumProvider *electrum.ServerProvider
-	if config.usesProvidedElectrum {
-		electrumProvider = electrum.NewServerProvider([]string{
-			config.providedElectrum,
-		})
-	} else {
-		electrumProvider = electrum.NewServerProvider(electrum.PublicServers)
+	userKey, muunKey, err := getBasePublicKeys(decryptedKeys)
+	if err != nil {
+		exitWithError(err)
 	}
 
-	connectionPool := electrum.NewPool(electrumPoolSize, !config.usesProvidedElectrum)
-
-	utxoScanner := scanner.NewScanner(connectionPool, electrumProvider)
+	addrGen := NewAddressGenerator(userKey, muunKey, config.generateContacts, config.gapLimit)
 
-	addresses := addrGen.Stream()
+	chainBackend := newBackend(&config)
 
 	sweeper := Sweeper{
 		UserKey:      decryptedKeys[0].Key,
 		MuunKey:      decryptedKeys[1].Key,
 		Birthday:     decryptedKeys[1].Birthday,
-		SweepAddress: destinationAddress,
+		Destinations: destinations,
+		Network:      config.network,
+		Backend:      chainBackend,
+
+		BroadcastServers: config.broadcastServers,
+	}
+
+	utxos := scanUtxos(addrGen, chainBackend, &config)
+
+	if len(utxos) == 0 {
+		sayBlock("No funds were discovered\n\n")
+		return
+	}
+
+	printUtxos(utxos)
+	if config.onlyScan {
+		return
+	}
+
+	fee := getSweepFee(&sweeper, utxos, &config)
+
+	if config.psbtFile != "" {
+		writeSweepPSBT(&sweeper, utxos, fee, config.psbtFile)
+		return
+	}
+
+	sweepTx := buildSignedSweep(&sweeper, utxos, fee)
+
+	recordSweep(&config, newSweepAttempt(userKey, muunKey, utxos, sweepTx, fee, destinations))
+
+	broadcastSweep(&sweeper, sweepTx)
+}
+
+// getDecryptedKeys asks for the Recovery Code and the Emergency Kit, and decrypts the keys.
+func getDecryptedKeys(config *config) []*libwallet.DecryptedPrivateKey {
+	// First on our list is the Recovery Code. This is the time to go looking for that piece of paper:
+	recoveryCode := getRecoveryCode(config)
+
+	// Good! Now, on to those keys. We need to read them and decrypt them:
+	encryptedKeys, err := getBackup(config)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	decryptedKeys, err := decryptKeys(encryptedKeys, recoveryCode, config.network)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	decryptedKeys[0].Key.Path = basePath // a little adjustment for legacy users.
+
+	return decryptedKeys
+}
+
+// recordSweep saves a sweep transaction to the sweeps file, so it can be bumped later. Failing to
+// save it doesn't stop the sweep.
+func recordSweep(config *config, attempt *sweepAttempt) {
+	err := appendSweepsFile(config.sweepsFile, attempt)
+	if err != nil {
+		say("{yellow The transaction couldn't be recorded}: %v\n", err)
+	}
+}
+
+// errSweepNotSeen is returned by sendSweep when the transaction was accepted, but didn't show up in
+// the mempool while we waited.
+var errSweepNotSeen = errors.New("the transaction was sent, but hasn't shown up in the mempool")
+
+// broadcastSweep sends the signed sweep transaction, and exits if it fails or isn't seen.
+func broadcastSweep(sweeper *Sweeper, sweepTx *wire.MsgTx) {
+	err := sendSweep(sweeper, sweepTx)
+
+	if errors.Is(err, errSweepNotSeen) {
+		os.Exit(exitCodeNotSeen) // the outcome was already reported
+	}
+
+	if err != nil {
+		exitWithError(err)
+	}
+}
+
+// sendSweep sends the signed sweep transaction, and reports the outcome. If the transaction was
+// accepted but not seen afterwards, it returns errSweepNotSeen.
+func sendSweep(sweeper *Sweeper, sweepTx *wire.MsgTx) error {
+	sayBlock("Sending transaction...")
+
+	outcome, err := sweeper.BroadcastTx(sweepTx)
+
+	if outcome != nil {
+		printBroadcastResults(outcome.Results)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	txID := sweepTx.TxHash().String()
+
+	emitEvent(newBroadcastEvent(txID, outcome))
+
+	if outcome.AlreadyKnown {
+		sayBlock("The network already knows this transaction, so it wasn't sent again.")
+	}
+
+	txURL := getTxURL(sweeper.Network, txID)
+
+	if !outcome.Seen {
+		if txURL == "" {
+			txURL = txID
+		}
+
+		sayBlock(`
+			{yellow The transaction was accepted, but hasn't shown up in the mempool yet.}
+			It may not have been relayed. Check its status in a few minutes: %v
+			and broadcast it again if it's missing.
+
+		`, txURL)
+
+		return errSweepNotSeen
+	}
+
+	if txURL == "" {
+		sayBlock("Transaction sent! Its ID is {white %v}\n\n", txID)
+		return nil
+	}
+
+	sayBlock(`
+		Transaction sent! You can check the status here: %v
+		(it will appear in mempool.space after a short delay)
+
+	`, txURL)
+
+	return nil
+}
+
+// printBroadcastResults shows whether each server accepted the transaction, when sent to many.
+func printBroadcastResults(results []backend.BroadcastResult) {
+	for _, result := range results {
+		if result.Err == nil {
+			say("{green ✓} %s accepted the transaction\n", result.Server)
+		} else {
+			say("{red ✗} %s: %v\n", result.Server, result.Err)
+		}
+	}
+}
+
+// newBackend creates the backend that provides blockchain data, and broadcasts transactions. It's
+// the given node or Esplora servers if any, or Electrum servers otherwise.
+func newBackend(config *config) backend.Backend {
+	if config.bitcoindURL != "" {
+		return newBitcoindBackend(config)
+	}
+
+	if len(config.esploraServers) > 0 {
+		return newEsploraBackend(config)
+	}
+
+	return backend.NewElectrum(
+		config.electrumServers,
+		!config.usesProvidedElectrum,
+		getGenesisHash(config.network),
+		config.dialer,
+		config.trustStore,
+	)
+}
+
+// newBitcoindBackend connects to the given node, and exits if it can't be used.
+func newBitcoindBackend(config *config) backend.Backend {
+	client := bitcoind.NewClient(config.bitcoindURL, bitcoind.Auth{
+		User:       config.bitcoindUser,
+		Password:   config.bitcoindPassword,
+		CookieFile: config.bitcoindCookie,
+	})
+
+	node := backend.NewBitcoind(client, getGenesisHash(config.network))
+
+	err := node.Check()
+	if err != nil {
+		exitWithError(&inputError{
+			exitCodeElectrum,
+			fmt.Errorf("couldn't connect to the bitcoind node at %s: %w", config.bitcoindURL, err),
+		})
+	}
+
+	return node
+}
+
+// newEsploraBackend checks the given Esplora servers, and exits if they can't be used.
+func newEsploraBackend(config *config) backend.Backend {
+	servers := backend.NewEsplora(
+		config.esploraServers,
+		esploraPoolSize,
+		getGenesisHash(config.network),
+		config.dialer,
+	)
+
+	err := servers.Check()
+	if err != nil {
+		exitWithError(&inputError{
+			exitCodeElectrum,
+			fmt.Errorf("couldn't use the esplora servers: %w", err),
+		})
 	}
 
-	reports := utxoScanner.Scan(addresses)
+	return servers
+}
+
+// scanUtxos runs the scan over all addresses from the generator, and returns the UTXOs found.
+func scanUtxos(addrGen *AddressGenerator, chainBackend backend.Backend, config *config) []*scanner.Utxo {
+	fixedDepth := useFixedDepth(addrGen, chainBackend)
+	if fixedDepth > 0 {
+		say("{yellow The node keeps no history, so emptied addresses look unused and the gap limit can't be trusted.}\n")
+		say("{yellow Scanning the first %d indices of every branch instead. Raise --gap-limit to scan deeper.}\n\n", fixedDepth)
+	}
+
+	checkpoint := getCheckpoint(addrGen, config)
+
+	utxoScanner := scanner.NewScanner(chainBackend, config.network, checkpoint)
+
+	if config.consensus > 1 {
+		err := utxoScanner.UseConsensus(config.consensus)
+		if err != nil {
+			exitWithError(invalidInput("can't use --consensus: %v", err))
+		}
+	}
+
+	reports := utxoScanner.Scan(addrGen)
 
 	say("► {white Finding servers...}")
 
@@ -133,82 +367,343 @@ func doRecovery(
 		printReport(lastReport)
 	}
 
-	fmt.Println()
-	fmt.Println()
+	fmt.Fprintln(textOutput)
+	fmt.Fprintln(textOutput)
 
 	if lastReport.Err != nil {
+		if checkpoint.CompletedBatches() > 0 {
+			say("Progress was saved to {white %s}. Run the tool again with {white --resume} to continue.\n\n", config.checkpointFile)
+		}
+
 		exitWithError(fmt.Errorf("error while scanning addresses: %w", lastReport.Err))
 	}
 
+	// The scan is complete, a new one should start from scratch:
+	err := checkpoint.Remove()
+	if err != nil {
+		say("{yellow %v}\n", err)
+	}
+
 	say("{green ✓ Scan complete}\n")
-	utxos := lastReport.UtxosFound
 
-	if len(utxos) == 0 {
-		sayBlock("No funds were discovered\n\n")
+	if fixedDepth > 0 {
+		printFixedDepths(addrGen)
+	}
+
+	printHighWaterMarks(lastReport.HighWaterMarks)
+	printConsensus(lastReport)
+
+	if config.audit {
+		printAudit(lastReport.UsedAddresses)
+	}
+
+	return dropInvalidUtxos(lastReport.UtxosFound)
+}
+
+// useFixedDepth makes the generator scan a fixed depth of every branch when the backend can't tell
+// emptied addresses from unused ones, since a run of emptied addresses would stop a gap limit scan
+// before funds further along. It returns the depth of the change and external branches, or 0 if
+// the gap limit applies.
+func useFixedDepth(addrGen *AddressGenerator, chainBackend backend.Backend) int {
+	if unspentOnly, ok := chainBackend.(backend.UnspentOnly); !ok || !unspentOnly.IsUnspentOnly() {
+		return 0
+	}
+
+	addrGen.UseFixedDepth(addrGen.gapLimit * fixedDepthFactor)
+
+	depth, _ := addrGen.FixedDepths()
+	return depth
+}
+
+// printFixedDepths tells where a fixed depth scan stopped, since funds further along weren't
+// looked for.
+func printFixedDepths(addrGen *AddressGenerator) {
+	depth, contactDepth := addrGen.FixedDepths()
+
+	if addrGen.generateContacts {
+		say("{yellow Stopped at a fixed depth}: %d indices of every branch, %d of every contact\n", depth, contactDepth)
+	} else {
+		say("{yellow Stopped at a fixed depth}: %d indices of every branch\n", depth)
+	}
+}
+
+// dropInvalidUtxos leaves out the UTXOs that failed verification, since the server made them up
+// and spending them would make the sweep invalid.
+func dropInvalidUtxos(utxos []*scanner.Utxo) []*scanner.Utxo {
+	var valid []*scanner.Utxo
+
+	for _, utxo := range utxos {
+		if utxo.Verification == scanner.Invalid {
+			say("{red ✗} Ignoring %s:%d, the server sent an invalid proof for it\n", utxo.TxID, utxo.OutputIndex)
+			continue
+		}
+
+		valid = append(valid, utxo)
+	}
+
+	return valid
+}
+
+// getCheckpoint returns the checkpoint of a previous scan when resuming, or a new one otherwise.
+func getCheckpoint(addrGen *AddressGenerator, config *config) *scanner.Checkpoint {
+	walletID := getWalletID(addrGen.userKey, addrGen.muunKey)
+
+	if !config.resume {
+		return scanner.NewCheckpoint(config.checkpointFile, walletID)
+	}
+
+	checkpoint, err := scanner.LoadCheckpoint(config.checkpointFile, walletID)
+	if errors.Is(err, os.ErrNotExist) {
+		say("No checkpoint found at {white %s}, starting a new scan.\n", config.checkpointFile)
+		return scanner.NewCheckpoint(config.checkpointFile, walletID)
+	}
+
+	if err != nil {
+		exitWithError(invalidInput("can't resume the scan: %v", err))
+	}
+
+	say("Resuming scan, {white %d} batches were already completed.\n", checkpoint.CompletedBatches())
+
+	return checkpoint
+}
+
+// getWalletID identifies a wallet and its network in checkpoints, without revealing its keys.
+func getWalletID(userKey, muunKey *libwallet.HDPublicKey) string {
+	id := fmt.Sprintf("%s:%s:%d", userKey.String(), muunKey.String(), userKey.Network.ToParams().Net)
+	hash := sha256.Sum256([]byte(id))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// printHighWaterMarks shows the highest used index of every branch with used addresses.
+func printHighWaterMarks(marks map[string]int) {
+	var names []string
+	for name, mark := range marks {
+		if mark >= 0 {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return
+	}
+
+	sort.Strings(names)
+
+	say("\n{white Highest used index by branch}\n")
+	for _, name := range names {
+		say("• %s: {white %d}\n", name, marks[name])
+	}
+	say("\n")
+}
+
+// printConsensus shows how many batches the servers of a consensus scan agreed on, and the
+// differences in the rest.
+func printConsensus(report *scanner.Report) {
+	if report.Consensus == 0 || report.ScannedBatches == 0 {
+		return
+	}
+
+	agreed := report.ScannedBatches - len(report.Disagreements)
+	confidence := float64(agreed) / float64(report.ScannedBatches) * 100
+
+	say(
+		"{white Consensus}: %d of %d batches agreed on %d servers each (%.0f%% confidence)\n",
+		agreed, report.ScannedBatches, report.Consensus, confidence,
+	)
+
+	if len(report.Disagreements) == 0 {
+		say("\n")
 		return
 	}
 
+	say("{yellow Servers disagreed on %d batches.} Every UTXO any of them reported was kept:\n", len(report.Disagreements))
+
+	for _, disagreement := range report.Disagreements {
+		first := disagreement.Addresses[0].DerivationPath()
+		last := disagreement.Addresses[len(disagreement.Addresses)-1].DerivationPath()
+
+		say("• %s to %s: {white %s} differed\n", first, last, strings.Join(disagreement.Dissenters, ", "))
+
+		for _, server := range disagreement.Servers {
+			for _, utxo := range disagreement.Missing[server] {
+				say("  └ %s didn't report %s\n", server, utxo)
+			}
+		}
+	}
+
+	say("\n")
+}
+
+// printAudit shows every transaction that touched the wallet, oldest first, with the addresses
+// involved.
+func printAudit(usedAddresses []*scanner.AddressActivity) {
+	event := newAuditEvent(usedAddresses)
+	emitEvent(event)
+
+	say("\n{white Transaction history} (%d transactions)\n", len(event.Transactions))
+
+	for _, tx := range event.Transactions {
+		if tx.Height > 0 {
+			say("• %s in block {white %d}\n", tx.TxID, tx.Height)
+		} else {
+			say("• %s {yellow unconfirmed}\n", tx.TxID)
+		}
+
+		for _, address := range tx.Addresses {
+			say("  └ %s (%s)\n", address.Address, address.DerivationPath)
+		}
+	}
+
+	say("\n")
+}
+
+func printUtxos(utxos []*scanner.Utxo) {
 	var total int64
 	for _, utxo := range utxos {
 		total += utxo.Amount
-		say("• {white %d} sats in %s\n", utxo.Amount, utxo.Address.Address())
+		say("• {white %d} sats in %s "+describeVerification(utxo)+"\n", utxo.Amount, utxo.Address.Address())
 	}
 
 	say("\n— {white %d} sats total\n", total)
-	if config.onlyScan {
-		return
+}
+
+// describeVerification shows whether a UTXO was proven to be mined, with SPV, as a colored tag
+// for say.
+func describeVerification(utxo *scanner.Utxo) string {
+	switch {
+	case utxo.Verification == scanner.Verified:
+		return "{green ✓ verified}"
+	case utxo.Verification == scanner.Invalid:
+		return "{red ✗ invalid}"
+	case utxo.Height <= 0 && utxo.Verification != "":
+		return "{yellow unconfirmed}"
+	default:
+		return "{yellow unverified}"
 	}
+}
 
-	txOutputAmount, txWeightInBytes, err := sweeper.GetSweepTxAmountAndWeightInBytes(utxos)
+// getSweepFee asks for the fee of the sweep transaction, and for confirmation to go ahead.
+func getSweepFee(sweeper *Sweeper, utxos []*scanner.Utxo, config *config) int64 {
+	txOutputAmount, txSize, err := sweeper.GetSweepTxAmountAndSize(utxos)
 	if err != nil {
 		exitWithError(err)
 	}
 
-	fee := readFee(txOutputAmount, txWeightInBytes)
+	fee := getFee(config, sweeper.Backend, txOutputAmount, txSize, sweeper.Destinations)
 
-	// Then we re-build the sweep tx with the actual fee
-	sweepTx, err := sweeper.BuildSweepTx(utxos, fee)
+	outputs, err := getSweepOutputs(sweeper.Destinations, txOutputAmount-fee)
 	if err != nil {
 		exitWithError(err)
 	}
 
-	sayBlock("Sending transaction...")
+	getConfirmation(config, fee, txSize, outputs)
+
+	return fee
+}
 
-	err = sweeper.BroadcastTx(sweepTx)
+// buildSignedSweep builds the fully signed sweep transaction with the given fee, and exits if it
+// fails.
+func buildSignedSweep(sweeper *Sweeper, utxos []*scanner.Utxo, fee int64) *wire.MsgTx {
+	sweepTx, err := signSweep(sweeper, utxos, fee)
 	if err != nil {
 		exitWithError(err)
 	}
 
-	sayBlock(`
-		Transaction sent! You can check the status here: https://mempool.space/tx/%v
-		(it will appear in mempool.space after a short delay)
+	return sweepTx
+}
+
+// signSweep builds and signs the sweep transaction with the actual fee.
+func signSweep(sweeper *Sweeper, utxos []*scanner.Utxo, fee int64) (*wire.MsgTx, error) {
+	sweepTx, err := sweeper.BuildSweepTx(utxos, fee)
+	if err != nil {
+		return nil, err
+	}
+
+	if eventEncoder != nil {
+		event, err := newSweepEvent(sweepTx, true, fee, sweeper.Destinations)
+		if err != nil {
+			return nil, err
+		}
 
-	`, sweepTx.TxHash().String())
+		emitEvent(event)
+	}
+
+	return sweepTx, nil
 }
 
-func validateProvidedElectrum(providedElectrum string) {
-	client := electrum.NewClient(false)
-	err := client.Connect(providedElectrum)
-	defer func(client *electrum.Client) {
-		_ = client.Disconnect()
-	}(client)
+// writeSweepPSBT exports the sweep transaction as an unsigned PSBT, instead of broadcasting it.
+func writeSweepPSBT(sweeper *Sweeper, utxos []*scanner.Utxo, fee int64, path string) {
+	packet, err := sweeper.BuildSweepPSBT(utxos, fee)
+	if err != nil {
+		exitWithError(err)
+	}
 
+	encodedPSBT, unsignedTxHex, err := encodePSBT(packet)
 	if err != nil {
-		sayBlock(`
-				{red Error!}
-				The Recovery Tool couldn't connect to the provided Electrum server %v.
+		exitWithError(err)
+	}
+
+	err = os.WriteFile(path, []byte(encodedPSBT), 0600)
+	if err != nil {
+		exitWithError(fmt.Errorf("failed to write psbt: %w", err))
+	}
+
+	if eventEncoder != nil {
+		// We sign a copy of the transaction with the only purpose of checking its virtual size:
+		signedTx, err := sweeper.BuildSweepTx(utxos, fee)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		event, err := newSweepEvent(packet.UnsignedTx, false, fee, sweeper.Destinations)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		event.TxHex = unsignedTxHex
+		event.PSBT = encodedPSBT
+		event.VSize = getVirtualSize(signedTx)
+
+		emitEvent(event)
+	}
+
+	sayBlock(`
+		PSBT written to {white %v}
+		The transaction was {yellow not} broadcast. Sign it and broadcast it with your wallet software.
+
+	`, path)
+}
+
+// validateProvidedElectrum exits unless one of the provided Electrum servers can be reached.
+func validateProvidedElectrum(config *config) {
+	var err error
 
-				If the problem persists, contact {blue support@muun.com}.
-				
-				――― {white error report} ―――
-				%v
-				――――――――――――――――――――
+	for _, providedElectrum := range config.electrumServers {
+		client := electrum.NewClient(false, getGenesisHash(config.network), config.dialer, config.trustStore)
 
-				We're always there to help.
-			`, providedElectrum, err)
+		err = client.Connect(providedElectrum)
+		_ = client.Disconnect()
 
-		os.Exit(2)
+		if err == nil {
+			return
+		}
 	}
+
+	sayBlock(`
+			{red Error!}
+			The Recovery Tool couldn't connect to the provided Electrum server %v.
+
+			If the problem persists, contact {blue support@muun.com}.
+			
+			――― {white error report} ―――
+			%v
+			――――――――――――――――――――
+
+			We're always there to help.
+		`, config.providedElectrum, err)
+
+	os.Exit(exitCodeElectrum)
 }
 
 func exitWithError(err error) {
@@ -230,7 +725,17 @@ func exitWithError(err error) {
 	_ = utils.NewLogger("").Errorf("exited with error: %s", err.Error())
 	_ = os.WriteFile("error_log", debugOutputStream.Bytes(), 0600)
 
-	os.Exit(1)
+	// Errors caused by the values we were given have their own exit codes:
+	exitCode := exitCodeError
+
+	var inputErr *inputError
+	if errors.As(err, &inputErr) {
+		exitCode = inputErr.code
+	}
+
+	emitEvent(&errorEvent{Type: "error", ExitCode: exitCode, Message: err.Error()})
+
+	os.Exit(exitCode)
 }
 
 func printWelcomeMessage() {
@@ -247,12 +752,36 @@ func printWelcomeMessage() {
 	`, version)
 }
 
+func printNetwork(config *config) {
+	if config.networkName == networkMainnet {
+		return
+	}
+
+	sayBlock("{yellow Running on %v}. Keys and addresses must belong to this network.\n", config.networkName)
+}
+
 func printUsage() {
-	fmt.Println("Usage: recovery-tool [optional: path to Emergency Kit PDF]")
+	fmt.Println("Usage: recovery-tool [options] [optional: path to Emergency Kit PDF]")
 	flag.PrintDefaults()
+
+	fmt.Println()
+	fmt.Println("For an air-gapped recovery, use one of these commands (add -h for their options):")
+	fmt.Println("  xpubs      print the extended public keys needed to scan (offline)")
+	fmt.Println("  scan       find the funds using only the extended public keys, and write a UTXO file")
+	fmt.Println("  sign       sign the sweep transaction for a UTXO file (offline)")
+	fmt.Println("  broadcast  send a signed transaction")
+	fmt.Println()
+	fmt.Println("If a sweep transaction is stuck, use one of these commands to accelerate it:")
+	fmt.Println("  bump       re-sign the last recorded sweep paying a higher fee (replace-by-fee)")
+	fmt.Println("  cpfp       spend the sweep output with a child paying for both (child-pays-for-parent)")
+	fmt.Println()
+	fmt.Println("To catch funds that arrive after a recovery, use:")
+	fmt.Println("  watch      report new funds as they arrive, and optionally sweep them")
 }
 
 func printReport(report *scanner.Report) {
+	emitEvent(newReportEvent(report))
+
 	if utils.DebugMode {
 		return // don't print reports while debugging, there's richer information in the logs
 	}
@@ -265,6 +794,30 @@ func printReport(report *scanner.Report) {
 	say("\r► {white Scanned addresses}: %d | {white Sats found}: %d", report.ScannedAddresses, total)
 }
 
+// getRecoveryCode returns the Recovery Code given in the config or, if interactive, asks for it.
+func getRecoveryCode(config *config) string {
+	if config.recoveryCode != "" {
+		recoveryCode, err := parseRecoveryCode(config.recoveryCode)
+		if err == nil {
+			return recoveryCode
+		}
+
+		if config.nonInteractive {
+			exitWithError(invalidInput("invalid recovery code: %v", err))
+		}
+
+		say(`
+			The provided recovery code is not valid: %v
+		`, err)
+	}
+
+	if config.nonInteractive {
+		exitWithError(missingInput("recovery code"))
+	}
+
+	return readRecoveryCode()
+}
+
 func readRecoveryCode() string {
 	sayBlock(`
 		{yellow Enter your Recovery Code}
@@ -274,28 +827,69 @@ func readRecoveryCode() string {
 	var userInput string
 	ask(&userInput)
 
-	userInput = strings.TrimSpace(userInput)
-	finalRC := strings.ToUpper(userInput)
-
-	if strings.Count(finalRC, "-") != 7 {
+	finalRC, err := parseRecoveryCode(userInput)
+	if err != nil {
 		say(`
-			Invalid recovery code. Did you add the '-' separator between each 4-characters segment?
+			%v
 			Please, try again
-		`)
+		`, err)
 
 		return readRecoveryCode()
 	}
 
+	return finalRC
+}
+
+func parseRecoveryCode(input string) (string, error) {
+	finalRC := strings.ToUpper(strings.TrimSpace(input))
+
+	if strings.Count(finalRC, "-") != 7 {
+		return "", errors.New(
+			"Invalid recovery code. Did you add the '-' separator between each 4-characters segment?",
+		)
+	}
+
 	if len(finalRC) != 39 {
-		say(`
-			Your recovery code must have 39 characters
-			Please, try again
-		`)
+		return "", errors.New("Your recovery code must have 39 characters")
+	}
 
-		return readRecoveryCode()
+	return finalRC, nil
+}
+
+// getBackup returns the encrypted keys, taken from the encrypted keys or the Emergency Kit given
+// in the config. If interactive, it falls back to asking for them.
+func getBackup(config *config) ([]*libwallet.EncryptedPrivateKeyInfo, error) {
+	if config.firstKey != "" || config.secondKey != "" {
+		if config.firstKey == "" {
+			return nil, missingInput("first encrypted private key")
+		}
+
+		if config.secondKey == "" {
+			return nil, missingInput("second encrypted private key")
+		}
+
+		encryptedKeys, err := decodeKeysFromInput(config.firstKey, config.secondKey)
+		if err != nil {
+			return nil, invalidInput("invalid encrypted keys: %w", err)
+		}
+
+		return encryptedKeys, nil
 	}
 
-	return finalRC
+	if !config.nonInteractive {
+		return readBackupFromInputOrPDF(config.emergencyKit)
+	}
+
+	if config.emergencyKit == "" {
+		return nil, missingInput("Emergency Kit or encrypted private keys")
+	}
+
+	encryptedKeys, err := readBackupFromPDF(config.emergencyKit)
+	if err != nil {
+		return nil, invalidInput("couldn't read the Emergency Kit: %w", err)
+	}
+
+	return encryptedKeys, nil
 }
 
 func readBackupFromInputOrPDF(optionalPDF string) ([]*libwallet.EncryptedPrivateKeyInfo, error) {
@@ -386,71 +980,223 @@ func readKey(keyType string) string {
 	return userInput
 }
 
-func readAddress() btcutil.Address {
+// getDestinations returns the destinations given in the config or, if interactive, asks for them.
+func getDestinations(config *config) []destination {
+	if config.destination != "" {
+		destinations, err := parseDestinations(config.destination, config.network)
+		if err == nil {
+			return destinations
+		}
+
+		if config.nonInteractive {
+			exitWithError(invalidInput("invalid destination: %v", err))
+		}
+
+		say(`
+			The provided destination can't be used: %v
+		`, err)
+	}
+
+	if config.nonInteractive {
+		exitWithError(missingInput("destination address"))
+	}
+
+	return readDestinations(config.network)
+}
+
+func readDestinations(network *libwallet.Network) []destination {
 	sayBlock(`
 		{yellow Enter your destination bitcoin address}
+		To split the funds, enter several addresses separated by commas (no spaces), each followed by
+		:amount in sats, :percentage%% or :rest. For example, {white address1:60%%,address2:40%%}.
 	`)
 
 	var userInput string
 	ask(&userInput)
 
-	userInput = strings.TrimSpace(userInput)
-
-	addr, err := btcutilw.DecodeAddress(userInput, &chainParams)
+	destinations, err := parseDestinations(userInput, network)
 	if err != nil {
 		say(`
-			This is not a valid bitcoin address
+			This destination can't be used: %v
 			Please, try again
-		`)
+		`, err)
 
-		return readAddress()
+		return readDestinations(network)
 	}
 
-	return addr
+	return destinations
 }
 
-func readFee(totalBalance, weight int64) int64 {
-	sayBlock(`
-		{yellow Enter the fee rate (sats/byte)}
-		Your transaction weighs %v bytes. You can get suggestions in https://mempool.space/ under "Transaction fees".
-	`, weight)
+func parseAddress(input string, network *libwallet.Network) (btcutil.Address, error) {
+	addr, err := btcutilw.DecodeAddress(strings.TrimSpace(input), network.ToParams())
+	if err != nil {
+		return nil, err
+	}
 
-	var userInput string
-	ask(&userInput)
+	if !addr.IsForNet(network.ToParams()) {
+		return nil, fmt.Errorf("address is not for %s", network.Name())
+	}
+
+	return addr, nil
+}
+
+// getFee returns the total fee for the fee rate given in the config or, if interactive, asks for
+// a fee rate suggesting the ones estimated by the backend.
+func getFee(
+	config *config,
+	chainBackend backend.Backend,
+	totalBalance int64,
+	size SweepSize,
+	destinations []destination,
+) int64 {
+
+	if config.feeRate != 0 {
+		totalFee, err := calculateFee(totalBalance, size.VSize, config.feeRate, destinations)
+		if err == nil {
+			return totalFee
+		}
+
+		if config.nonInteractive {
+			exitWithError(invalidInput("invalid fee rate: %v", err))
+		}
 
-	feeInSatsPerByte, err := strconv.ParseInt(userInput, 10, 64)
-	if err != nil || feeInSatsPerByte <= 0 {
 		say(`
-			The fee must be a whole number
-			Please, try again
-		`)
+			The provided fee rate can't be used: %v
+		`, err)
+	}
 
-		return readFee(totalBalance, weight)
+	if config.nonInteractive {
+		exitWithError(missingInput("fee rate"))
 	}
 
-	totalFee := feeInSatsPerByte * weight
+	suggestions := getFeeSuggestions(chainBackend, totalBalance, size.VSize, destinations)
+
+	return readFee(totalBalance, size, destinations, suggestions)
+}
+
+// readFee asks for a fee rate, or the name of one of the suggestions.
+func readFee(totalBalance int64, size SweepSize, destinations []destination, suggestions []feeSuggestion) int64 {
+	if len(suggestions) == 0 {
+		sayBlock(`
+			{yellow Enter the fee rate (sats/vB)}
+			Your transaction takes %v vbytes (%v weight units). You can get suggestions in https://mempool.space/ under "Transaction fees".
+		`, size.VSize, size.Weight)
+	} else {
+		sayBlock(`
+			{yellow Enter the fee rate (sats/vB)}
+			Your transaction takes %v vbytes (%v weight units). Suggested fee rates:
+		`, size.VSize, size.Weight)
+
+		for _, suggestion := range suggestions {
+			say(
+				"• {white %-8s} %4d sats/vB, %d sats total, confirms in %s (%d blocks)\n",
+				suggestion.name,
+				suggestion.feeRate,
+				suggestion.totalFee,
+				suggestion.eta,
+				suggestion.target,
+			)
+		}
+
+		say("\nType the name of a suggestion, or a fee rate of your choice.\n")
+	}
+
+	var userInput string
+	ask(&userInput)
+
+	for _, suggestion := range suggestions {
+		if strings.EqualFold(strings.TrimSpace(userInput), suggestion.name) {
+			return suggestion.totalFee
+		}
+	}
 
-	if totalBalance-totalFee < 546 {
+	totalFee, err := parseFee(totalBalance, size.VSize, userInput, destinations)
+	if err != nil {
 		say(`
-			The fee is too high. The remaining amount after deducting is too low to send.
+			%v
 			Please, try again
-		`)
+		`, err)
 
-		return readFee(totalBalance, weight)
+		return readFee(totalBalance, size, destinations, suggestions)
 	}
 
 	return totalFee
 }
 
-func readConfirmation(value, fee int64, address string) {
+// parseFee returns the total fee for a fee rate typed by the user.
+func parseFee(totalBalance, vsize int64, userInput string, destinations []destination) (int64, error) {
+	feeRate, err := strconv.ParseInt(strings.TrimSpace(userInput), 10, 64)
+	if err != nil {
+		return 0, errors.New("The fee must be a whole number")
+	}
+
+	return calculateFee(totalBalance, vsize, feeRate, destinations)
+}
+
+// calculateFee returns the total fee for a transaction of the given virtual size, paying a fee
+// rate in sats/vB, if every destination still gets more than dust.
+func calculateFee(totalBalance, vsize, feeRate int64, destinations []destination) (int64, error) {
+	if feeRate < minRelayFeeRate {
+		return 0, fmt.Errorf("The fee rate must be at least %d sats/vB, or nodes won't relay the transaction", minRelayFeeRate)
+	}
+
+	totalFee := feeRate * vsize
+
+	_, err := splitAmount(destinations, totalBalance-totalFee)
+	if err != nil {
+		return 0, fmt.Errorf("The fee is too high: %v", err)
+	}
+
+	return totalFee, nil
+}
+
+// getConfirmation shows the sweep summary and, unless confirmed in the config, asks the user to
+// confirm it.
+func getConfirmation(config *config, fee int64, size SweepSize, outputs []sweepOutput) {
+	printSummary(fee, size, outputs)
+
+	if config.assumeYes {
+		return
+	}
+
+	if config.nonInteractive {
+		exitWithError(&inputError{
+			exitCodeNotConfirmed,
+			errors.New("the transaction must be confirmed with --yes in non-interactive mode"),
+		})
+	}
+
+	readConfirmation()
+}
+
+func printSummary(fee int64, size SweepSize, outputs []sweepOutput) {
+	var value int64
+	for _, output := range outputs {
+		value += output.amount
+	}
+
 	sayBlock(`
 		{whiteUnderline Summary}
 		  {white Amount}: %v sats
-		  {white Fee}: %v sats
-		  {white Destination}: %v
+		  {white Fee}: %v sats (%.1f sats/vB)
+		  {white Size}: %v vbytes (%v weight units)
+	`, value, fee, float64(fee)/float64(size.VSize), size.VSize, size.Weight)
+
+	if len(outputs) == 1 {
+		say("  {white Destination}: %v\n", outputs[0].address)
+		return
+	}
 
+	say("  {white Destinations}:\n")
+	for _, output := range outputs {
+		say("    • %v sats to %v\n", output.amount, output.address)
+	}
+}
+
+func readConfirmation() {
+	sayBlock(`
 		{yellow Confirm?} (y/n)
-	`, value, fee, address)
+	`)
 
 	var userInput string
 	ask(&userInput)
@@ -464,13 +1210,13 @@ func readConfirmation(value, fee int64, address string) {
 			Recovery tool stopped
 			You can try again or contact us at {blue support@muun.com}
 		`)
-		os.Exit(1)
+		os.Exit(exitCodeNotConfirmed)
 	}
 
 	say(`You can only enter 'y' to confirm or 'n' to cancel`)
 
-	fmt.Print("\n\n")
-	readConfirmation(value, fee, address)
+	fmt.Fprint(textOutput, "\n\n")
+	readConfirmation()
 }
 
 var leadingIndentRe = regexp.MustCompile("^[ \t]+")
@@ -489,11 +1235,11 @@ func say(message string, v ...interface{}) {
 		return applyColor(groups[1], groups[2])
 	})
 
-	fmt.Printf(withColors, v...)
+	fmt.Fprintf(textOutput, withColors, v...)
 }
 
 func sayBlock(message string, v ...interface{}) {
-	fmt.Println()
+	fmt.Fprintln(textOutput)
 	say(message, v...)
 }
 
@@ -517,7 +1263,7 @@ func applyColor(colorName string, text string) string {
 }
 
 func askMultiline(minChars int) string {
-	fmt.Print("➜ ")
+	fmt.Fprint(textOutput, "➜ ")
 
 	var result strings.Builder
 
@@ -532,6 +1278,6 @@ func askMultiline(minChars int) string {
 }
 
 func ask(result *string) {
-	fmt.Print("➜ ")
+	fmt.Fprint(textOutput, "➜ ")
 	fmt.Scan(result)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/esplora"
+)
+
+// Values accepted by the `--network` flag.
+const (
+	networkMainnet = "mainnet"
+	networkTestnet = "testnet"
+	networkRegtest = "regtest"
+	networkSignet  = "signet"
+)
+
+// getNetwork returns the network for a value of the `--network` flag. Custom signets are created
+// from the hex-encoded challenge, if given.
+func getNetwork(name string, signetChallenge string) (*libwallet.Network, error) {
+	if signetChallenge != "" && name != networkSignet {
+		return nil, fmt.Errorf("a signet challenge can't be used with network %q", name)
+	}
+
+	switch name {
+	case networkMainnet:
+		return libwallet.Mainnet(), nil
+	case networkTestnet:
+		return libwallet.Testnet(), nil
+	case networkRegtest:
+		return libwallet.Regtest(), nil
+	case networkSignet:
+		if signetChallenge == "" {
+			return libwallet.Signet(), nil
+		}
+
+		challenge, err := hex.DecodeString(signetChallenge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signet challenge: %w", err)
+		}
+
+		return libwallet.CustomSignet(challenge)
+	}
+
+	return nil, fmt.Errorf(
+		"unknown network %q, use %q, %q, %q or %q",
+		name, networkMainnet, networkTestnet, networkSignet, networkRegtest,
+	)
+}
+
+// getDefaultElectrumServers returns the public servers for a network. There are none for signet and
+// regtest.
+func getDefaultElectrumServers(network *libwallet.Network) []string {
+	switch network.Name() {
+	case chaincfg.MainNetParams.Name:
+		return electrum.PublicServers
+	case chaincfg.TestNet3Params.Name:
+		return electrum.TestnetServers
+	}
+
+	return nil
+}
+
+// esploraPublic is the value of `--esplora` that selects the public servers for the network.
+const esploraPublic = "public"
+
+// getDefaultEsploraServers returns the public Esplora servers for a network. There are none for
+// custom signets and regtest.
+func getDefaultEsploraServers(network *libwallet.Network) []string {
+	switch network.Name() {
+	case chaincfg.MainNetParams.Name:
+		return esplora.PublicServers
+	case chaincfg.TestNet3Params.Name:
+		return esplora.TestnetServers
+	case networkSignet:
+		if network.ToParams().Net == libwallet.Signet().ToParams().Net {
+			return esplora.SignetServers
+		}
+	}
+
+	return nil
+}
+
+// getDefaultCookiePath returns the path of the `.cookie` file that Bitcoin Core creates in its
+// default data directory for a network.
+func getDefaultCookiePath(network *libwallet.Network) string {
+	var dataDir string
+
+	home, _ := os.UserHomeDir()
+
+	switch runtime.GOOS {
+	case "windows":
+		dataDir = filepath.Join(os.Getenv("APPDATA"), "Bitcoin")
+	case "darwin":
+		dataDir = filepath.Join(home, "Library", "Application Support", "Bitcoin")
+	default:
+		dataDir = filepath.Join(home, ".bitcoin")
+	}
+
+	switch network.Name() {
+	case chaincfg.TestNet3Params.Name:
+		dataDir = filepath.Join(dataDir, "testnet3")
+	case chaincfg.RegressionNetParams.Name:
+		dataDir = filepath.Join(dataDir, "regtest")
+	case networkSignet:
+		dataDir = filepath.Join(dataDir, "signet")
+	}
+
+	return filepath.Join(dataDir, ".cookie")
+}
+
+// getGenesisHash returns the genesis block hash that Electrum servers must report for a network.
+func getGenesisHash(network *libwallet.Network) string {
+	return network.ToParams().GenesisHash.String()
+}
+
+// getTxURL returns a link to a transaction in a block explorer, or an empty string if the network
+// has no public explorer.
+func getTxURL(network *libwallet.Network, txID string) string {
+	switch network.Name() {
+	case chaincfg.MainNetParams.Name:
+		return "https://mempool.space/tx/" + txID
+	case chaincfg.TestNet3Params.Name:
+		return "https://mempool.space/testnet/tx/" + txID
+	case networkSignet:
+		// Custom signets have the same name, but not the same magic:
+		if network.ToParams().Net == libwallet.Signet().ToParams().Net {
+			return "https://mempool.space/signet/tx/" + txID
+		}
+	}
+
+	return ""
+}
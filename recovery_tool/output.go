@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/scanner"
+)
+
+// Output formats accepted by the `--output` flag.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// textOutput receives all human-readable messages. In JSON mode, it's moved to stderr to keep
+// stdout clean for events.
+var textOutput io.Writer = os.Stdout
+
+// eventEncoder writes newline-delimited JSON events to stdout. It's nil unless JSON output was
+// requested.
+var eventEncoder *json.Encoder
+
+// setOutputFormat configures where human-readable messages and machine-readable events go.
+func setOutputFormat(format string) error {
+	switch format {
+	case outputText:
+		textOutput = os.Stdout
+		eventEncoder = nil
+
+	case outputJSON:
+		textOutput = os.Stderr
+		eventEncoder = json.NewEncoder(os.Stdout)
+
+	default:
+		return invalidInput("unknown output format %q, use %q or %q", format, outputText, outputJSON)
+	}
+
+	return nil
+}
+
+// reportEvent is emitted for every scanner.Report.
+type reportEvent struct {
+	Type             string              `json:"type"`
+	ScannedAddresses int                 `json:"scannedAddresses"`
+	TotalAmount      int64               `json:"totalAmount"`
+	UtxosFound       []utxoEvent         `json:"utxosFound"`
+	UsedAddresses    []addressEvent      `json:"usedAddresses"`
+	HighWaterMarks   map[string]int      `json:"highWaterMarks"`
+	Consensus        int                 `json:"consensus,omitempty"`
+	ScannedBatches   int                 `json:"scannedBatches"`
+	Disagreements    []disagreementEvent `json:"disagreements,omitempty"`
+	Error            string              `json:"error,omitempty"`
+}
+
+// disagreementEvent describes a batch the servers of a consensus scan disagreed on, from a
+// scanner.Disagreement.
+type disagreementEvent struct {
+	Addresses  []string            `json:"addresses"`
+	Servers    []string            `json:"servers"`
+	Dissenters []string            `json:"dissenters"`
+	Missing    map[string][]string `json:"missing"`
+}
+
+// utxoEvent describes a single scanner.Utxo. It's also the entry format of the UTXO file.
+type utxoEvent struct {
+	TxID           string `json:"txid"`
+	Vout           int    `json:"vout"`
+	Amount         int64  `json:"amount"`
+	Address        string `json:"address"`
+	AddressVersion int    `json:"addressVersion"`
+	DerivationPath string `json:"derivationPath"`
+	Height         int    `json:"height,omitempty"`
+	Verification   string `json:"verification,omitempty"`
+}
+
+// addressEvent describes the activity of a used address, from a scanner.AddressActivity.
+type addressEvent struct {
+	Address        string `json:"address"`
+	DerivationPath string `json:"derivationPath"`
+	TxCount        int    `json:"txCount"`
+	FirstSeen      int    `json:"firstSeen"`
+	LastSeen       int    `json:"lastSeen"`
+}
+
+// auditEvent lists every transaction that touched the wallet, when `--audit` is given.
+type auditEvent struct {
+	Type         string      `json:"type"`
+	Transactions []auditedTx `json:"transactions"`
+}
+
+// auditedTx is a transaction in an auditEvent. Height is 0 or less while unconfirmed.
+type auditedTx struct {
+	TxID      string         `json:"txid"`
+	Height    int            `json:"height"`
+	Addresses []addressEvent `json:"addresses"`
+}
+
+// sweepEvent is the final document describing the sweep transaction.
+type sweepEvent struct {
+	Type        string        `json:"type"`
+	Signed      bool          `json:"signed"`
+	TxHex       string        `json:"txHex"`
+	PSBT        string        `json:"psbt,omitempty"`
+	TxID        string        `json:"txid"`
+	VSize       int64         `json:"vsize"`
+	Amount      int64         `json:"amount"`
+	Fee         int64         `json:"fee"`
+	Destination string        `json:"destination"`
+	Outputs     []outputEvent `json:"outputs"`
+}
+
+// outputEvent is an output of the sweep transaction.
+type outputEvent struct {
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+}
+
+// broadcastEvent is emitted once the sweep transaction was accepted by a server.
+type broadcastEvent struct {
+	Type         string        `json:"type"`
+	TxID         string        `json:"txid"`
+	AlreadyKnown bool          `json:"alreadyKnown"`
+	Seen         bool          `json:"seen"`
+	Servers      []serverEvent `json:"servers,omitempty"`
+}
+
+// cpfpEvent describes the child transaction that accelerates a sweep, emitted even if the tool
+// can't sign it.
+type cpfpEvent struct {
+	Type           string `json:"type"`
+	TxID           string `json:"txid"`
+	Vout           int    `json:"vout"`
+	ParentFee      int64  `json:"parentFee"`
+	ParentVSize    int64  `json:"parentVsize"`
+	PackageFeeRate int64  `json:"packageFeeRate"`
+	ChildFee       int64  `json:"childFee"`
+	ChildVSize     int64  `json:"childVsize"`
+}
+
+// watchEvent is emitted by `watch` when the status of an address changes, with the UTXOs that
+// arrived, confirmed or were spent since the last one.
+type watchEvent struct {
+	Type           string      `json:"type"`
+	Address        string      `json:"address"`
+	DerivationPath string      `json:"derivationPath"`
+	Status         string      `json:"status"`
+	Received       []utxoEvent `json:"received,omitempty"`
+	Confirmed      []utxoEvent `json:"confirmed,omitempty"`
+	Spent          []utxoEvent `json:"spent,omitempty"`
+}
+
+// serverEvent is the outcome of broadcasting to a single server. Error is empty if it accepted.
+type serverEvent struct {
+	Server string `json:"server"`
+	Error  string `json:"error,omitempty"`
+}
+
+// errorEvent is emitted when the tool exits with an error.
+type errorEvent struct {
+	Type     string `json:"type"`
+	ExitCode int    `json:"exitCode"`
+	Message  string `json:"message"`
+}
+
+// emitEvent writes an event to stdout if JSON output was requested, and does nothing otherwise.
+func emitEvent(event interface{}) {
+	if eventEncoder == nil {
+		return
+	}
+
+	_ = eventEncoder.Encode(event)
+}
+
+func newReportEvent(report *scanner.Report) *reportEvent {
+	event := &reportEvent{
+		Type:             "report",
+		ScannedAddresses: report.ScannedAddresses,
+		UtxosFound:       make([]utxoEvent, len(report.UtxosFound)),
+		UsedAddresses:    make([]addressEvent, len(report.UsedAddresses)),
+		HighWaterMarks:   report.HighWaterMarks,
+		Consensus:        report.Consensus,
+		ScannedBatches:   report.ScannedBatches,
+	}
+
+	for _, disagreement := range report.Disagreements {
+		event.Disagreements = append(event.Disagreements, newDisagreementEvent(disagreement))
+	}
+
+	for i, activity := range report.UsedAddresses {
+		event.UsedAddresses[i] = newAddressEvent(activity)
+	}
+
+	for i, utxo := range report.UtxosFound {
+		event.TotalAmount += utxo.Amount
+		event.UtxosFound[i] = newUtxoEvent(utxo)
+	}
+
+	if report.Err != nil {
+		event.Error = report.Err.Error()
+	}
+
+	return event
+}
+
+func newDisagreementEvent(disagreement *scanner.Disagreement) disagreementEvent {
+	event := disagreementEvent{
+		Addresses:  make([]string, len(disagreement.Addresses)),
+		Servers:    disagreement.Servers,
+		Dissenters: disagreement.Dissenters,
+		Missing:    disagreement.Missing,
+	}
+
+	for i, address := range disagreement.Addresses {
+		event.Addresses[i] = address.Address()
+	}
+
+	return event
+}
+
+func newUtxoEvent(utxo *scanner.Utxo) utxoEvent {
+	return utxoEvent{
+		TxID:           utxo.TxID,
+		Vout:           utxo.OutputIndex,
+		Amount:         utxo.Amount,
+		Address:        utxo.Address.Address(),
+		AddressVersion: utxo.Address.Version(),
+		DerivationPath: utxo.Address.DerivationPath(),
+		Height:         utxo.Height,
+		Verification:   string(utxo.Verification),
+	}
+}
+
+func newWatchEvent(addr libwallet.MuunAddress) *watchEvent {
+	return &watchEvent{
+		Type:           "watch",
+		Address:        addr.Address(),
+		DerivationPath: addr.DerivationPath(),
+	}
+}
+
+func newAddressEvent(activity *scanner.AddressActivity) addressEvent {
+	return addressEvent{
+		Address:        activity.Address.Address(),
+		DerivationPath: activity.Address.DerivationPath(),
+		TxCount:        activity.TxCount,
+		FirstSeen:      activity.FirstSeen,
+		LastSeen:       activity.LastSeen,
+	}
+}
+
+// newAuditEvent groups the history of all used addresses by transaction, sorted by height with
+// unconfirmed transactions last.
+func newAuditEvent(usedAddresses []*scanner.AddressActivity) *auditEvent {
+	txsByID := make(map[string]*auditedTx)
+
+	for _, activity := range usedAddresses {
+		for _, tx := range activity.Transactions {
+			audited, ok := txsByID[tx.TxID]
+			if !ok {
+				audited = &auditedTx{TxID: tx.TxID, Height: tx.Height}
+				txsByID[tx.TxID] = audited
+			}
+
+			audited.Addresses = append(audited.Addresses, newAddressEvent(activity))
+		}
+	}
+
+	event := &auditEvent{Type: "audit", Transactions: make([]auditedTx, 0, len(txsByID))}
+	for _, audited := range txsByID {
+		event.Transactions = append(event.Transactions, *audited)
+	}
+
+	sort.Slice(event.Transactions, func(i, j int) bool {
+		a, b := event.Transactions[i], event.Transactions[j]
+
+		if (a.Height > 0) != (b.Height > 0) {
+			return a.Height > 0
+		}
+
+		if a.Height != b.Height {
+			return a.Height < b.Height
+		}
+
+		return a.TxID < b.TxID
+	})
+
+	return event
+}
+
+func newSweepEvent(tx *wire.MsgTx, signed bool, fee int64, destinations []destination) (*sweepEvent, error) {
+	txBytes := new(bytes.Buffer)
+
+	err := tx.BtcEncode(txBytes, wire.ProtocolVersion, wire.WitnessEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("error while encoding tx: %w", err)
+	}
+
+	var amount int64
+	outputs := make([]outputEvent, len(tx.TxOut))
+
+	for i, txOut := range tx.TxOut {
+		amount += txOut.Value
+		outputs[i] = outputEvent{Address: destinations[i].address.String(), Amount: txOut.Value}
+	}
+
+	return &sweepEvent{
+		Type:        "sweep",
+		Signed:      signed,
+		TxHex:       hex.EncodeToString(txBytes.Bytes()),
+		TxID:        tx.TxHash().String(),
+		VSize:       getVirtualSize(tx),
+		Amount:      amount,
+		Fee:         fee,
+		Destination: formatDestinations(destinations),
+		Outputs:     outputs,
+	}, nil
+}
+
+// getVirtualSize returns the size of a transaction in virtual bytes, as defined by BIP141.
+func getVirtualSize(tx *wire.MsgTx) int64 {
+	weight := blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+
+	return (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor
+}
+
+func newBroadcastEvent(txID string, outcome *BroadcastOutcome) *broadcastEvent {
+	event := &broadcastEvent{
+		Type:         "broadcast",
+		TxID:         txID,
+		AlreadyKnown: outcome.AlreadyKnown,
+		Seen:         outcome.Seen,
+	}
+
+	for _, result := range outcome.Results {
+		server := serverEvent{Server: result.Server}
+		if result.Err != nil {
+			server.Error = result.Err.Error()
+		}
+
+		event.Servers = append(event.Servers, server)
+	}
+
+	return event
+}
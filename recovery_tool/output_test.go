@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/scanner"
+)
+
+// testAddress is a libwallet.MuunAddress with fixed values.
+type testAddress struct {
+	version int
+	path    string
+	address string
+}
+
+func (a *testAddress) Version() int           { return a.version }
+func (a *testAddress) DerivationPath() string { return a.path }
+func (a *testAddress) Address() string        { return a.address }
+
+// encodeEvent returns an event as consumers of the JSON output see it.
+func encodeEvent(t *testing.T, event interface{}) map[string]interface{} {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+
+	err = json.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+func TestReportEventSchema(t *testing.T) {
+	legacy := &testAddress{libwallet.AddressVersionV2, "m/1'/1'/1/3", "2N8WD8EfNRjSNMocgjBYrqjV4Gykjc22acy"}
+	segwit := &testAddress{libwallet.AddressVersionV4, "m/1'/1'/0/7", "bcrt1qu63lqmqn8m7pzkrtytyzpvnpneu67pfc70x8smwugltcp4kqwmnq7txxrd"}
+
+	report := &scanner.Report{
+		ScannedAddresses: 400,
+		ScannedBatches:   4,
+		HighWaterMarks:   map[string]int{"external": 3, "change": 7},
+		UtxosFound: []*scanner.Utxo{
+			{TxID: "aa", OutputIndex: 1, Amount: 10000, Address: legacy, Height: 120, Verification: scanner.Verified},
+			{TxID: "bb", OutputIndex: 0, Amount: 5000, Address: segwit, Verification: scanner.Unverified},
+		},
+		UsedAddresses: []*scanner.AddressActivity{
+			{Address: legacy, TxCount: 2, FirstSeen: 100, LastSeen: 120},
+		},
+	}
+
+	event := encodeEvent(t, newReportEvent(report))
+
+	expected := map[string]interface{}{
+		"type":             "report",
+		"scannedAddresses": 400.0,
+		"scannedBatches":   4.0,
+		"totalAmount":      15000.0,
+		"highWaterMarks":   map[string]interface{}{"external": 3.0, "change": 7.0},
+		"utxosFound": []interface{}{
+			map[string]interface{}{
+				"txid":           "aa",
+				"vout":           1.0,
+				"amount":         10000.0,
+				"address":        legacy.address,
+				"addressVersion": 2.0,
+				"derivationPath": "m/1'/1'/1/3",
+				"height":         120.0,
+				"verification":   "verified",
+			},
+			map[string]interface{}{
+				"txid":           "bb",
+				"vout":           0.0,
+				"amount":         5000.0,
+				"address":        segwit.address,
+				"addressVersion": 4.0,
+				"derivationPath": "m/1'/1'/0/7",
+				"verification":   "unverified",
+			},
+		},
+		"usedAddresses": []interface{}{
+			map[string]interface{}{
+				"address":        legacy.address,
+				"derivationPath": "m/1'/1'/1/3",
+				"txCount":        2.0,
+				"firstSeen":      100.0,
+				"lastSeen":       120.0,
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(event, expected) {
+		t.Fatalf("expected %v, got %v", expected, event)
+	}
+}
+
+func TestSweepEventSchema(t *testing.T) {
+	addresses := createTestAddresses(t, libwallet.Regtest(), 2)
+	destinations := []destination{{address: addresses[0], amount: 3000}, {address: addresses[1], rest: true}}
+
+	hash, _ := chainhash.NewHashFromStr(strings.Repeat("aa", 32))
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, 1), nil, nil))
+
+	for i, amount := range []int64{3000, 6500} {
+		script, err := txscript.PayToAddrScript(addresses[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx.AddTxOut(wire.NewTxOut(amount, script))
+	}
+
+	sweep, err := newSweepEvent(tx, true, 500, destinations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := encodeEvent(t, sweep)
+
+	txBytes := new(bytes.Buffer)
+	if err := tx.Serialize(txBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"type":        "sweep",
+		"signed":      true,
+		"txHex":       hex.EncodeToString(txBytes.Bytes()),
+		"txid":        tx.TxHash().String(),
+		"vsize":       float64(getVirtualSize(tx)),
+		"amount":      9500.0,
+		"fee":         500.0,
+		"destination": addresses[0].String() + ":3000," + addresses[1].String() + ":rest",
+		"outputs": []interface{}{
+			map[string]interface{}{"address": addresses[0].String(), "amount": 3000.0},
+			map[string]interface{}{"address": addresses[1].String(), "amount": 6500.0},
+		},
+	}
+
+	if !reflect.DeepEqual(event, expected) {
+		t.Fatalf("expected %v, got %v", expected, event)
+	}
+
+	// The destination can be parsed back, to repeat the sweep:
+	parsed, err := parseDestinations(event["destination"].(string), libwallet.Regtest())
+	if err != nil || !reflect.DeepEqual(parsed, destinations) {
+		t.Fatalf("expected %+v, got %+v (%v)", destinations, parsed, err)
+	}
+}
+
+func TestAuditEventOrder(t *testing.T) {
+	first := &testAddress{libwallet.AddressVersionV4, "m/1'/1'/1/0", "first"}
+	second := &testAddress{libwallet.AddressVersionV4, "m/1'/1'/1/1", "second"}
+
+	usedAddresses := []*scanner.AddressActivity{
+		{
+			Address: first,
+			Transactions: []scanner.Transaction{
+				{TxID: "unconfirmed-b", Height: 0},
+				{TxID: "shared", Height: 120},
+				{TxID: "old", Height: 100},
+			},
+		},
+		{
+			Address: second,
+			Transactions: []scanner.Transaction{
+				{TxID: "shared", Height: 120},
+				{TxID: "unconfirmed-a", Height: -1}, // with an unconfirmed parent
+			},
+		},
+	}
+
+	event := newAuditEvent(usedAddresses)
+
+	var order []string
+	for _, tx := range event.Transactions {
+		order = append(order, tx.TxID)
+	}
+
+	// Confirmed transactions by height, and unconfirmed ones last:
+	expected := []string{"old", "shared", "unconfirmed-a", "unconfirmed-b"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected %v, got %v", expected, order)
+	}
+
+	shared := event.Transactions[1]
+	if len(shared.Addresses) != 2 || shared.Addresses[0].Address != "first" || shared.Addresses[1].Address != "second" {
+		t.Fatalf("expected the shared transaction to list both addresses, got %+v", shared.Addresses)
+	}
+
+	encoded := encodeEvent(t, event)
+	if encoded["type"] != "audit" || len(encoded["transactions"].([]interface{})) != 4 {
+		t.Fatalf("unexpected audit event %v", encoded)
+	}
+}
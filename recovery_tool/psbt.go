@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/muun/libwallet"
+	"github.com/muun/libwallet/addresses"
+	"github.com/muun/libwallet/hdpath"
+	"github.com/muun/libwallet/musig"
+	"github.com/muun/recovery/scanner"
+)
+
+// Input key types from BIP371 (taproot) and BIP373 (MuSig2), which the psbt package doesn't know
+// about. We add them as unknown key-value pairs.
+const (
+	psbtInTapBip32Derivation       = 0x16
+	psbtInTapInternalKey           = 0x17
+	psbtInMusig2ParticipantPubkeys = 0x1a
+)
+
+// BuildSweepPSBT creates an unsigned BIP174 PSBT for the sweep transaction, including the scripts
+// and key derivations needed for other software to sign it.
+func (s *Sweeper) BuildSweepPSBT(utxos []*scanner.Utxo, fee int64) (*psbt.Packet, error) {
+	rawTx, err := buildSweepTx(utxos, s.Destinations, fee)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := wire.NewMsgTx(0)
+	err = tx.Deserialize(bytes.NewReader(rawTx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode sweep tx: %w", err)
+	}
+
+	packet, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create psbt: %w", err)
+	}
+
+	for i, utxo := range utxos {
+		err := s.fillPSBTInput(&packet.Inputs[i], utxo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fill psbt input %d: %w", i, err)
+		}
+	}
+
+	err = packet.SanityCheck()
+	if err != nil {
+		return nil, fmt.Errorf("invalid psbt: %w", err)
+	}
+
+	return packet, nil
+}
+
+func (s *Sweeper) fillPSBTInput(pInput *psbt.PInput, utxo *scanner.Utxo) error {
+	path := utxo.Address.DerivationPath()
+
+	userKey, err := s.UserKey.DeriveTo(path)
+	if err != nil {
+		return fmt.Errorf("failed to derive user key: %w", err)
+	}
+
+	muunKey, err := s.MuunKey.DeriveTo(path)
+	if err != nil {
+		return fmt.Errorf("failed to derive muun key: %w", err)
+	}
+
+	userPublicKey := userKey.PublicKey()
+	muunPublicKey := muunKey.PublicKey()
+
+	userExtendedKey, err := hdkeychain.NewKeyFromString(userPublicKey.String())
+	if err != nil {
+		return err
+	}
+
+	muunExtendedKey, err := hdkeychain.NewKeyFromString(muunPublicKey.String())
+	if err != nil {
+		return err
+	}
+
+	userDerivation, err := newBip32Derivation(s.UserKey.PublicKey(), userPublicKey, path)
+	if err != nil {
+		return err
+	}
+
+	muunDerivation, err := newBip32Derivation(s.MuunKey.PublicKey(), muunPublicKey, path)
+	if err != nil {
+		return err
+	}
+
+	witnessUtxo := wire.NewTxOut(utxo.Amount, utxo.Script)
+
+	switch utxo.Address.Version() {
+	case libwallet.AddressVersionV2:
+		// Legacy inputs require the full previous transaction, not only the spent output:
+		prevTx, err := s.getTransaction(utxo.TxID)
+		if err != nil {
+			return err
+		}
+
+		redeemScript, err := addresses.CreateRedeemScriptV2(userExtendedKey, muunExtendedKey, s.Network.ToParams())
+		if err != nil {
+			return err
+		}
+
+		pInput.NonWitnessUtxo = prevTx
+		pInput.RedeemScript = redeemScript
+		pInput.Bip32Derivation = []*psbt.Bip32Derivation{userDerivation, muunDerivation}
+
+	case libwallet.AddressVersionV3:
+		redeemScript, err := addresses.CreateRedeemScriptV3(userExtendedKey, muunExtendedKey, s.Network.ToParams())
+		if err != nil {
+			return err
+		}
+
+		witnessScript, err := addresses.CreateWitnessScriptV3(userExtendedKey, muunExtendedKey, s.Network.ToParams())
+		if err != nil {
+			return err
+		}
+
+		pInput.WitnessUtxo = witnessUtxo
+		pInput.RedeemScript = redeemScript
+		pInput.WitnessScript = witnessScript
+		pInput.Bip32Derivation = []*psbt.Bip32Derivation{userDerivation, muunDerivation}
+
+	case libwallet.AddressVersionV4:
+		witnessScript, err := addresses.CreateWitnessScriptV4(userExtendedKey, muunExtendedKey, s.Network.ToParams())
+		if err != nil {
+			return err
+		}
+
+		pInput.WitnessUtxo = witnessUtxo
+		pInput.WitnessScript = witnessScript
+		pInput.Bip32Derivation = []*psbt.Bip32Derivation{userDerivation, muunDerivation}
+
+	case libwallet.AddressVersionV5:
+		unknowns, err := createTaprootUnknowns(userPublicKey, muunPublicKey, userDerivation, muunDerivation)
+		if err != nil {
+			return err
+		}
+
+		pInput.WitnessUtxo = witnessUtxo
+		pInput.Unknowns = unknowns
+
+	default:
+		return fmt.Errorf("unsupported address version %d", utxo.Address.Version())
+	}
+
+	return nil
+}
+
+// createTaprootUnknowns returns the BIP371 and BIP373 fields for a V5 input.
+//
+// NOTE:
+// V5 addresses aggregate x-only keys (following an early MuSig2 draft), so the aggregate and the
+// participant keys are encoded as compressed keys with even Y.
+func createTaprootUnknowns(
+	userKey, muunKey *libwallet.HDPublicKey,
+	userDerivation, muunDerivation *psbt.Bip32Derivation,
+) ([]*psbt.Unknown, error) {
+
+	userXOnly := userKey.Raw()[1:]
+	muunXOnly := muunKey.Raw()[1:]
+
+	userEvenKey := append([]byte{0x02}, userXOnly...)
+	muunEvenKey := append([]byte{0x02}, muunXOnly...)
+
+	userECKey, err := btcec.ParsePubKey(userKey.Raw(), btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+
+	muunECKey, err := btcec.ParsePubKey(muunKey.Raw(), btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+
+	internalKey, err := musig.CombinePubKeys(userECKey, muunECKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to combine keys: %w", err)
+	}
+
+	internalKeyBytes := internalKey.SerializeCompressed()
+
+	return []*psbt.Unknown{
+		{
+			Key:   append([]byte{psbtInTapBip32Derivation}, userXOnly...),
+			Value: serializeTapBip32Derivation(userDerivation),
+		},
+		{
+			Key:   append([]byte{psbtInTapBip32Derivation}, muunXOnly...),
+			Value: serializeTapBip32Derivation(muunDerivation),
+		},
+		{
+			Key:   []byte{psbtInTapInternalKey},
+			Value: internalKeyBytes[1:],
+		},
+		{
+			Key:   append([]byte{psbtInMusig2ParticipantPubkeys}, internalKeyBytes...),
+			Value: append(userEvenKey, muunEvenKey...),
+		},
+	}, nil
+}
+
+// serializeTapBip32Derivation encodes a key-path-only BIP371 derivation (with no leaf hashes).
+func serializeTapBip32Derivation(derivation *psbt.Bip32Derivation) []byte {
+	leafHashCount := []byte{0}
+
+	return append(
+		leafHashCount,
+		psbt.SerializeBIP32Derivation(derivation.MasterKeyFingerprint, derivation.Bip32Path)...,
+	)
+}
+
+// newBip32Derivation describes the derivation of a child key from a key in the Emergency Kit,
+// identified by its fingerprint. Signers match the fingerprint against the key they hold, so the
+// path starts at that key: the user key is already at m/1'/1', while the Muun key is at m.
+func newBip32Derivation(rootKey, childKey *libwallet.HDPublicKey, path string) (*psbt.Bip32Derivation, error) {
+	parsedPath, err := hdpath.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse derivation path %s: %w", path, err)
+	}
+
+	parsedRootPath, err := hdpath.Parse(rootKey.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse derivation path %s: %w", rootKey.Path, err)
+	}
+
+	indexes := parsedPath.Indexes()
+	rootIndexes := parsedRootPath.Indexes()
+
+	if len(indexes) < len(rootIndexes) {
+		return nil, fmt.Errorf("derivation path %s is not below %s", path, rootKey.Path)
+	}
+
+	for i, rootIndex := range rootIndexes {
+		if indexes[i].Index != rootIndex.Index || indexes[i].Hardened != rootIndex.Hardened {
+			return nil, fmt.Errorf("derivation path %s is not below %s", path, rootKey.Path)
+		}
+	}
+
+	var bip32Path []uint32
+	for _, pathIndex := range parsedPath.IndexesFrom(parsedRootPath) {
+		index := pathIndex.Index
+		if pathIndex.Hardened {
+			index += hdkeychain.HardenedKeyStart
+		}
+
+		bip32Path = append(bip32Path, index)
+	}
+
+	return &psbt.Bip32Derivation{
+		PubKey:               childKey.Raw(),
+		MasterKeyFingerprint: binary.LittleEndian.Uint32(rootKey.Fingerprint()),
+		Bip32Path:            bip32Path,
+	}, nil
+}
+
+// encodePSBT returns the base64 encoding of a PSBT, along with the hex of its unsigned transaction.
+func encodePSBT(packet *psbt.Packet) (string, string, error) {
+	encoded, err := packet.B64Encode()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode psbt: %w", err)
+	}
+
+	txBytes := new(bytes.Buffer)
+	err = packet.UnsignedTx.Serialize(txBytes)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode unsigned tx: %w", err)
+	}
+
+	return encoded, hex.EncodeToString(txBytes.Bytes()), nil
+}
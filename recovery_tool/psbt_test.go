@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/muun/libwallet"
+)
+
+func TestNewBip32Derivation(t *testing.T) {
+	network := libwallet.Regtest()
+
+	userRoot, _ := libwallet.NewHDPrivateKey([]byte("0123456789abcdef0123456789abcdef"), network)
+	muunKey, _ := libwallet.NewHDPrivateKey([]byte("fedcba9876543210fedcba9876543210"), network)
+
+	// The user key in the Emergency Kit is already at the base path, while the Muun key is a root:
+	userKey, err := userRoot.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const path = "m/1'/1'/1/3"
+
+	for _, key := range []*libwallet.HDPrivateKey{userKey, muunKey} {
+		childKey, err := key.DeriveTo(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		derivation, err := newBip32Derivation(key.PublicKey(), childKey.PublicKey(), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if derivation.MasterKeyFingerprint != binary.LittleEndian.Uint32(key.PublicKey().Fingerprint()) {
+			t.Fatalf("key at %s: the fingerprint doesn't match the key", key.Path)
+		}
+
+		// A signer holding the key gets the child key by following the path from it:
+		extendedKey, err := hdkeychain.NewKeyFromString(key.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, index := range derivation.Bip32Path {
+			extendedKey, err = extendedKey.Child(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pubKey, err := extendedKey.ECPubKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(pubKey.SerializeCompressed(), derivation.PubKey) {
+			t.Fatalf("key at %s: the path %v doesn't lead to the child key", key.Path, derivation.Bip32Path)
+		}
+	}
+
+	if _, err := newBip32Derivation(userKey.PublicKey(), userKey.PublicKey(), "m/2'/1'/1/3"); err == nil {
+		t.Fatal("expected an error for a path outside the key")
+	}
+}
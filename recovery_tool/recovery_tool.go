@@ -6,14 +6,17 @@ import (
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/btcsuite/btcutil"
 
 	"github.com/muun/libwallet"
 	"github.com/muun/libwallet/btcsuitew/txscriptw"
 	"github.com/muun/recovery/scanner"
 )
 
-func buildSweepTx(utxos []*scanner.Utxo, sweepAddress btcutil.Address, fee int64) ([]byte, error) {
+// rbfSequence is the input sequence number that signals the sweep can be replaced by one paying a
+// higher fee, as defined by BIP125.
+const rbfSequence = wire.MaxTxInSequenceNum - 2
+
+func buildSweepTx(utxos []*scanner.Utxo, destinations []destination, fee int64) ([]byte, error) {
 
 	tx := wire.NewMsgTx(2)
 	value := int64(0)
@@ -29,17 +32,25 @@ func buildSweepTx(utxos []*scanner.Utxo, sweepAddress btcutil.Address, fee int64
 			Index: uint32(utxo.OutputIndex),
 		}
 
-		tx.AddTxIn(wire.NewTxIn(&outpoint, []byte{}, [][]byte{}))
+		txIn := wire.NewTxIn(&outpoint, []byte{}, [][]byte{})
+		txIn.Sequence = rbfSequence
+
+		tx.AddTxIn(txIn)
 		value += utxo.Amount
 	}
 
-	value -= fee
-
-	script, err := txscriptw.PayToAddrScript(sweepAddress)
+	amounts, err := splitAmount(destinations, value-fee)
 	if err != nil {
 		return nil, err
 	}
-	tx.AddTxOut(wire.NewTxOut(value, script))
+
+	for i, dest := range destinations {
+		script, err := txscriptw.PayToAddrScript(dest.address)
+		if err != nil {
+			return nil, err
+		}
+		tx.AddTxOut(wire.NewTxOut(amounts[i], script))
+	}
 
 	writer := &bytes.Buffer{}
 	err = tx.Serialize(writer)
@@ -47,10 +58,6 @@ func buildSweepTx(utxos []*scanner.Utxo, sweepAddress btcutil.Address, fee int64
 		return nil, err
 	}
 
-	if fee != 0 {
-		readConfirmation(value, fee, sweepAddress.String())
-	}
-
 	return writer.Bytes(), nil
 }
 
@@ -0,0 +1,302 @@
+package scanner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/muun/libwallet"
+)
+
+const checkpointVersion = 1
+
+// Checkpoint persists the progress of a scan to a file, so that an interrupted scan can be resumed
+// without scanning completed batches again.
+//
+// Batches are identified by the range of derivation paths they cover. Since the AddressSource
+// decides how far to look based on the results, completed batches are replayed in full (used
+// addresses included) rather than just skipped.
+type Checkpoint struct {
+	path string
+	mu   sync.Mutex
+	data checkpointData
+}
+
+// checkpointData models the JSON document stored in the checkpoint file.
+type checkpointData struct {
+	Version int                         `json:"version"`
+	Wallet  string                      `json:"wallet"`
+	Server  string                      `json:"server"`
+	Batches map[string]*checkpointBatch `json:"batches"`
+}
+
+// checkpointBatch contains the results of a completed batch, and the server that provided them.
+type checkpointBatch struct {
+	Server       string                  `json:"server"`
+	Utxos        []checkpointUtxo        `json:"utxos"`
+	Activity     []checkpointActivity    `json:"activity"`
+	Disagreement *checkpointDisagreement `json:"disagreement,omitempty"`
+}
+
+type checkpointDisagreement struct {
+	Servers    []string            `json:"servers"`
+	Dissenters []string            `json:"dissenters"`
+	Missing    map[string][]string `json:"missing"`
+}
+
+type checkpointUtxo struct {
+	TxID         string       `json:"txid"`
+	Vout         int          `json:"vout"`
+	Amount       int64        `json:"amount"`
+	Address      string       `json:"address"`
+	Height       int          `json:"height,omitempty"`
+	Verification Verification `json:"verification,omitempty"`
+}
+
+type checkpointActivity struct {
+	Address      string         `json:"address"`
+	TxCount      int            `json:"txCount"`
+	FirstSeen    int            `json:"firstSeen"`
+	LastSeen     int            `json:"lastSeen"`
+	Transactions []checkpointTx `json:"transactions"`
+}
+
+type checkpointTx struct {
+	TxID   string `json:"txid"`
+	Height int    `json:"height"`
+}
+
+// NewCheckpoint creates an empty Checkpoint for a wallet, that will be saved to the given path.
+func NewCheckpoint(path string, wallet string) *Checkpoint {
+	return &Checkpoint{
+		path: path,
+		data: checkpointData{
+			Version: checkpointVersion,
+			Wallet:  wallet,
+			Batches: make(map[string]*checkpointBatch),
+		},
+	}
+}
+
+// LoadCheckpoint reads a Checkpoint saved by a previous scan of the same wallet. If the file
+// doesn't exist, the returned error wraps os.ErrNotExist.
+func LoadCheckpoint(path string, wallet string) (*Checkpoint, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	checkpoint := &Checkpoint{path: path}
+
+	err = json.Unmarshal(content, &checkpoint.data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint: %w", err)
+	}
+
+	if checkpoint.data.Version != checkpointVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version %d", checkpoint.data.Version)
+	}
+
+	if checkpoint.data.Wallet != wallet {
+		return nil, errors.New("the checkpoint was created for a different wallet or network")
+	}
+
+	if checkpoint.data.Batches == nil {
+		checkpoint.data.Batches = make(map[string]*checkpointBatch)
+	}
+
+	return checkpoint, nil
+}
+
+// CompletedBatches returns the number of batches recorded so far.
+func (c *Checkpoint) CompletedBatches() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.data.Batches)
+}
+
+// Remove deletes the checkpoint file, once it's no longer needed.
+func (c *Checkpoint) Remove() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := os.Remove(c.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// record adds the results of a completed batch, and saves the checkpoint.
+func (c *Checkpoint) record(result *scanTaskResult) error {
+	batch := &checkpointBatch{
+		Server:   result.Server,
+		Utxos:    make([]checkpointUtxo, len(result.Utxos)),
+		Activity: make([]checkpointActivity, len(result.Activity)),
+	}
+
+	for i, utxo := range result.Utxos {
+		batch.Utxos[i] = checkpointUtxo{
+			TxID:         utxo.TxID,
+			Vout:         utxo.OutputIndex,
+			Amount:       utxo.Amount,
+			Address:      utxo.Address.Address(),
+			Height:       utxo.Height,
+			Verification: utxo.Verification,
+		}
+	}
+
+	if result.Disagreement != nil {
+		batch.Disagreement = &checkpointDisagreement{
+			Servers:    result.Disagreement.Servers,
+			Dissenters: result.Disagreement.Dissenters,
+			Missing:    result.Disagreement.Missing,
+		}
+	}
+
+	for i, activity := range result.Activity {
+		batch.Activity[i] = checkpointActivity{
+			Address:      activity.Address.Address(),
+			TxCount:      activity.TxCount,
+			FirstSeen:    activity.FirstSeen,
+			LastSeen:     activity.LastSeen,
+			Transactions: make([]checkpointTx, len(activity.Transactions)),
+		}
+
+		for j, tx := range activity.Transactions {
+			batch.Activity[i].Transactions[j] = checkpointTx{TxID: tx.TxID, Height: tx.Height}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.data.Batches[getBatchKey(result.Task.addresses)] = batch
+	c.data.Server = result.Server
+
+	return c.save()
+}
+
+// restore re-creates the result of a batch completed in a previous scan, if it was recorded.
+func (c *Checkpoint) restore(
+	addresses []libwallet.MuunAddress,
+	network *libwallet.Network,
+) (*scanTaskResult, bool) {
+
+	c.mu.Lock()
+	batch, ok := c.data.Batches[getBatchKey(addresses)]
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	outputScripts, err := getOutputScripts(addresses, network)
+	if err != nil {
+		return nil, false
+	}
+
+	indexByAddress := make(map[string]int, len(addresses))
+	for i, address := range addresses {
+		indexByAddress[address.Address()] = i
+	}
+
+	result := &scanTaskResult{
+		Task:     &scanTask{addresses: addresses},
+		Server:   batch.Server,
+		Restored: true,
+	}
+
+	if batch.Disagreement != nil {
+		result.Disagreement = &Disagreement{
+			Addresses:  addresses,
+			Servers:    batch.Disagreement.Servers,
+			Dissenters: batch.Disagreement.Dissenters,
+			Missing:    batch.Disagreement.Missing,
+		}
+	}
+
+	for _, utxo := range batch.Utxos {
+		i, ok := indexByAddress[utxo.Address]
+		if !ok {
+			return nil, false // recorded for a different address set, scan it again
+		}
+
+		verification := utxo.Verification
+		if verification == "" {
+			verification = Unverified
+		}
+
+		result.Utxos = append(result.Utxos, &Utxo{
+			TxID:         utxo.TxID,
+			OutputIndex:  utxo.Vout,
+			Amount:       utxo.Amount,
+			Address:      addresses[i],
+			Script:       outputScripts[i],
+			Height:       utxo.Height,
+			Verification: verification,
+		})
+	}
+
+	for _, activity := range batch.Activity {
+		i, ok := indexByAddress[activity.Address]
+		if !ok {
+			return nil, false
+		}
+
+		restored := &AddressActivity{
+			Address:      addresses[i],
+			TxCount:      activity.TxCount,
+			FirstSeen:    activity.FirstSeen,
+			LastSeen:     activity.LastSeen,
+			Transactions: make([]Transaction, len(activity.Transactions)),
+		}
+
+		for j, tx := range activity.Transactions {
+			restored.Transactions[j] = Transaction{TxID: tx.TxID, Height: tx.Height}
+		}
+
+		result.Activity = append(result.Activity, restored)
+	}
+
+	return result, true
+}
+
+// save writes the checkpoint to a temporary file and moves it into place, so that an interruption
+// never leaves a corrupt file behind. The caller must hold the mutex.
+func (c *Checkpoint) save() error {
+	content, err := json.Marshal(&c.data)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+
+	tmpPath := c.path + ".tmp"
+
+	err = os.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	err = os.Rename(tmpPath, c.path)
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// getBatchKey identifies a batch by the derivation paths it covers.
+func getBatchKey(addresses []libwallet.MuunAddress) string {
+	if len(addresses) == 0 {
+		return ""
+	}
+
+	first := addresses[0].DerivationPath()
+	last := addresses[len(addresses)-1].DerivationPath()
+
+	return fmt.Sprintf("%s..%s#%d", first, last, len(addresses))
+}
@@ -0,0 +1,274 @@
+package scanner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/backend"
+)
+
+// consensusRetries is how many times a batch is queried again when the servers disagree, in case
+// some of them were lagging behind.
+const consensusRetries = 2
+
+// consensusRetryDelay is the wait before querying a batch again, to let lagging servers catch up.
+var consensusRetryDelay = 10 * time.Second
+
+// Disagreement describes a batch for which the servers of a consensus scan reported different
+// UTXOs, even after querying them again. The scan keeps every UTXO reported by any of them.
+type Disagreement struct {
+	Addresses  []libwallet.MuunAddress
+	Servers    []string            // every server queried
+	Dissenters []string            // the servers that differ from the majority, or all if there's none
+	Missing    map[string][]string // the UTXOs (as given by getUtxoKey) each server didn't report
+}
+
+// consensus picks the servers to query each batch on, from different operators.
+type consensus struct {
+	size      int
+	operators [][]backend.Replica // servers grouped by operator
+
+	mu   sync.Mutex
+	next int
+}
+
+// newConsensus groups the replicas of a backend by operator, and fails if there aren't enough
+// operators for the given size.
+func newConsensus(replicas []backend.Replica, size int) (*consensus, error) {
+	var operators [][]backend.Replica
+	indexByOperator := make(map[string]int)
+
+	for _, replica := range replicas {
+		i, ok := indexByOperator[replica.Operator]
+		if !ok {
+			i = len(operators)
+			indexByOperator[replica.Operator] = i
+			operators = append(operators, nil)
+		}
+
+		operators[i] = append(operators[i], replica)
+	}
+
+	if len(operators) < size {
+		return nil, fmt.Errorf(
+			"a consensus of %d needs servers from %d different operators, but there are only %d",
+			size, size, len(operators),
+		)
+	}
+
+	return &consensus{size: size, operators: operators}, nil
+}
+
+// pick returns servers of different operators. It rotates through the operators and their
+// servers, so batches are spread among all of them and retries go to different ones.
+func (c *consensus) pick() []backend.Replica {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	picked := make([]backend.Replica, c.size)
+
+	for i := range picked {
+		index := c.next + i
+		servers := c.operators[index%len(c.operators)]
+		picked[i] = servers[(index/len(c.operators))%len(servers)]
+	}
+
+	c.next += c.size
+
+	return picked
+}
+
+// tryExecuteConsensus scans the batch on servers of different operators, and queries it again on
+// the next servers if they disagree, so a single lagging server can't use up every retry. If they
+// still do, the result records the disagreement.
+func (t *scanTask) tryExecuteConsensus(outputScripts [][]byte) *scanTaskResult {
+	for attempt := 0; ; attempt++ {
+		results := t.queryReplicas(t.consensus.pick(), outputScripts)
+
+		for _, result := range results {
+			if result.Err != nil {
+				return result // retry the task, with other servers
+			}
+		}
+
+		disagreement := compareResults(t.addresses, results)
+
+		if disagreement == nil || attempt == consensusRetries {
+			merged := t.mergeResults(results)
+			merged.Disagreement = disagreement
+
+			return merged
+		}
+
+		t.log.Printf("Servers disagree on a batch, querying again: %s", strings.Join(disagreement.Dissenters, ", "))
+
+		select {
+		case <-t.exit:
+			return t.exitResult()
+
+		case <-time.After(consensusRetryDelay):
+		}
+	}
+}
+
+// queryReplicas scans the batch on every server at once.
+func (t *scanTask) queryReplicas(replicas []backend.Replica, outputScripts [][]byte) []*scanTaskResult {
+	results := make([]*scanTaskResult, len(replicas))
+
+	var wg sync.WaitGroup
+
+	for i, replica := range replicas {
+		wg.Add(1)
+
+		go func(i int, replica backend.Replica) {
+			defer wg.Done()
+
+			results[i] = t.query(replica, outputScripts)
+			if results[i].Err != nil {
+				results[i].Err = fmt.Errorf("%s failed: %w", replica.Name(), results[i].Err)
+			}
+		}(i, replica)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// compareResults returns the differences between the UTXOs servers reported, or nil if they all
+// agree.
+func compareResults(addresses []libwallet.MuunAddress, results []*scanTaskResult) *Disagreement {
+	sets := make([]map[string]bool, len(results))
+	union := make(map[string]bool)
+	votes := make(map[string]int)
+	signatures := make([]string, len(results))
+
+	for i, result := range results {
+		sets[i] = make(map[string]bool)
+
+		for _, utxo := range result.Utxos {
+			key := getUtxoKey(utxo)
+			sets[i][key] = true
+			union[key] = true
+		}
+
+		signatures[i] = getSetSignature(sets[i])
+		votes[signatures[i]]++
+	}
+
+	if len(votes) == 1 {
+		return nil
+	}
+
+	var majority string
+	var hasMajority bool
+
+	for signature, count := range votes {
+		if count*2 > len(results) {
+			majority, hasMajority = signature, true
+		}
+	}
+
+	disagreement := &Disagreement{
+		Addresses: addresses,
+		Missing:   make(map[string][]string),
+	}
+
+	for i, result := range results {
+		disagreement.Servers = append(disagreement.Servers, result.Server)
+
+		if !hasMajority || signatures[i] != majority {
+			disagreement.Dissenters = append(disagreement.Dissenters, result.Server)
+		}
+
+		for key := range union {
+			if !sets[i][key] {
+				disagreement.Missing[result.Server] = append(disagreement.Missing[result.Server], key)
+			}
+		}
+
+		sort.Strings(disagreement.Missing[result.Server])
+	}
+
+	return disagreement
+}
+
+// mergeResults combines the results of several servers, keeping every UTXO and used address
+// reported by any of them. When servers report an output with different amounts or heights, the
+// copy reported by most of them is kept.
+func (t *scanTask) mergeResults(results []*scanTaskResult) *scanTaskResult {
+	var utxos []*Utxo
+	var activity []*AddressActivity
+	var servers []string
+
+	votes := make(map[string]int)
+	for _, result := range results {
+		for _, utxo := range result.Utxos {
+			votes[getUtxoKey(utxo)]++
+		}
+	}
+
+	utxoByOutpoint := make(map[string]int)
+	activityByAddress := make(map[string]int)
+
+	for _, result := range results {
+		servers = append(servers, result.Server)
+
+		for _, utxo := range result.Utxos {
+			outpoint := fmt.Sprintf("%s:%d", utxo.TxID, utxo.OutputIndex)
+
+			i, ok := utxoByOutpoint[outpoint]
+			if !ok {
+				utxoByOutpoint[outpoint] = len(utxos)
+				utxos = append(utxos, utxo)
+			} else if votes[getUtxoKey(utxo)] > votes[getUtxoKey(utxos[i])] {
+				utxos[i] = utxo
+			}
+		}
+
+		// Keep the longest history of every address:
+		for _, addressActivity := range result.Activity {
+			address := addressActivity.Address.Address()
+
+			i, ok := activityByAddress[address]
+			if !ok {
+				activityByAddress[address] = len(activity)
+				activity = append(activity, addressActivity)
+			} else if addressActivity.TxCount > activity[i].TxCount {
+				activity[i] = addressActivity
+			}
+		}
+	}
+
+	result := t.successResult(utxos, activity)
+	result.Server = strings.Join(servers, ", ")
+
+	return result
+}
+
+// getUtxoKey identifies a UTXO with its amount and height, so servers that report the same output
+// differently disagree. Unconfirmed heights are all the same.
+func getUtxoKey(utxo *Utxo) string {
+	height := utxo.Height
+	if height < 0 {
+		height = 0
+	}
+
+	return fmt.Sprintf("%s:%d (%d sats, height %d)", utxo.TxID, utxo.OutputIndex, utxo.Amount, height)
+}
+
+// getSetSignature identifies a set of UTXO keys, so equal sets have equal signatures.
+func getSetSignature(set map[string]bool) string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,230 @@
+package scanner
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/backend"
+)
+
+// fakeServers is a backend with several servers, each a fakeBackend.
+type fakeServers struct {
+	fakeBackend
+	replicas []backend.Replica
+}
+
+func (s *fakeServers) Replicas() []backend.Replica {
+	return s.replicas
+}
+
+func TestScanWithConsensus(t *testing.T) {
+	consensusRetryDelay = 0
+
+	network := libwallet.Regtest()
+	addresses := createTestAddresses(t, network, 6)
+
+	scripts, err := getOutputScripts(addresses, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unspents := map[string][]backend.Unspent{
+		hex.EncodeToString(scripts[4]): {{TxID: "bb", Vout: 1, Amount: 5000, Height: 120}},
+	}
+
+	history := map[string][]backend.HistoryItem{
+		hex.EncodeToString(scripts[4]): {{TxID: "bb", Height: 120}},
+	}
+
+	honest1 := &fakeBackend{name: "honest1", unspents: unspents, history: history}
+	honest2 := &fakeBackend{name: "honest2", unspents: unspents, history: history}
+	liar := &fakeBackend{name: "liar"}
+
+	servers := &fakeServers{replicas: []backend.Replica{
+		{Backend: honest1, Operator: "a"},
+		{Backend: honest2, Operator: "b"},
+		{Backend: liar, Operator: "c"},
+	}}
+
+	scanner := NewScanner(servers, network, nil)
+
+	err = scanner.UseConsensus(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeSource{batches: [][]libwallet.MuunAddress{addresses[:3], addresses[3:]}}
+
+	report := scanAll(scanner, source)
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+
+	if report.Consensus != 3 || report.ScannedBatches != 2 {
+		t.Errorf("expected 2 batches scanned on 3 servers, got %d on %d", report.ScannedBatches, report.Consensus)
+	}
+
+	if len(report.UtxosFound) != 1 || report.UtxosFound[0].TxID != "bb" {
+		t.Fatalf("expected the utxo reported by some servers to be kept, got %+v", report.UtxosFound)
+	}
+
+	if len(report.Disagreements) != 1 {
+		t.Fatalf("expected 1 disagreement, got %d", len(report.Disagreements))
+	}
+
+	disagreement := report.Disagreements[0]
+
+	if !reflect.DeepEqual(disagreement.Dissenters, []string{"liar"}) {
+		t.Errorf("expected the liar to dissent, got %v", disagreement.Dissenters)
+	}
+
+	if !reflect.DeepEqual(disagreement.Missing, map[string][]string{"liar": {"bb:1 (5000 sats, height 120)"}}) {
+		t.Errorf("unexpected missing utxos %v", disagreement.Missing)
+	}
+
+	// Once for the batch they agree on, and once more for every retry of the other:
+	if liar.calls != 2+consensusRetries {
+		t.Errorf("expected the liar to be queried %d times, got %d", 2+consensusRetries, liar.calls)
+	}
+}
+
+func TestConsensusComparesAmounts(t *testing.T) {
+	consensusRetryDelay = 0
+
+	network := libwallet.Regtest()
+	addresses := createTestAddresses(t, network, 3)
+
+	scripts, err := getOutputScripts(addresses, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newServer := func(name string, amount int64) *fakeBackend {
+		return &fakeBackend{
+			name: name,
+			unspents: map[string][]backend.Unspent{
+				hex.EncodeToString(scripts[1]): {{TxID: "bb", Vout: 1, Amount: amount, Height: 120}},
+			},
+			history: map[string][]backend.HistoryItem{
+				hex.EncodeToString(scripts[1]): {{TxID: "bb", Height: 120}},
+			},
+		}
+	}
+
+	// The same output, with a made up amount:
+	servers := &fakeServers{replicas: []backend.Replica{
+		{Backend: newServer("liar", 500000), Operator: "a"},
+		{Backend: newServer("honest1", 5000), Operator: "b"},
+		{Backend: newServer("honest2", 5000), Operator: "c"},
+	}}
+
+	scanner := NewScanner(servers, network, nil)
+
+	err = scanner.UseConsensus(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := scanAll(scanner, &fakeSource{batches: [][]libwallet.MuunAddress{addresses}})
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+
+	if len(report.UtxosFound) != 1 || report.UtxosFound[0].Amount != 5000 {
+		t.Fatalf("expected a single utxo with the amount most servers agree on, got %+v", report.UtxosFound)
+	}
+
+	if len(report.Disagreements) != 1 || !reflect.DeepEqual(report.Disagreements[0].Dissenters, []string{"liar"}) {
+		t.Fatalf("expected the liar to dissent, got %+v", report.Disagreements)
+	}
+}
+
+func TestConsensusRetriesOnOtherServers(t *testing.T) {
+	consensusRetryDelay = 0
+
+	network := libwallet.Regtest()
+	addresses := createTestAddresses(t, network, 3)
+
+	scripts, err := getOutputScripts(addresses, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unspents := map[string][]backend.Unspent{
+		hex.EncodeToString(scripts[1]): {{TxID: "bb", Vout: 1, Amount: 5000, Height: 120}},
+	}
+
+	history := map[string][]backend.HistoryItem{
+		hex.EncodeToString(scripts[1]): {{TxID: "bb", Height: 120}},
+	}
+
+	lagging := &fakeBackend{name: "lagging"}
+
+	// The lagging server is picked first, and replaced by another of the same operator on retry:
+	servers := &fakeServers{replicas: []backend.Replica{
+		{Backend: &fakeBackend{name: "a", unspents: unspents, history: history}, Operator: "a"},
+		{Backend: &fakeBackend{name: "b", unspents: unspents, history: history}, Operator: "b"},
+		{Backend: lagging, Operator: "c"},
+		{Backend: &fakeBackend{name: "c2", unspents: unspents, history: history}, Operator: "c"},
+	}}
+
+	scanner := NewScanner(servers, network, nil)
+
+	err = scanner.UseConsensus(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := scanAll(scanner, &fakeSource{batches: [][]libwallet.MuunAddress{addresses}})
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+
+	if len(report.Disagreements) != 0 || len(report.UtxosFound) != 1 {
+		t.Fatalf("expected the retry to agree, got %+v and %d utxos", report.Disagreements, len(report.UtxosFound))
+	}
+
+	if lagging.calls != 1 {
+		t.Errorf("expected the lagging server to be queried once, got %d", lagging.calls)
+	}
+}
+
+func TestConsensusPicksDifferentOperators(t *testing.T) {
+	replicas := []backend.Replica{
+		{Backend: &fakeBackend{name: "a1"}, Operator: "a"},
+		{Backend: &fakeBackend{name: "a2"}, Operator: "a"},
+		{Backend: &fakeBackend{name: "b1"}, Operator: "b"},
+	}
+
+	_, err := newConsensus(replicas, 3)
+	if err == nil {
+		t.Fatal("expected an error with 2 operators for a consensus of 3")
+	}
+
+	consensus, err := newConsensus(replicas, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var picks [][]string
+	for i := 0; i < 2; i++ {
+		var names []string
+		for _, replica := range consensus.pick() {
+			names = append(names, replica.Name())
+		}
+
+		picks = append(picks, names)
+	}
+
+	expected := [][]string{{"a1", "b1"}, {"a2", "b1"}}
+	if !reflect.DeepEqual(picks, expected) {
+		t.Errorf("expected picks %v, got %v", expected, picks)
+	}
+
+	err = NewScanner(&fakeBackend{}, libwallet.Regtest(), nil).UseConsensus(2)
+	if err == nil {
+		t.Error("expected an error for a backend with a single server")
+	}
+}
@@ -0,0 +1,76 @@
+package scanner
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/electrum/electrumtest"
+)
+
+func TestScanWithElectrum(t *testing.T) {
+	network := libwallet.Regtest()
+	addresses := createTestAddresses(t, network, 6)
+
+	scripts, err := getOutputScripts(addresses, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := electrumtest.NewChain(&chaincfg.RegressionNetParams)
+
+	confirmed := []string{
+		chain.Fund(scripts[1], 10000).TxHash().String(),
+		chain.Fund(scripts[4], 20000).TxHash().String(),
+	}
+	chain.Mine()
+	chain.Mine()
+
+	unconfirmed := chain.Fund(scripts[5], 3000).TxHash().String()
+
+	// Every batch fails once, and a server on another network is skipped:
+	server := electrumtest.NewTLSServer(t, chain)
+	server.Fail("blockchain.scripthash.listunspent", electrumtest.EOF, 2)
+
+	otherNetwork := electrumtest.NewTLSServer(t, chain)
+	otherNetwork.Fail("server.features", electrumtest.WrongGenesis, 0)
+
+	electrum := backend.NewElectrum(
+		[]string{otherNetwork.Address, server.Address}, true, chain.GenesisHash(), nil, nil,
+	)
+
+	source := &fakeSource{batches: [][]libwallet.MuunAddress{addresses[:3], addresses[3:]}}
+
+	report := scanAll(NewScanner(electrum, network, nil), source)
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+
+	if len(report.UtxosFound) != 3 {
+		t.Fatalf("expected 3 utxos, got %+v", report.UtxosFound)
+	}
+
+	verifications := make(map[string]Verification)
+	for _, utxo := range report.UtxosFound {
+		verifications[utxo.TxID] = utxo.Verification
+	}
+
+	for _, txID := range confirmed {
+		if verifications[txID] != Verified {
+			t.Errorf("expected confirmed %s to be verified, got %q", txID, verifications[txID])
+		}
+	}
+
+	if verifications[unconfirmed] != Unverified {
+		t.Errorf("expected unconfirmed %s to be unverified, got %q", unconfirmed, verifications[unconfirmed])
+	}
+
+	if len(source.used) != 3 {
+		t.Errorf("expected the source to learn about 3 used addresses, got %v", source.used)
+	}
+
+	if server.Requests("blockchain.scripthash.listunspent") == 0 || otherNetwork.Requests("blockchain.scripthash.listunspent") != 0 {
+		t.Error("expected to scan only on the server of the right network")
+	}
+}
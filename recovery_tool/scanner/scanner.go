@@ -1,63 +1,122 @@
 package scanner
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/muun/libwallet"
-	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/spv"
 	"github.com/muun/recovery/utils"
 )
 
 const taskTimeout = 15 * time.Minute
-const batchSize = 100
+const maxConcurrentTasks = 6
 
-// Scanner finds unspent outputs and their transactions when given a map of addresses.
+// Scanner finds unspent outputs and their transactions when given a source of addresses.
 //
-// It implements multi-server support, batching feature detection and use, concurrency control,
-// timeouts and cancellations, and provides a channel-based interface.
+// It implements concurrency control, retries, timeouts and cancellations, and provides a
+// channel-based interface.
 //
-// Servers are provided by a ServerProvider instance, and rotated when unreachable or faulty. We
-// trust ServerProvider to prioritize good targets.
+// Blockchain data comes from a backend.Backend, which manages its own connections (rotating
+// servers when unreachable or faulty, for Electrum). Batches are created by the AddressSource,
+// which is told about used addresses as results come in, and decides how far to look.
 //
-// Batching is leveraged when supported by a particular server, falling back to sequential requests
-// for single addresses (which is much slower, but can get us out of trouble when better servers are
-// not available).
+// Progress can be saved to a Checkpoint, so that batches completed before a failure are not scanned
+// again when resuming.
 //
 // Timeouts and cancellations are an internal affair, not configurable by callers. See taskTimeout
 // declared above.
 //
-// Concurrency control works by using an electrum.Pool, limiting access to clients, and not an
-// internal worker pool. This is the Go way (limiting access to resources rather than having a fixed
-// number of parallel goroutines), and (more to the point) semantically correct. We don't care
-// about the number of concurrent workers, what we want to avoid is too many connections to
-// Electrum servers.
+// Concurrency control works by limiting the number of tasks in flight, and not with an internal
+// worker pool. Backends can limit access to their own resources further (the Electrum backend has
+// a pool of clients).
 type Scanner struct {
-	pool    *electrum.Pool
-	servers *electrum.ServerProvider
-	log     *utils.Logger
+	backend    backend.Backend
+	tasks      chan struct{}
+	network    *libwallet.Network
+	checkpoint *Checkpoint
+	verifier   *spv.Verifier
+	consensus  *consensus
+	log        *utils.Logger
 }
 
-// Report contains information about an ongoing scan.
+// AddressSource provides the addresses for a Scanner, and learns which ones were used so it can
+// decide whether to keep looking.
+type AddressSource interface {
+	// Batches returns a channel of address groups to scan together, closed when there are no more.
+	// Batches should be small enough for a single Electrum request.
+	Batches() <-chan []libwallet.MuunAddress
+
+	// MarkScanned is called once for every batch, with the subset of its addresses that were used.
+	MarkScanned(batch []libwallet.MuunAddress, used []libwallet.MuunAddress)
+
+	// HighWaterMarks returns the highest used index of every branch scanned so far, or -1 for
+	// branches with no used addresses.
+	HighWaterMarks() map[string]int
+}
+
+// Report contains information about an ongoing scan. In a consensus scan, Consensus is the amount
+// of servers each batch is compared on, and Disagreements lists the batches where they differed.
 type Report struct {
 	ScannedAddresses int
+	ScannedBatches   int
 	UtxosFound       []*Utxo
+	UsedAddresses    []*AddressActivity
+	HighWaterMarks   map[string]int
+	Consensus        int
+	Disagreements    []*Disagreement
 	Err              error
 }
 
-// Utxo references a transaction output, plus the associated MuunAddress and script.
+// AddressActivity summarizes the history of an address with at least one transaction, which may
+// have been emptied since.
+type AddressActivity struct {
+	Address      libwallet.MuunAddress
+	TxCount      int
+	FirstSeen    int // lowest confirmation height, 0 if all transactions are unconfirmed
+	LastSeen     int // highest confirmation height, 0 if all transactions are unconfirmed
+	Transactions []Transaction
+}
+
+// Transaction references a transaction in the history of an address. Height is 0 or less for
+// unconfirmed transactions.
+type Transaction struct {
+	TxID   string
+	Height int
+}
+
+// Utxo references a transaction output, plus the associated MuunAddress and script. Height is 0
+// or less while unconfirmed.
 type Utxo struct {
-	TxID        string
-	OutputIndex int
-	Amount      int64
-	Address     libwallet.MuunAddress
-	Script      []byte
+	TxID         string
+	OutputIndex  int
+	Amount       int64
+	Address      libwallet.MuunAddress
+	Script       []byte
+	Height       int
+	Verification Verification
 }
 
+// Verification is the outcome of checking a Utxo against the block headers (SPV).
+type Verification string
+
+const (
+	// Unverified UTXOs are unconfirmed, or come from a backend that can't prove them.
+	Unverified Verification = "unverified"
+
+	// Verified UTXOs are proven to be mined in a block of a chain with valid proof of work.
+	Verified Verification = "verified"
+
+	// Invalid UTXOs failed verification, the server lied about them.
+	Invalid Verification = "invalid"
+)
+
 // scanContext contains the synchronization objects for a single Scanner round, to manage Tasks.
 type scanContext struct {
 	// Task management:
-	addresses   chan libwallet.MuunAddress
+	source      AddressSource
 	results     chan *scanTaskResult
 	stopScan    chan struct{}
 	stopCollect chan struct{}
@@ -68,22 +127,53 @@ type scanContext struct {
 	reportCache *Report
 }
 
-// NewScanner creates an initialized Scanner.
-func NewScanner(connectionPool *electrum.Pool, electrumProvider *electrum.ServerProvider) *Scanner {
+// NewScanner creates an initialized Scanner, for addresses in the given network. The checkpoint
+// is optional. Confirmed UTXOs are verified if the backend serves block headers.
+func NewScanner(
+	backend backend.Backend,
+	network *libwallet.Network,
+	checkpoint *Checkpoint,
+) *Scanner {
+	var verifier *spv.Verifier
+	if source, ok := backend.(spv.Source); ok {
+		verifier = spv.NewVerifier(source, network.ToParams())
+	}
+
 	return &Scanner{
-		pool:    connectionPool,
-		servers: electrumProvider,
-		log:     utils.NewLogger("Scanner"),
+		backend:    backend,
+		tasks:      make(chan struct{}, maxConcurrentTasks),
+		network:    network,
+		checkpoint: checkpoint,
+		verifier:   verifier,
+		log:        utils.NewLogger("Scanner"),
+	}
+}
+
+// UseConsensus makes the scanner query every batch on servers of size different operators, and
+// compare their results. It fails if the backend has a single server, or not enough operators.
+func (s *Scanner) UseConsensus(size int) error {
+	replicable, ok := s.backend.(backend.Replicable)
+	if !ok {
+		return fmt.Errorf("a consensus needs several servers, but %s has one", s.backend.Name())
 	}
+
+	consensus, err := newConsensus(replicable.Replicas(), size)
+	if err != nil {
+		return err
+	}
+
+	s.consensus = consensus
+
+	return nil
 }
 
 // Scan an address space and return all relevant transactions for a sweep.
-func (s *Scanner) Scan(addresses chan libwallet.MuunAddress) <-chan *Report {
+func (s *Scanner) Scan(source AddressSource) <-chan *Report {
 	var waitGroup sync.WaitGroup
 
 	// Create the Context that goroutines will share:
 	ctx := &scanContext{
-		addresses:   addresses,
+		source:      source,
 		results:     make(chan *scanTaskResult),
 		stopScan:    make(chan struct{}),
 		stopCollect: make(chan struct{}),
@@ -93,9 +183,14 @@ func (s *Scanner) Scan(addresses chan libwallet.MuunAddress) <-chan *Report {
 		reportCache: &Report{
 			ScannedAddresses: 0,
 			UtxosFound:       []*Utxo{},
+			UsedAddresses:    []*AddressActivity{},
 		},
 	}
 
+	if s.consensus != nil {
+		ctx.reportCache.Consensus = s.consensus.size
+	}
+
 	// Start the scan in background:
 	go s.startCollect(ctx)
 	go s.startScan(ctx)
@@ -122,8 +217,26 @@ func (s *Scanner) startCollect(ctx *scanContext) {
 				return
 			}
 
+			if s.checkpoint != nil && !result.Restored {
+				err := s.checkpoint.record(result)
+				if err != nil {
+					s.log.Printf("Failed to save checkpoint: %v", err) // the scan can go on without it
+				}
+			}
+
+			// Let the source know before reporting, so it can extend the scan if needed:
+			ctx.source.MarkScanned(result.Task.addresses, getUsedAddresses(result))
+
 			ctx.reportCache.ScannedAddresses += len(result.Task.addresses)
+			ctx.reportCache.ScannedBatches++
 			ctx.reportCache.UtxosFound = append(ctx.reportCache.UtxosFound, result.Utxos...)
+			ctx.reportCache.UsedAddresses = append(ctx.reportCache.UsedAddresses, result.Activity...)
+			ctx.reportCache.HighWaterMarks = ctx.source.HighWaterMarks()
+
+			if result.Disagreement != nil {
+				ctx.reportCache.Disagreements = append(ctx.reportCache.Disagreements, result.Disagreement)
+			}
+
 			ctx.reports <- ctx.reportCache
 
 		case <-ctx.stopCollect:
@@ -136,27 +249,39 @@ func (s *Scanner) startCollect(ctx *scanContext) {
 func (s *Scanner) startScan(ctx *scanContext) {
 	s.log.Printf("Scan started")
 
-	batches := streamBatches(ctx.addresses)
-
-	var client *electrum.Client
+	batches := ctx.source.Batches()
 
 	for batch := range batches {
-		// Stop the loop until a client becomes available, or the scan is canceled:
+		// Batches completed in a previous scan are replayed from the checkpoint:
+		if s.checkpoint != nil {
+			if result, ok := s.checkpoint.restore(batch, s.network); ok {
+				select {
+				case <-ctx.stopScan:
+					return
+
+				case ctx.results <- result:
+				}
+
+				continue
+			}
+		}
+
+		// Stop the loop until a task slot becomes available, or the scan is canceled:
 		select {
 		case <-ctx.stopScan:
 			return
 
-		case client = <-s.pool.Acquire():
+		case s.tasks <- struct{}{}:
 		}
 
 		// Start scanning this address in background:
 		ctx.wg.Add(1)
 
 		go func(batch []libwallet.MuunAddress) {
-			defer s.pool.Release(client)
+			defer func() { <-s.tasks }()
 			defer ctx.wg.Done()
 
-			s.scanBatch(ctx, client, batch)
+			s.scanBatch(ctx, batch)
 		}(batch)
 	}
 
@@ -168,50 +293,29 @@ func (s *Scanner) startScan(ctx *scanContext) {
 	close(ctx.stopCollect)
 }
 
-func (s *Scanner) scanBatch(ctx *scanContext, client *electrum.Client, batch []libwallet.MuunAddress) {
-	// NOTE:
-	// We begin by building the task, passing our selected Client. Since we're choosing the instance,
-	// it's our job to control acquisition and release of Clients to prevent sharing (remember,
-	// clients are single-user). The task won't enforce this safety measure (it can't), it's fully
-	// up to us.
+func (s *Scanner) scanBatch(ctx *scanContext, batch []libwallet.MuunAddress) {
 	task := &scanTask{
-		servers:   s.servers,
-		client:    client,
+		backend:   s.backend,
 		addresses: batch,
+		network:   s.network,
+		verifier:  s.verifier,
+		consensus: s.consensus,
 		timeout:   taskTimeout,
 		exit:      ctx.stopCollect,
+		log:       s.log,
 	}
 
 	// Do the thing and send back the result:
 	ctx.results <- task.Execute()
 }
 
-func streamBatches(addresses chan libwallet.MuunAddress) chan []libwallet.MuunAddress {
-	batches := make(chan []libwallet.MuunAddress)
-
-	go func() {
-		var nextBatch []libwallet.MuunAddress
-
-		for address := range addresses {
-			// Add items to the batch until we reach the limit:
-			nextBatch = append(nextBatch, address)
-
-			if len(nextBatch) < batchSize {
-				continue
-			}
+// getUsedAddresses returns the addresses of a successful task that have any history.
+func getUsedAddresses(result *scanTaskResult) []libwallet.MuunAddress {
+	used := make([]libwallet.MuunAddress, len(result.Activity))
 
-			// Send back the batch and start over:
-			batches <- nextBatch
-			nextBatch = []libwallet.MuunAddress{}
-		}
-
-		// Send back an incomplete batch with any remaining addresses:
-		if len(nextBatch) > 0 {
-			batches <- nextBatch
-		}
-
-		close(batches)
-	}()
+	for i, activity := range result.Activity {
+		used[i] = activity.Address
+	}
 
-	return batches
+	return used
 }
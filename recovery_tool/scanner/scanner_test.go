@@ -0,0 +1,253 @@
+package scanner
+
+import (
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/backend"
+)
+
+// fakeBackend serves unspent outputs and history from memory, keyed by hex-encoded script.
+type fakeBackend struct {
+	name     string
+	mu       sync.Mutex
+	unspents map[string][]backend.Unspent
+	history  map[string][]backend.HistoryItem
+	calls    int
+	fail     bool
+}
+
+func (b *fakeBackend) Name() string {
+	if b.name != "" {
+		return b.name
+	}
+
+	return "fake"
+}
+
+func (b *fakeBackend) ListUnspent(scripts [][]byte) ([][]backend.Unspent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls++
+	if b.fail {
+		return nil, errors.New("fake failure")
+	}
+
+	result := make([][]backend.Unspent, len(scripts))
+	for i, script := range scripts {
+		result[i] = b.unspents[hex.EncodeToString(script)]
+	}
+
+	return result, nil
+}
+
+func (b *fakeBackend) GetHistory(scripts [][]byte) ([][]backend.HistoryItem, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	result := make([][]backend.HistoryItem, len(scripts))
+	for i, script := range scripts {
+		result[i] = b.history[hex.EncodeToString(script)]
+	}
+
+	return result, nil
+}
+
+func (b *fakeBackend) GetTransaction(txID string) (*wire.MsgTx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (b *fakeBackend) Broadcast(tx *wire.MsgTx) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (b *fakeBackend) EstimateFee(targetBlocks int) (float64, error) {
+	return 0, errors.New("not implemented")
+}
+
+// fakeSource emits fixed batches, and records the used addresses it's told about.
+type fakeSource struct {
+	batches [][]libwallet.MuunAddress
+
+	mu   sync.Mutex
+	used []string
+}
+
+func (s *fakeSource) Batches() <-chan []libwallet.MuunAddress {
+	ch := make(chan []libwallet.MuunAddress, len(s.batches))
+	for _, batch := range s.batches {
+		ch <- batch
+	}
+	close(ch)
+
+	return ch
+}
+
+func (s *fakeSource) MarkScanned(batch []libwallet.MuunAddress, used []libwallet.MuunAddress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, address := range used {
+		s.used = append(s.used, address.Address())
+	}
+}
+
+func (s *fakeSource) HighWaterMarks() map[string]int {
+	return map[string]int{}
+}
+
+func createTestAddresses(t *testing.T, network *libwallet.Network, count int) []libwallet.MuunAddress {
+	userKey, _ := libwallet.NewHDPrivateKey([]byte("0123456789abcdef0123456789abcdef"), network)
+	muunKey, _ := libwallet.NewHDPrivateKey([]byte("fedcba9876543210fedcba9876543210"), network)
+
+	var addresses []libwallet.MuunAddress
+
+	for i := 0; i < count; i++ {
+		derivedUserKey, _ := userKey.PublicKey().DerivedAt(int64(i))
+		derivedMuunKey, _ := muunKey.PublicKey().DerivedAt(int64(i))
+
+		address, err := libwallet.CreateAddressV4(derivedUserKey, derivedMuunKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addresses = append(addresses, address)
+	}
+
+	return addresses
+}
+
+func scanAll(scanner *Scanner, source AddressSource) *Report {
+	var lastReport *Report
+	for lastReport = range scanner.Scan(source) {
+	}
+
+	return lastReport
+}
+
+func TestScan(t *testing.T) {
+	network := libwallet.Regtest()
+	addresses := createTestAddresses(t, network, 6)
+
+	scripts, err := getOutputScripts(addresses, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeBackend{
+		unspents: map[string][]backend.Unspent{
+			hex.EncodeToString(scripts[4]): {{TxID: "bb", Vout: 1, Amount: 5000, Height: 120}},
+		},
+		history: map[string][]backend.HistoryItem{
+			hex.EncodeToString(scripts[1]): {{TxID: "aa", Height: 100}, {TxID: "cc", Height: 130}},
+			hex.EncodeToString(scripts[4]): {{TxID: "bb", Height: 120}},
+		},
+	}
+
+	source := &fakeSource{batches: [][]libwallet.MuunAddress{addresses[:3], addresses[3:]}}
+
+	report := scanAll(NewScanner(fake, network, nil), source)
+
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+
+	if report.ScannedAddresses != 6 {
+		t.Errorf("expected 6 scanned addresses, got %d", report.ScannedAddresses)
+	}
+
+	if len(report.UtxosFound) != 1 || report.UtxosFound[0].Amount != 5000 {
+		t.Fatalf("unexpected utxos %+v", report.UtxosFound)
+	}
+
+	if report.UtxosFound[0].Address.Address() != addresses[4].Address() {
+		t.Errorf("utxo has address %s, expected %s", report.UtxosFound[0].Address.Address(), addresses[4].Address())
+	}
+
+	if len(report.UsedAddresses) != 2 {
+		t.Fatalf("expected 2 used addresses, got %d", len(report.UsedAddresses))
+	}
+
+	for _, activity := range report.UsedAddresses {
+		if activity.Address.Address() != addresses[1].Address() {
+			continue
+		}
+
+		if activity.TxCount != 2 || activity.FirstSeen != 100 || activity.LastSeen != 130 {
+			t.Errorf("unexpected activity %+v", activity)
+		}
+	}
+
+	if len(source.used) != 2 {
+		t.Errorf("expected the source to learn about 2 used addresses, got %v", source.used)
+	}
+}
+
+func TestScanResumesFromCheckpoint(t *testing.T) {
+	network := libwallet.Regtest()
+	addresses := createTestAddresses(t, network, 4)
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	scripts, err := getOutputScripts(addresses, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeBackend{
+		unspents: map[string][]backend.Unspent{
+			hex.EncodeToString(scripts[2]): {{TxID: "aa", Vout: 0, Amount: 1000, Height: 100}},
+		},
+		history: map[string][]backend.HistoryItem{
+			hex.EncodeToString(scripts[2]): {{TxID: "aa", Height: 100}},
+		},
+	}
+
+	batches := [][]libwallet.MuunAddress{addresses[:2], addresses[2:]}
+
+	report := scanAll(NewScanner(fake, network, NewCheckpoint(path, "wallet")), &fakeSource{batches: batches})
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+
+	// A failing backend can't be reached, since all batches were completed:
+	failing := &fakeBackend{fail: true}
+
+	checkpoint, err := LoadCheckpoint(path, "wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checkpoint.CompletedBatches() != 2 {
+		t.Fatalf("expected 2 completed batches, got %d", checkpoint.CompletedBatches())
+	}
+
+	source := &fakeSource{batches: batches}
+
+	report = scanAll(NewScanner(failing, network, checkpoint), source)
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+
+	if failing.calls != 0 {
+		t.Errorf("expected no backend calls, got %d", failing.calls)
+	}
+
+	if len(report.UtxosFound) != 1 || report.UtxosFound[0].Address.Address() != addresses[2].Address() {
+		t.Errorf("unexpected utxos %+v", report.UtxosFound)
+	}
+
+	if len(source.used) != 1 {
+		t.Errorf("expected the source to learn about 1 used address, got %v", source.used)
+	}
+
+	_, err = LoadCheckpoint(path, "another wallet")
+	if err == nil {
+		t.Error("expected an error loading a checkpoint for another wallet")
+	}
+}
@@ -1,30 +1,41 @@
 package scanner
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/muun/libwallet"
 	"github.com/muun/libwallet/btcsuitew/btcutilw"
 	"github.com/muun/libwallet/btcsuitew/txscriptw"
-	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/spv"
+	"github.com/muun/recovery/utils"
 )
 
 // scanTask encapsulates a parallelizable Scanner unit of work.
 type scanTask struct {
-	servers   *electrum.ServerProvider
-	client    *electrum.Client
+	backend   backend.Backend
 	addresses []libwallet.MuunAddress
+	network   *libwallet.Network
+	verifier  *spv.Verifier
+	consensus *consensus
 	timeout   time.Duration
 	exit      chan struct{}
+	log       *utils.Logger
 }
 
 // scanTaskResult contains a summary of the execution of a task.
 type scanTaskResult struct {
-	Task  *scanTask
-	Utxos []*Utxo
-	Err   error
+	Task     *scanTask
+	Utxos    []*Utxo
+	Activity []*AddressActivity
+	Server   string
+	Restored bool // true if the result comes from a Checkpoint
+	Err      error
+
+	// Disagreement describes the differences between servers, in a consensus scan:
+	Disagreement *Disagreement
 }
 
 // Execute obtains the Utxo set for the Task address, implementing a retry strategy.
@@ -59,128 +70,180 @@ func (t *scanTask) Execute() *scanTaskResult {
 }
 
 func (t *scanTask) tryExecuteAsync(results chan *scanTaskResult) {
-	// Errors will almost certainly arise from Electrum server failures, which are extremely
-	// common. Unreachable IPs, dropped connections, sudden EOFs, etc. We'll run this task, assuming
-	// the servers are at fault when something fails, disconnecting and cycling them as we retry.
-	result := t.tryExecute()
+	// Errors will almost certainly arise from backend failures (with Electrum, those are extremely
+	// common). The backend takes care of cycling connections, we just retry.
+	results <- t.tryExecute()
+}
 
-	if result.Err != nil {
-		t.client.Disconnect()
+func (t *scanTask) tryExecute() *scanTaskResult {
+	// Prepare the output scripts for all given addresses:
+	outputScripts, err := getOutputScripts(t.addresses, t.network)
+	if err != nil {
+		return t.errorResult(err)
 	}
 
-	results <- result
-}
+	var result *scanTaskResult
+	if t.consensus != nil {
+		result = t.tryExecuteConsensus(outputScripts)
+	} else {
+		result = t.query(t.backend, outputScripts)
+	}
 
-func (t *scanTask) tryExecute() *scanTaskResult {
-	// If our client is not connected, make an attempt to connect to a server:
-	if !t.client.IsConnected() {
-		err := t.client.Connect(t.servers.NextServer())
+	if result.Err != nil {
+		return result
+	}
 
+	// Check the confirmed UTXOs, so the server can't make up funds:
+	for _, utxo := range result.Utxos {
+		err := t.verify(utxo)
 		if err != nil {
 			return t.errorResult(err)
 		}
 	}
 
-	// Prepare the output scripts for all given addresses:
-	outputScripts, err := getOutputScripts(t.addresses)
-	if err != nil {
-		return t.errorResult(err)
+	return result
+}
+
+// queryScripts gets the unspent outputs and the history of the scripts, in a single query if the
+// backend supports it, so both halves come from the same server.
+func queryScripts(chainBackend backend.Backend, scripts [][]byte) ([][]backend.Unspent, [][]backend.HistoryItem, error) {
+	if querier, ok := chainBackend.(backend.ScriptQuerier); ok {
+		return querier.QueryScripts(scripts)
 	}
 
-	// Prepare the index hashes that Electrum requires to list outputs:
-	indexHashes, err := getIndexHashes(outputScripts)
+	unspentGroups, err := chainBackend.ListUnspent(scripts)
 	if err != nil {
-		return t.errorResult(err)
+		return nil, nil, err
 	}
 
-	// Call Electrum to get the unspent output list, grouped by index for each address:
-	var unspentRefGroups [][]electrum.UnspentRef
-
-	if t.client.SupportsBatching() {
-		unspentRefGroups, err = t.listUnspentWithBatching(indexHashes)
-	} else {
-		unspentRefGroups, err = t.listUnspentWithoutBatching(indexHashes)
+	historyGroups, err := chainBackend.GetHistory(scripts)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	return unspentGroups, historyGroups, nil
+}
+
+// query scans the batch on a backend.
+func (t *scanTask) query(backend backend.Backend, outputScripts [][]byte) *scanTaskResult {
+	// Get the unspent output list and the history, grouped by index for each address:
+	unspentGroups, historyGroups, err := queryScripts(backend, outputScripts)
 	if err != nil {
 		return t.errorResult(err)
 	}
 
+	if len(unspentGroups) != len(t.addresses) || len(historyGroups) != len(t.addresses) {
+		return t.errorResult(fmt.Errorf("Backend returned results for the wrong number of addresses"))
+	}
+
 	// Compile the results into a list of `Utxos`:
 	var utxos []*Utxo
 
-	for i, unspentRefGroup := range unspentRefGroups {
-		for _, unspentRef := range unspentRefGroup {
+	for i, unspentGroup := range unspentGroups {
+		for _, unspent := range unspentGroup {
 			newUtxo := &Utxo{
-				TxID:        unspentRef.TxHash,
-				OutputIndex: unspentRef.TxPos,
-				Amount:      unspentRef.Value,
-				Script:      outputScripts[i],
-				Address:     t.addresses[i],
+				TxID:         unspent.TxID,
+				OutputIndex:  unspent.Vout,
+				Amount:       unspent.Amount,
+				Script:       outputScripts[i],
+				Address:      t.addresses[i],
+				Height:       unspent.Height,
+				Verification: Unverified,
 			}
 
 			utxos = append(utxos, newUtxo)
 		}
 	}
 
-	return t.successResult(utxos)
-}
+	// Summarize the history of every address that was ever used:
+	var activity []*AddressActivity
 
-func (t *scanTask) listUnspentWithBatching(indexHashes []string) ([][]electrum.UnspentRef, error) {
-	unspentRefGroups, err := t.client.ListUnspentBatch(indexHashes)
-	if err != nil {
-		return nil, fmt.Errorf("Listing with batching failed: %w", err)
+	for i, historyGroup := range historyGroups {
+		if len(historyGroup) > 0 {
+			activity = append(activity, newAddressActivity(t.addresses[i], historyGroup))
+		}
 	}
 
-	return unspentRefGroups, nil
+	result := t.successResult(utxos, activity)
+	result.Server = backend.Name()
+
+	return result
 }
 
-func (t *scanTask) listUnspentWithoutBatching(indexHashes []string) ([][]electrum.UnspentRef, error) {
-	var unspentRefGroups [][]electrum.UnspentRef
+// verify sets the Verification of a Utxo. It fails if the data to verify it can't be fetched, so
+// the task is retried.
+func (t *scanTask) verify(utxo *Utxo) error {
+	if t.verifier == nil || utxo.Height <= 0 {
+		return nil
+	}
 
-	for _, indexHash := range indexHashes {
-		newGroup, err := t.client.ListUnspent(indexHash)
-		if err != nil {
-			return nil, fmt.Errorf("Listing without batching failed: %w", err)
-		}
+	err := t.verifier.Verify(utxo.TxID, utxo.OutputIndex, utxo.Script, utxo.Amount, utxo.Height)
 
-		unspentRefGroups = append(unspentRefGroups, newGroup)
+	switch {
+	case err == nil:
+		utxo.Verification = Verified
+
+	case errors.Is(err, spv.ErrInvalidProof):
+		t.log.Printf("Verification of %s:%d failed: %v", utxo.TxID, utxo.OutputIndex, err)
+		utxo.Verification = Invalid
+
+	case errors.Is(err, spv.ErrTooFar):
+		t.log.Printf("Can't verify %s:%d: %v", utxo.TxID, utxo.OutputIndex, err)
+
+	default:
+		return fmt.Errorf("Verification of %s:%d failed: %w", utxo.TxID, utxo.OutputIndex, err)
 	}
 
-	return unspentRefGroups, nil
+	return nil
 }
 
 func (t *scanTask) errorResult(err error) *scanTaskResult {
 	return &scanTaskResult{Task: t, Err: err}
 }
 
-func (t *scanTask) successResult(utxos []*Utxo) *scanTaskResult {
-	return &scanTaskResult{Task: t, Utxos: utxos}
+func (t *scanTask) successResult(utxos []*Utxo, activity []*AddressActivity) *scanTaskResult {
+	return &scanTaskResult{Task: t, Utxos: utxos, Activity: activity, Server: t.backend.Name()}
 }
 
 func (t *scanTask) exitResult() *scanTaskResult {
 	return &scanTaskResult{Task: t}
 }
 
-// getIndexHashes calculates all the Electrum index hashes for a list of output scripts.
-func getIndexHashes(outputScripts [][]byte) ([]string, error) {
-	indexHashes := make([]string, len(outputScripts))
+// newAddressActivity summarizes the history of an address.
+func newAddressActivity(address libwallet.MuunAddress, history []backend.HistoryItem) *AddressActivity {
+	activity := &AddressActivity{
+		Address:      address,
+		TxCount:      len(history),
+		Transactions: make([]Transaction, len(history)),
+	}
+
+	for i, item := range history {
+		activity.Transactions[i] = Transaction{TxID: item.TxID, Height: item.Height}
 
-	for i, outputScript := range outputScripts {
-		indexHashes[i] = electrum.GetIndexHash(outputScript)
+		if item.Height <= 0 {
+			continue // unconfirmed
+		}
+
+		if activity.FirstSeen == 0 || item.Height < activity.FirstSeen {
+			activity.FirstSeen = item.Height
+		}
+
+		if item.Height > activity.LastSeen {
+			activity.LastSeen = item.Height
+		}
 	}
 
-	return indexHashes, nil
+	return activity
 }
 
 // getOutputScripts creates all the scripts that send to an list of Bitcoin address.
-func getOutputScripts(addresses []libwallet.MuunAddress) ([][]byte, error) {
+func getOutputScripts(addresses []libwallet.MuunAddress, network *libwallet.Network) ([][]byte, error) {
 	outputScripts := make([][]byte, len(addresses))
 
 	for i, address := range addresses {
 		rawAddress := address.Address()
 
-		decodedAddress, err := btcutilw.DecodeAddress(rawAddress, &chaincfg.MainNetParams)
+		decodedAddress, err := btcutilw.DecodeAddress(rawAddress, network.ToParams())
 		if err != nil {
 			return nil, fmt.Errorf("Failed to decode address %s: %w", rawAddress, err)
 		}
@@ -0,0 +1,270 @@
+package spv
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/backend"
+)
+
+// maxHeadersPerRequest is the most headers Electrum servers return at once.
+const maxHeadersPerRequest = 2016
+
+// ErrInvalidChain is wrapped by the errors of headers that don't form a valid chain.
+var ErrInvalidChain = errors.New("invalid header chain")
+
+// headerChain is a contiguous run of block headers that were checked to form a valid chain
+// through a hard-coded checkpoint. It grows in both directions as needed.
+type headerChain struct {
+	provider   backend.HeaderProvider
+	params     *chaincfg.Params
+	checkpoint chaincfg.Checkpoint
+	base       int // height of headers[0]
+	headers    []*wire.BlockHeader
+}
+
+// newHeaderChain creates an empty chain anchored at the last checkpoint of the network, or at the
+// genesis block if it has none.
+func newHeaderChain(provider backend.HeaderProvider, params *chaincfg.Params) *headerChain {
+	checkpoint := chaincfg.Checkpoint{Height: 0, Hash: params.GenesisHash}
+
+	if len(params.Checkpoints) > 0 {
+		checkpoint = params.Checkpoints[len(params.Checkpoints)-1]
+	}
+
+	return &headerChain{
+		provider:   provider,
+		params:     params,
+		checkpoint: checkpoint,
+		base:       int(checkpoint.Height),
+	}
+}
+
+// distance returns how many headers must be fetched to reach a height from the checkpoint.
+func (c *headerChain) distance(height int) int {
+	distance := height - int(c.checkpoint.Height)
+	if distance < 0 {
+		return -distance
+	}
+
+	return distance
+}
+
+// getHeader returns the header at a height, fetching and checking the headers between it and the
+// chain first.
+func (c *headerChain) getHeader(height int) (*wire.BlockHeader, error) {
+	if len(c.headers) == 0 {
+		err := c.fetchCheckpoint()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for height >= c.base+len(c.headers) {
+		err := c.extendUp(height)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for height < c.base {
+		err := c.extendDown(height)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c.headers[height-c.base], nil
+}
+
+// fetchCheckpoint starts the chain with the header of the checkpoint.
+func (c *headerChain) fetchCheckpoint() error {
+	headers, err := c.provider.GetHeaders(int(c.checkpoint.Height), 1)
+	if err != nil {
+		return err
+	}
+
+	if len(headers) != 1 {
+		return fmt.Errorf("%w: no header for the checkpoint at %d", ErrInvalidChain, c.checkpoint.Height)
+	}
+
+	hash := headers[0].BlockHash()
+	if !hash.IsEqual(c.checkpoint.Hash) {
+		return fmt.Errorf("%w: the block at %d is %v, not the checkpoint", ErrInvalidChain, c.checkpoint.Height, hash)
+	}
+
+	err = c.checkProofOfWork(headers[0])
+	if err != nil {
+		return err
+	}
+
+	c.headers = headers
+
+	return nil
+}
+
+// extendUp fetches the headers that follow the chain, up to a height, and appends them.
+func (c *headerChain) extendUp(height int) error {
+	start := c.base + len(c.headers)
+
+	count := height - start + 1
+	if count > maxHeadersPerRequest {
+		count = maxHeadersPerRequest
+	}
+
+	headers, err := c.provider.GetHeaders(start, count)
+	if err != nil {
+		return err
+	}
+
+	if len(headers) == 0 {
+		return fmt.Errorf("%w: no headers after %d", ErrInvalidChain, start-1)
+	}
+
+	prev := c.headers[len(c.headers)-1]
+
+	for i, header := range headers {
+		err := c.checkLink(prev, header, start+i)
+		if err != nil {
+			return err
+		}
+
+		prev = header
+	}
+
+	c.headers = append(c.headers, headers...)
+
+	return nil
+}
+
+// extendDown fetches the headers that precede the chain, down to a height, and prepends them.
+func (c *headerChain) extendDown(height int) error {
+	start := height
+	if start < c.base-maxHeadersPerRequest {
+		start = c.base - maxHeadersPerRequest
+	}
+
+	count := c.base - start
+
+	headers, err := c.provider.GetHeaders(start, count)
+	if err != nil {
+		return err
+	}
+
+	if len(headers) != count {
+		return fmt.Errorf("%w: got %d headers from %d, expected %d", ErrInvalidChain, len(headers), start, count)
+	}
+
+	next := c.headers[0]
+
+	for i := len(headers) - 1; i >= 0; i-- {
+		err := c.checkLink(headers[i], next, start+i+1)
+		if err != nil {
+			return err
+		}
+
+		err = c.checkProofOfWork(headers[i])
+		if err != nil {
+			return err
+		}
+
+		next = headers[i]
+	}
+
+	c.headers = append(headers, c.headers...)
+	c.base = start
+
+	return nil
+}
+
+// checkLink verifies that a header follows the previous one, with enough proof of work and a
+// difficulty the network allows.
+func (c *headerChain) checkLink(prev, header *wire.BlockHeader, height int) error {
+	prevHash := prev.BlockHash()
+	if !header.PrevBlock.IsEqual(&prevHash) {
+		return fmt.Errorf("%w: the block at %d doesn't follow the previous one", ErrInvalidChain, height)
+	}
+
+	err := c.checkProofOfWork(header)
+	if err != nil {
+		return err
+	}
+
+	return c.checkDifficulty(prev, header, height)
+}
+
+// checkProofOfWork verifies that the hash of a header meets the target it claims, and that the
+// target is within the limit of the network.
+func (c *headerChain) checkProofOfWork(header *wire.BlockHeader) error {
+	target := blockchain.CompactToBig(header.Bits)
+
+	if target.Sign() <= 0 || target.Cmp(c.params.PowLimit) > 0 {
+		return fmt.Errorf("%w: the target of block %v is out of range", ErrInvalidChain, header.BlockHash())
+	}
+
+	hash := header.BlockHash()
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return fmt.Errorf("%w: block %v doesn't meet its target", ErrInvalidChain, hash)
+	}
+
+	return nil
+}
+
+// checkDifficulty verifies that the target only changes at retarget heights, and by no more than
+// the network allows. Networks that allow minimum difficulty blocks (testnet and regtest) skip it.
+func (c *headerChain) checkDifficulty(prev, header *wire.BlockHeader, height int) error {
+	if c.params.ReduceMinDifficulty {
+		return nil
+	}
+
+	blocksPerRetarget := int(c.params.TargetTimespan / c.params.TargetTimePerBlock)
+
+	if height%blocksPerRetarget != 0 {
+		if header.Bits != prev.Bits {
+			return fmt.Errorf("%w: the target of the block at %d changed between retargets", ErrInvalidChain, height)
+		}
+
+		return nil
+	}
+
+	prevTarget := blockchain.CompactToBig(prev.Bits)
+	target := blockchain.CompactToBig(header.Bits)
+	factor := big.NewInt(c.params.RetargetAdjustmentFactor)
+
+	minTarget := new(big.Int).Div(prevTarget, factor)
+	maxTarget := new(big.Int).Mul(prevTarget, factor)
+	if maxTarget.Cmp(c.params.PowLimit) > 0 {
+		maxTarget = c.params.PowLimit
+	}
+
+	// Targets are encoded with limited precision, so the bounds are rounded the same way:
+	minTarget = blockchain.CompactToBig(blockchain.BigToCompact(minTarget))
+	maxTarget = blockchain.CompactToBig(blockchain.BigToCompact(maxTarget))
+
+	if target.Cmp(minTarget) < 0 || target.Cmp(maxTarget) > 0 {
+		return fmt.Errorf("%w: the target of the block at %d changed too much", ErrInvalidChain, height)
+	}
+
+	return nil
+}
+
+// getMerkleRoot computes the merkle root of a block from a transaction and the proof of its
+// inclusion.
+func getMerkleRoot(txHash *chainhash.Hash, proof *backend.MerkleProof) *chainhash.Hash {
+	root := txHash
+
+	for i, sibling := range proof.Branch {
+		if (proof.Pos>>uint(i))&1 == 1 {
+			root = blockchain.HashMerkleBranches(sibling, root)
+		} else {
+			root = blockchain.HashMerkleBranches(root, sibling)
+		}
+	}
+
+	return root
+}
@@ -0,0 +1,152 @@
+// Package spv verifies blockchain data from untrusted servers with Simplified Payment Verification:
+// a transaction is proven to be mined by its inclusion in the merkle root of a block header, and
+// the header by a chain of proof of work from a checkpoint hard-coded in the network parameters.
+package spv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/utils"
+)
+
+// maxDistance is the most headers we fetch from the checkpoint to verify a block, around 40MB.
+// Blocks further away are left unverified.
+const maxDistance = 500000
+
+// ErrInvalidProof is wrapped by the errors of outputs that failed verification, because the server
+// lied about them.
+var ErrInvalidProof = errors.New("invalid proof")
+
+// ErrTooFar is wrapped by the errors of outputs in blocks too far from the checkpoint to verify.
+var ErrTooFar = errors.New("block too far from the checkpoint")
+
+// Source provides the data to verify, usually a backend.Backend.
+type Source interface {
+	backend.HeaderProvider
+
+	// GetTransaction fetches a transaction by its ID.
+	GetTransaction(txID string) (*wire.MsgTx, error)
+}
+
+// Verifier checks transaction outputs reported by a server. It's safe for concurrent use, and
+// keeps the headers it fetched to verify later outputs.
+type Verifier struct {
+	source Source
+	mu     sync.Mutex
+	chain  *headerChain
+	tip    int
+	log    *utils.Logger
+}
+
+// NewVerifier creates a Verifier for a network, that fetches data from the given source.
+func NewVerifier(source Source, params *chaincfg.Params) *Verifier {
+	return &Verifier{
+		source: source,
+		chain:  newHeaderChain(source, params),
+		log:    utils.NewLogger("SPV"),
+	}
+}
+
+// Verify checks that the output of a transaction pays an amount to a script, and that the
+// transaction was mined in the block at the given height of the best chain.
+//
+// Errors that wrap ErrInvalidProof mean the server lied. Those that wrap ErrTooFar mean the output
+// can't be verified. Others are failures to get the data, which can be retried.
+func (v *Verifier) Verify(txID string, vout int, script []byte, amount int64, height int) error {
+	tx, err := v.source.GetTransaction(txID)
+	if err != nil {
+		return err
+	}
+
+	err = checkOutput(tx, txID, vout, script, amount)
+	if err != nil {
+		return err
+	}
+
+	proof, err := v.source.GetMerkleProof(txID, height)
+	if err != nil {
+		return err
+	}
+
+	if proof.Height != height {
+		return fmt.Errorf("%w: the proof of %s is for block %d, not %d", ErrInvalidProof, txID, proof.Height, height)
+	}
+
+	header, err := v.getHeader(height)
+	if err != nil {
+		return err
+	}
+
+	txHash := tx.TxHash()
+	root := getMerkleRoot(&txHash, proof)
+
+	if !root.IsEqual(&header.MerkleRoot) {
+		return fmt.Errorf("%w: %s is not in the block at %d", ErrInvalidProof, txID, height)
+	}
+
+	return nil
+}
+
+// getHeader returns the verified header at a height of the best chain.
+func (v *Verifier) getHeader(height int) (*wire.BlockHeader, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.tip == 0 {
+		tip, err := v.source.GetTipHeight()
+		if err != nil {
+			return nil, err
+		}
+
+		v.tip = tip
+	}
+
+	if height > v.tip {
+		return nil, fmt.Errorf("%w: block %d is above the tip at %d", ErrInvalidProof, height, v.tip)
+	}
+
+	if v.chain.distance(height) > maxDistance {
+		return nil, fmt.Errorf("%w: block %d", ErrTooFar, height)
+	}
+
+	v.log.Printf("Verifying headers up to block %d", height)
+
+	return v.chain.getHeader(height)
+}
+
+// checkOutput verifies that a transaction has the expected ID, and pays the amount to the script
+// in an output.
+func checkOutput(tx *wire.MsgTx, txID string, vout int, script []byte, amount int64) error {
+	expectedHash, err := chainhash.NewHashFromStr(txID)
+	if err != nil {
+		return fmt.Errorf("%w: invalid transaction ID %s", ErrInvalidProof, txID)
+	}
+
+	txHash := tx.TxHash()
+	if !txHash.IsEqual(expectedHash) {
+		return fmt.Errorf("%w: the server sent transaction %v instead of %s", ErrInvalidProof, txHash, txID)
+	}
+
+	if vout < 0 || vout >= len(tx.TxOut) {
+		return fmt.Errorf("%w: %s has no output %d", ErrInvalidProof, txID, vout)
+	}
+
+	output := tx.TxOut[vout]
+
+	if !bytes.Equal(output.PkScript, script) {
+		return fmt.Errorf("%w: the output %s:%d pays to a different script", ErrInvalidProof, txID, vout)
+	}
+
+	if output.Value != amount {
+		return fmt.Errorf("%w: the output %s:%d has %d sats, not %d", ErrInvalidProof, txID, vout, output.Value, amount)
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+package spv
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/recovery/backend"
+)
+
+var testScript = []byte{0x00, 0x14, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+// fakeSource serves a regtest chain, with blocks of a few transactions each.
+type fakeSource struct {
+	headers []*wire.BlockHeader
+	blocks  [][]*wire.MsgTx
+	txs     map[string]*wire.MsgTx
+}
+
+func newFakeSource(t *testing.T, blockCount int) *fakeSource {
+	genesis := chaincfg.RegressionNetParams.GenesisBlock
+
+	source := &fakeSource{
+		headers: []*wire.BlockHeader{&genesis.Header},
+		blocks:  [][]*wire.MsgTx{genesis.Transactions},
+		txs:     make(map[string]*wire.MsgTx),
+	}
+
+	for height := 1; height <= blockCount; height++ {
+		var txs []*wire.MsgTx
+
+		for i := 0; i < 3; i++ {
+			tx := wire.NewMsgTx(2)
+			tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: uint32(height*10 + i)}, nil, nil))
+			tx.AddTxOut(wire.NewTxOut(int64(height*1000+i), testScript))
+
+			txs = append(txs, tx)
+			source.txs[tx.TxHash().String()] = tx
+		}
+
+		header := &wire.BlockHeader{
+			Version:    1,
+			PrevBlock:  source.headers[height-1].BlockHash(),
+			MerkleRoot: getTestMerkleRoot(txs),
+			Bits:       chaincfg.RegressionNetParams.PowLimitBits,
+		}
+		mine(t, header)
+
+		source.headers = append(source.headers, header)
+		source.blocks = append(source.blocks, txs)
+	}
+
+	return source
+}
+
+func (s *fakeSource) GetTipHeight() (int, error) {
+	return len(s.headers) - 1, nil
+}
+
+func (s *fakeSource) GetHeaders(startHeight int, count int) ([]*wire.BlockHeader, error) {
+	if startHeight >= len(s.headers) {
+		return nil, nil
+	}
+
+	end := startHeight + count
+	if end > len(s.headers) {
+		end = len(s.headers)
+	}
+
+	return s.headers[startHeight:end], nil
+}
+
+func (s *fakeSource) GetMerkleProof(txID string, height int) (*backend.MerkleProof, error) {
+	txs := s.blocks[height]
+
+	for pos, tx := range txs {
+		if tx.TxHash().String() == txID {
+			return &backend.MerkleProof{Height: height, Pos: pos, Branch: getTestBranch(txs, pos)}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("tx %s not found in block %d", txID, height)
+}
+
+func (s *fakeSource) GetTransaction(txID string) (*wire.MsgTx, error) {
+	tx, ok := s.txs[txID]
+	if !ok {
+		return nil, fmt.Errorf("tx %s not found", txID)
+	}
+
+	return tx, nil
+}
+
+// mine finds a nonce that meets the target of the header.
+func mine(t *testing.T, header *wire.BlockHeader) {
+	for header.Nonce = 0; header.Nonce < 1000; header.Nonce++ {
+		if meetsTarget(header) {
+			return
+		}
+	}
+
+	t.Fatal("failed to mine a block")
+}
+
+func meetsTarget(header *wire.BlockHeader) bool {
+	hash := header.BlockHash()
+	return blockchain.HashToBig(&hash).Cmp(blockchain.CompactToBig(header.Bits)) <= 0
+}
+
+// getTestHashes returns the bottom level of the merkle tree of a block.
+func getTestHashes(txs []*wire.MsgTx) []*chainhash.Hash {
+	hashes := make([]*chainhash.Hash, len(txs))
+	for i, tx := range txs {
+		hash := tx.TxHash()
+		hashes[i] = &hash
+	}
+
+	return hashes
+}
+
+// nextLevel hashes pairs of a level of the merkle tree, duplicating the last hash if it's odd.
+func nextLevel(hashes []*chainhash.Hash) []*chainhash.Hash {
+	if len(hashes)%2 == 1 {
+		hashes = append(hashes, hashes[len(hashes)-1])
+	}
+
+	var next []*chainhash.Hash
+	for i := 0; i < len(hashes); i += 2 {
+		next = append(next, blockchain.HashMerkleBranches(hashes[i], hashes[i+1]))
+	}
+
+	return next
+}
+
+func getTestMerkleRoot(txs []*wire.MsgTx) chainhash.Hash {
+	hashes := getTestHashes(txs)
+	for len(hashes) > 1 {
+		hashes = nextLevel(hashes)
+	}
+
+	return *hashes[0]
+}
+
+func getTestBranch(txs []*wire.MsgTx, pos int) []*chainhash.Hash {
+	var branch []*chainhash.Hash
+
+	hashes := getTestHashes(txs)
+	for len(hashes) > 1 {
+		if len(hashes)%2 == 1 {
+			hashes = append(hashes, hashes[len(hashes)-1])
+		}
+
+		branch = append(branch, hashes[pos^1])
+		hashes = nextLevel(hashes)
+		pos /= 2
+	}
+
+	return branch
+}
+
+func TestVerify(t *testing.T) {
+	source := newFakeSource(t, 10)
+	verifier := NewVerifier(source, &chaincfg.RegressionNetParams)
+
+	for height := 1; height <= 10; height++ {
+		for i, tx := range source.blocks[height] {
+			err := verifier.Verify(tx.TxHash().String(), 0, testScript, int64(height*1000+i), height)
+			if err != nil {
+				t.Fatalf("failed to verify tx %d of block %d: %v", i, height, err)
+			}
+		}
+	}
+}
+
+func TestVerifyFromCheckpoint(t *testing.T) {
+	source := newFakeSource(t, 10)
+
+	checkpointHash := source.headers[6].BlockHash()
+
+	params := chaincfg.RegressionNetParams
+	params.Checkpoints = []chaincfg.Checkpoint{{Height: 6, Hash: &checkpointHash}}
+
+	verifier := NewVerifier(source, &params)
+
+	// Blocks before the checkpoint are verified going down, and after it going up:
+	for _, height := range []int{2, 9, 1, 6} {
+		tx := source.blocks[height][0]
+
+		err := verifier.Verify(tx.TxHash().String(), 0, testScript, int64(height*1000), height)
+		if err != nil {
+			t.Fatalf("failed to verify block %d: %v", height, err)
+		}
+	}
+
+	// A chain that doesn't go through the checkpoint is rejected:
+	source.headers[6].Nonce++
+
+	tx := source.blocks[2][0]
+
+	err := NewVerifier(source, &params).Verify(tx.TxHash().String(), 0, testScript, 2000, 2)
+	if !errors.Is(err, ErrInvalidChain) {
+		t.Fatalf("expected %v, got %v", ErrInvalidChain, err)
+	}
+}
+
+func TestVerifyRejectsLies(t *testing.T) {
+	tx := func(source *fakeSource) *wire.MsgTx {
+		return source.blocks[5][1]
+	}
+
+	testCases := []struct {
+		name   string
+		tamper func(source *fakeSource) (txID string, vout int, amount int64, height int)
+		want   error
+	}{
+		{
+			name: "wrong amount",
+			tamper: func(source *fakeSource) (string, int, int64, int) {
+				return tx(source).TxHash().String(), 0, 9999, 5
+			},
+			want: ErrInvalidProof,
+		},
+		{
+			name: "missing output",
+			tamper: func(source *fakeSource) (string, int, int64, int) {
+				return tx(source).TxHash().String(), 1, 5001, 5
+			},
+			want: ErrInvalidProof,
+		},
+		{
+			name: "wrong block",
+			tamper: func(source *fakeSource) (string, int, int64, int) {
+				source.blocks[4] = source.blocks[5]
+				return tx(source).TxHash().String(), 0, 5001, 4
+			},
+			want: ErrInvalidProof,
+		},
+		{
+			name: "above the tip",
+			tamper: func(source *fakeSource) (string, int, int64, int) {
+				source.blocks = append(source.blocks, source.blocks[5])
+				return tx(source).TxHash().String(), 0, 5001, 11
+			},
+			want: ErrInvalidProof,
+		},
+		{
+			name: "broken chain",
+			tamper: func(source *fakeSource) (string, int, int64, int) {
+				source.headers[3].PrevBlock = chainhash.Hash{}
+				return tx(source).TxHash().String(), 0, 5001, 5
+			},
+			want: ErrInvalidChain,
+		},
+		{
+			name: "no proof of work",
+			tamper: func(source *fakeSource) (string, int, int64, int) {
+				header := *source.headers[5]
+				for meetsTarget(&header) {
+					header.Nonce++
+				}
+				source.headers[5] = &header
+				return tx(source).TxHash().String(), 0, 5001, 5
+			},
+			want: ErrInvalidChain,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			source := newFakeSource(t, 10)
+			txID, vout, amount, height := testCase.tamper(source)
+
+			err := NewVerifier(source, &chaincfg.RegressionNetParams).Verify(txID, vout, testScript, amount, height)
+			if !errors.Is(err, testCase.want) {
+				t.Fatalf("expected %v, got %v", testCase.want, err)
+			}
+		})
+	}
+}
+
+func TestCheckDifficulty(t *testing.T) {
+	chain := newHeaderChain(nil, &chaincfg.MainNetParams)
+	prev := &wire.BlockHeader{Bits: 0x1d00ffff}
+
+	testCases := []struct {
+		height int
+		bits   uint32
+		valid  bool
+	}{
+		{height: 2015, bits: 0x1d00ffff, valid: true},
+		{height: 2015, bits: 0x1c7fffff, valid: false},
+		{height: 2016, bits: 0x1c7fffff, valid: true},
+		{height: 2016, bits: 0x1c3fffc0, valid: true},
+		{height: 2016, bits: 0x1c3fffbf, valid: false},
+		{height: 2016, bits: 0x1b7fffff, valid: false},
+	}
+
+	for _, testCase := range testCases {
+		err := chain.checkDifficulty(prev, &wire.BlockHeader{Bits: testCase.bits}, testCase.height)
+		if (err == nil) != testCase.valid {
+			t.Errorf("bits %x at %d: expected valid %v, got %v", testCase.bits, testCase.height, testCase.valid, err)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"os"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 
@@ -26,6 +25,7 @@ type Config struct {
 	Workers            int
 	SpeedTestDuration  time.Duration
 	SpeedTestBatchSize int
+	Dialer             electrum.Dialer // optional, to connect through a proxy
 }
 
 type Result struct {
@@ -141,17 +141,17 @@ func (s *Survey) processTask(task *surveyTask) *Result {
 	// When a testing method returns an error, it means the server failed completely and we couldn't
 	// obtain meaningful results (while some internal errors in a test are expected and handled).
 
-	impl, version, timeToConnect, err := testConnection(task)
+	impl, version, timeToConnect, err := s.testConnection(task)
 	if err != nil {
 		return &Result{Server: task.server, Err: err}
 	}
 
-	isBitcoinMainnet, err := testBitcoinMainnet(task)
+	isBitcoinMainnet, err := s.testBitcoinMainnet(task)
 	if err != nil || !isBitcoinMainnet {
 		return &Result{Server: task.server, Err: fmt.Errorf("not on Bitcoin mainnet: %w", err)}
 	}
 
-	batchSupport, err := testBatchSupport(task)
+	batchSupport, err := s.testBatchSupport(task)
 	if err != nil {
 		return &Result{Server: task.server, Err: err}
 	}
@@ -161,13 +161,13 @@ func (s *Survey) processTask(task *surveyTask) *Result {
 		return &Result{Server: task.server, Err: err}
 	}
 
-	peers, err := getPeers(task)
+	peers, err := s.getPeers(task)
 	if err != nil {
 		return &Result{Server: task.server, Err: err}
 	}
 
 	for _, peer := range peers {
-		if strings.Contains(peer, ".onion:") {
+		if electrum.IsOnion(peer) && s.config.Dialer == nil {
 			continue
 		}
 
@@ -192,9 +192,14 @@ func (s *Survey) processTask(task *surveyTask) *Result {
 	}
 }
 
+// newClient creates a Client that connects through the configured dialer, if any.
+func (s *Survey) newClient() *electrum.Client {
+	return electrum.NewClient(true, "", s.config.Dialer, nil)
+}
+
 // testConnection returns the server implementation, protocol version and time to connect
-func testConnection(task *surveyTask) (string, string, time.Duration, error) {
-	client := electrum.NewClient(true)
+func (s *Survey) testConnection(task *surveyTask) (string, string, time.Duration, error) {
+	client := s.newClient()
 
 	start := time.Now()
 	err := client.Connect(task.server)
@@ -206,8 +211,8 @@ func testConnection(task *surveyTask) (string, string, time.Duration, error) {
 }
 
 // testsBlockchain returns whether this server is operating on Bitcoin mainnet
-func testBitcoinMainnet(task *surveyTask) (bool, error) {
-	client := electrum.NewClient(true)
+func (s *Survey) testBitcoinMainnet(task *surveyTask) (bool, error) {
+	client := s.newClient()
 
 	err := client.Connect(task.server)
 	if err != nil {
@@ -228,8 +233,8 @@ func testBitcoinMainnet(task *surveyTask) (bool, error) {
 }
 
 // testBatchSupport returns whether the server successfully responded to a batched request
-func testBatchSupport(task *surveyTask) (bool, error) {
-	client := electrum.NewClient(true)
+func (s *Survey) testBatchSupport(task *surveyTask) (bool, error) {
+	client := s.newClient()
 
 	err := client.Connect(task.server)
 	if err != nil {
@@ -247,7 +252,7 @@ func testBatchSupport(task *surveyTask) (bool, error) {
 // measureSpeed returns the amount of successful ListUnspentBatch calls in SPEED_TEST_DURATION
 // seconds. It assumes batch support was verified beforehand.
 func (s *Survey) measureSpeed(task *surveyTask) (int, error) {
-	client := electrum.NewClient(true)
+	client := s.newClient()
 
 	err := client.Connect(task.server)
 	if err != nil {
@@ -272,8 +277,8 @@ func (s *Survey) measureSpeed(task *surveyTask) (int, error) {
 }
 
 // getPeers returns the list of peers from a server, or empty if it doesn't responds to the request
-func getPeers(task *surveyTask) ([]string, error) {
-	client := electrum.NewClient(true)
+func (s *Survey) getPeers(task *surveyTask) ([]string, error) {
+	client := s.newClient()
 
 	err := client.Connect(task.server)
 	if err != nil {
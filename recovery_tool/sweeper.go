@@ -1,42 +1,76 @@
 package main
 
 import (
-	"bytes"
-	"encoding/hex"
+	"errors"
 	"fmt"
+	"time"
 
-	"github.com/muun/recovery/electrum"
+	"github.com/muun/recovery/backend"
 	"github.com/muun/recovery/scanner"
 
-	"github.com/btcsuite/btcd/chaincfg"
-
+	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/muun/libwallet"
 )
 
-var (
-	chainParams = chaincfg.MainNetParams
+// How often, and for how long, we look for a broadcasted transaction in the mempool.
+const (
+	mempoolPollInterval = 2 * time.Second
+	mempoolPollTimeout  = 60 * time.Second
 )
 
 type Sweeper struct {
 	UserKey      *libwallet.HDPrivateKey
 	MuunKey      *libwallet.HDPrivateKey
 	Birthday     int
-	SweepAddress btcutil.Address
+	Destinations []destination
+	Network      *libwallet.Network
+	Backend      backend.Backend
+
+	// BroadcastServers is the amount of servers to send the transaction to, if the backend has
+	// more than one. Zero or one uses the backend's regular broadcast.
+	BroadcastServers int
+}
+
+// BroadcastOutcome describes how a transaction reached the network.
+type BroadcastOutcome struct {
+	AlreadyKnown bool                      // the backend had the tx, so it wasn't sent again
+	Results      []backend.BroadcastResult // the outcome per server, when sent to many
+	Seen         bool                      // the tx was found in the mempool (or a block) afterwards
 }
 
-func (s *Sweeper) GetSweepTxAmountAndWeightInBytes(utxos []*scanner.Utxo) (outputAmount int64, weightInBytes int64, err error) {
+// SweepSize is the size of a signed sweep transaction, which its fee pays for.
+type SweepSize struct {
+	Weight int64 // in weight units, as defined by BIP141
+	VSize  int64 // in virtual bytes, the weight divided by 4 and rounded up
+}
+
+// maxSignatureGrowth is how many bytes longer an ECDSA signature of the same key can be. We estimate
+// the size with the signatures for a zero fee, and the final ones may be longer.
+const maxSignatureGrowth = 1
+
+// GetSweepTxAmountAndSize returns the amount the sweep would send with no fee, and its size once
+// signed, with an output for each destination.
+func (s *Sweeper) GetSweepTxAmountAndSize(utxos []*scanner.Utxo) (outputAmount int64, size SweepSize, err error) {
 	// we build a sweep tx with 0 fee with the only purpose of checking its signed size
 	zeroFeeSweepTx, err := s.BuildSweepTx(utxos, 0)
 	if err != nil {
-		return 0, 0, err
+		return 0, SweepSize{}, err
 	}
 
-	outputAmount = zeroFeeSweepTx.TxOut[0].Value
-	weightInBytes = int64(zeroFeeSweepTx.SerializeSize())
+	for _, txOut := range zeroFeeSweepTx.TxOut {
+		outputAmount += txOut.Value
+	}
+
+	// Each input has up to 2 ECDSA signatures. We count their growth at the non-witness weight,
+	// since V2 inputs have them in the signature script:
+	growth := int64(len(zeroFeeSweepTx.TxIn)) * 2 * maxSignatureGrowth * blockchain.WitnessScaleFactor
 
-	return outputAmount, weightInBytes, nil
+	size.Weight = blockchain.GetTransactionWeight(btcutil.NewTx(zeroFeeSweepTx)) + growth
+	size.VSize = (size.Weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor
+
+	return outputAmount, size, nil
 }
 
 func (s *Sweeper) BuildSweepTx(utxos []*scanner.Utxo, fee int64) (*wire.MsgTx, error) {
@@ -44,7 +78,7 @@ func (s *Sweeper) BuildSweepTx(utxos []*scanner.Utxo, fee int64) (*wire.MsgTx, e
 	if err != nil {
 		return nil, err
 	}
-	sweepTx, err := buildSweepTx(utxos, s.SweepAddress, fee)
+	sweepTx, err := buildSweepTx(utxos, s.Destinations, fee)
 	if err != nil {
 		return nil, err
 	}
@@ -52,30 +86,73 @@ func (s *Sweeper) BuildSweepTx(utxos []*scanner.Utxo, fee int64) (*wire.MsgTx, e
 	return buildSignedTx(utxos, sweepTx, s.UserKey, derivedMuunKey)
 }
 
-func (s *Sweeper) BroadcastTx(tx *wire.MsgTx) error {
-	// Connect to an Electurm server using a fresh client and provider pair:
-	sp := electrum.NewServerProvider(electrum.PublicServers) // TODO create servers module, for provider and pool
-	client := electrum.NewClient(true)
+// BroadcastTx sends a transaction through the backend, unless it already knows it, and waits until
+// the transaction can be fetched back from the mempool.
+func (s *Sweeper) BroadcastTx(tx *wire.MsgTx) (*BroadcastOutcome, error) {
+	txID := tx.TxHash().String()
 
-	for !client.IsConnected() {
-		client.Connect(sp.NextServer())
+	if _, err := s.getTransaction(txID); err == nil {
+		return &BroadcastOutcome{AlreadyKnown: true, Seen: true}, nil
 	}
 
-	// Encode the transaction for broadcast:
-	txBytes := new(bytes.Buffer)
+	outcome := &BroadcastOutcome{}
 
-	err := tx.BtcEncode(txBytes, wire.ProtocolVersion, wire.WitnessEncoding)
-	if err != nil {
-		return fmt.Errorf("error while encoding tx: %w", err)
+	multi, ok := s.Backend.(backend.MultiBroadcaster)
+
+	if ok && s.BroadcastServers > 1 {
+		outcome.Results = multi.BroadcastToMany(tx, s.BroadcastServers)
+
+		err := getBroadcastError(outcome.Results)
+		if err != nil {
+			return outcome, err
+		}
+
+	} else {
+		_, err := s.Backend.Broadcast(tx)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	txHex := hex.EncodeToString(txBytes.Bytes())
+	outcome.Seen = s.waitForMempool(txID)
 
-	// Do the thing!
-	_, err = client.Broadcast(txHex)
-	if err != nil {
-		return fmt.Errorf("error while broadcasting: %w", err)
+	return outcome, nil
+}
+
+// waitForMempool polls the backend for a transaction, and tells whether it appeared in time.
+func (s *Sweeper) waitForMempool(txID string) bool {
+	deadline := time.Now().Add(mempoolPollTimeout)
+
+	for time.Now().Before(deadline) {
+		if _, err := s.getTransaction(txID); err == nil {
+			return true
+		}
+
+		time.Sleep(mempoolPollInterval)
+	}
+
+	return false
+}
+
+// getTransaction fetches a transaction by its ID.
+func (s *Sweeper) getTransaction(txID string) (*wire.MsgTx, error) {
+	return s.Backend.GetTransaction(txID)
+}
+
+// getBroadcastError returns an error if no server accepted the transaction, with the reason given
+// by the last one.
+func getBroadcastError(results []backend.BroadcastResult) error {
+	if len(results) == 0 {
+		return errors.New("no server to broadcast to")
 	}
 
-	return nil
+	for _, result := range results {
+		if result.Err == nil {
+			return nil
+		}
+	}
+
+	last := results[len(results)-1]
+
+	return fmt.Errorf("no server accepted the transaction (%s: %w)", last.Server, last.Err)
 }
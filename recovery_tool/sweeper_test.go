@@ -0,0 +1,192 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/libwallet/btcsuitew/txscriptw"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/electrum/electrumtest"
+	"github.com/muun/recovery/scanner"
+)
+
+// createTestScript returns the output script of a wallet address, given its derivation path and
+// version.
+func createTestScript(
+	t *testing.T, userKey, muunKey *libwallet.HDPublicKey, path string, version int,
+) []byte {
+	derivedUserKey, err := userKey.DeriveTo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derivedMuunKey, err := muunKey.DeriveTo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var address libwallet.MuunAddress
+
+	switch version {
+	case libwallet.AddressVersionV3:
+		address, err = libwallet.CreateAddressV3(derivedUserKey, derivedMuunKey)
+	case libwallet.AddressVersionV4:
+		address, err = libwallet.CreateAddressV4(derivedUserKey, derivedMuunKey)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := btcutilw.DecodeAddress(address.Address(), userKey.Network.ToParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := txscriptw.PayToAddrScript(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return script
+}
+
+func TestScanAndSweepWithElectrum(t *testing.T) {
+	network := libwallet.Regtest()
+
+	userRoot, _ := libwallet.NewHDPrivateKey([]byte("0123456789abcdef0123456789abcdef"), network)
+	muunKey, _ := libwallet.NewHDPrivateKey([]byte("fedcba9876543210fedcba9876543210"), network)
+
+	// Like in the Emergency Kit, the user key is at the base path and the muun key is the root:
+	userKey, err := userRoot.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	muunBaseKey, err := muunKey.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := electrumtest.NewChain(&chaincfg.RegressionNetParams)
+
+	chain.Fund(createTestScript(t, userKey.PublicKey(), muunBaseKey.PublicKey(), "m/1'/1'/1/3", libwallet.AddressVersionV4), 30000)
+	chain.Fund(createTestScript(t, userKey.PublicKey(), muunBaseKey.PublicKey(), "m/1'/1'/0/0", libwallet.AddressVersionV3), 12000)
+	chain.Mine()
+
+	server := electrumtest.NewTLSServer(t, chain)
+	electrum := backend.NewElectrum([]string{server.Address}, true, chain.GenesisHash(), nil, nil)
+
+	// Scan:
+	addrGen := NewAddressGenerator(userKey.PublicKey(), muunBaseKey.PublicKey(), false, 5)
+
+	var report *scanner.Report
+	for report = range scanner.NewScanner(electrum, network, nil).Scan(addrGen) {
+	}
+
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+
+	utxos := report.UtxosFound
+	if len(utxos) != 2 {
+		t.Fatalf("expected 2 utxos, got %d", len(utxos))
+	}
+
+	for _, utxo := range utxos {
+		if utxo.Verification != scanner.Verified {
+			t.Errorf("expected %s:%d to be verified, got %q", utxo.TxID, utxo.OutputIndex, utxo.Verification)
+		}
+	}
+
+	// Sweep:
+	destinationAddress, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), network.ToParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destinations, err := parseDestinations(destinationAddress.String(), network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sweeper := &Sweeper{
+		UserKey:      userKey,
+		MuunKey:      muunKey,
+		Destinations: destinations,
+		Network:      network,
+		Backend:      electrum,
+	}
+
+	amount, size, err := sweeper.GetSweepTxAmountAndSize(utxos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fee := size.VSize * 2
+
+	tx, err := sweeper.BuildSweepTx(utxos, fee)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if amount != 42000 || len(tx.TxOut) != 1 || tx.TxOut[0].Value != amount-fee {
+		t.Fatalf("expected to sweep %d sats minus a fee of %d, got %+v", amount, fee, tx.TxOut)
+	}
+
+	// Every input is signed by both keys:
+	for i, txIn := range tx.TxIn {
+		utxo := findUtxo(utxos, txIn.PreviousOutPoint.Hash.String(), int(txIn.PreviousOutPoint.Index))
+		if utxo == nil {
+			t.Fatalf("input %d spends an unknown output", i)
+		}
+
+		engine, err := txscript.NewEngine(
+			utxo.Script, tx, i, txscript.StandardVerifyFlags, nil, txscript.NewTxSigHashes(tx), utxo.Amount,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = engine.Execute()
+		if err != nil {
+			t.Fatalf("input %d has invalid signatures: %v", i, err)
+		}
+	}
+
+	// Broadcast:
+	outcome, err := sweeper.BroadcastTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mempool := chain.Mempool()
+
+	if outcome.AlreadyKnown || !outcome.Seen || len(mempool) != 1 || mempool[0].TxHash() != tx.TxHash() {
+		t.Fatalf("expected the sweep to reach the mempool, got %+v", outcome)
+	}
+
+	// Broadcasting again doesn't send it twice:
+	outcome, err = sweeper.BroadcastTx(tx)
+	if err != nil || !outcome.AlreadyKnown {
+		t.Fatalf("expected the sweep to be known, got %+v (%v)", outcome, err)
+	}
+
+	if server.Requests("blockchain.transaction.broadcast") != 1 {
+		t.Errorf("expected 1 broadcast, got %d", server.Requests("blockchain.transaction.broadcast"))
+	}
+}
+
+func findUtxo(utxos []*scanner.Utxo, txID string, vout int) *scanner.Utxo {
+	for _, utxo := range utxos {
+		if utxo.TxID == txID && utxo.OutputIndex == vout {
+			return utxo
+		}
+	}
+
+	return nil
+}
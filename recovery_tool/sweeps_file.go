@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/scanner"
+)
+
+const sweepsFileVersion = 1
+
+// sweepsFile is the document where we record every sweep transaction before broadcasting it, so
+// `bump` can replace one that got stuck.
+type sweepsFile struct {
+	Version int            `json:"version"`
+	Sweeps  []sweepAttempt `json:"sweeps"`
+}
+
+// sweepAttempt is a sweep transaction, with the UTXOs it spends so it can be built again. Like
+// the UTXO file, it only carries public data.
+type sweepAttempt struct {
+	TxID        string      `json:"txid"`
+	Fee         int64       `json:"fee"`
+	Destination string      `json:"destination"`
+	Replaces    string      `json:"replaces,omitempty"`
+	Time        time.Time   `json:"time"`
+	UserXpub    string      `json:"userXpub"`
+	MuunXpub    string      `json:"muunXpub"`
+	Utxos       []utxoEvent `json:"utxos"`
+}
+
+func newSweepAttempt(
+	userKey, muunKey *libwallet.HDPublicKey,
+	utxos []*scanner.Utxo,
+	tx *wire.MsgTx,
+	fee int64,
+	destinations []destination,
+) *sweepAttempt {
+
+	attempt := &sweepAttempt{
+		TxID:        tx.TxHash().String(),
+		Fee:         fee,
+		Destination: formatDestinations(destinations),
+		Time:        time.Now().UTC(),
+		UserXpub:    userKey.String(),
+		MuunXpub:    muunKey.String(),
+		Utxos:       make([]utxoEvent, len(utxos)),
+	}
+
+	for i, utxo := range utxos {
+		attempt.Utxos[i] = newUtxoEvent(utxo)
+	}
+
+	return attempt
+}
+
+// readSweepsFile reads the recorded sweeps, or returns an empty record if the file doesn't exist.
+func readSweepsFile(path string) (*sweepsFile, error) {
+	file := &sweepsFile{Version: sweepsFileVersion}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sweeps file: %w", err)
+	}
+
+	err = json.Unmarshal(content, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sweeps file: %w", err)
+	}
+
+	if file.Version != sweepsFileVersion {
+		return nil, fmt.Errorf("unsupported sweeps file version %d", file.Version)
+	}
+
+	return file, nil
+}
+
+// appendSweepsFile adds a sweep to the file, creating it if needed.
+func appendSweepsFile(path string, attempt *sweepAttempt) error {
+	file, err := readSweepsFile(path)
+	if err != nil {
+		return err
+	}
+
+	file.Sweeps = append(file.Sweeps, *attempt)
+
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sweeps file: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+
+	err = os.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write sweeps file: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("failed to write sweeps file: %w", err)
+	}
+
+	return nil
+}
+
+// find returns the sweep with a transaction ID, or the last one recorded if it's empty.
+func (f *sweepsFile) find(txID string) (*sweepAttempt, error) {
+	if len(f.Sweeps) == 0 {
+		return nil, errors.New("no sweep transactions were recorded")
+	}
+
+	if txID == "" {
+		return &f.Sweeps[len(f.Sweeps)-1], nil
+	}
+
+	for i := range f.Sweeps {
+		if f.Sweeps[i].TxID == txID {
+			return &f.Sweeps[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("the sweep transaction %s wasn't recorded", txID)
+}
+
+// restoreUtxos re-creates the UTXOs the sweep spends from our own keys, as the UTXO file does,
+// checking them against the previous transactions fetched from the backend.
+func (a *sweepAttempt) restoreUtxos(
+	userKey, muunKey *libwallet.HDPublicKey,
+	chainBackend backend.Backend,
+) ([]*scanner.Utxo, error) {
+
+	prevTxs, err := fetchPrevTxs(chainBackend, a.Utxos)
+	if err != nil {
+		return nil, err
+	}
+
+	file := utxoFile{UserXpub: a.UserXpub, MuunXpub: a.MuunXpub, Utxos: a.Utxos, PrevTxs: prevTxs}
+
+	return file.restoreUtxos(userKey, muunKey)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+	"github.com/muun/libwallet/btcsuitew/btcutilw"
+	"github.com/muun/libwallet/btcsuitew/txscriptw"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/scanner"
+)
+
+const utxoFileVersion = 2
+
+// utxoFile is the document `scan` writes and `sign` reads. It carries only public data, so it can
+// be moved between an online and an offline machine.
+type utxoFile struct {
+	Version  int               `json:"version"`
+	UserXpub string            `json:"userXpub"`
+	MuunXpub string            `json:"muunXpub"`
+	Utxos    []utxoEvent       `json:"utxos"`
+	PrevTxs  map[string]string `json:"prevTxs"` // hex-encoded transactions that created the UTXOs, by ID
+}
+
+func writeUtxoFile(
+	path string,
+	userKey, muunKey *libwallet.HDPublicKey,
+	utxos []*scanner.Utxo,
+	prevTxs map[string]string,
+) error {
+
+	file := utxoFile{
+		Version:  utxoFileVersion,
+		UserXpub: userKey.String(),
+		MuunXpub: muunKey.String(),
+		Utxos:    make([]utxoEvent, len(utxos)),
+		PrevTxs:  prevTxs,
+	}
+
+	for i, utxo := range utxos {
+		file.Utxos[i] = newUtxoEvent(utxo)
+	}
+
+	content, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode utxo file: %w", err)
+	}
+
+	err = os.WriteFile(path, content, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write utxo file: %w", err)
+	}
+
+	return nil
+}
+
+func readUtxoFile(path string) (*utxoFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, invalidInput("failed to read utxo file: %v", err)
+	}
+
+	var file utxoFile
+
+	err = json.Unmarshal(content, &file)
+	if err != nil {
+		return nil, invalidInput("failed to parse utxo file: %v", err)
+	}
+
+	if file.Version != utxoFileVersion {
+		return nil, invalidInput("unsupported utxo file version %d", file.Version)
+	}
+
+	return &file, nil
+}
+
+// fetchPrevTxs fetches the transactions that created the UTXOs, hex-encoded by ID.
+func fetchPrevTxs(chainBackend backend.Backend, utxos []utxoEvent) (map[string]string, error) {
+	prevTxs := make(map[string]string)
+
+	for _, utxo := range utxos {
+		if _, ok := prevTxs[utxo.TxID]; ok {
+			continue
+		}
+
+		tx, err := chainBackend.GetTransaction(utxo.TxID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch transaction %s: %w", utxo.TxID, err)
+		}
+
+		txBytes := new(bytes.Buffer)
+
+		err = tx.BtcEncode(txBytes, wire.ProtocolVersion, wire.WitnessEncoding)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode transaction %s: %w", utxo.TxID, err)
+		}
+
+		prevTxs[utxo.TxID] = hex.EncodeToString(txBytes.Bytes())
+	}
+
+	return prevTxs, nil
+}
+
+// restoreUtxos re-creates the UTXOs in the file from our own keys. Addresses are derived again
+// rather than trusted, and amounts are checked against the previous transactions, so a tampered
+// file can't make us sign for outputs we don't own, or pay a higher fee than we show. Segwit
+// signatures commit to amounts, so only legacy (V2) UTXOs require their previous transaction.
+func (f *utxoFile) restoreUtxos(userKey, muunKey *libwallet.HDPublicKey) ([]*scanner.Utxo, error) {
+	if f.UserXpub != userKey.String() || f.MuunXpub != muunKey.String() {
+		return nil, invalidInput("the utxo file was created for a different wallet")
+	}
+
+	utxos := make([]*scanner.Utxo, len(f.Utxos))
+
+	for i, entry := range f.Utxos {
+		derivedUserKey, err := userKey.DeriveTo(entry.DerivationPath)
+		if err != nil {
+			return nil, invalidInput("invalid derivation path %s: %v", entry.DerivationPath, err)
+		}
+
+		derivedMuunKey, err := muunKey.DeriveTo(entry.DerivationPath)
+		if err != nil {
+			return nil, invalidInput("invalid derivation path %s: %v", entry.DerivationPath, err)
+		}
+
+		addr, err := createAddress(entry.AddressVersion, derivedUserKey, derivedMuunKey)
+		if err != nil {
+			return nil, invalidInput("failed to create address for %s: %v", entry.Address, err)
+		}
+
+		if addr.Address() != entry.Address {
+			return nil, invalidInput(
+				"address %s doesn't match derivation path %s", entry.Address, entry.DerivationPath,
+			)
+		}
+
+		script, err := getOutputScript(addr, userKey.Network)
+		if err != nil {
+			return nil, err
+		}
+
+		err = f.checkPrevTx(entry, script)
+		if err != nil {
+			return nil, err
+		}
+
+		utxos[i] = &scanner.Utxo{
+			TxID:         entry.TxID,
+			OutputIndex:  entry.Vout,
+			Amount:       entry.Amount,
+			Address:      addr,
+			Script:       script,
+			Height:       entry.Height,
+			Verification: scanner.Verification(entry.Verification),
+		}
+	}
+
+	return utxos, nil
+}
+
+// checkPrevTx makes sure the transaction that created a UTXO pays its amount to its script. It
+// fails if the transaction is missing, unless the UTXO is segwit.
+func (f *utxoFile) checkPrevTx(entry utxoEvent, script []byte) error {
+	rawTx, ok := f.PrevTxs[entry.TxID]
+	if !ok {
+		if entry.AddressVersion == libwallet.AddressVersionV2 {
+			return invalidInput("the utxo file is missing transaction %s, run scan again", entry.TxID)
+		}
+
+		return nil
+	}
+
+	txBytes, err := hex.DecodeString(rawTx)
+	if err != nil {
+		return invalidInput("invalid transaction %s in the utxo file: %v", entry.TxID, err)
+	}
+
+	var tx wire.MsgTx
+
+	err = tx.Deserialize(bytes.NewReader(txBytes))
+	if err != nil {
+		return invalidInput("invalid transaction %s in the utxo file: %v", entry.TxID, err)
+	}
+
+	if tx.TxHash().String() != entry.TxID {
+		return invalidInput("transaction %s in the utxo file has a different ID", entry.TxID)
+	}
+
+	if entry.Vout < 0 || entry.Vout >= len(tx.TxOut) {
+		return invalidInput("transaction %s has no output %d", entry.TxID, entry.Vout)
+	}
+
+	output := tx.TxOut[entry.Vout]
+
+	if output.Value != entry.Amount || !bytes.Equal(output.PkScript, script) {
+		return invalidInput(
+			"utxo %s:%d doesn't match its transaction, which pays %d sats to another script or amount",
+			entry.TxID, entry.Vout, output.Value,
+		)
+	}
+
+	return nil
+}
+
+// getOutputScript creates the script that sends to an address.
+func getOutputScript(addr libwallet.MuunAddress, network *libwallet.Network) ([]byte, error) {
+	decodedAddress, err := btcutilw.DecodeAddress(addr.Address(), network.ToParams())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode address %s: %w", addr.Address(), err)
+	}
+
+	script, err := txscriptw.PayToAddrScript(decodedAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to craft script for %s: %w", addr.Address(), err)
+	}
+
+	return script, nil
+}
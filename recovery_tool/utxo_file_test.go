@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/muun/libwallet"
+)
+
+func TestRestoreUtxosChecksPrevTxs(t *testing.T) {
+	network := libwallet.Regtest()
+
+	userRoot, _ := libwallet.NewHDPrivateKey([]byte("0123456789abcdef0123456789abcdef"), network)
+	muunKey, _ := libwallet.NewHDPrivateKey([]byte("fedcba9876543210fedcba9876543210"), network)
+
+	userKey, err := userRoot.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	muunBaseKey, err := muunKey.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createEntry := func(path string, version int, amount int64) (utxoEvent, string) {
+		derivedUserKey, err := userKey.PublicKey().DeriveTo(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		derivedMuunKey, err := muunBaseKey.PublicKey().DeriveTo(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr, err := createAddress(version, derivedUserKey, derivedMuunKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		script, err := getOutputScript(addr, network)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx := wire.NewMsgTx(2)
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 3}, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(1000, []byte{0x6a}))
+		tx.AddTxOut(wire.NewTxOut(amount, script))
+
+		txBytes := new(bytes.Buffer)
+		if err := tx.Serialize(txBytes); err != nil {
+			t.Fatal(err)
+		}
+
+		entry := utxoEvent{
+			TxID:           tx.TxHash().String(),
+			Vout:           1,
+			Amount:         amount,
+			Address:        addr.Address(),
+			AddressVersion: version,
+			DerivationPath: path,
+		}
+
+		return entry, hex.EncodeToString(txBytes.Bytes())
+	}
+
+	legacy, legacyTx := createEntry("m/1'/1'/1/3", libwallet.AddressVersionV2, 40000)
+	segwit, _ := createEntry("m/1'/1'/0/1", libwallet.AddressVersionV4, 25000)
+
+	understated := legacy
+	understated.Amount = 4000
+
+	testCases := []struct {
+		desc    string
+		utxos   []utxoEvent
+		prevTxs map[string]string
+		valid   bool
+	}{
+		{
+			desc:    "matching transaction",
+			utxos:   []utxoEvent{legacy},
+			prevTxs: map[string]string{legacy.TxID: legacyTx},
+			valid:   true,
+		},
+		{
+			desc:    "understated amount",
+			utxos:   []utxoEvent{understated},
+			prevTxs: map[string]string{legacy.TxID: legacyTx},
+		},
+		{
+			desc:    "wrong output",
+			utxos:   []utxoEvent{func() utxoEvent { entry := legacy; entry.Vout = 0; return entry }()},
+			prevTxs: map[string]string{legacy.TxID: legacyTx},
+		},
+		{
+			desc:    "transaction with another ID",
+			utxos:   []utxoEvent{segwit},
+			prevTxs: map[string]string{segwit.TxID: legacyTx},
+		},
+		{
+			desc:  "legacy utxo without transaction",
+			utxos: []utxoEvent{legacy},
+		},
+		{
+			desc:  "segwit utxo without transaction",
+			utxos: []utxoEvent{segwit},
+			valid: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			file := &utxoFile{
+				Version:  utxoFileVersion,
+				UserXpub: userKey.PublicKey().String(),
+				MuunXpub: muunBaseKey.PublicKey().String(),
+				Utxos:    tc.utxos,
+				PrevTxs:  tc.prevTxs,
+			}
+
+			utxos, err := file.restoreUtxos(userKey.PublicKey(), muunBaseKey.PublicKey())
+			if tc.valid && err != nil {
+				t.Fatalf("expected the utxos to be restored, got %v", err)
+			}
+
+			if !tc.valid && err == nil {
+				t.Fatalf("expected an error, got %+v", utxos)
+			}
+		})
+	}
+}
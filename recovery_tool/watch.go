@@ -0,0 +1,511 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/scanner"
+)
+
+// watchRetryDelay is how long `watch` waits to subscribe again when the connection ends, or to try
+// a failed sweep again. Tests shorten it.
+var watchRetryDelay = 10 * time.Second
+
+// errAddressesExtended ends a subscription when new funds moved a high-water mark, so the watcher
+// subscribes again to the addresses past it.
+var errAddressesExtended = errors.New("the watched addresses were extended")
+
+// runWatch scans the wallet, and then follows its addresses to report funds as they arrive. Given
+// a threshold, it sweeps the new confirmed funds once they add up to it.
+func runWatch(args []string) {
+	var config config
+
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	config.registerCommonFlags(flags)
+	config.registerScanFlags(flags)
+	config.registerKeyFlags(flags)
+	config.registerSweepFlags(flags)
+	config.registerBroadcastFlags(flags)
+	config.registerSweepsFlag(flags)
+	flags.StringVar(&config.userXpub, "user-xpub", "", "User extended public key, to watch without the Recovery Code")
+	flags.StringVar(&config.muunXpub, "muun-xpub", "", "Muun extended public key, to watch without the Recovery Code")
+	flags.Int64Var(&config.sweepThreshold, "sweep-threshold", 0, "Sweep new confirmed funds once they add up to this many sats")
+
+	setupCommand(&config, flags, args, "watch [options] [optional: path to Emergency Kit PDF]", true)
+
+	err := config.requireBackend()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	printNetwork(&config)
+
+	if config.usesProvidedElectrum {
+		validateProvidedElectrum(&config)
+	}
+
+	chainBackend := newBackend(&config)
+
+	subscriber, ok := chainBackend.(backend.ScriptSubscriber)
+	if !ok {
+		exitWithError(invalidInput("watching needs Electrum servers, %s can't notify changes", chainBackend.Name()))
+	}
+
+	var userKey, muunKey *libwallet.HDPublicKey
+	var sweeper *Sweeper
+
+	if config.sweepThreshold > 0 {
+		// Sweeping unattended, there's nobody to ask for the fee:
+		if config.feeRate == 0 {
+			exitWithError(missingInput("fee rate"))
+		}
+
+		decryptedKeys := getDecryptedKeys(&config)
+		destinations := getDestinations(&config)
+
+		userKey, muunKey, err = getBasePublicKeys(decryptedKeys)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		sweeper = &Sweeper{
+			UserKey:      decryptedKeys[0].Key,
+			MuunKey:      decryptedKeys[1].Key,
+			Birthday:     decryptedKeys[1].Birthday,
+			Destinations: destinations,
+			Network:      config.network,
+			Backend:      chainBackend,
+
+			BroadcastServers: config.broadcastServers,
+		}
+	} else {
+		userKey = getXpub(&config, config.userXpub, "user xpub")
+		muunKey = getXpub(&config, config.muunXpub, "muun xpub")
+	}
+
+	sayBlock(`
+		Starting scan of all possible addresses. This will take a few minutes.
+	`)
+
+	addrGen := NewAddressGenerator(userKey, muunKey, config.generateContacts, config.gapLimit)
+
+	utxos := scanUtxos(addrGen, chainBackend, &config)
+
+	if len(utxos) > 0 {
+		printUtxos(utxos)
+
+		if sweeper != nil {
+			sayBlock("These funds were already there, so they won't be swept. Only new funds are.\n")
+		}
+	}
+
+	w, err := newWatcher(addrGen, utxos, chainBackend, subscriber, &config)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	w.userKey = userKey
+	w.muunKey = muunKey
+	w.sweeper = sweeper
+
+	sayBlock("Watching for new funds. Press Ctrl+C to stop.\n\n")
+
+	w.run(nil)
+}
+
+// watcher follows the addresses of a wallet, and rescans those whose status changed to report the
+// funds that arrive, confirm or leave. With a sweeper, it sweeps the new confirmed funds once they
+// add up to the threshold.
+type watcher struct {
+	addrGen    *AddressGenerator // extended when funds arrive near the end of a branch
+	addresses  []libwallet.MuunAddress
+	scripts    [][]byte
+	scanner    *scanner.Scanner // reused, so headers are verified only once
+	subscriber backend.ScriptSubscriber
+	config     *config
+
+	userKey *libwallet.HDPublicKey
+	muunKey *libwallet.HDPublicKey
+	sweeper *Sweeper // nil to only report
+
+	statuses    map[string]string        // the last seen, by address
+	utxos       map[string]*scanner.Utxo // the funds of the wallet, by outpoint
+	old         map[string]bool          // outpoints there before watching, never swept
+	swept       map[string]bool          // outpoints spent by our sweeps
+	extended    bool                     // whether the addresses must be derived again
+	sweepFailed bool                     // whether the last sweep must be tried again
+}
+
+func newWatcher(
+	addrGen *AddressGenerator,
+	utxos []*scanner.Utxo,
+	chainBackend backend.Backend,
+	subscriber backend.ScriptSubscriber,
+	config *config,
+) (*watcher, error) {
+
+	w := &watcher{
+		addrGen:    addrGen,
+		scanner:    scanner.NewScanner(chainBackend, config.network, nil),
+		subscriber: subscriber,
+		config:     config,
+		statuses:   make(map[string]string),
+		utxos:      make(map[string]*scanner.Utxo),
+		old:        make(map[string]bool),
+		swept:      make(map[string]bool),
+	}
+
+	err := w.deriveAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, utxo := range utxos {
+		w.utxos[getUtxoKey(utxo)] = utxo
+		w.old[getUtxoKey(utxo)] = true
+	}
+
+	return w, nil
+}
+
+// deriveAddresses updates the watched addresses and their scripts from the generator.
+func (w *watcher) deriveAddresses() error {
+	addresses := w.addrGen.Addresses()
+	scripts := make([][]byte, len(addresses))
+
+	for i, addr := range addresses {
+		script, err := getOutputScript(addr, w.config.network)
+		if err != nil {
+			return err
+		}
+
+		scripts[i] = script
+	}
+
+	w.addresses = addresses
+	w.scripts = scripts
+	w.extended = false
+
+	return nil
+}
+
+// run follows the addresses until stop is closed, subscribing again whenever the connection ends,
+// or right away with more addresses when a high-water mark moved.
+func (w *watcher) run(stop <-chan struct{}) {
+	for {
+		err := w.follow(stop)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if errors.Is(err, errAddressesExtended) {
+			err = w.deriveAddresses()
+			if err == nil {
+				continue
+			}
+		}
+
+		say("{yellow Stopped watching}: %v\nTrying again in %v\n", err, watchRetryDelay)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(watchRetryDelay):
+		}
+	}
+}
+
+// follow subscribes to every address and handles the changes until the subscription ends. Changes
+// missed while subscribing again are found comparing the statuses with the last seen.
+func (w *watcher) follow(stop <-chan struct{}) error {
+	cancel := make(chan struct{})
+	defer close(cancel)
+
+	subscription, err := w.subscriber.SubscribeScripts(w.scripts, cancel)
+	if err != nil {
+		return err
+	}
+
+	say("{green ✓} Watching {white %d} addresses\n", len(w.addresses))
+
+	changed := make(map[int]string)
+	for i, status := range subscription.Statuses {
+		if status != w.statuses[w.addresses[i].Address()] {
+			changed[i] = status
+		}
+	}
+
+	sweepAgain := w.sweepFailed
+	var retry <-chan time.Time // fires to try a failed sweep again
+
+	for {
+		if len(changed) > 0 {
+			err := w.rescan(changed)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(changed) > 0 || sweepAgain {
+			retry = nil
+
+			// Failing to sweep shouldn't stop the watch. The funds stay unswept until the next try:
+			err := w.sweepIfReady()
+			w.sweepFailed = err != nil
+
+			if err != nil {
+				say("{yellow Couldn't sweep}: %v\nTrying again in %v, or on the next change\n", err, watchRetryDelay)
+				retry = time.After(watchRetryDelay)
+			}
+		}
+
+		if w.extended {
+			return errAddressesExtended
+		}
+
+		changed = make(map[int]string)
+		sweepAgain = false
+
+		select {
+		case change, ok := <-subscription.Changes:
+			if !ok {
+				return errors.New("the connection ended")
+			}
+
+			changed[change.Index] = change.Status
+
+		case <-retry:
+			sweepAgain = true
+			continue
+
+		case <-stop:
+			return nil
+		}
+
+		// Rescan together the changes that are already waiting, like those of a new block:
+	drain:
+		for {
+			select {
+			case change, ok := <-subscription.Changes:
+				if !ok {
+					break drain
+				}
+
+				changed[change.Index] = change.Status
+
+			default:
+				break drain
+			}
+		}
+	}
+}
+
+// rescan scans the addresses whose status changed, and reports the funds that arrived, confirmed or
+// left each one. Addresses seen for the first time with history are reported only if their funds
+// changed, since the initial scan already showed them. Used addresses move the high-water marks,
+// and the watch is extended if they were close to the end of their branch.
+func (w *watcher) rescan(changed map[int]string) error {
+	indices := make([]int, 0, len(changed))
+	for index := range changed {
+		indices = append(indices, index)
+	}
+
+	sort.Ints(indices)
+
+	addresses := make([]libwallet.MuunAddress, len(indices))
+	for i, index := range indices {
+		addresses[i] = w.addresses[index]
+	}
+
+	var report *scanner.Report
+	for report = range w.scanner.Scan(newAddressList(addresses)) {
+	}
+
+	if report.Err != nil {
+		return fmt.Errorf("error while scanning changed addresses: %w", report.Err)
+	}
+
+	used := make([]libwallet.MuunAddress, len(report.UsedAddresses))
+	for i, activity := range report.UsedAddresses {
+		used[i] = activity.Address
+	}
+
+	if w.addrGen.MarkUsed(used) {
+		w.extended = true
+	}
+
+	found := make(map[string][]*scanner.Utxo) // by address
+	for _, utxo := range dropInvalidUtxos(report.UtxosFound) {
+		found[utxo.Address.Address()] = append(found[utxo.Address.Address()], utxo)
+	}
+
+	for _, index := range indices {
+		addr := w.addresses[index]
+		event := w.update(addr, found[addr.Address()])
+		event.Status = changed[index]
+
+		if len(event.Received) > 0 || len(event.Confirmed) > 0 || len(event.Spent) > 0 || w.statuses[addr.Address()] != "" {
+			emitEvent(event)
+		}
+
+		w.statuses[addr.Address()] = changed[index]
+	}
+
+	return nil
+}
+
+// update replaces the funds of an address with those found, printing the differences, and returns
+// them as an event.
+func (w *watcher) update(addr libwallet.MuunAddress, utxos []*scanner.Utxo) *watchEvent {
+	event := newWatchEvent(addr)
+
+	current := make(map[string]bool)
+
+	for _, utxo := range utxos {
+		key := getUtxoKey(utxo)
+		current[key] = true
+
+		previous, known := w.utxos[key]
+		w.utxos[key] = utxo
+
+		switch {
+		case !known:
+			event.Received = append(event.Received, newUtxoEvent(utxo))
+			say("{green ↓} {white %d} sats received in %s "+describeVerification(utxo)+"\n", utxo.Amount, addr.Address())
+
+		case previous.Height <= 0 && utxo.Height > 0:
+			event.Confirmed = append(event.Confirmed, newUtxoEvent(utxo))
+			say("{green ✓} {white %d} sats in %s confirmed in block %d "+describeVerification(utxo)+"\n", utxo.Amount, addr.Address(), utxo.Height)
+		}
+	}
+
+	for key, utxo := range w.utxos {
+		if utxo.Address.Address() != addr.Address() || current[key] {
+			continue
+		}
+
+		delete(w.utxos, key)
+
+		event.Spent = append(event.Spent, newUtxoEvent(utxo))
+		say("{yellow ↑} {white %d} sats in %s were spent\n", utxo.Amount, addr.Address())
+	}
+
+	return event
+}
+
+// sweepIfReady sweeps the new confirmed funds once they add up to the threshold. The fee rate must
+// leave more than dust for every destination, or the sweep waits for more funds. If the sweep
+// fails, the funds are left unswept to try again.
+func (w *watcher) sweepIfReady() error {
+	if w.sweeper == nil {
+		return nil
+	}
+
+	var utxos []*scanner.Utxo
+	var total int64
+
+	for key, utxo := range w.utxos {
+		if utxo.Height > 0 && !w.old[key] && !w.swept[key] {
+			utxos = append(utxos, utxo)
+			total += utxo.Amount
+		}
+	}
+
+	if total == 0 || total < w.config.sweepThreshold {
+		return nil
+	}
+
+	sort.Slice(utxos, func(i, j int) bool {
+		return getUtxoKey(utxos[i]) < getUtxoKey(utxos[j])
+	})
+
+	txOutputAmount, txSize, err := w.sweeper.GetSweepTxAmountAndSize(utxos)
+	if err != nil {
+		return err
+	}
+
+	fee, err := calculateFee(txOutputAmount, txSize.VSize, w.config.feeRate, w.sweeper.Destinations)
+	if err != nil {
+		say("{yellow Not sweeping %d sats yet}: %v\n", total, err)
+		return nil
+	}
+
+	outputs, err := getSweepOutputs(w.sweeper.Destinations, txOutputAmount-fee)
+	if err != nil {
+		return err
+	}
+
+	printSummary(fee, txSize, outputs)
+
+	sweepTx, err := signSweep(w.sweeper, utxos, fee)
+	if err != nil {
+		return err
+	}
+
+	recordSweep(w.config, newSweepAttempt(w.userKey, w.muunKey, utxos, sweepTx, fee, w.sweeper.Destinations))
+
+	// A sweep that was accepted but not seen yet can't be sent again without conflicting with it:
+	err = sendSweep(w.sweeper, sweepTx)
+	if err != nil && !errors.Is(err, errSweepNotSeen) {
+		return err
+	}
+
+	for _, utxo := range utxos {
+		w.swept[getUtxoKey(utxo)] = true
+	}
+
+	return nil
+}
+
+// addressList is a scanner.AddressSource with fixed addresses, to rescan those that changed.
+type addressList struct {
+	batches [][]libwallet.MuunAddress
+}
+
+func newAddressList(addresses []libwallet.MuunAddress) *addressList {
+	batchSize := indicesPerBatch * len(addressVersions)
+
+	list := &addressList{}
+
+	for start := 0; start < len(addresses); start += batchSize {
+		end := start + batchSize
+		if end > len(addresses) {
+			end = len(addresses)
+		}
+
+		list.batches = append(list.batches, addresses[start:end])
+	}
+
+	return list
+}
+
+// Batches returns the addresses, in batches of the same size as the AddressGenerator's.
+func (l *addressList) Batches() <-chan []libwallet.MuunAddress {
+	ch := make(chan []libwallet.MuunAddress, len(l.batches))
+	for _, batch := range l.batches {
+		ch <- batch
+	}
+	close(ch)
+
+	return ch
+}
+
+// MarkScanned does nothing, since the list doesn't grow.
+func (l *addressList) MarkScanned(batch []libwallet.MuunAddress, used []libwallet.MuunAddress) {}
+
+// HighWaterMarks returns no marks, since the list has no branches.
+func (l *addressList) HighWaterMarks() map[string]int {
+	return map[string]int{}
+}
+
+func getUtxoKey(utxo *scanner.Utxo) string {
+	return fmt.Sprintf("%s:%d", utxo.TxID, utxo.OutputIndex)
+}
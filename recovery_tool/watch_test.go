@@ -0,0 +1,257 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/muun/libwallet"
+	"github.com/muun/recovery/backend"
+	"github.com/muun/recovery/electrum/electrumtest"
+	"github.com/muun/recovery/scanner"
+)
+
+func TestWatchSweepsNewFunds(t *testing.T) {
+	defer func(delay time.Duration) { watchRetryDelay = delay }(watchRetryDelay)
+	watchRetryDelay = 100 * time.Millisecond
+
+	network := libwallet.Regtest()
+
+	userRoot, _ := libwallet.NewHDPrivateKey([]byte("0123456789abcdef0123456789abcdef"), network)
+	muunKey, _ := libwallet.NewHDPrivateKey([]byte("fedcba9876543210fedcba9876543210"), network)
+
+	userKey, err := userRoot.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	muunBaseKey, err := muunKey.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := func(path string, version int) []byte {
+		return createTestScript(t, userKey.PublicKey(), muunBaseKey.PublicKey(), path, version)
+	}
+
+	chain := electrumtest.NewChain(&chaincfg.RegressionNetParams)
+
+	// Funds from before watching are left alone:
+	old := chain.Fund(script("m/1'/1'/1/0", libwallet.AddressVersionV3), 15000)
+	chain.Mine()
+
+	// The first subscription fails, so the watch has to try again:
+	server := electrumtest.NewTLSServer(t, chain)
+	server.Fail("blockchain.scripthash.subscribe", electrumtest.EOF, 1)
+
+	electrum := backend.NewElectrum([]string{server.Address}, true, chain.GenesisHash(), nil, nil)
+
+	addrGen := NewAddressGenerator(userKey.PublicKey(), muunBaseKey.PublicKey(), false, 5)
+
+	var report *scanner.Report
+	for report = range scanner.NewScanner(electrum, network, nil).Scan(addrGen) {
+	}
+
+	if report.Err != nil || len(report.UtxosFound) != 1 {
+		t.Fatalf("expected the old utxo, got %+v (%v)", report.UtxosFound, report.Err)
+	}
+
+	destinationAddress, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), network.ToParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destinations, err := parseDestinations(destinationAddress.String(), network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &config{
+		network:        network,
+		feeRate:        2,
+		sweepThreshold: 20000,
+		sweepsFile:     filepath.Join(t.TempDir(), "sweeps.json"),
+	}
+
+	w, err := newWatcher(addrGen, report.UtxosFound, electrum, electrum, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.userKey = userKey.PublicKey()
+	w.muunKey = muunBaseKey.PublicKey()
+	w.sweeper = &Sweeper{
+		UserKey:      userKey,
+		MuunKey:      muunKey,
+		Destinations: destinations,
+		Network:      network,
+		Backend:      electrum,
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		w.run(stop)
+		close(stopped)
+	}()
+
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	// Two deposits add up to the threshold once confirmed, while a third one is still unconfirmed:
+	first := chain.Fund(script("m/1'/1'/1/2", libwallet.AddressVersionV4), 12000)
+	second := chain.Fund(script("m/1'/1'/0/4", libwallet.AddressVersionV3), 10000)
+	chain.Mine()
+	chain.Fund(script("m/1'/1'/1/1", libwallet.AddressVersionV4), 5000)
+
+	sweep := waitForSpend(t, chain, first.TxHash().String())
+
+	spent := make(map[string]bool)
+	for _, txIn := range sweep.TxIn {
+		spent[txIn.PreviousOutPoint.Hash.String()] = true
+	}
+
+	if len(spent) != 2 || !spent[second.TxHash().String()] || spent[old.TxHash().String()] {
+		t.Fatalf("expected to sweep only the new confirmed funds, got inputs %v", spent)
+	}
+
+	file, err := readSweepsFile(config.sweepsFile)
+	if err != nil || len(file.Sweeps) != 1 || file.Sweeps[0].TxID != sweep.TxHash().String() {
+		t.Fatalf("expected the sweep to be recorded, got %+v (%v)", file, err)
+	}
+}
+
+func TestWatchExtendsAddressesAndRetriesSweeps(t *testing.T) {
+	defer func(delay time.Duration) { watchRetryDelay = delay }(watchRetryDelay)
+	watchRetryDelay = 100 * time.Millisecond
+
+	network := libwallet.Regtest()
+
+	userRoot, _ := libwallet.NewHDPrivateKey([]byte("0123456789abcdef0123456789abcdef"), network)
+	muunKey, _ := libwallet.NewHDPrivateKey([]byte("fedcba9876543210fedcba9876543210"), network)
+
+	userKey, err := userRoot.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	muunBaseKey, err := muunKey.DeriveTo(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := func(path string) []byte {
+		return createTestScript(t, userKey.PublicKey(), muunBaseKey.PublicKey(), path, libwallet.AddressVersionV4)
+	}
+
+	chain := electrumtest.NewChain(&chaincfg.RegressionNetParams)
+	server := electrumtest.NewTLSServer(t, chain)
+
+	electrum := backend.NewElectrum([]string{server.Address}, true, chain.GenesisHash(), nil, nil)
+
+	// An empty wallet, so only indices 0 to 4 of each branch are watched at first:
+	addrGen := NewAddressGenerator(userKey.PublicKey(), muunBaseKey.PublicKey(), false, 5)
+
+	var report *scanner.Report
+	for report = range scanner.NewScanner(electrum, network, nil).Scan(addrGen) {
+	}
+
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+
+	destinationAddress, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), network.ToParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destinations, err := parseDestinations(destinationAddress.String(), network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &config{
+		network:        network,
+		feeRate:        2,
+		sweepThreshold: 20000,
+		sweepsFile:     filepath.Join(t.TempDir(), "sweeps.json"),
+	}
+
+	w, err := newWatcher(addrGen, nil, electrum, electrum, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.userKey = userKey.PublicKey()
+	w.muunKey = muunBaseKey.PublicKey()
+	w.sweeper = &Sweeper{
+		UserKey:      userKey,
+		MuunKey:      muunKey,
+		Destinations: destinations,
+		Network:      network,
+		Backend:      electrum,
+	}
+
+	// The first broadcast fails, which must not stop the watch:
+	server.Fail("blockchain.transaction.broadcast", electrumtest.EOF, 1)
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		w.run(stop)
+		close(stopped)
+	}()
+
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	// A deposit to the last watched index extends the watch, so the next one is seen:
+	first := chain.Fund(script("m/1'/1'/1/4"), 12000)
+	second := chain.Fund(script("m/1'/1'/1/8"), 10000)
+	chain.Mine()
+
+	sweep := waitForSpend(t, chain, first.TxHash().String())
+
+	spent := make(map[string]bool)
+	for _, txIn := range sweep.TxIn {
+		spent[txIn.PreviousOutPoint.Hash.String()] = true
+	}
+
+	if len(spent) != 2 || !spent[second.TxHash().String()] {
+		t.Fatalf("expected to sweep both deposits, got inputs %v", spent)
+	}
+
+	if server.Requests("blockchain.transaction.broadcast") < 2 {
+		t.Errorf("expected the broadcast to be tried again")
+	}
+}
+
+// waitForSpend returns the mempool transaction that spends an output of txID, failing if none
+// shows up.
+func waitForSpend(t *testing.T, chain *electrumtest.Chain, txID string) *wire.MsgTx {
+	deadline := time.Now().Add(10 * time.Second)
+
+	for time.Now().Before(deadline) {
+		for _, tx := range chain.Mempool() {
+			for _, txIn := range tx.TxIn {
+				if txIn.PreviousOutPoint.Hash.String() == txID {
+					return tx
+				}
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("expected a transaction spending %s", txID)
+	return nil
+}